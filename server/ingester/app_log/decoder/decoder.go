@@ -170,20 +170,27 @@ func (d *Decoder) Run() {
 				log.Warning("get application log decode queue data type wrong")
 				continue
 			}
+			recvBytes, err := receiver.DecompressRecvBuffer(recvBytes)
+			if err != nil {
+				receiver.ReleaseRecvBuffer(recvBytes)
+				continue
+			}
 			decoder.Init(recvBytes.Buffer[recvBytes.Begin:recvBytes.End])
 			d.orgId, d.teamId = uint16(recvBytes.OrgID), uint16(recvBytes.TeamID)
+			records, partial := 0, false
 			switch d.msgType {
 			case datatype.MESSAGE_TYPE_APPLICATION_LOG:
-				d.handleAppLog(recvBytes.VtapID, decoder)
+				records, partial = d.handleAppLog(recvBytes.VtapID, decoder)
 			case datatype.MESSAGE_TYPE_SYSLOG, datatype.MESSAGE_TYPE_AGENT_LOG:
-				d.handleAgentLog(recvBytes.VtapID, decoder)
+				records, partial = d.handleAgentLog(recvBytes.VtapID, decoder)
 			}
+			receiver.ReportRecords(recvBytes, records, partial)
 			receiver.ReleaseRecvBuffer(recvBytes)
 		}
 	}
 }
 
-func (d *Decoder) handleAgentLog(agentId uint16, decoder *codec.SimpleDecoder) {
+func (d *Decoder) handleAgentLog(agentId uint16, decoder *codec.SimpleDecoder) (records int, partial bool) {
 	for !decoder.IsEnd() {
 		bytes := decoder.ReadBytes()
 		if decoder.Failed() {
@@ -191,7 +198,7 @@ func (d *Decoder) handleAgentLog(agentId uint16, decoder *codec.SimpleDecoder) {
 				log.Errorf("syslog decode failed, offset=%d len=%d", decoder.Offset(), len(decoder.Bytes()))
 			}
 			d.counter.ErrorCount++
-			return
+			return records, true
 		}
 
 		if err := d.WriteAgentLog(agentId, bytes); err != nil {
@@ -201,8 +208,10 @@ func (d *Decoder) handleAgentLog(agentId uint16, decoder *codec.SimpleDecoder) {
 			d.counter.ErrorCount++
 			continue
 		}
+		records++
 		d.counter.OutCount++
 	}
+	return records, false
 }
 
 func (d *Decoder) WriteAgentLog(agentId uint16, bs []byte) error {
@@ -466,7 +475,7 @@ type AppLogEntry struct {
 	AppService string      `json:"app_service"`
 }
 
-func (d *Decoder) handleAppLog(agentId uint16, decoder *codec.SimpleDecoder) {
+func (d *Decoder) handleAppLog(agentId uint16, decoder *codec.SimpleDecoder) (records int, partial bool) {
 	for !decoder.IsEnd() {
 		bytes := decoder.ReadBytes()
 		if decoder.Failed() {
@@ -474,7 +483,7 @@ func (d *Decoder) handleAppLog(agentId uint16, decoder *codec.SimpleDecoder) {
 				log.Errorf("application log decode failed, offset=%d len=%d", decoder.Offset(), len(decoder.Bytes()))
 			}
 			d.counter.ErrorCount++
-			return
+			return records, true
 		}
 		d.counter.OutCount++
 
@@ -486,8 +495,9 @@ func (d *Decoder) handleAppLog(agentId uint16, decoder *codec.SimpleDecoder) {
 				log.Errorf("application log json decode failed: %s", err)
 			}
 			d.counter.ErrorCount++
-			return
+			return records, true
 		}
+		records++
 		for i, appLogEntry := range d.appLogEntrysCache {
 			if err := d.WriteAppLog(agentId, &appLogEntry); err != nil {
 				if d.counter.ErrorCount == 0 {
@@ -499,4 +509,5 @@ func (d *Decoder) handleAppLog(agentId uint16, decoder *codec.SimpleDecoder) {
 			d.appLogEntrysCache[i] = AppLogEntry{}
 		}
 	}
+	return records, false
 }
@@ -158,6 +158,15 @@ type Config struct {
 	UDPReadBuffer            int             `yaml:"udp-read-buffer"`
 	TCPReadBuffer            int             `yaml:"tcp-read-buffer"`
 	TCPReaderBuffer          int             `yaml:"tcp-reader-buffer"`
+	HeaderCRCRequired        bool            `yaml:"header-crc-required"`
+	LegacyHeaderDisabled     bool            `yaml:"legacy-header-disabled"`
+	TenantRules              []string        `yaml:"tenant-rules"`
+	MirrorDestination        string          `yaml:"mirror-destination"`
+	MirrorFilters            []string        `yaml:"mirror-filters"`
+	ReceiverStatsdAddress    string          `yaml:"receiver-statsd-address"`
+	AgentNameReverseDNS      bool            `yaml:"agent-name-reverse-dns"`
+	AgentNameFile            string          `yaml:"agent-name-file"`
+	ErrorTapDirectory        string          `yaml:"error-tap-directory"`
 	CKDiskMonitor            CKDiskMonitor   `yaml:"ck-disk-monitor"`
 	ColdStorage              CKDBColdStorage `yaml:"ckdb-cold-storage"`
 	ckdbColdStorages         map[string]*ckdb.ColdStorage
@@ -0,0 +1,180 @@
+/*
+ * Copyright (c) 2024 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnel
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/deepflowio/deepflow/server/libs/datatype"
+	"github.com/deepflowio/deepflow/server/libs/pcap"
+)
+
+// 以逗号分隔的隧道类型名称, 例如"vxlan,geneve"
+func parseTunnelTypes(arg string) (datatype.TunnelTypeBitmap, error) {
+	bitmap := datatype.TunnelTypeBitmap(0)
+	for _, name := range strings.Split(arg, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		tunnelType, ok := datatype.TunnelTypeFromName(name)
+		if !ok {
+			return 0, fmt.Errorf("unknown tunnel type %s", name)
+		}
+		bitmap.Add(tunnelType)
+	}
+	if bitmap.IsEmpty() {
+		return 0, fmt.Errorf("no tunnel type specified")
+	}
+	return bitmap, nil
+}
+
+// 与agent配置中的UDP端口表相同, 格式为"类型=端口[,端口]", 例如"vxlan=4789,6082", 端口为空时恢复默认端口
+func parseUdpTunnelPorts(arg string) (datatype.TunnelType, []uint16, error) {
+	i := strings.IndexByte(arg, '=')
+	if i < 0 {
+		return 0, nil, fmt.Errorf("invalid udp port %q, expect TYPE=PORT[,PORT]", arg)
+	}
+	tunnelType, ok := datatype.TunnelTypeFromName(strings.TrimSpace(arg[:i]))
+	if !ok {
+		return 0, nil, fmt.Errorf("unknown tunnel type %s", arg[:i])
+	}
+	ports := []uint16{}
+	for _, field := range strings.Split(arg[i+1:], ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		port, err := strconv.ParseUint(field, 10, 16)
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid port %s", field)
+		}
+		ports = append(ports, uint16(port))
+	}
+	return tunnelType, ports, nil
+}
+
+// 参数为十六进制的以太网帧(可带空格, 冒号和0x前缀), 或"文件:帧序号", 帧序号与wireshark一致从1开始
+func loadFrame(arg string) ([]byte, error) {
+	if i := strings.LastIndexByte(arg, ':'); i > 0 {
+		if _, err := os.Stat(arg[:i]); err == nil {
+			index, err := strconv.Atoi(arg[i+1:])
+			if err != nil || index < 1 {
+				return nil, fmt.Errorf("invalid frame number %s", arg[i+1:])
+			}
+			return loadPcapFrame(arg[:i], index)
+		}
+	}
+	text := strings.NewReplacer(" ", "", ":", "", "\n", "").Replace(strings.TrimPrefix(arg, "0x"))
+	frame, err := hex.DecodeString(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex string: %s", err)
+	}
+	return frame, nil
+}
+
+func loadPcapFrame(file string, index int) ([]byte, error) {
+	reader, closer, err := pcap.OpenFile(file)
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+	for i := 1; ; i++ {
+		data, _, err := reader.ReadPacketData()
+		if err != nil {
+			return nil, fmt.Errorf("read frame %d of %s failed: %s", index, file, err)
+		}
+		if i == index {
+			return data, nil
+		}
+	}
+}
+
+func explainFrame(frame []byte, bitmap datatype.TunnelTypeBitmap) string {
+	datatype.GetDecapsulateCounter()
+	tunnel, inner, trace := datatype.ExplainDecapsulate(frame, bitmap)
+	var sb strings.Builder
+	for i, step := range trace {
+		fmt.Fprintf(&sb, "%d: %s\n", i, step)
+	}
+	if c := datatype.GetDecapsulateCounter(); *c != (datatype.DecapsulateCounter{}) {
+		fmt.Fprintf(&sb, "counters: fragmented %d, stt-continued %d, suspect %d, truncated %d\n",
+			c.DecapFragmented, c.DecapSttContinued, c.DecapSuspect, c.DecapTruncated)
+	}
+	if tunnel.Tier == 0 {
+		sb.WriteString("no tunnel decapsulated")
+		if tunnel.Fragment {
+			sb.WriteString(", outer IP is a non-first fragment")
+		}
+		return sb.String()
+	}
+	// 负载为IP的隧道剥离时移动了L2头, 内层帧只能从ExplainDecapsulate的结果中取, 不能按偏移截取frame
+	fmt.Fprintf(&sb, "tunnel: %s\ninner frame at offset %d: %x", tunnel, len(frame)-len(inner), inner)
+	return sb.String()
+}
+
+// 在客户端本地解析, 不依赖ingester, 默认开启所有隧道类型. 可以按agent的配置指定UDP端口和VXLAN严格校验
+func RegisterDecapExplainCommand() *cobra.Command {
+	var types string
+	var udpPorts []string
+	var vxlanStrict bool
+	cmd := &cobra.Command{
+		Use:   "decap-explain <hexstring|file.pcap:frame#>",
+		Short: "decapsulate an ethernet frame and explain each decision",
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) != 1 {
+				fmt.Println(cmd.Use)
+				return
+			}
+			bitmap := datatype.AllTunnelTypes()
+			if types != "" {
+				var err error
+				if bitmap, err = parseTunnelTypes(types); err != nil {
+					fmt.Println(err)
+					return
+				}
+			}
+			for _, arg := range udpPorts {
+				tunnelType, ports, err := parseUdpTunnelPorts(arg)
+				if err == nil {
+					err = datatype.SetUdpTunnelPorts(tunnelType, ports)
+				}
+				if err != nil {
+					fmt.Println(err)
+					return
+				}
+			}
+			datatype.SetVxlanStrict(vxlanStrict)
+			frame, err := loadFrame(args[0])
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			fmt.Println(explainFrame(frame, bitmap))
+		},
+	}
+	cmd.Flags().StringVar(&types, "types", "", "tunnel types to try, e.g. vxlan,geneve. default all")
+	cmd.Flags().StringArrayVar(&udpPorts, "udp-port", nil, "UDP destination ports of a tunnel type, e.g. vxlan=4789,6082. can be repeated")
+	cmd.Flags().BoolVar(&vxlanStrict, "vxlan-strict", false, "require the VXLAN reserved flags and fields to be zero")
+	return cmd
+}
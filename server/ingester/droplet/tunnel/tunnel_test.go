@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) 2024 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnel
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+
+	"github.com/deepflowio/deepflow/server/libs/datatype"
+)
+
+// 外层172.16.1.103->172.20.1.171, VNI 123的VXLAN报文, 内层为ICMP
+const vxlanFrameHex = "ac853ddd88c3f01fafda76790800450000860000000040111f31ac100167ac1401abc00012b50072000008008c0d00007b00" +
+	"fa163e77b2eafa163ef2143b080045000054000040004001b73bc0a80105c0a80118"
+
+func TestDecapExplain(t *testing.T) {
+	frame, _ := hex.DecodeString(vxlanFrameHex)
+	file := filepath.Join(t.TempDir(), "vxlan.pcap")
+	f, _ := os.Create(file)
+	w := pcapgo.NewWriter(f)
+	w.WriteFileHeader(65535, layers.LinkTypeEthernet)
+	w.WritePacket(gopacket.CaptureInfo{CaptureLength: 4, Length: 4}, frame[:4])
+	w.WritePacket(gopacket.CaptureInfo{CaptureLength: len(frame), Length: len(frame)}, frame)
+	f.Close()
+
+	for _, arg := range []string{vxlanFrameHex, "0x" + vxlanFrameHex[:8] + " " + vxlanFrameHex[8:], file + ":2"} {
+		actual, err := loadFrame(arg)
+		if err != nil || hex.EncodeToString(actual) != vxlanFrameHex {
+			t.Errorf("load %.20s...: %x, %v", arg, actual, err)
+		}
+	}
+	for _, arg := range []string{"xyz", file + ":0", file + ":3"} {
+		if _, err := loadFrame(arg); err == nil {
+			t.Errorf("load %s: expect error", arg)
+		}
+	}
+
+	result := explainFrame(frame, datatype.AllTunnelTypes())
+	if !strings.Contains(result, "UDP sport 49152 dport 4789 → VXLAN flags 0x08 ok → vxlan 172.16.1.103->172.20.1.171 vni 123") ||
+		!strings.Contains(result, "inner frame at offset 50: fa163e77b2ea") {
+		t.Errorf("unexpected result %s", result)
+	}
+	if result := explainFrame(frame, datatype.NewTunnelTypeBitmap(datatype.TUNNEL_TYPE_GENEVE)); !strings.HasSuffix(result, "no tunnel decapsulated") {
+		t.Errorf("unexpected result %s", result)
+	}
+}
+
+// 外层172.16.1.103->172.20.1.171的IPIP报文, 内层为ICMP
+const ipipFrameHex = "ac853ddd88c3f01fafda767908004500006800004000400400" + "00ac100167ac1401ab" +
+	"45000054000040004001b73bc0a80105c0a80118"
+
+// 负载为IP的隧道剥离时L2头被移到内层IP头前, 输出的内层帧应以原L2头开始
+func TestDecapExplainIPPayload(t *testing.T) {
+	frame, _ := hex.DecodeString(ipipFrameHex)
+	result := explainFrame(frame, datatype.AllTunnelTypes())
+	if !strings.Contains(result, "ipip 172.16.1.103->172.20.1.171") ||
+		!strings.HasSuffix(result, "inner frame at offset 20: ac853ddd88c3f01fafda7679080045000054000040004001b73bc0a80105c0a80118") {
+		t.Errorf("unexpected result %s", result)
+	}
+	if hex.EncodeToString(frame) != ipipFrameHex {
+		t.Error("input frame should not be modified")
+	}
+}
+
+func TestDecapExplainOptions(t *testing.T) {
+	defer datatype.SetUdpTunnelPorts(datatype.TUNNEL_TYPE_VXLAN, nil)
+	defer datatype.SetVxlanStrict(false)
+	frame, _ := hex.DecodeString(vxlanFrameHex)
+
+	for _, arg := range []string{"vxlan", "unknown=2152", "vxlan=4789,x", "vxlan=65536"} {
+		if _, _, err := parseUdpTunnelPorts(arg); err == nil {
+			t.Errorf("%s: expect error", arg)
+		}
+	}
+	// 与agent使用相同的端口配置时, 4789不再识别为VXLAN
+	tunnelType, ports, err := parseUdpTunnelPorts("vxlan=6082, 4790")
+	if err != nil || tunnelType != datatype.TUNNEL_TYPE_VXLAN || len(ports) != 2 || ports[0] != 6082 || ports[1] != 4790 {
+		t.Fatalf("unexpected %s %v %v", tunnelType, ports, err)
+	}
+	datatype.SetUdpTunnelPorts(tunnelType, ports)
+	if result := explainFrame(frame, datatype.AllTunnelTypes()); !strings.HasSuffix(result, "no tunnel decapsulated") {
+		t.Errorf("unexpected result %s", result)
+	}
+	datatype.SetUdpTunnelPorts(datatype.TUNNEL_TYPE_VXLAN, nil)
+
+	// 严格校验时VXLAN保留字段非0的报文不剥离, 并输出计数
+	frame[42+1] = 1 // 以太网, IP和UDP头之后为VXLAN标志, 其后为保留字段
+	if result := explainFrame(frame, datatype.AllTunnelTypes()); !strings.Contains(result, "vxlan 172.16.1.103->172.20.1.171") {
+		t.Errorf("unexpected result %s", result)
+	}
+	datatype.SetVxlanStrict(true)
+	if result := explainFrame(frame, datatype.AllTunnelTypes()); !strings.Contains(result, "counters: fragmented 0, stt-continued 0, suspect 1, truncated 0") ||
+		!strings.HasSuffix(result, "no tunnel decapsulated") {
+		t.Errorf("unexpected result %s", result)
+	}
+}
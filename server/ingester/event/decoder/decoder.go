@@ -135,9 +135,15 @@ func (d *Decoder) Run() {
 					log.Warning("get perf event decode queue data type wrong")
 					continue
 				}
+				recvBytes, err := receiver.DecompressRecvBuffer(recvBytes)
+				if err != nil {
+					receiver.ReleaseRecvBuffer(recvBytes)
+					continue
+				}
 				decoder.Init(recvBytes.Buffer[recvBytes.Begin:recvBytes.End])
 				d.orgId, d.teamId = uint16(recvBytes.OrgID), uint16(recvBytes.TeamID)
-				d.handlePerfEvent(recvBytes.VtapID, decoder)
+				records, partial := d.handlePerfEvent(recvBytes.VtapID, decoder)
+				receiver.ReportRecords(recvBytes, records, partial)
 				receiver.ReleaseRecvBuffer(recvBytes)
 			case common.ALERT_EVENT:
 				recvBytes, ok := buffer[i].(*receiver.RecvBuffer)
@@ -145,8 +151,14 @@ func (d *Decoder) Run() {
 					log.Warning("get alert event decode queue data type wrong")
 					continue
 				}
+				recvBytes, err := receiver.DecompressRecvBuffer(recvBytes)
+				if err != nil {
+					receiver.ReleaseRecvBuffer(recvBytes)
+					continue
+				}
 				decoder.Init(recvBytes.Buffer[recvBytes.Begin:recvBytes.End])
-				d.handleAlertEvent(decoder)
+				records, partial := d.handleAlertEvent(decoder)
+				receiver.ReportRecords(recvBytes, records, partial)
 				receiver.ReleaseRecvBuffer(recvBytes)
 			case common.K8S_EVENT:
 				recvBytes, ok := buffer[i].(*receiver.RecvBuffer)
@@ -154,9 +166,15 @@ func (d *Decoder) Run() {
 					log.Warning("get k8s event decode queue data type wrong")
 					continue
 				}
+				recvBytes, err := receiver.DecompressRecvBuffer(recvBytes)
+				if err != nil {
+					receiver.ReleaseRecvBuffer(recvBytes)
+					continue
+				}
 				decoder.Init(recvBytes.Buffer[recvBytes.Begin:recvBytes.End])
 				d.orgId, d.teamId = uint16(recvBytes.OrgID), uint16(recvBytes.TeamID)
-				d.handleK8sEvent(recvBytes.VtapID, decoder)
+				records, partial := d.handleK8sEvent(recvBytes.VtapID, decoder)
+				receiver.ReportRecords(recvBytes, records, partial)
 				receiver.ReleaseRecvBuffer(recvBytes)
 			}
 		}
@@ -261,7 +279,7 @@ func (d *Decoder) export(item exporterscommon.ExportItem) {
 	d.exporters.Put(d.eventType.DataSource(), d.index, item)
 }
 
-func (d *Decoder) handlePerfEvent(vtapId uint16, decoder *codec.SimpleDecoder) {
+func (d *Decoder) handlePerfEvent(vtapId uint16, decoder *codec.SimpleDecoder) (records int, partial bool) {
 	for !decoder.IsEnd() {
 		bytes := decoder.ReadBytes()
 		if decoder.Failed() {
@@ -269,7 +287,7 @@ func (d *Decoder) handlePerfEvent(vtapId uint16, decoder *codec.SimpleDecoder) {
 				log.Errorf("proc event decode failed, offset=%d len=%d", decoder.Offset(), len(decoder.Bytes()))
 			}
 			d.counter.ErrorCount++
-			return
+			return records, true
 		}
 		pbPerfEvent := &pb.ProcEvent{}
 		if err := pbPerfEvent.Unmarshal(bytes); err != nil {
@@ -279,9 +297,11 @@ func (d *Decoder) handlePerfEvent(vtapId uint16, decoder *codec.SimpleDecoder) {
 			d.counter.ErrorCount++
 			continue
 		}
+		records++
 		d.counter.OutCount++
 		d.WritePerfEvent(vtapId, pbPerfEvent)
 	}
+	return records, false
 }
 
 func uint32ArrayToStr(u32s []uint32) string {
@@ -417,7 +437,7 @@ func (d *Decoder) handleResourceEvent(event *eventapi.ResourceEvent) {
 	d.eventWriter.Write(s)
 }
 
-func (d *Decoder) handleAlertEvent(decoder *codec.SimpleDecoder) {
+func (d *Decoder) handleAlertEvent(decoder *codec.SimpleDecoder) (records int, partial bool) {
 	for !decoder.IsEnd() {
 		bytes := decoder.ReadBytes()
 		if decoder.Failed() {
@@ -425,7 +445,7 @@ func (d *Decoder) handleAlertEvent(decoder *codec.SimpleDecoder) {
 				log.Errorf("alert event decode failed, offset=%d len=%d", decoder.Offset(), len(decoder.Bytes()))
 			}
 			d.counter.ErrorCount++
-			return
+			return records, true
 		}
 		pbAlertEvent := &alert_event.AlertEvent{}
 		if err := pbAlertEvent.Unmarshal(bytes); err != nil {
@@ -435,9 +455,11 @@ func (d *Decoder) handleAlertEvent(decoder *codec.SimpleDecoder) {
 			d.counter.ErrorCount++
 			continue
 		}
+		records++
 		d.counter.OutCount++
 		d.writeAlertEvent(pbAlertEvent)
 	}
+	return records, false
 }
 
 func (d *Decoder) writeAlertEvent(event *alert_event.AlertEvent) {
@@ -117,7 +117,7 @@ func (d *Decoder) WriteK8sEvent(vtapId uint16, e *pb.KubernetesEvent) {
 	d.eventWriter.Write(s)
 }
 
-func (d *Decoder) handleK8sEvent(vtapId uint16, decoder *codec.SimpleDecoder) {
+func (d *Decoder) handleK8sEvent(vtapId uint16, decoder *codec.SimpleDecoder) (records int, partial bool) {
 	for !decoder.IsEnd() {
 		bytes := decoder.ReadBytes()
 		if decoder.Failed() {
@@ -125,7 +125,7 @@ func (d *Decoder) handleK8sEvent(vtapId uint16, decoder *codec.SimpleDecoder) {
 				log.Errorf("proc event decode failed, offset=%d len=%d", decoder.Offset(), len(decoder.Bytes()))
 			}
 			d.counter.ErrorCount++
-			return
+			return records, true
 		}
 		pbK8sEvent := &pb.KubernetesEvent{}
 		if err := pbK8sEvent.Unmarshal(bytes); err != nil {
@@ -135,7 +135,9 @@ func (d *Decoder) handleK8sEvent(vtapId uint16, decoder *codec.SimpleDecoder) {
 			d.counter.ErrorCount++
 			continue
 		}
+		records++
 		d.counter.OutCount++
 		d.WriteK8sEvent(vtapId, pbK8sEvent)
 	}
+	return records, false
 }
@@ -127,19 +127,26 @@ func (d *Decoder) Run() {
 				log.Warning("get decode queue data type wrong")
 				continue
 			}
+			recvBytes, err := receiver.DecompressRecvBuffer(recvBytes)
+			if err != nil {
+				receiver.ReleaseRecvBuffer(recvBytes)
+				continue
+			}
 			decoder.Init(recvBytes.Buffer[recvBytes.Begin:recvBytes.End])
 			d.orgId, d.teamId = uint16(recvBytes.OrgID), uint16(recvBytes.TeamID)
+			records, partial := 0, false
 			if d.msgType == datatype.MESSAGE_TYPE_TELEGRAF {
-				d.handleTelegraf(recvBytes.VtapID, decoder)
+				records, partial = d.handleTelegraf(recvBytes.VtapID, decoder)
 			} else if d.msgType == datatype.MESSAGE_TYPE_DFSTATS || d.msgType == datatype.MESSAGE_TYPE_SERVER_DFSTATS {
-				d.handleDeepflowStats(recvBytes.VtapID, decoder)
+				records, partial = d.handleDeepflowStats(recvBytes.VtapID, decoder)
 			}
+			receiver.ReportRecords(recvBytes, records, partial)
 			receiver.ReleaseRecvBuffer(recvBytes)
 		}
 	}
 }
 
-func (d *Decoder) handleTelegraf(vtapID uint16, decoder *codec.SimpleDecoder) {
+func (d *Decoder) handleTelegraf(vtapID uint16, decoder *codec.SimpleDecoder) (records int, partial bool) {
 	for !decoder.IsEnd() {
 		bytes := decoder.ReadBytes()
 		if decoder.Failed() {
@@ -147,7 +154,7 @@ func (d *Decoder) handleTelegraf(vtapID uint16, decoder *codec.SimpleDecoder) {
 				log.Errorf("telegraf decode failed, offset=%d len=%d", decoder.Offset(), len(decoder.Bytes()))
 			}
 			d.counter.ErrorCount++
-			return
+			return records, true
 		}
 		points, err := models.ParsePoints(bytes)
 		if err != nil {
@@ -155,12 +162,15 @@ func (d *Decoder) handleTelegraf(vtapID uint16, decoder *codec.SimpleDecoder) {
 				log.Warningf("telegraf parse failed, err msg: %s", err)
 			}
 			d.counter.ErrorCount++
+		} else {
+			records++
 		}
 
 		for _, point := range points {
 			d.sendTelegraf(vtapID, point)
 		}
 	}
+	return records, false
 }
 
 func (d *Decoder) sendTelegraf(vtapID uint16, point models.Point) {
@@ -179,7 +189,7 @@ func (d *Decoder) sendTelegraf(vtapID uint16, point models.Point) {
 	d.counter.OutCount++
 }
 
-func (d *Decoder) handleDeepflowStats(vtapID uint16, decoder *codec.SimpleDecoder) {
+func (d *Decoder) handleDeepflowStats(vtapID uint16, decoder *codec.SimpleDecoder) (records int, partial bool) {
 	for !decoder.IsEnd() {
 		pbStats := &pb.Stats{}
 		bytes := decoder.ReadBytes()
@@ -188,7 +198,7 @@ func (d *Decoder) handleDeepflowStats(vtapID uint16, decoder *codec.SimpleDecode
 				log.Errorf("deepflow stats decode failed, offset=%d len=%d", decoder.Offset(), len(decoder.Bytes()))
 			}
 			d.counter.ErrorCount++
-			return
+			return records, true
 		}
 		if err := pbStats.Unmarshal(bytes); err != nil || pbStats.Name == "" {
 			if d.counter.ErrorCount == 0 {
@@ -198,6 +208,7 @@ func (d *Decoder) handleDeepflowStats(vtapID uint16, decoder *codec.SimpleDecode
 			continue
 		}
 
+		records++
 		if d.debugEnabled {
 			log.Debugf("decoder %d vtap %d recv deepflow stats: %v", d.index, vtapID, pbStats)
 		}
@@ -212,6 +223,7 @@ func (d *Decoder) handleDeepflowStats(vtapID uint16, decoder *codec.SimpleDecode
 		d.extMetricsWriters[dbId].Write(metrics)
 		d.counter.OutCount++
 	}
+	return records, false
 }
 
 func (d *Decoder) StatsToExtMetrics(vtapID uint16, s *pb.Stats) (*dbwriter.ExtMetrics, dbwriter.WriterDBID) {
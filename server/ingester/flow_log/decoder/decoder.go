@@ -24,6 +24,7 @@ import (
 	"time"
 
 	"github.com/golang/protobuf/proto"
+	"github.com/google/gopacket/layers"
 	logging "github.com/op/go-logging"
 	v1 "go.opentelemetry.io/proto/otlp/trace/v1"
 
@@ -54,6 +55,44 @@ const (
 	L7_PROTO_MAX = datatype.L7_PROTOCOL_DNS + 1
 )
 
+// L4流日志按协议分类计数
+const (
+	L4_PROTOCOL_TCP = iota
+	L4_PROTOCOL_UDP
+	L4_PROTOCOL_ICMP
+	L4_PROTOCOL_OTHER
+	L4_PROTOCOL_NON_IP
+	L4_PROTOCOL_MAX
+)
+
+var L4ProtocolString = [L4_PROTOCOL_MAX]string{
+	L4_PROTOCOL_TCP:    "TCP",
+	L4_PROTOCOL_UDP:    "UDP",
+	L4_PROTOCOL_ICMP:   "ICMP",
+	L4_PROTOCOL_OTHER:  "Other",
+	L4_PROTOCOL_NON_IP: "Non-IP",
+}
+
+// 按IP协议号查表, 避免每条流都走switch
+var l4ProtocolIndex [256]uint8
+
+func init() {
+	for i := range l4ProtocolIndex {
+		l4ProtocolIndex[i] = L4_PROTOCOL_OTHER
+	}
+	l4ProtocolIndex[layers.IPProtocolTCP] = L4_PROTOCOL_TCP
+	l4ProtocolIndex[layers.IPProtocolUDP] = L4_PROTOCOL_UDP
+	l4ProtocolIndex[layers.IPProtocolICMPv4] = L4_PROTOCOL_ICMP
+	l4ProtocolIndex[layers.IPProtocolICMPv6] = L4_PROTOCOL_ICMP
+}
+
+func getL4ProtocolIndex(flow *pb.Flow) uint8 {
+	if flow.EthType != uint32(layers.EthernetTypeIPv4) && flow.EthType != uint32(layers.EthernetTypeIPv6) {
+		return L4_PROTOCOL_NON_IP
+	}
+	return l4ProtocolIndex[uint8(flow.FlowKey.Proto)]
+}
+
 type Counter struct {
 	RawCount         int64 `statsd:"raw-count"`
 	L7HTTPCount      int64 `statsd:"l7-http-count"`
@@ -72,6 +111,14 @@ type Counter struct {
 	Count            int64 `statsd:"count"`
 	DropCount        int64 `statsd:"drop-count"`
 
+	L4TCPCount   int64 `statsd:"l4-tcp-count"`
+	L4UDPCount   int64 `statsd:"l4-udp-count"`
+	L4ICMPCount  int64 `statsd:"l4-icmp-count"`
+	L4OtherCount int64 `statsd:"l4-other-count"`
+	L4NonIPCount int64 `statsd:"l4-non-ip-count"`
+	// 解码时只累加数组, 获取counter时再填充到上面的统计字段
+	L4Protocols [L4_PROTOCOL_MAX]int64
+
 	TotalTime int64 `statsd:"total-time"`
 	AvgTime   int64 `statsd:"avg-time"`
 }
@@ -137,6 +184,11 @@ func (d *Decoder) GetCounter() interface{} {
 	if counter.Count > 0 {
 		counter.AvgTime = counter.TotalTime / counter.Count
 	}
+	counter.L4TCPCount = counter.L4Protocols[L4_PROTOCOL_TCP]
+	counter.L4UDPCount = counter.L4Protocols[L4_PROTOCOL_UDP]
+	counter.L4ICMPCount = counter.L4Protocols[L4_PROTOCOL_ICMP]
+	counter.L4OtherCount = counter.L4Protocols[L4_PROTOCOL_OTHER]
+	counter.L4NonIPCount = counter.L4Protocols[L4_PROTOCOL_NON_IP]
 	d.lastCounter = *counter
 	return counter
 }
@@ -167,49 +219,59 @@ func (d *Decoder) Run() {
 				log.Warning("get decode queue data type wrong")
 				continue
 			}
+			recvBytes, err := receiver.DecompressRecvBuffer(recvBytes)
+			if err != nil {
+				receiver.ReleaseRecvBuffer(recvBytes)
+				continue
+			}
 
 			decoder.Init(recvBytes.Buffer[recvBytes.Begin:recvBytes.End])
 			d.agentId, d.orgId, d.teamId = recvBytes.VtapID, uint16(recvBytes.OrgID), uint16(recvBytes.TeamID)
+			records, partial := 0, false
 			switch d.msgType {
 			case datatype.MESSAGE_TYPE_PROTOCOLLOG:
-				d.handleProtoLog(decoder)
+				records, partial = d.handleProtoLog(decoder)
 			case datatype.MESSAGE_TYPE_TAGGEDFLOW:
-				d.handleTaggedFlow(decoder, pbTaggedFlow)
+				records, partial = d.handleTaggedFlow(decoder, pbTaggedFlow)
 			case datatype.MESSAGE_TYPE_OPENTELEMETRY:
-				d.handleOpenTelemetry(decoder, pbTracesData, false)
+				records, partial = d.handleOpenTelemetry(decoder, pbTracesData, false)
 			case datatype.MESSAGE_TYPE_OPENTELEMETRY_COMPRESSED:
-				d.handleOpenTelemetry(decoder, pbTracesData, true)
+				records, partial = d.handleOpenTelemetry(decoder, pbTracesData, true)
 			case datatype.MESSAGE_TYPE_PACKETSEQUENCE:
-				d.handleL4Packet(decoder)
+				records, partial = d.handleL4Packet(decoder)
 			default:
 				log.Warningf("unknown msg type: %d", d.msgType)
 
 			}
+			receiver.ReportRecords(recvBytes, records, partial)
 			receiver.ReleaseRecvBuffer(recvBytes)
 		}
 		d.counter.TotalTime += int64(time.Since(start))
 	}
 }
 
-func (d *Decoder) handleTaggedFlow(decoder *codec.SimpleDecoder, pbTaggedFlow *pb.TaggedFlow) {
+func (d *Decoder) handleTaggedFlow(decoder *codec.SimpleDecoder, pbTaggedFlow *pb.TaggedFlow) (records int, partial bool) {
 	for !decoder.IsEnd() {
 		pbTaggedFlow.ResetAll()
 		decoder.ReadPB(pbTaggedFlow)
 		if decoder.Failed() {
 			d.counter.ErrorCount++
 			log.Errorf("flow decode failed, offset=%d len=%d", decoder.Offset(), len(decoder.Bytes()))
-			return
+			return records, true
 		}
 		if !pbTaggedFlow.IsValid() {
 			d.counter.ErrorCount++
 			log.Warningf("invalid flow %s", pbTaggedFlow.Flow)
 			continue
 		}
+		records++
+		d.counter.L4Protocols[getL4ProtocolIndex(pbTaggedFlow.Flow)]++
 		d.sendFlow(pbTaggedFlow)
 	}
+	return records, false
 }
 
-func (d *Decoder) handleProtoLog(decoder *codec.SimpleDecoder) {
+func (d *Decoder) handleProtoLog(decoder *codec.SimpleDecoder) (records int, partial bool) {
 	for !decoder.IsEnd() {
 		protoLog := pb.AcquirePbAppProtoLogsData()
 
@@ -218,10 +280,12 @@ func (d *Decoder) handleProtoLog(decoder *codec.SimpleDecoder) {
 			d.counter.ErrorCount++
 			pb.ReleasePbAppProtoLogsData(protoLog)
 			log.Errorf("proto log decode failed, offset=%d len=%d", decoder.Offset(), len(decoder.Bytes()))
-			return
+			return records, true
 		}
+		records++
 		d.sendProto(protoLog)
 	}
+	return records, false
 }
 
 func decompressOpenTelemetry(compressed []byte) ([]byte, error) {
@@ -234,7 +298,7 @@ func decompressOpenTelemetry(compressed []byte) ([]byte, error) {
 	return ioutil.ReadAll(reader)
 }
 
-func (d *Decoder) handleOpenTelemetry(decoder *codec.SimpleDecoder, pbTracesData *v1.TracesData, compressed bool) {
+func (d *Decoder) handleOpenTelemetry(decoder *codec.SimpleDecoder, pbTracesData *v1.TracesData, compressed bool) (records int, partial bool) {
 	var err error
 	for !decoder.IsEnd() {
 		pbTracesData.Reset()
@@ -252,10 +316,12 @@ func (d *Decoder) handleOpenTelemetry(decoder *codec.SimpleDecoder, pbTracesData
 				log.Errorf("OpenTelemetry log decode failed, offset=%d len=%d err: %s", decoder.Offset(), len(decoder.Bytes()), err)
 			}
 			d.counter.ErrorCount++
-			return
+			return records, true
 		}
+		records++
 		d.sendOpenMetetry(pbTracesData)
 	}
+	return records, false
 }
 
 func (d *Decoder) sendOpenMetetry(tracesData *v1.TracesData) {
@@ -279,7 +345,7 @@ func (d *Decoder) sendOpenMetetry(tracesData *v1.TracesData) {
 	}
 }
 
-func (d *Decoder) handleL4Packet(decoder *codec.SimpleDecoder) {
+func (d *Decoder) handleL4Packet(decoder *codec.SimpleDecoder) (records int, partial bool) {
 	for !decoder.IsEnd() {
 		l4Packet, err := log_data.DecodePacketSequence(d.agentId, d.orgId, d.teamId, decoder)
 		if decoder.Failed() || err != nil {
@@ -288,15 +354,17 @@ func (d *Decoder) handleL4Packet(decoder *codec.SimpleDecoder) {
 			}
 			l4Packet.Release()
 			d.counter.ErrorCount++
-			return
+			return records, true
 		}
 
+		records++
 		if d.debugEnabled {
 			log.Debugf("decoder %d vtap %d recv l4 packet: %s", d.index, d.agentId, l4Packet)
 		}
 		d.counter.Count++
 		d.throttler.SendWithoutThrottling(l4Packet)
 	}
+	return records, false
 }
 
 func (d *Decoder) sendFlow(flow *pb.TaggedFlow) {
@@ -233,6 +233,7 @@ func NewL4FlowLogger(config *config.Config, platformDataManager *grpc.PlatformDa
 			config,
 		)
 	}
+	debug.ServerRegisterSimple(ingesterctl.CMD_L4_FLOW_LOG_PROTOCOLS, &l4ProtocolsCommand{decoders})
 	return &Logger{
 		Config:        config,
 		Decoders:      decoders,
@@ -321,6 +322,37 @@ func (l *Logger) HandleSimpleCommand(op uint16, arg string) string {
 	return sb.String()
 }
 
+// L4流日志各decoder上一个统计周期的协议分布
+type l4ProtocolsCommand struct {
+	decoders []*decoder.Decoder
+}
+
+func (c *l4ProtocolsCommand) HandleSimpleCommand(op uint16, arg string) string {
+	total := [decoder.L4_PROTOCOL_MAX]int64{}
+	sb := &strings.Builder{}
+	sb.WriteString("last 10s l4 protocol counter:\n")
+	sb.WriteString(fmt.Sprintf("  %-8s", "Decoder"))
+	for _, name := range decoder.L4ProtocolString {
+		sb.WriteString(fmt.Sprintf(" %12s", name))
+	}
+	sb.WriteString("\n")
+	for i, d := range c.decoders {
+		protocols := d.GetLastCounter().L4Protocols
+		sb.WriteString(fmt.Sprintf("  %-8d", i))
+		for j, count := range protocols {
+			total[j] += count
+			sb.WriteString(fmt.Sprintf(" %12d", count))
+		}
+		sb.WriteString("\n")
+	}
+	sb.WriteString(fmt.Sprintf("  %-8s", "Total"))
+	for _, count := range total {
+		sb.WriteString(fmt.Sprintf(" %12d", count))
+	}
+	sb.WriteString("\n")
+	return sb.String()
+}
+
 func (l *Logger) Start() {
 	for _, platformData := range l.PlatformDatas {
 		if platformData != nil {
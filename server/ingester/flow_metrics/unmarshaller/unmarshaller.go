@@ -228,16 +228,28 @@ func (u *Unmarshaller) QueueProcess() {
 		for i := 0; i < n; i++ {
 			value := rawDocs[i]
 			if recvBytes, ok := value.(*receiver.RecvBuffer); ok {
+				recvBytes, err := receiver.DecompressRecvBuffer(recvBytes)
+				if err != nil {
+					u.counter.ErrDocCount++
+					receiver.ReleaseRecvBuffer(recvBytes)
+					continue
+				}
 				bytes := recvBytes.Buffer[recvBytes.Begin:recvBytes.End]
 				decoder.Init(bytes)
+				records, partial := 0, false
 				for !decoder.Failed() && !decoder.IsEnd() {
 					pbDoc.ResetAll()
 					doc, err := app.DecodePB(decoder, pbDoc)
 					if err != nil {
-						u.counter.ErrDocCount++
-						log.Warningf("Decode failed, bytes len=%d err=%s", len([]byte(bytes)), err)
+						// 被截断的消息解码到截断位置失败是预期的, 不计为错误
+						if !recvBytes.Truncated {
+							u.counter.ErrDocCount++
+							log.Warningf("Decode failed, bytes len=%d err=%s", len([]byte(bytes)), err)
+						}
+						partial = true
 						break
 					}
+					records++
 					doc.Tags().TeamID = uint16(recvBytes.TeamID)
 					doc.Tags().OrgId = uint16(recvBytes.OrgID)
 					u.isGoodDocument(int64(doc.Time()))
@@ -269,6 +281,7 @@ func (u *Unmarshaller) QueueProcess() {
 					u.export(doc)
 					u.putStoreQueue(doc)
 				}
+				receiver.ReportRecords(recvBytes, records, partial)
 				receiver.ReleaseRecvBuffer(recvBytes)
 			} else if value == nil { // flush ticker
 				u.flushStoreQueue()
@@ -93,7 +93,22 @@ func Start(configPath string, shared *servercommon.ControllerIngesterShared) []i
 	stats.SetRemoteType(stats.REMOTE_TYPE_DFSTATSD)
 	stats.SetDFRemote(net.JoinHostPort("127.0.0.1", strconv.Itoa(int(cfg.ListenPort))))
 
-	receiver := receiver.NewReceiver(int(cfg.ListenPort), cfg.UDPReadBuffer, cfg.TCPReadBuffer, cfg.TCPReaderBuffer)
+	receiver, err := receiver.NewReceiverWithConfig(receiver.ReceiverConfig{
+		ListenPort:           int(cfg.ListenPort),
+		UDPReadBuffer:        cfg.UDPReadBuffer,
+		TCPReadBuffer:        cfg.TCPReadBuffer,
+		TCPReaderBuffer:      cfg.TCPReaderBuffer,
+		HeaderCRCRequired:    cfg.HeaderCRCRequired,
+		LegacyHeaderDisabled: cfg.LegacyHeaderDisabled,
+		TenantRules:          cfg.TenantRules,
+		MirrorDestination:    cfg.MirrorDestination,
+		MirrorFilters:        cfg.MirrorFilters,
+		StatsdAddress:        cfg.ReceiverStatsdAddress,
+		AgentNameReverseDNS:  cfg.AgentNameReverseDNS,
+		AgentNameFile:        cfg.AgentNameFile,
+		ErrorTapDirectory:    cfg.ErrorTapDirectory,
+	})
+	checkError(err)
 
 	ingesterOrgHandler := NewOrgHandler(cfg)
 	closers := []io.Closer{}
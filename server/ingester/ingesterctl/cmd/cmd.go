@@ -27,6 +27,7 @@ import (
 	"github.com/deepflowio/deepflow/server/ingester/common"
 	"github.com/deepflowio/deepflow/server/ingester/droplet/profiler"
 	"github.com/deepflowio/deepflow/server/ingester/droplet/queue"
+	"github.com/deepflowio/deepflow/server/ingester/droplet/tunnel"
 	"github.com/deepflowio/deepflow/server/ingester/ingesterctl"
 	"github.com/deepflowio/deepflow/server/ingester/prometheus/decoder"
 	"github.com/deepflowio/deepflow/server/libs/ckdb"
@@ -98,6 +99,7 @@ func RegisterIngesterCommand(root *cobra.Command) {
 		"1-receiver-to-statsd",
 		"1-receiver-to-syslog",
 	}))
+	dropletCmd.AddCommand(tunnel.RegisterDecapExplainCommand())
 
 	flowMetricsCmd.AddCommand(queue.RegisterCommand(ingesterctl.INGESTERCTL_FLOW_METRICS_QUEUE, []string{"1-recv-unmarshall"}))
 	flowMetricsCmd.AddCommand(debug.ClientRegisterSimple(ingesterctl.CMD_PLATFORMDATA_FLOW_METRIC, debug.CmdHelper{"platformData [filter]", "show flow metrics platform data statistics"}, nil))
@@ -109,6 +111,7 @@ func RegisterIngesterCommand(root *cobra.Command) {
 	}))
 	flowLogCmd.AddCommand(debug.ClientRegisterSimple(ingesterctl.CMD_PLATFORMDATA_FLOW_LOG, debug.CmdHelper{"platformData [filter]", "show flow log platform data statistics"}, nil))
 	flowLogCmd.AddCommand(debug.ClientRegisterSimple(ingesterctl.CMD_L7_FLOW_LOG, debug.CmdHelper{"l7", "show l7 flow log counter"}, nil))
+	flowLogCmd.AddCommand(debug.ClientRegisterSimple(ingesterctl.CMD_L4_FLOW_LOG_PROTOCOLS, debug.CmdHelper{"protocols", "show l4 flow log protocol counter"}, nil))
 
 	prometheusCmd.AddCommand(debug.ClientRegisterSimple(ingesterctl.CMD_PLATFORMDATA_PROMETHEUS, debug.CmdHelper{"platformData [filter]", "show prometheus platform data statistics"}, nil))
 	prometheusCmd.AddCommand(decoder.RegisterClientPrometheusLabelCommand())
@@ -58,6 +58,7 @@ const (
 	CMD_EXPORTER_PLATFORMDATA
 	CMD_CONTINUOUS_PROFILER
 	CMD_ORG_SWITCH
+	CMD_L4_FLOW_LOG_PROTOCOLS
 )
 
 const (
@@ -135,15 +135,21 @@ func (d *Decoder) Run() {
 				log.Warning("pcap get decode queue data type wrong")
 				continue
 			}
+			recvBytes, err := receiver.DecompressRecvBuffer(recvBytes)
+			if err != nil {
+				receiver.ReleaseRecvBuffer(recvBytes)
+				continue
+			}
 			decoder.Init(recvBytes.Buffer[recvBytes.Begin:recvBytes.End])
 			d.orgId, d.teamId = uint16(recvBytes.OrgID), uint16(recvBytes.TeamID)
-			d.handlePcap(recvBytes.VtapID, decoder, encoder, pcapHeader, pcapBatch)
+			records, partial := d.handlePcap(recvBytes.VtapID, decoder, encoder, pcapHeader, pcapBatch)
+			receiver.ReportRecords(recvBytes, records, partial)
 			receiver.ReleaseRecvBuffer(recvBytes)
 		}
 	}
 }
 
-func (d *Decoder) handlePcap(vtapID uint16, decoder *codec.SimpleDecoder, encoder *codec.SimpleEncoder, pcapHeader *PcapHeader, pcapBatch *trident.PcapBatch) {
+func (d *Decoder) handlePcap(vtapID uint16, decoder *codec.SimpleDecoder, encoder *codec.SimpleEncoder, pcapHeader *PcapHeader, pcapBatch *trident.PcapBatch) (records int, partial bool) {
 	var err error
 	for !decoder.IsEnd() {
 		bytes := decoder.ReadBytes()
@@ -155,8 +161,9 @@ func (d *Decoder) handlePcap(vtapID uint16, decoder *codec.SimpleDecoder, encode
 				log.Errorf("pcap decode failed, offset=%d len=%d err: %s", decoder.Offset(), len(decoder.Bytes()), err)
 			}
 			d.counter.ErrorCount++
-			return
+			return records, true
 		}
+		records++
 		pcapHeader.Magic = pcapBatch.GetMagic()
 		pcapHeader.Encode(encoder)
 		for _, pcap := range pcapBatch.Batches {
@@ -164,6 +171,7 @@ func (d *Decoder) handlePcap(vtapID uint16, decoder *codec.SimpleDecoder, encode
 			d.pcapWriter.Write(d.pcapToStore(vtapID, encoder.Bytes(), pcap))
 		}
 	}
+	return records, false
 }
 
 func (d *Decoder) pcapToStore(vtapID uint16, pcapHeader []byte, pcap *trident.Pcap) *dbwriter.PcapStore {
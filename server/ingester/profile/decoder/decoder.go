@@ -155,10 +155,16 @@ func (d *Decoder) Run() {
 				log.Warning("get decode queue data type wrong")
 				continue
 			}
+			recvBytes, err := receiver.DecompressRecvBuffer(recvBytes)
+			if err != nil {
+				receiver.ReleaseRecvBuffer(recvBytes)
+				continue
+			}
 			decoder.Init(recvBytes.Buffer[recvBytes.Begin:recvBytes.End])
 			d.orgId, d.teamId = uint16(recvBytes.OrgID), uint16(recvBytes.TeamID)
 			if d.msgType == datatype.MESSAGE_TYPE_PROFILE {
-				d.handleProfileData(recvBytes.VtapID, decoder)
+				records, partial := d.handleProfileData(recvBytes.VtapID, decoder)
+				receiver.ReportRecords(recvBytes, records, partial)
 			}
 			receiver.ReleaseRecvBuffer(recvBytes)
 		}
@@ -178,15 +184,16 @@ func (d *Decoder) appServiceTagWrite(p *dbwriter.InProcessProfile) {
 	d.appServiceTagWriter.Write(p.Time, dbwriter.PROFILE_TABLE, p.AppService, p.AppInstance, p.OrgId, p.TeamID)
 }
 
-func (d *Decoder) handleProfileData(vtapID uint16, decoder *codec.SimpleDecoder) {
+func (d *Decoder) handleProfileData(vtapID uint16, decoder *codec.SimpleDecoder) (records int, partial bool) {
 	for !decoder.IsEnd() {
 		profile := &pb.Profile{}
 		decoder.ReadPB(profile)
 		if decoder.Failed() || profile == nil {
 			log.Errorf("profile data decode failed, offset=%d len=%d", decoder.Offset(), len(decoder.Bytes()))
-			return
+			return records, true
 		}
 
+		records++
 		parser := &Parser{
 			vtapID:                      vtapID,
 			orgId:                       d.orgId,
@@ -212,7 +219,7 @@ func (d *Decoder) handleProfileData(vtapID uint16, decoder *codec.SimpleDecoder)
 			decompressJfr, err := profile_common.GzipDecompress(profile.Data)
 			if err != nil {
 				log.Errorf("decompress java profile data failed, offset=%d, len=%d, err=%s", decoder.Offset(), len(decoder.Bytes()), err)
-				return
+				return records, true
 			}
 			err = d.sendProfileData(&jfr.RawProfile{
 				FormDataContentType: string(profile.ContentType),
@@ -221,7 +228,7 @@ func (d *Decoder) handleProfileData(vtapID uint16, decoder *codec.SimpleDecoder)
 
 			if err != nil {
 				log.Errorf("decode java profile data failed, offset=%d, len=%d, err=%s", decoder.Offset(), len(decoder.Bytes()), err)
-				return
+				return records, true
 			}
 		case "pprof":
 			atomic.AddInt64(&d.counter.GolangProfileCount, 1)
@@ -233,7 +240,7 @@ func (d *Decoder) handleProfileData(vtapID uint16, decoder *codec.SimpleDecoder)
 			}, profile.Format, parser, metadata)
 			if err != nil {
 				log.Errorf("decode golang profile data failed, offset=%d, len=%d, err=%s", decoder.Offset(), len(decoder.Bytes()), err)
-				return
+				return records, true
 			}
 		case "":
 			// 如果 format == "" && contentType 有 "multipart/form-data"，默认当作 pprof 来解析，且 StreamingParser&PoolStreamingParser = true
@@ -250,7 +257,7 @@ func (d *Decoder) handleProfileData(vtapID uint16, decoder *codec.SimpleDecoder)
 				}, profile.Format, parser, metadata)
 				if err != nil {
 					log.Errorf("decode golang profile data failed, offset=%d, len=%d, err=%s", decoder.Offset(), len(decoder.Bytes()), err)
-					return
+					return records, true
 				}
 			} else {
 				atomic.AddInt64(&d.counter.EBPFProfileCount, 1)
@@ -268,7 +275,7 @@ func (d *Decoder) handleProfileData(vtapID uint16, decoder *codec.SimpleDecoder)
 				}, profile.Format, parser, metadata)
 				if err != nil {
 					log.Errorf("decode ebpf profile data failed, offset=%d, len=%d, err=%s", decoder.Offset(), len(decoder.Bytes()), err)
-					return
+					return records, true
 				}
 			}
 		case "speedscope", "tree", "trie", "lines":
@@ -276,6 +283,7 @@ func (d *Decoder) handleProfileData(vtapID uint16, decoder *codec.SimpleDecoder)
 			continue
 		}
 	}
+	return records, false
 }
 
 func (d *Decoder) filleBPFData(profile *pb.Profile) *pb.Profile {
@@ -195,9 +195,15 @@ func (d *Decoder) Run() {
 				log.Warning("get decode queue data type wrong")
 				continue
 			}
+			recvBytes, err := receiver.DecompressRecvBuffer(recvBytes)
+			if err != nil {
+				receiver.ReleaseRecvBuffer(recvBytes)
+				continue
+			}
 			decoder.Init(recvBytes.Buffer[recvBytes.Begin:recvBytes.End])
 			d.orgId, d.teamId = uint16(recvBytes.OrgID), uint16(recvBytes.TeamID)
-			d.handlePrometheusData(recvBytes.VtapID, decoder, &decodeBuffer, promWriteRequest, prometheusMetric, extraLabels)
+			records, partial := d.handlePrometheusData(recvBytes.VtapID, decoder, &decodeBuffer, promWriteRequest, prometheusMetric, extraLabels)
+			receiver.ReportRecords(recvBytes, records, partial)
 			receiver.ReleaseRecvBuffer(recvBytes)
 		}
 	}
@@ -226,7 +232,7 @@ func prometheusMetricReset(m *pb.PrometheusMetric) {
 	m.ExtraLabelValues = m.ExtraLabelValues[:0]
 }
 
-func (d *Decoder) handlePrometheusData(vtapID uint16, decoder *codec.SimpleDecoder, decodeBuffer *[]byte, req *prompb.WriteRequest, prometheusMetric *pb.PrometheusMetric, extraLabels *[]prompb.Label) {
+func (d *Decoder) handlePrometheusData(vtapID uint16, decoder *codec.SimpleDecoder, decodeBuffer *[]byte, req *prompb.WriteRequest, prometheusMetric *pb.PrometheusMetric, extraLabels *[]prompb.Label) (records int, partial bool) {
 	for !decoder.IsEnd() {
 		prometheusMetricReset(prometheusMetric)
 		bytes := decoder.ReadBytes()
@@ -235,7 +241,7 @@ func (d *Decoder) handlePrometheusData(vtapID uint16, decoder *codec.SimpleDecod
 				log.Errorf("prometheus decode failed, offset=%d len=%d", decoder.Offset(), len(decoder.Bytes()))
 			}
 			d.counter.ErrCount++
-			return
+			return records, true
 		}
 
 		if err := prometheusMetric.Unmarshal(bytes); err != nil {
@@ -255,6 +261,7 @@ func (d *Decoder) handlePrometheusData(vtapID uint16, decoder *codec.SimpleDecod
 			continue
 		}
 
+		records++
 		*extraLabels = (*extraLabels)[:0]
 		for i := range prometheusMetric.ExtraLabelNames {
 			*extraLabels = append(*extraLabels, prompb.Label{
@@ -269,6 +276,7 @@ func (d *Decoder) handlePrometheusData(vtapID uint16, decoder *codec.SimpleDecod
 		}
 		req.ResetWithBufferReserved() // release memory as soon as possible
 	}
+	return records, false
 }
 
 func (d *Decoder) sendPrometheus(vtapID uint16, ts *prompb.TimeSeries, extraLabels []prompb.Label) {
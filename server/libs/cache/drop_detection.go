@@ -62,6 +62,13 @@ func (d *DropDetection) GetCounter() interface{} {
 	return counter
 }
 
+func (i *Instance) resetCache() {
+	for j := range i.cache {
+		i.cache[j] = false
+	}
+	i.cacheStartIndex = 0
+}
+
 func (d *DropDetection) findAndAdd(id uint32) *Instance {
 	var instance *Instance
 	if instance = d.instances[id]; instance == nil {
@@ -77,6 +84,11 @@ func (d *DropDetection) Detect(id uint32, seq uint64, timestamp uint32) {
 	instance := d.findAndAdd(id)
 
 	if instance.seq == 0 || seq == 1 {
+		if instance.seq > 1 && timestamp > instance.maxTimestamp {
+			// seq从1重新开始且时间更大时trident已重启, 重启前缓存的包不能当作新序列中的包.
+			// 时间没有增大时可能是乱序到达的seq 1, 不能清除当前窗口
+			instance.resetCache()
+		}
 		instance.seq = seq
 		log.Infof("%s received first packet from %s, with seq %d", d.name, IpFromUint32(uint32(id)), seq)
 	}
@@ -86,10 +98,7 @@ func (d *DropDetection) Detect(id uint32, seq uint64, timestamp uint32) {
 			// 序列号更小但时间更大，此时为trident重启，有进程重启告警因此不计算丢包
 			log.Infof("%s restart, %s time %s, cache time %s, reset sequence from %d to max(%d-%d, %d)",
 				IpFromUint32(uint32(id)), d.name, time.Unix(int64(timestamp), 0), time.Unix(int64(instance.maxTimestamp), 0), instance.seq, seq, d.windowSize, 1)
-			for i := range instance.cache {
-				instance.cache[i] = false
-			}
-			instance.cacheStartIndex = 0
+			instance.resetCache()
 			if seq > d.windowSize {
 				instance.seq = seq - d.windowSize
 			} else {
@@ -17,7 +17,14 @@
 package cache
 
 import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
 	"testing"
+	"time"
+
+	logging "github.com/op/go-logging"
 )
 
 func TestDropdetection(t *testing.T) {
@@ -62,3 +69,152 @@ func TestDropdetection(t *testing.T) {
 		t.Errorf("TestDropdetection dropped error: %v", counter)
 	}
 }
+
+// 返回窗口中已收到但尚未移出窗口的seq
+func cachedSeqs(d *DropDetection, instance *Instance) []uint64 {
+	seqs := []uint64{}
+	for i := uint64(0); i < d.windowSize; i++ {
+		if instance.cache[(instance.cacheStartIndex+i)&(d.windowSize-1)] {
+			seqs = append(seqs, instance.seq+i)
+		}
+	}
+	return seqs
+}
+
+func TestDropDetectionRestart(t *testing.T) {
+	type packet struct {
+		seq       uint64
+		timestamp uint32
+	}
+	// 每个用例先发送before建立状态并清空计数, 再发送after后检查
+	testCases := []struct {
+		name     string
+		before   []packet
+		after    []packet
+		seq      uint64   // 窗口起始seq
+		cached   []uint64 // 窗口中已收到的seq
+		dropped  uint64
+		disorder uint64
+	}{
+		// 重启后窗口起始为seq-windowSize, 其本身已移出窗口, 计为1个丢包
+		{"empty-cache", []packet{{100, 10}, {101, 10}}, []packet{{80, 20}}, 17, []uint64{80}, 1, 0},
+		// 重启前等待101而缓存的102和103被丢弃, 不会当作新序列中的包
+		{"partial-cache", []packet{{100, 10}, {102, 10}, {103, 10}}, []packet{{80, 20}}, 17, []uint64{80}, 1, 0},
+		// 窗口前移时重启前未收到的17和18计为丢包
+		{"partial-cache-continue", []packet{{100, 10}, {102, 10}, {103, 10}}, []packet{{80, 20}, {82, 20}}, 19, []uint64{80, 82}, 3, 0},
+		// 新seq小于windowSize时从1开始
+		{"small-seq", []packet{{100, 10}, {102, 10}}, []packet{{35, 20}}, 1, []uint64{35}, 0, 0},
+		{"small-seq-fill", []packet{{100, 10}, {102, 10}}, []packet{{3, 20}, {1, 20}}, 2, []uint64{3}, 0, 0},
+		// seq为1且时间更大时同样视为重启, 之前缓存的包需要清除
+		{"seq-1", []packet{{100, 10}, {102, 10}, {103, 10}}, []packet{{1, 20}}, 2, []uint64{}, 0, 0},
+		{"seq-1-gap", []packet{{100, 10}, {102, 10}, {103, 10}}, []packet{{1, 20}, {4, 20}}, 2, []uint64{4}, 0, 0},
+		// 时间没有增大的seq 1可能是乱序包, 与之前一样从1重新开始但不清除缓存, 已缓存的包依次移出窗口
+		{"seq-1-reordered", []packet{{2, 10}, {4, 10}}, []packet{{1, 10}}, 3, []uint64{}, 0, 0},
+		{"seq-1-older", []packet{{100, 10}, {102, 10}, {103, 10}}, []packet{{1, 9}}, 4, []uint64{}, 0, 0},
+		// 时间没有增大时是乱序而不是重启, 窗口保持不变
+		{"same-timestamp", []packet{{100, 10}, {102, 10}}, []packet{{80, 10}}, 101, []uint64{102}, 0, 1},
+		{"older-timestamp", []packet{{100, 10}, {102, 10}}, []packet{{80, 9}}, 101, []uint64{102}, 0, 1},
+	}
+	for _, tc := range testCases {
+		d := &DropDetection{}
+		d.Init(tc.name, 64)
+		for _, p := range tc.before {
+			d.Detect(1, p.seq, p.timestamp)
+		}
+		d.GetCounter()
+		for _, p := range tc.after {
+			d.Detect(1, p.seq, p.timestamp)
+		}
+		instance := d.instances[1]
+		counter := d.GetCounter().(*DropCounter)
+		if cached := cachedSeqs(d, instance); instance.seq != tc.seq || !reflect.DeepEqual(cached, tc.cached) ||
+			counter.Dropped != tc.dropped || counter.Disorder != tc.disorder {
+			t.Errorf("%s: expect seq %d cached %v dropped %d disorder %d, actual seq %d cached %v %+v",
+				tc.name, tc.seq, tc.cached, tc.dropped, tc.disorder, instance.seq, cached, counter)
+		}
+	}
+}
+
+type dropProfile struct {
+	name            string
+	lossRate        float64 // 丢包比例
+	burstSize       int     // 每次连续丢失的包数
+	reorderRate     float64 // 乱序包比例
+	reorderDistance int     // 乱序包最多被推迟的包数
+}
+
+var dropProfiles = []dropProfile{
+	{"clean-lan", 0, 1, 0.001, 4},
+	{"lossy-wan", 0.01, 4, 0.01, 32},
+	{"pathological", 0.05, 8, 0.1, 256},
+}
+
+// 生成长度为n的seq序列(从1开始), 返回实际到达的序列和丢失的包数
+func generateSeqTrace(profile dropProfile, n int, seed int64) ([]uint64, int) {
+	rnd := rand.New(rand.NewSource(seed))
+	type arrival struct {
+		seq uint64
+		key int
+	}
+	arrivals := make([]arrival, 0, n)
+	lost := 0
+	for i := 0; i < n; i++ {
+		if profile.lossRate > 0 && rnd.Float64() < profile.lossRate/float64(profile.burstSize) {
+			burst := profile.burstSize
+			if i+burst > n {
+				burst = n - i
+			}
+			lost += burst
+			i += burst - 1
+			continue
+		}
+		key := i
+		if profile.reorderDistance > 0 && rnd.Float64() < profile.reorderRate {
+			key += 1 + rnd.Intn(profile.reorderDistance)
+		}
+		arrivals = append(arrivals, arrival{uint64(i + 1), key})
+	}
+	sort.SliceStable(arrivals, func(i, j int) bool { return arrivals[i].key < arrivals[j].key })
+	trace := make([]uint64, len(arrivals))
+	for i := range arrivals {
+		trace[i] = arrivals[i].seq
+	}
+	return trace, lost
+}
+
+// 按不同丢包和乱序模型重放seq序列, 除耗时外输出每个包对应的dropped和disorder计数,
+// 以及trace中实际丢失的比例(lost/pkt)用于对比, 便于调整windowSize
+func BenchmarkDropDetection(b *testing.B) {
+	const traceLen = 1 << 16
+	// 丢包和乱序日志会淹没benchmark输出
+	level := logging.GetLevel("cache")
+	logging.SetLevel(logging.WARNING, "cache")
+	defer logging.SetLevel(level, "cache")
+
+	for _, profile := range dropProfiles {
+		trace, lost := generateSeqTrace(profile, traceLen, 1)
+		for _, windowSize := range []uint64{64, 1024} {
+			b.Run(fmt.Sprintf("%s/window-%d", profile.name, windowSize), func(b *testing.B) {
+				d := &DropDetection{}
+				d.Init("benchmark", windowSize)
+
+				b.ResetTimer()
+				start := time.Now()
+				for i := 0; i < b.N; i++ {
+					// 每轮重放时seq整体后移, 保证跨轮次连续
+					round, index := uint64(i/len(trace)), i%len(trace)
+					seq := round*traceLen + trace[index]
+					d.Detect(1, seq, uint32(seq/1000))
+				}
+				elapsed := time.Since(start)
+				b.StopTimer()
+
+				counter := d.GetCounter().(*DropCounter)
+				b.ReportMetric(float64(b.N)/elapsed.Seconds(), "pkts/s")
+				b.ReportMetric(float64(counter.Dropped)/float64(b.N), "dropped/pkt")
+				b.ReportMetric(float64(counter.Disorder)/float64(b.N), "disorder/pkt")
+				b.ReportMetric(float64(lost)/float64(len(trace)), "lost/pkt")
+			})
+		}
+	}
+}
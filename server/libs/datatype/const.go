@@ -72,6 +72,7 @@ const (
 	MAX_TCP_OPTION_SIZE = 40
 
 	ETH_HEADER_SIZE          = MAC_ADDR_LEN*2 + ETH_TYPE_LEN
+	VLAN_HEADER_SIZE         = 4 // TPID(2B) + TCI(2B)
 	ARP_HEADER_SIZE          = 28
 	VXLAN_HEADER_SIZE        = 8
 	IP_HEADER_SIZE           = 20
@@ -130,13 +131,93 @@ const (
 	IP6_PROTO_OFFSET = 6
 	IP6_SIP_OFFSET   = 20 // 用于解析tunnel，仅使用后四个字节
 	IP6_DIP_OFFSET   = 36 // 用于解析tunnel，仅使用后四个字节
+	UDP_SPORT_OFFSET = 0
 	UDP_DPORT_OFFSET = 2
+	UDP_LEN_OFFSET   = 4
 
 	VXLAN_FLAGS_OFFSET = 0
 	VXLAN_VNI_OFFSET   = 4
 
+	VXLAN_GPE_FLAGS_VER_MASK         = 0x30
+	VXLAN_GPE_FLAGS_P                = 0x04 // Next Protocol字段有效
+	VXLAN_GPE_NEXT_PROTOCOL_OFFSET   = 3
+	VXLAN_GPE_NEXT_PROTOCOL_IPV4     = 1
+	VXLAN_GPE_NEXT_PROTOCOL_IPV6     = 2
+	VXLAN_GPE_NEXT_PROTOCOL_ETHERNET = 3
+
+	IP6_SRC_ADDR_OFFSET        = 8 // 完整的IPv6源地址
+	IP6_DST_ADDR_OFFSET        = 24
+	IP6_EXT_NEXT_HEADER_OFFSET = 0
+	IP6_EXT_LEN_OFFSET         = 1 // 以8字节为单位, 不包括前8个字节
+	IP6_FRAG_OFFSET_OFFSET     = 2
+	IP6_EXT_HEADER_MIN_SIZE    = 8
+
+	IP_TOS_OFFSET        = 1
+	IP_TTL_OFFSET        = 8
+	IP6_HOP_LIMIT_OFFSET = 7 // Traffic Class位于第0字节低4位和第1字节高4位
+
+	IP_FRAG_OFFSET      = 6 // Flags(3b) + Fragment Offset(13b)
+	IP_FRAG_OFFSET_MASK = 0x1fff
+
+	MPLS_LABEL_SIZE      = 4
+	MPLS_BOTTOM_OF_STACK = 1 << 8
+	MPLS_LABEL_SHIFT     = 12
+
+	GENEVE_HEADER_SIZE        = 8
+	GENEVE_VER_OPT_LEN_OFFSET = 0 // Ver(2b) + Opt Len(6b), Opt Len以4字节为单位
+	GENEVE_PROTOCOL_OFFSET    = 2
+	GENEVE_VNI_OFFSET         = 4
+	GENEVE_OPTION_HEADER_SIZE = 4
+	GENEVE_OPTION_LEN_OFFSET  = 3 // R(3b) + Length(5b), Length以4字节为单位
+
 	ERSPAN_ID_OFFSET       = 0 // erspan2和3共用，4字节取0x3ff
+	ERSPAN_VERSION_OFFSET  = 0 // erspan2和3共用，高4位为Ver
+	ERSPANII_VERSION       = 1
+	ERSPANIII_VERSION      = 2
 	ERSPANIII_FLAGS_OFFSET = 11
+
+	ERSPANIII_VLAN_OFFSET  = 0  // Ver(4b) + VLAN(12b)
+	ERSPANIII_COS_OFFSET   = 2  // COS(3b) + BSO(2b) + T(1b) + Session ID(10b)
+	ERSPANIII_HW_ID_OFFSET = 10 // P(1b) + FT(5b) + Hardware ID(6b) + D(1b) + Gra(2b) + O(1b)
+	ERSPANIII_FLAG_D       = 0x8
+	ERSPANIII_FLAG_O       = 0x1
+
+	ERSPANIII_TIMESTAMP_OFFSET = 4
+	ERSPANIII_GRA_SHIFT        = 1 // Gra位于ERSPANIII_FLAGS_OFFSET字节的bit1~2
+	ERSPANIII_GRA_MASK         = 0x3
+
+	TCP_DPORT_OFFSET       = 2
+	TCP_DATA_OFFSET_OFFSET = 12 // Data Offset(4b), 以4字节为单位
+	STT_FRAG_OFFSET_OFFSET = 6  // STT复用TCP序列号, 高16位为帧长度, 低16位为分段偏移
+
+	STT_HEADER_SIZE       = 18 // Version(1B) + Flags(1B) + L4 Offset(1B) + Reserved(1B) + MSS(2B) + VLAN TCI(2B) + Context ID(8B) + Padding(2B)
+	STT_VERSION_OFFSET    = 0
+	STT_VERSION           = 0
+	STT_CONTEXT_ID_OFFSET = 8
+
+	CAPWAP_HEADER_MIN_SIZE    = 8      // Preamble(1B) + HLEN/RID/WBID/Flags(3B) + Fragment ID(2B) + Fragment Offset(2B)
+	CAPWAP_PREAMBLE_OFFSET    = 0      // Version(4b) + Type(4b), Type为1时为DTLS加密的报文
+	CAPWAP_FRAG_OFFSET_OFFSET = 6      // Fragment Offset(13b) + Reserved(3b)
+	CAPWAP_HLEN_SHIFT         = 19     // 首个4字节中: Preamble(8b) + HLEN(5b) + RID(5b) + WBID(5b) + T/F/L/W/M/K + Flags(3b)
+	CAPWAP_HLEN_MASK          = 0x1f   // 以4字节为单位, 包括Radio MAC和Wireless Specific Information
+	CAPWAP_FLAG_T             = 1 << 8 // 负载为WBID指定的原生格式(如802.11), 否则为802.3帧
+	CAPWAP_FLAG_F             = 1 << 7 // 分片
+	CAPWAP_FLAG_W             = 1 << 5 // 携带Wireless Specific Information
+	CAPWAP_FLAG_M             = 1 << 4 // 携带Radio MAC
+	CAPWAP_FLAG_K             = 1 << 3 // Data Channel Keep-Alive, 没有负载帧
+
+	GTPU_HEADER_SIZE     = 8 // Flags(1B) + Message Type(1B) + Length(2B) + TEID(4B)
+	GTPU_FLAGS_OFFSET    = 0 // Version(3b) + PT(1b) + Reserved(1b) + E(1b) + S(1b) + PN(1b)
+	GTPU_MSG_TYPE_OFFSET = 1
+	GTPU_LENGTH_OFFSET   = 2 // 不包括前8个字节
+	GTPU_TEID_OFFSET     = 4
+	GTPU_VERSION         = 1
+	GTPU_FLAGS_PT        = 0x10 // 为0时是GTP'
+	GTPU_FLAGS_E         = 0x04 // 携带扩展头
+	GTPU_FLAGS_OPTIONAL  = 0x07 // E, S, PN任一置位时携带4字节可选字段
+	GTPU_OPTIONAL_SIZE   = 4    // Sequence Number(2B) + N-PDU Number(1B) + Next Extension Header Type(1B)
+	GTPU_MSG_TYPE_GPDU   = 0xff // 承载用户数据, 其它消息类型为Echo, Error Indication等信令
+	GTPU_EXT_LEN_UNIT    = 4    // 扩展头首字节为以4字节为单位的长度, 末字节为下一个扩展头的类型
 )
 
 const (
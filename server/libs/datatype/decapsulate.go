@@ -18,7 +18,12 @@ package datatype
 
 import (
 	. "encoding/binary"
+	"encoding/json"
 	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 
 	. "github.com/google/gopacket/layers"
@@ -30,11 +35,23 @@ import (
 type TunnelType uint8
 
 const (
-	TUNNEL_TYPE_NONE          = TunnelType(pb.DecapType_DECAP_TYPE_NONE)
-	TUNNEL_TYPE_VXLAN         = TunnelType(pb.DecapType_DECAP_TYPE_VXLAN)
-	TUNNEL_TYPE_IPIP          = TunnelType(pb.DecapType_DECAP_TYPE_IPIP)
-	TUNNEL_TYPE_TENCENT_GRE   = TunnelType(pb.DecapType_DECAP_TYPE_TENCENT) // GRE.ver=0/1 GRE.protoType=IPv4/IPv6
-	TUNNEL_TYPE_ERSPAN_OR_TEB = TUNNEL_TYPE_TENCENT_GRE + 1
+	TUNNEL_TYPE_NONE        = TunnelType(pb.DecapType_DECAP_TYPE_NONE)
+	TUNNEL_TYPE_VXLAN       = TunnelType(pb.DecapType_DECAP_TYPE_VXLAN)
+	TUNNEL_TYPE_IPIP        = TunnelType(pb.DecapType_DECAP_TYPE_IPIP)
+	TUNNEL_TYPE_TENCENT_GRE = TunnelType(pb.DecapType_DECAP_TYPE_TENCENT) // GRE.ver=0/1 GRE.protoType=IPv4/IPv6
+	TUNNEL_TYPE_GENEVE      = TunnelType(pb.DecapType_DECAP_TYPE_GENEVE)
+	TUNNEL_TYPE_ERSPAN      = TUNNEL_TYPE_GENEVE + 1 // 与agent/src/common/decapsulate.rs取值一致, 服务端不单独解析, 仅用于显示agent上报的类型
+	TUNNEL_TYPE_TEB         = TUNNEL_TYPE_ERSPAN + 1
+
+	// 0~9留给protobuf和agent, 服务端独有的类型从10开始, 因TunnelTypeBitmap为uint32, 最大为31
+	_TUNNEL_TYPE_SERVER_START = 10
+	TUNNEL_TYPE_ERSPAN_OR_TEB = TunnelType(_TUNNEL_TYPE_SERVER_START)
+	TUNNEL_TYPE_GRE           = TUNNEL_TYPE_ERSPAN_OR_TEB + 1 // GRE.ver=0 GRE.protoType=IPv4/IPv6, Key作为隧道ID
+	TUNNEL_TYPE_NVGRE         = TUNNEL_TYPE_GRE + 1           // GRE.protoType=TEB, Key高24位为VSID
+	TUNNEL_TYPE_VXLAN_GPE     = TUNNEL_TYPE_NVGRE + 1
+	TUNNEL_TYPE_STT           = TUNNEL_TYPE_VXLAN_GPE + 1 // NSX-V使用, 64位Context ID的低32位作为隧道ID
+	TUNNEL_TYPE_CAPWAP        = TUNNEL_TYPE_STT + 1       // AP与无线控制器之间的数据通道, 没有隧道ID
+	TUNNEL_TYPE_GTPU          = TUNNEL_TYPE_CAPWAP + 1    // 移动核心网用户面, TEID作为隧道ID
 
 	LE_IPV4_PROTO_TYPE_I      = 0x0008 // 0x0800's LittleEndian
 	LE_IPV6_PROTO_TYPE_I      = 0xDD86 // 0x86dd's LittleEndian
@@ -44,26 +61,84 @@ const (
 	LE_VXLAN_PROTO_UDP_DPORT2 = 0x1821 // 0x2118(8472)'s LittleEndian
 	LE_VXLAN_PROTO_UDP_DPORT3 = 0x801A // 0x1A80(6784)'s LittleEndian
 	LE_TEB_PROTO              = 0x5865 // 0x6558(25944)'s LittleEndian
+	LE_GENEVE_PROTO_UDP_DPORT = 0xC117 // 0x17C1(6081)'s LittleEndian
+	GENEVE_VERSION            = 0
+	LE_VXLAN_GPE_UDP_DPORT    = 0xB612 // 0x12B6(4790)'s LittleEndian
+	LE_STT_TCP_DPORT          = 0x2F1D // 0x1D2F(7471)'s LittleEndian
+	LE_CAPWAP_DATA_UDP_PORT   = 0x7F14 // 0x147F(5247)'s LittleEndian, 控制通道5246不解析
 	VXLAN_FLAGS               = 8
+	NVGRE_FLAGS               = GRE_FLAGS_KEY_MASK // NVGRE必须设置K位, 部分设备还会携带Checksum或Sequence
 
 	_TUNNEL_TIER_LIMIT = 2
+
+	DEFAULT_TUNNEL_DEPTH = 2
+	TUNNEL_LAYER_MAX     = 4 // DecapsulateAll最多剥离和记录的隧道层数
+
+	_IP6_EXT_HEADER_LIMIT = 4 // 最多跳过的IPv6扩展头个数
+
+	_GTPU_EXT_HEADER_LIMIT = 4 // 最多跳过的GTP-U扩展头个数
+
+	MPLS_LABEL_LIMIT = 8 // 最多跳过的MPLS标签个数
+
+	MAX_VLAN_TAGS = 2 // QinQ
+	VLAN_ID_MASK  = 0xfff
 )
 
-var (
-	tunnelTypeTips = [...]string{
-		TUNNEL_TYPE_NONE:          "none",
-		TUNNEL_TYPE_VXLAN:         "VXLAN",
-		TUNNEL_TYPE_IPIP:          "IPIP",
-		TUNNEL_TYPE_TENCENT_GRE:   "GRE",
-		TUNNEL_TYPE_ERSPAN_OR_TEB: "ERSPAN_TEB",
+type tunnelTypeInfo struct {
+	tip    string // String()的输出
+	name   string // Name()的输出, 用于日志和JSON, 为空时服务端不解析该类型
+	idName string // Id字段的含义, 为空时隧道没有ID
+}
+
+var tunnelTypeInfos = [...]tunnelTypeInfo{
+	TUNNEL_TYPE_NONE:          {"none", "none", ""},
+	TUNNEL_TYPE_VXLAN:         {"VXLAN", "vxlan", "vni"},
+	TUNNEL_TYPE_IPIP:          {"IPIP", "ipip", ""},
+	TUNNEL_TYPE_TENCENT_GRE:   {"GRE", "tencent-gre", "key"},
+	TUNNEL_TYPE_GENEVE:        {"GENEVE", "geneve", "vni"},
+	TUNNEL_TYPE_ERSPAN:        {"ERSPAN", "", ""},
+	TUNNEL_TYPE_TEB:           {"TEB", "", ""},
+	TUNNEL_TYPE_ERSPAN_OR_TEB: {"ERSPAN_TEB", "erspan-teb", "id"},
+	TUNNEL_TYPE_GRE:           {"PLAIN_GRE", "gre", "key"},
+	TUNNEL_TYPE_NVGRE:         {"NVGRE", "nvgre", "vsid"},
+	TUNNEL_TYPE_VXLAN_GPE:     {"VXLAN_GPE", "vxlan-gpe", "vni"},
+	TUNNEL_TYPE_STT:           {"STT", "stt", "context"},
+	TUNNEL_TYPE_CAPWAP:        {"CAPWAP", "capwap", ""},
+	TUNNEL_TYPE_GTPU:          {"GTP_U", "gtpu", "teid"},
+}
+
+// 超出范围时返回空的tunnelTypeInfo, agent上报的值可能比服务端定义的多
+func (t TunnelType) info() tunnelTypeInfo {
+	if int(t) < len(tunnelTypeInfos) {
+		return tunnelTypeInfos[t]
 	}
-)
+	return tunnelTypeInfo{}
+}
 
 func (t TunnelType) String() string {
-	return tunnelTypeTips[t]
+	if tip := t.info().tip; tip != "" {
+		return tip
+	}
+	return fmt.Sprintf("unknown-%d", t)
 }
 
-type TunnelTypeBitmap uint16
+func (t TunnelType) Name() string {
+	if name := t.info().name; name != "" {
+		return name
+	}
+	return fmt.Sprintf("unknown-%d", t)
+}
+
+// 隧道名称, 地址和ID, 例如"vxlan 172.16.1.103->172.20.1.171 vni 123"
+func tunnelSummary(tunnelType TunnelType, src, dst net.IP, id uint64) string {
+	summary := fmt.Sprintf("%s %s->%s", tunnelType.Name(), src, dst)
+	if idName := tunnelType.info().idName; idName != "" {
+		summary += fmt.Sprintf(" %s %d", idName, id)
+	}
+	return summary
+}
+
+type TunnelTypeBitmap uint32
 
 func NewTunnelTypeBitmap(items ...TunnelType) TunnelTypeBitmap {
 	bitmap := TunnelTypeBitmap(0)
@@ -87,14 +162,224 @@ func (b TunnelTypeBitmap) IsEmpty() bool {
 
 func (b TunnelTypeBitmap) String() string {
 	context := ""
-	for i := TunnelType(0); i <= TUNNEL_TYPE_ERSPAN_OR_TEB; i++ {
+	for i := TunnelType(0); int(i) < len(tunnelTypeInfos); i++ {
 		if b.Has(i) {
-			context += tunnelTypeTips[i]
+			context += tunnelTypeInfos[i].tip
 		}
 	}
 	return context
 }
 
+// 按名称查找隧道类型, 名称与Name()一致
+func TunnelTypeFromName(name string) (TunnelType, bool) {
+	for i := TUNNEL_TYPE_VXLAN; int(i) < len(tunnelTypeInfos); i++ {
+		if tunnelTypeInfos[i].name != "" && tunnelTypeInfos[i].name == name {
+			return i, true
+		}
+	}
+	return TUNNEL_TYPE_NONE, false
+}
+
+// 所有支持解析的隧道类型
+func AllTunnelTypes() TunnelTypeBitmap {
+	bitmap := TunnelTypeBitmap(0)
+	for i := TUNNEL_TYPE_VXLAN; int(i) < len(tunnelTypeInfos); i++ {
+		if tunnelTypeInfos[i].name != "" {
+			bitmap.Add(i)
+		}
+	}
+	return bitmap
+}
+
+// 按名称输出包含的隧道类型, 以逗号分隔
+func (b TunnelTypeBitmap) Names() string {
+	names := ""
+	for i := TUNNEL_TYPE_VXLAN; int(i) < len(tunnelTypeInfos); i++ {
+		if b.Has(i) {
+			if names != "" {
+				names += ","
+			}
+			names += tunnelTypeInfos[i].name
+		}
+	}
+	return names
+}
+
+// 全局开启的隧道类型, Decapsulate和Decapsulate6只解析同时在其中和调用方bitmap中的类型, 默认全部开启.
+// 关闭的类型与不识别该类型时的行为完全一致
+var enabledTunnelTypes = ^uint32(0)
+
+// 运行时替换开启的隧道类型
+func SetEnabledTunnelTypes(bitmap TunnelTypeBitmap) {
+	atomic.StoreUint32(&enabledTunnelTypes, uint32(bitmap))
+}
+
+func GetEnabledTunnelTypes() TunnelTypeBitmap {
+	return TunnelTypeBitmap(atomic.LoadUint32(&enabledTunnelTypes))
+}
+
+// 开启enable中的类型并关闭disable中的类型, 返回修改后开启的隧道类型
+func UpdateEnabledTunnelTypes(enable, disable TunnelTypeBitmap) TunnelTypeBitmap {
+	for {
+		old := atomic.LoadUint32(&enabledTunnelTypes)
+		updated := (old | uint32(enable)) &^ uint32(disable)
+		if atomic.CompareAndSwapUint32(&enabledTunnelTypes, old, updated) {
+			return TunnelTypeBitmap(updated)
+		}
+	}
+}
+
+var (
+	DEFAULT_VXLAN_PORTS     = []uint16{4789, 8472, 6784}
+	DEFAULT_VXLAN_GPE_PORTS = []uint16{4790}
+	DEFAULT_GENEVE_PORTS    = []uint16{6081}
+	DEFAULT_GTPU_PORTS      = []uint16{2152}
+)
+
+// 按目的端口识别的UDP隧道类型及其默认端口
+var defaultUdpTunnelPorts = map[TunnelType][]uint16{
+	TUNNEL_TYPE_VXLAN:     DEFAULT_VXLAN_PORTS,
+	TUNNEL_TYPE_VXLAN_GPE: DEFAULT_VXLAN_GPE_PORTS,
+	TUNNEL_TYPE_GENEVE:    DEFAULT_GENEVE_PORTS,
+	TUNNEL_TYPE_GTPU:      DEFAULT_GTPU_PORTS,
+}
+
+// 下标为UDP目的端口, 值为该端口对应的隧道类型. 解析时端口按小端读出, 因此以字节序交换后的端口为下标
+type udpTunnelPortTable [1 << 16]TunnelType
+
+var (
+	udpTunnelPorts     = unsafe.Pointer(newUdpTunnelPortTable())
+	udpTunnelPortsLock sync.Mutex // 串行化修改, 读取时只原子地加载指针
+)
+
+func toLePort(port uint16) uint16 {
+	return port>>8 | port<<8
+}
+
+func newUdpTunnelPortTable() *udpTunnelPortTable {
+	table := &udpTunnelPortTable{}
+	for tunnelType, ports := range defaultUdpTunnelPorts {
+		for _, port := range ports {
+			table[toLePort(port)] = tunnelType
+		}
+	}
+	return table
+}
+
+// 设置识别为tunnelType的UDP目的端口, 替换该类型原有的所有端口, 为空时恢复默认端口.
+// 一个端口只对应一种隧道类型, 已分配给其它类型的端口会转给tunnelType. 运行中可随时调用, 修改立即生效
+func SetUdpTunnelPorts(tunnelType TunnelType, ports []uint16) error {
+	if _, ok := defaultUdpTunnelPorts[tunnelType]; !ok {
+		return fmt.Errorf("tunnel type %s is not identified by udp port", tunnelType.Name())
+	}
+	if len(ports) == 0 {
+		ports = defaultUdpTunnelPorts[tunnelType]
+	}
+	udpTunnelPortsLock.Lock()
+	defer udpTunnelPortsLock.Unlock()
+	table := *(*udpTunnelPortTable)(atomic.LoadPointer(&udpTunnelPorts))
+	for lePort := range table {
+		if table[lePort] == tunnelType {
+			table[lePort] = TUNNEL_TYPE_NONE
+		}
+	}
+	for _, port := range ports {
+		table[toLePort(port)] = tunnelType
+	}
+	atomic.StorePointer(&udpTunnelPorts, unsafe.Pointer(&table))
+	return nil
+}
+
+// 返回识别为tunnelType的UDP目的端口, 从小到大排列
+func GetUdpTunnelPorts(tunnelType TunnelType) []uint16 {
+	table := (*udpTunnelPortTable)(atomic.LoadPointer(&udpTunnelPorts))
+	ports := []uint16{}
+	for port := 0; port < 1<<16; port++ {
+		if table[toLePort(uint16(port))] == tunnelType {
+			ports = append(ports, uint16(port))
+		}
+	}
+	return ports
+}
+
+// lePort为按小端读出的UDP目的端口, 未配置的端口返回TUNNEL_TYPE_NONE
+func udpTunnelType(lePort uint16) TunnelType {
+	return (*udpTunnelPortTable)(atomic.LoadPointer(&udpTunnelPorts))[lePort]
+}
+
+// 设置识别为VXLAN的UDP目的端口, 为空时恢复默认端口, 运行中可随时调用
+func SetVxlanPorts(ports []uint16) {
+	SetUdpTunnelPorts(TUNNEL_TYPE_VXLAN, ports)
+}
+
+func GetVxlanPorts() []uint16 {
+	return GetUdpTunnelPorts(TUNNEL_TYPE_VXLAN)
+}
+
+func isVxlanPort(lePort uint16) bool {
+	return udpTunnelType(lePort) == TUNNEL_TYPE_VXLAN
+}
+
+// 非0时开启VXLAN严格校验, 默认关闭
+var vxlanStrict uint32
+
+// 严格校验要求VXLAN头中除I位外的标志位和所有保留字段为0, 用于过滤恰好使用VXLAN端口的普通UDP报文.
+// 可以在运行时修改
+func SetVxlanStrict(strict bool) {
+	if strict {
+		atomic.StoreUint32(&vxlanStrict, 1)
+	} else {
+		atomic.StoreUint32(&vxlanStrict, 0)
+	}
+}
+
+func IsVxlanStrict() bool {
+	return atomic.LoadUint32(&vxlanStrict) != 0
+}
+
+// vxlan为VXLAN头, 调用方保证长度足够. 严格模式下校验失败的报文计入DecapSuspect
+func isVxlanHeaderValid(vxlan []byte) bool {
+	_ = vxlan[VXLAN_HEADER_SIZE-1] // 提前检查一次边界
+	if atomic.LoadUint32(&vxlanStrict) == 0 {
+		return vxlan[VXLAN_FLAGS_OFFSET] == VXLAN_FLAGS
+	}
+	// Flags(1B) + Reserved(3B)和VNI之后的Reserved(1B)
+	if BigEndian.Uint32(vxlan[VXLAN_FLAGS_OFFSET:]) != VXLAN_FLAGS<<24 || vxlan[VXLAN_VNI_OFFSET+3] != 0 {
+		atomic.AddUint64(&decapsulateCounter.DecapSuspect, 1)
+		return false
+	}
+	return true
+}
+
+// 多层隧道中某一层的信息, IPv6 underlay时Src和Dst为地址的后四个字节
+type TunnelLayer struct {
+	Src       IPv4Int
+	Dst       IPv4Int
+	Id        uint32
+	Type      TunnelType
+	IsIPv6    bool
+	IPPayload bool
+}
+
+// IPv6地址仅有后四个字节, 输出为"::xxxx:xxxx"
+func (l TunnelLayer) underlay() (net.IP, net.IP) {
+	if l.IsIPv6 {
+		src, dst := make(net.IP, net.IPv6len), make(net.IP, net.IPv6len)
+		BigEndian.PutUint32(src[net.IPv6len-4:], uint32(l.Src))
+		BigEndian.PutUint32(dst[net.IPv6len-4:], uint32(l.Dst))
+		return src, dst
+	}
+	return IpFromUint32(l.Src), IpFromUint32(l.Dst)
+}
+
+func (l TunnelLayer) String() string {
+	if l.Type == TUNNEL_TYPE_NONE {
+		return TUNNEL_TYPE_NONE.Name()
+	}
+	src, dst := l.underlay()
+	return tunnelSummary(l.Type, src, dst, uint64(l.Id))
+}
+
 type TunnelInfo struct {
 	Src    IPv4Int
 	Dst    IPv4Int
@@ -104,133 +389,483 @@ type TunnelInfo struct {
 	Type   TunnelType
 	Tier   uint8
 	IsIPv6 bool
+	Src6   [net.IPv6len]byte // underlay为IPv6时的完整地址, Src和Dst仅保存后四个字节
+	Dst6   [net.IPv6len]byte
+	Ttl    uint8                         // 最外层IPv4的TTL或IPv6的Hop Limit
+	Tos    uint8                         // 最外层IPv4的TOS或IPv6的Traffic Class, 高6位为DSCP
+	Layers [TUNNEL_LAYER_MAX]TunnelLayer // 仅DecapsulateAll填写, 由外向内共Tier层
+
+	// 仅ERSPAN III填写
+	Erspan ErspanMeta
+
+	// 由SkipMplsLabels填写, 最内层(栈底)的MPLS标签
+	MplsLabel uint32
+	HasMpls   bool
+	// 外层IPv4/IPv6为UDP/GRE/IPIP的非首片, 或STT帧的后续分段, 不包含隧道头, 此时Tier为0
+	Fragment bool
+
+	// 仅STT填写, 完整的64位Context ID, Id为其低32位
+	ContextId uint64
+
+	// 隧道负载为IP报文(IPIP, GRE, 腾讯GRE, 内层为IP的VXLAN-GPE, GTP-U), 否则为以太网帧.
+	// 两种情况下Decapsulate返回的偏移都指向L2头, 负载为IP时该L2头由外层移入(腾讯GRE为伪造的MAC), 不是报文原有的内层MAC
+	IPPayload bool
+
+	// 仅DecapsulateFrame填写, 最外层以太网头的完整MAC, 用于定位leaf交换机或VTEP网卡
+	OuterMacSrc MacInt
+	OuterMacDst MacInt
+
+	// 仅UDP封装的隧道(VXLAN, Geneve, VXLAN-GPE, CAPWAP, GTP-U)填写, 最外层UDP端口.
+	// 源端口通常由封装端根据内层报文计算, 用作ECMP的熵, 同一隧道的不同流可能不同
+	SrcPort uint16
+	DstPort uint16
+}
+
+// ERSPAN III头中的元数据, 仅Type III时Valid为true
+type ErspanMeta struct {
+	Valid      bool
+	Vlan       uint16
+	Cos        uint8
+	HardwareId uint8
+	Egress     bool // D位, 镜像的是出方向的报文
+	Subheader  bool // O位, 携带8字节平台相关子头
+	// 交换机打上的硬件时间戳, 单位由Granularity决定, 见TimestampDuration
+	Timestamp   uint32
+	Granularity ErspanGranularity
+}
+
+// ERSPAN III头中Gra字段, 表示Timestamp的精度
+type ErspanGranularity uint8
+
+const (
+	ERSPAN_GRA_100US    ErspanGranularity = iota // 以100微秒为单位
+	ERSPAN_GRA_100NS                             // 以100纳秒为单位
+	ERSPAN_GRA_IEEE1588                          // IEEE 1588的纳秒部分, 秒数在平台相关子头中, 此处不解析
+	ERSPAN_GRA_USER                              // 用户自定义, 无法换算
+)
+
+// 按Granularity将Timestamp换算为时长, 非ERSPAN III或精度为用户自定义时返回false
+func (m *ErspanMeta) TimestampDuration() (time.Duration, bool) {
+	if !m.Valid {
+		return 0, false
+	}
+	switch m.Granularity {
+	case ERSPAN_GRA_100US:
+		return time.Duration(m.Timestamp) * 100 * time.Microsecond, true
+	case ERSPAN_GRA_100NS:
+		return time.Duration(m.Timestamp) * 100, true
+	case ERSPAN_GRA_IEEE1588:
+		return time.Duration(m.Timestamp), true
+	}
+	return 0, false
+}
+
+// erspan为ERSPAN III头, 调用方保证长度足够
+func (m *ErspanMeta) parse(erspan []byte) {
+	m.Valid = true
+	m.Vlan = BigEndian.Uint16(erspan[ERSPANIII_VLAN_OFFSET:]) & VLAN_ID_MASK
+	m.Cos = erspan[ERSPANIII_COS_OFFSET] >> 5
+	m.HardwareId = uint8(BigEndian.Uint16(erspan[ERSPANIII_HW_ID_OFFSET:])>>4) & 0x3f
+	m.Egress = erspan[ERSPANIII_FLAGS_OFFSET]&ERSPANIII_FLAG_D != 0
+	m.Subheader = erspan[ERSPANIII_FLAGS_OFFSET]&ERSPANIII_FLAG_O != 0
+	m.Timestamp = BigEndian.Uint32(erspan[ERSPANIII_TIMESTAMP_OFFSET:])
+	m.Granularity = ErspanGranularity(erspan[ERSPANIII_FLAGS_OFFSET]>>ERSPANIII_GRA_SHIFT) & ERSPANIII_GRA_MASK
+}
+
+type DecapsulateCounter struct {
+	DecapFragmented   uint64 `statsd:"decap_fragmented"`    // 因外层IP为非首片而未解析的报文数
+	DecapSttContinued uint64 `statsd:"decap_stt_continued"` // STT帧的后续分段数, 这些分段不包含STT头
+	DecapSuspect      uint64 `statsd:"decap_suspect"`       // 严格模式下使用VXLAN端口但头部校验失败的报文数
+	DecapTruncated    uint64 `statsd:"decap_truncated"`     // 已识别出隧道类型但隧道头被截断的报文数
+}
+
+var decapsulateCounter DecapsulateCounter
+
+// 读取并清零计数, 调用方可将其包装为stats.Countable
+func GetDecapsulateCounter() *DecapsulateCounter {
+	return &DecapsulateCounter{
+		DecapFragmented:   atomic.SwapUint64(&decapsulateCounter.DecapFragmented, 0),
+		DecapSttContinued: atomic.SwapUint64(&decapsulateCounter.DecapSttContinued, 0),
+		DecapSuspect:      atomic.SwapUint64(&decapsulateCounter.DecapSuspect, 0),
+		DecapTruncated:    atomic.SwapUint64(&decapsulateCounter.DecapTruncated, 0),
+	}
+}
+
+func (t TunnelInfo) underlay() (net.IP, net.IP) {
+	if t.IsIPv6 {
+		return net.IP(t.Src6[:]), net.IP(t.Dst6[:])
+	}
+	return IpFromUint32(t.Src), IpFromUint32(t.Dst)
+}
+
+// 例如"vxlan 172.16.1.103->172.20.1.171 vni 123, port 49152->4789, mac afda7679->3ddd88c3, tier 1, ttl 64, tos 0",
+// DecapsulateAll剥离的内层隧道依次附加在后面
+func (t TunnelInfo) String() string {
+	if t.Type == TUNNEL_TYPE_NONE {
+		if t.HasMpls {
+			return fmt.Sprintf("%s, mpls label %d", TUNNEL_TYPE_NONE.Name(), t.MplsLabel)
+		}
+		return TUNNEL_TYPE_NONE.Name()
+	}
+	src, dst := t.underlay()
+	id := uint64(t.Id)
+	if t.Type == TUNNEL_TYPE_STT {
+		id = t.ContextId
+	}
+	status := tunnelSummary(t.Type, src, dst, id)
+	if t.DstPort != 0 {
+		status += fmt.Sprintf(", port %d->%d", t.SrcPort, t.DstPort)
+	}
+	status += fmt.Sprintf(", mac %08x->%08x, tier %d, ttl %d, tos %d", t.MacSrc, t.MacDst, t.Tier, t.Ttl, t.Tos)
+	if t.HasMpls {
+		status += fmt.Sprintf(", mpls label %d", t.MplsLabel)
+	}
+	// 外层信息已在前面输出, 仅输出内层
+	for i := 1; i < int(t.Tier) && i < TUNNEL_LAYER_MAX && t.Layers[i].Type != TUNNEL_TYPE_NONE; i++ {
+		status += fmt.Sprintf(" | %s", t.Layers[i])
+	}
+	return status
 }
 
-func (t *TunnelInfo) String() string {
-	return fmt.Sprintf(
-		"type: %s, src: %s %08x, dst: %s %08x, id: %d, tier: %d",
-		t.Type, IpFromUint32(t.Src), t.MacSrc, IpFromUint32(t.Dst), t.MacDst, t.Id, t.Tier)
+type tunnelLayerJSON struct {
+	Type string `json:"type"`
+	Src  string `json:"src"`
+	Dst  string `json:"dst"`
+	Id   uint32 `json:"id"`
 }
 
-func (t *TunnelInfo) DecapsulateVxlan(packet []byte, l2Len int) int {
+type tunnelInfoJSON struct {
+	Type   string             `json:"type"`
+	Src    string             `json:"src"`
+	Dst    string             `json:"dst"`
+	MacSrc string             `json:"mac_src"` // 仅低4字节
+	MacDst string             `json:"mac_dst"`
+	Id     uint32             `json:"id"`
+	Tier   uint8              `json:"tier"`
+	Ttl    uint8              `json:"ttl"`
+	Tos    uint8              `json:"tos"`
+	Layers []*tunnelLayerJSON `json:"layers,omitempty"`
+	Mpls   *uint32            `json:"mpls_label,omitempty"`
+
+	ContextId   uint64 `json:"context_id,omitempty"` // 仅STT
+	OuterMacSrc string `json:"outer_mac_src,omitempty"`
+	OuterMacDst string `json:"outer_mac_dst,omitempty"`
+	SrcPort     uint16 `json:"src_port,omitempty"` // 仅UDP封装的隧道
+	DstPort     uint16 `json:"dst_port,omitempty"`
+}
+
+// 地址输出为字符串, 类型输出为名称, 不支持反序列化
+func (t TunnelInfo) MarshalJSON() ([]byte, error) {
+	src, dst := t.underlay()
+	output := &tunnelInfoJSON{
+		Type:   t.Type.Name(),
+		Src:    src.String(),
+		Dst:    dst.String(),
+		MacSrc: fmt.Sprintf("%08x", t.MacSrc),
+		MacDst: fmt.Sprintf("%08x", t.MacDst),
+		Id:     t.Id,
+		Tier:   t.Tier,
+		Ttl:    t.Ttl,
+		Tos:    t.Tos,
+
+		ContextId: t.ContextId,
+		SrcPort:   t.SrcPort,
+		DstPort:   t.DstPort,
+	}
+	if t.HasMpls {
+		output.Mpls = &t.MplsLabel
+	}
+	if t.OuterMacSrc != 0 || t.OuterMacDst != 0 {
+		output.OuterMacSrc = Uint64ToMac(t.OuterMacSrc).String()
+		output.OuterMacDst = Uint64ToMac(t.OuterMacDst).String()
+	}
+	for i := 0; i < TUNNEL_LAYER_MAX && t.Layers[i].Type != TUNNEL_TYPE_NONE; i++ {
+		layer := &t.Layers[i]
+		src, dst := layer.underlay()
+		output.Layers = append(output.Layers, &tunnelLayerJSON{
+			Type: layer.Type.Name(),
+			Src:  src.String(),
+			Dst:  dst.String(),
+			Id:   layer.Id,
+		})
+	}
+	return json.Marshal(output)
+}
+
+// udp为外层UDP头, 调用方保证长度足够
+func (t *TunnelInfo) saveUdpPorts(udp []byte) {
+	udp = udp[:UDP_HEADER_SIZE]
+	t.SrcPort = BigEndian.Uint16(udp[UDP_SPORT_OFFSET:])
+	t.DstPort = BigEndian.Uint16(udp[UDP_DPORT_OFFSET:])
+}
+
+// 保存最外层隧道的underlay地址和MAC
+func (t *TunnelInfo) saveUnderlay(packet []byte, l2Len int, underlayIpv6 bool) {
+	// 先切出定长的头部, 之后的常量下标访问不再需要逐个检查边界
+	if underlayIpv6 {
+		ip6 := packet[l2Len : l2Len+IP6_HEADER_SIZE]
+		t.Src = IPv4Int(BigEndian.Uint32(ip6[IP6_SIP_OFFSET:]))
+		t.Dst = IPv4Int(BigEndian.Uint32(ip6[IP6_DIP_OFFSET:]))
+		copy(t.Src6[:], ip6[IP6_SRC_ADDR_OFFSET:])
+		copy(t.Dst6[:], ip6[IP6_DST_ADDR_OFFSET:])
+		t.IsIPv6 = true
+		t.Ttl = ip6[IP6_HOP_LIMIT_OFFSET]
+		t.Tos = uint8(BigEndian.Uint16(ip6) >> 4)
+	} else {
+		ip := packet[l2Len : l2Len+IP_HEADER_SIZE]
+		t.Src = IPv4Int(BigEndian.Uint32(ip[OFFSET_SIP-ETH_HEADER_SIZE:]))
+		t.Dst = IPv4Int(BigEndian.Uint32(ip[OFFSET_DIP-ETH_HEADER_SIZE:]))
+		t.Ttl = ip[IP_TTL_OFFSET]
+		t.Tos = ip[IP_TOS_OFFSET]
+	}
+	mac := packet[:OFFSET_SA_LOW4B+4]
+	t.MacSrc = BigEndian.Uint32(mac[OFFSET_SA_LOW4B:])
+	t.MacDst = BigEndian.Uint32(mac[OFFSET_DA_LOW4B:])
+}
+
+// 跳过IPv6扩展头, 返回上层协议和包括扩展头在内的IPv6头长度, 扩展头不合法或过多时长度为0,
+// 扩展头被截断时返回的长度超出l3Packet
+func ip6HeaderSize(l3Packet []byte) (IPProtocol, int) {
+	protocol, size, _ := ip6HeaderSizeFragment(l3Packet)
+	return protocol, size
+}
+
+// 与ip6HeaderSize相同, 非首片时返回IPProtocolIPv6Fragment和长度0, 同时返回分段头中记录的上层协议
+func ip6HeaderSizeFragment(l3Packet []byte) (IPProtocol, int, IPProtocol) {
+	protocol := IPProtocol(l3Packet[IP6_PROTO_OFFSET])
+	size := IP6_HEADER_SIZE
+	for i := 0; ; i++ {
+		switch protocol {
+		case IPProtocolIPv6HopByHop, IPProtocolIPv6Routing, IPProtocolIPv6Destination, IPProtocolIPv6Fragment:
+		default:
+			return protocol, size, 0
+		}
+		if i == _IP6_EXT_HEADER_LIMIT {
+			return protocol, 0, 0
+		}
+		if len(l3Packet) < size+IP6_EXT_HEADER_MIN_SIZE {
+			return protocol, size + IP6_EXT_HEADER_MIN_SIZE, 0
+		}
+		nextHeader := IPProtocol(l3Packet[size+IP6_EXT_NEXT_HEADER_OFFSET])
+		if protocol == IPProtocolIPv6Fragment {
+			// 非首片不包含上层协议头
+			if BigEndian.Uint16(l3Packet[size+IP6_FRAG_OFFSET_OFFSET:])&0xfff8 != 0 {
+				return protocol, 0, nextHeader
+			}
+			size += IP6_EXT_HEADER_MIN_SIZE
+		} else {
+			size += (int(l3Packet[size+IP6_EXT_LEN_OFFSET]) + 1) << 3
+		}
+		protocol = nextHeader
+	}
+}
+
+// 按IHL定位UDP头, 仅根据目的端口识别VXLAN, 带IP选项时固定偏移会读到源端口或选项
+func (t *TunnelInfo) DecapsulateVxlan(packet []byte, l2Len int) (int, error) {
 	l3Packet := packet[l2Len:]
-	if len(l3Packet) < OFFSET_VXLAN_FLAGS+VXLAN_HEADER_SIZE {
-		return 0
+	if len(l3Packet) < IP_HEADER_SIZE {
+		return 0, DECAP_ERR_TOO_SHORT
 	}
-	dstPort := *(*uint16)(unsafe.Pointer(&l3Packet[OFFSET_DPORT-ETH_HEADER_SIZE]))
-	if dstPort != LE_VXLAN_PROTO_UDP_DPORT &&
-		dstPort != LE_VXLAN_PROTO_UDP_DPORT2 &&
-		dstPort != LE_VXLAN_PROTO_UDP_DPORT3 {
-		return 0
+	ipHeaderSize := int(l3Packet[IP_IHL_OFFSET]&0xf) << 2
+	if ipHeaderSize < IP_HEADER_SIZE {
+		return 0, DECAP_ERR_BAD_IP_HEADER
 	}
-	if l3Packet[OFFSET_VXLAN_FLAGS-ETH_HEADER_SIZE] != VXLAN_FLAGS {
-		return 0
+	if len(l3Packet) < ipHeaderSize+UDP_HEADER_SIZE {
+		return 0, DECAP_ERR_TOO_SHORT
+	}
+	udp := l3Packet[ipHeaderSize : ipHeaderSize+UDP_HEADER_SIZE]
+	dstPort := *(*uint16)(unsafe.Pointer(&udp[UDP_DPORT_OFFSET]))
+	if !isVxlanPort(dstPort) {
+		return 0, DECAP_ERR_UNSUPPORTED_PROTOCOL
+	}
+	if len(l3Packet) < ipHeaderSize+UDP_HEADER_SIZE+VXLAN_HEADER_SIZE {
+		return 0, DECAP_ERR_TRUNCATED
+	}
+	vxlan := l3Packet[ipHeaderSize+UDP_HEADER_SIZE : ipHeaderSize+UDP_HEADER_SIZE+VXLAN_HEADER_SIZE]
+	if !isVxlanHeaderValid(vxlan) {
+		return 0, DECAP_ERR_BAD_VXLAN_FLAGS
 	}
 
 	// 仅保存最外层的隧道信息
 	if t.Tier == 0 {
-		t.Src = IPv4Int(BigEndian.Uint32(l3Packet[OFFSET_SIP-ETH_HEADER_SIZE:]))
-		t.Dst = IPv4Int(BigEndian.Uint32(l3Packet[OFFSET_DIP-ETH_HEADER_SIZE:]))
-		t.MacSrc = BigEndian.Uint32(packet[OFFSET_SA_LOW4B:])
-		t.MacDst = BigEndian.Uint32(packet[OFFSET_DA_LOW4B:])
+		t.saveUnderlay(packet, l2Len, false)
+		t.saveUdpPorts(udp)
 		t.Type = TUNNEL_TYPE_VXLAN
-		t.Id = BigEndian.Uint32(l3Packet[OFFSET_VXLAN_VNI-ETH_HEADER_SIZE:]) >> 8
+		t.Id = BigEndian.Uint32(vxlan[VXLAN_VNI_OFFSET:]) >> 8
+	}
+	t.Tier++
+
+	// return offset start from L3
+	return ipHeaderSize + UDP_HEADER_SIZE + VXLAN_HEADER_SIZE, nil
+}
+
+// 校验Geneve头并返回包括选项在内的长度, udpPayloadLen为UDP长度字段声明的负载长度,
+// 用于区分选项被截断和Opt Len超出报文
+func geneveHeaderSize(geneve []byte, udpPayloadLen int) (int, error) {
+	if len(geneve) < GENEVE_HEADER_SIZE {
+		return 0, DECAP_ERR_TRUNCATED
+	}
+	if geneve[GENEVE_VER_OPT_LEN_OFFSET]>>6 != GENEVE_VERSION {
+		return 0, DECAP_ERR_BAD_TUNNEL_HEADER
+	}
+	// 仅支持内层为以太网帧
+	if *(*uint16)(unsafe.Pointer(&geneve[GENEVE_PROTOCOL_OFFSET])) != LE_TEB_PROTO {
+		return 0, DECAP_ERR_UNSUPPORTED_PROTOCOL
+	}
+	size := GENEVE_HEADER_SIZE + int(geneve[GENEVE_VER_OPT_LEN_OFFSET]&0x3f)<<2
+	if len(geneve) < size {
+		if size <= udpPayloadLen {
+			return 0, DECAP_ERR_TRUNCATED
+		}
+		return 0, DECAP_ERR_OPTION_OVERRUN
+	}
+	// 逐个跳过选项TLV, 各选项长度之和必须与Opt Len一致
+	for offset := GENEVE_HEADER_SIZE; offset < size; {
+		if offset+GENEVE_OPTION_HEADER_SIZE > size {
+			return 0, DECAP_ERR_OPTION_OVERRUN
+		}
+		offset += GENEVE_OPTION_HEADER_SIZE + int(geneve[offset+GENEVE_OPTION_LEN_OFFSET]&0x1f)<<2
+		if offset > size {
+			return 0, DECAP_ERR_OPTION_OVERRUN
+		}
+	}
+	return size, nil
+}
+
+func (t *TunnelInfo) DecapsulateGeneve(packet []byte, l2Len, ipHeaderSize int, underlayIpv6 bool) (int, error) {
+	l3Packet := packet[l2Len:]
+	if len(l3Packet) < ipHeaderSize+UDP_HEADER_SIZE {
+		return 0, DECAP_ERR_TOO_SHORT
+	}
+	dstPort := *(*uint16)(unsafe.Pointer(&l3Packet[ipHeaderSize+UDP_DPORT_OFFSET]))
+	if udpTunnelType(dstPort) != TUNNEL_TYPE_GENEVE {
+		return 0, DECAP_ERR_UNSUPPORTED_PROTOCOL
+	}
+	geneve := l3Packet[ipHeaderSize+UDP_HEADER_SIZE:]
+	udpPayloadLen := int(BigEndian.Uint16(l3Packet[ipHeaderSize+UDP_LEN_OFFSET:])) - UDP_HEADER_SIZE
+	geneveSize, err := geneveHeaderSize(geneve, udpPayloadLen)
+	if err != nil {
+		return 0, err
+	}
+
+	// 仅保存最外层的隧道信息
+	if t.Tier == 0 {
+		t.saveUnderlay(packet, l2Len, underlayIpv6)
+		t.saveUdpPorts(l3Packet[ipHeaderSize:])
+		t.Type = TUNNEL_TYPE_GENEVE
+		t.Id = BigEndian.Uint32(geneve[GENEVE_VNI_OFFSET:]) >> 8
 	}
 	t.Tier++
 
 	// return offset start from L3
-	return OFFSET_VXLAN_FLAGS - ETH_HEADER_SIZE + VXLAN_HEADER_SIZE
+	return ipHeaderSize + UDP_HEADER_SIZE + geneveSize, nil
 }
 
-func (t *TunnelInfo) calcGreOptionSize(flags uint16) int {
-	size := 0
+// GRE头长度, 包括Checksum(C), Key(K)和Sequence(S)标志对应的可选字段
+func calcGreHeaderSize(flags uint16) int {
+	size := GRE_HEADER_SIZE
+	if flags&GRE_FLAGS_CSUM_MASK != 0 {
+		size += GRE_CSUM_LEN
+	}
 	if flags&GRE_FLAGS_KEY_MASK != 0 {
 		size += GRE_KEY_LEN
 	}
 	if flags&GRE_FLAGS_SEQ_MASK != 0 {
 		size += GRE_SEQ_LEN
 	}
+	return size
+}
+
+// Key从GRE头开始的偏移, 可选字段依次为Checksum, Key, Sequence
+func calcGreKeyOffset(flags uint16) int {
 	if flags&GRE_FLAGS_CSUM_MASK != 0 {
-		size += GRE_CSUM_LEN
+		return GRE_KEY_OFFSET + GRE_CSUM_LEN
 	}
-	return size
+	return GRE_KEY_OFFSET
 }
 
-func (t *TunnelInfo) DecapsulateErspan(packet []byte, l2Len int, flags, greProtocolType uint16, ipHeaderSize int) int {
+func (t *TunnelInfo) DecapsulateErspan(packet []byte, l2Len int, flags, greProtocolType uint16, ipHeaderSize int, underlayIpv6 bool) (int, error) {
 	l3Packet := packet[l2Len:]
 	switch greProtocolType {
 	case LE_ERSPAN_PROTO_TYPE_II:
-		if flags == 0 { // ERSPAN I
+		greHeaderSize := calcGreHeaderSize(flags)
+		// ERSPAN I与ERSPAN II的GRE协议类型相同, ERSPAN I没有Sequence且GRE头后直接是镜像的以太网帧
+		if flags&GRE_FLAGS_SEQ_MASK == 0 { // ERSPAN I
+			if len(l3Packet) < ipHeaderSize+greHeaderSize+ERSPANI_HEADER_SIZE {
+				return 0, DECAP_ERR_TRUNCATED
+			}
 			// 仅保存最外层的隧道信息
 			if t.Tier == 0 {
-				t.Src = IPv4Int(BigEndian.Uint32(l3Packet[OFFSET_SIP-ETH_HEADER_SIZE:]))
-				t.Dst = IPv4Int(BigEndian.Uint32(l3Packet[OFFSET_DIP-ETH_HEADER_SIZE:]))
-				t.MacSrc = BigEndian.Uint32(packet[OFFSET_SA_LOW4B:])
-				t.MacDst = BigEndian.Uint32(packet[OFFSET_DA_LOW4B:])
+				t.saveUnderlay(packet, l2Len, underlayIpv6)
 				t.Type = TUNNEL_TYPE_ERSPAN_OR_TEB
 			}
 			t.Tier++
-			return ipHeaderSize + GRE_HEADER_SIZE + ERSPANI_HEADER_SIZE
+			return ipHeaderSize + greHeaderSize + ERSPANI_HEADER_SIZE, nil
 		} else { // ERSPAN II
+			if len(l3Packet) < ipHeaderSize+greHeaderSize+ERSPANII_HEADER_SIZE {
+				return 0, DECAP_ERR_TRUNCATED
+			}
+			// 版本号不符时其余字段的含义未知, 不能当作会话ID等解析
+			if version := l3Packet[ipHeaderSize+greHeaderSize+ERSPAN_VERSION_OFFSET] >> 4; version != ERSPANII_VERSION {
+				return 0, ErspanVersionError(version)
+			}
 			// 仅保存最外层的隧道信息
-			greHeaderSize := GRE_HEADER_SIZE + t.calcGreOptionSize(flags)
 			if t.Tier == 0 {
-				t.Src = IPv4Int(BigEndian.Uint32(l3Packet[OFFSET_SIP-ETH_HEADER_SIZE:]))
-				t.Dst = IPv4Int(BigEndian.Uint32(l3Packet[OFFSET_DIP-ETH_HEADER_SIZE:]))
-				t.MacSrc = BigEndian.Uint32(packet[OFFSET_SA_LOW4B:])
-				t.MacDst = BigEndian.Uint32(packet[OFFSET_DA_LOW4B:])
+				t.saveUnderlay(packet, l2Len, underlayIpv6)
 				t.Type = TUNNEL_TYPE_ERSPAN_OR_TEB
 				t.Id = BigEndian.Uint32(l3Packet[ipHeaderSize+greHeaderSize+ERSPAN_ID_OFFSET:]) & 0x3ff
 			}
 			t.Tier++
-			return ipHeaderSize + greHeaderSize + ERSPANII_HEADER_SIZE
+			return ipHeaderSize + greHeaderSize + ERSPANII_HEADER_SIZE, nil
 		}
 	case LE_ERSPAN_PROTO_TYPE_III: // ERSPAN III
-		greHeaderSize := GRE_HEADER_SIZE + t.calcGreOptionSize(flags)
+		greHeaderSize := calcGreHeaderSize(flags)
+		if len(l3Packet) < ipHeaderSize+greHeaderSize+ERSPANIII_HEADER_SIZE {
+			return 0, DECAP_ERR_TRUNCATED
+		}
+		if version := l3Packet[ipHeaderSize+greHeaderSize+ERSPAN_VERSION_OFFSET] >> 4; version != ERSPANIII_VERSION {
+			return 0, ErspanVersionError(version)
+		}
+		size := ipHeaderSize + greHeaderSize + ERSPANIII_HEADER_SIZE
+		oFlag := l3Packet[ipHeaderSize+greHeaderSize+ERSPANIII_FLAGS_OFFSET] & ERSPANIII_FLAG_O
+		if oFlag != 0 {
+			size += ERSPANIII_SUBHEADER_SIZE
+			if len(l3Packet) < size {
+				return 0, DECAP_ERR_TRUNCATED
+			}
+		}
 		// 仅保存最外层的隧道信息
 		if t.Tier == 0 {
-			t.Src = IPv4Int(BigEndian.Uint32(l3Packet[OFFSET_SIP-ETH_HEADER_SIZE:]))
-			t.Dst = IPv4Int(BigEndian.Uint32(l3Packet[OFFSET_DIP-ETH_HEADER_SIZE:]))
-			t.MacSrc = BigEndian.Uint32(packet[OFFSET_SA_LOW4B:])
-			t.MacDst = BigEndian.Uint32(packet[OFFSET_DA_LOW4B:])
+			t.saveUnderlay(packet, l2Len, underlayIpv6)
 			t.Type = TUNNEL_TYPE_ERSPAN_OR_TEB
 			t.Id = BigEndian.Uint32(l3Packet[ipHeaderSize+greHeaderSize+ERSPAN_ID_OFFSET:]) & 0x3ff
+			t.Erspan.parse(l3Packet[ipHeaderSize+greHeaderSize:])
 		}
 		t.Tier++
-		oFlag := l3Packet[ipHeaderSize+greHeaderSize+ERSPANIII_FLAGS_OFFSET] & 0x1
-		if oFlag == 0 {
-			return ipHeaderSize + greHeaderSize + ERSPANIII_HEADER_SIZE
-		} else {
-			return ipHeaderSize + greHeaderSize + ERSPANIII_HEADER_SIZE + ERSPANIII_SUBHEADER_SIZE
-		}
-	default:
-		return 0
+		return size, nil
 	}
-	return 0
+	return 0, DECAP_ERR_UNSUPPORTED_PROTOCOL
 }
 
 func IsGrePseudoInnerMac(mac uint64) bool {
 	return mac>>16 == 0
 }
 
-func (t *TunnelInfo) DecapsulateTencentGre(packet []byte, l2Len int, flags, greProtocolType uint16, ipHeaderSize int) int {
+func (t *TunnelInfo) DecapsulateTencentGre(packet []byte, l2Len int, flags, greProtocolType uint16, ipHeaderSize int, underlayIpv6 bool) (int, error) {
 	// TCE GRE：Version 0、Version 1两种
 	if flags&GRE_FLAGS_VER_MASK > 1 || flags&GRE_FLAGS_KEY_MASK == 0 { // 未知的GRE
-		return 0
-	}
-	greHeaderSize := GRE_HEADER_SIZE + t.calcGreOptionSize(flags)
-	greKeyOffset := GRE_KEY_OFFSET
-	if flags&GRE_FLAGS_CSUM_MASK != 0 {
-		greKeyOffset += GRE_CSUM_LEN
+		return 0, DECAP_ERR_BAD_TUNNEL_HEADER
 	}
+	greHeaderSize, greKeyOffset := calcGreHeaderSize(flags), calcGreKeyOffset(flags)
 	l3Packet := packet[l2Len:]
+	if len(l3Packet) < ipHeaderSize+greHeaderSize {
+		return 0, DECAP_ERR_TRUNCATED
+	}
 	// 仅保存最外层的隧道信息
 	if t.Tier == 0 {
-		t.Src = IPv4Int(BigEndian.Uint32(l3Packet[OFFSET_SIP-ETH_HEADER_SIZE:]))
-		t.Dst = IPv4Int(BigEndian.Uint32(l3Packet[OFFSET_DIP-ETH_HEADER_SIZE:]))
-		t.MacSrc = BigEndian.Uint32(packet[OFFSET_SA_LOW4B:])
-		t.MacDst = BigEndian.Uint32(packet[OFFSET_DA_LOW4B:])
+		t.saveUnderlay(packet, l2Len, underlayIpv6)
 		t.Type = TUNNEL_TYPE_TENCENT_GRE
+		t.IPPayload = true
 		t.Id = BigEndian.Uint32(l3Packet[ipHeaderSize+greKeyOffset:])
 	}
 
@@ -258,173 +893,749 @@ func (t *TunnelInfo) DecapsulateTencentGre(packet []byte, l2Len int, flags, greP
 	} else {
 		copy(l3Packet[overlayOffset+MAC_ADDR_LEN*2:], []byte{0x86, 0xdd})
 	}
-	return overlayOffset
+	return overlayOffset, nil
 }
 
-func (t *TunnelInfo) DecapsulateTeb(packet []byte, l2Len int, flags, greProtocolType uint16, ipHeaderSize int) int {
+func (t *TunnelInfo) DecapsulateTeb(packet []byte, l2Len int, flags, greProtocolType uint16, ipHeaderSize int, underlayIpv6 bool) (int, error) {
 	if flags&GRE_FLAGS_VER_MASK != 0 || flags&GRE_FLAGS_KEY_MASK == 0 { // 未知的GRE
-		return 0
-	}
-	greHeaderSize := GRE_HEADER_SIZE + t.calcGreOptionSize(flags)
-	greKeyOffset := GRE_KEY_OFFSET
-	if flags&GRE_FLAGS_CSUM_MASK != 0 {
-		greKeyOffset += GRE_CSUM_LEN
+		return 0, DECAP_ERR_BAD_TUNNEL_HEADER
 	}
+	greHeaderSize, greKeyOffset := calcGreHeaderSize(flags), calcGreKeyOffset(flags)
 	l3Packet := packet[l2Len:]
+	if len(l3Packet) < ipHeaderSize+greHeaderSize {
+		return 0, DECAP_ERR_TRUNCATED
+	}
 	// 仅保存最外层的隧道信息
 	if t.Tier == 0 {
-		t.Src = IPv4Int(BigEndian.Uint32(l3Packet[OFFSET_SIP-ETH_HEADER_SIZE:]))
-		t.Dst = IPv4Int(BigEndian.Uint32(l3Packet[OFFSET_DIP-ETH_HEADER_SIZE:]))
-		t.MacSrc = BigEndian.Uint32(packet[OFFSET_SA_LOW4B:])
-		t.MacDst = BigEndian.Uint32(packet[OFFSET_DA_LOW4B:])
+		t.saveUnderlay(packet, l2Len, underlayIpv6)
 		t.Type = TUNNEL_TYPE_ERSPAN_OR_TEB
 		t.Id = BigEndian.Uint32(l3Packet[ipHeaderSize+greKeyOffset:])
 	}
 
 	t.Tier++
-	return greHeaderSize + ipHeaderSize
+	return greHeaderSize + ipHeaderSize, nil
 }
 
-func (t *TunnelInfo) DecapsulateGre(packet []byte, l2Len int, tunnelTypeBitmap TunnelTypeBitmap) int {
+func (t *TunnelInfo) DecapsulateNvgre(packet []byte, l2Len int, flags uint16, ipHeaderSize int, underlayIpv6 bool) (int, error) {
+	if flags&GRE_FLAGS_VER_MASK != 0 || flags&NVGRE_FLAGS == 0 {
+		return 0, DECAP_ERR_BAD_TUNNEL_HEADER
+	}
+	greHeaderSize := calcGreHeaderSize(flags)
 	l3Packet := packet[l2Len:]
-	ipHeaderSize := int((l3Packet[IP_IHL_OFFSET] & 0xf) << 2)
+	if len(l3Packet) < ipHeaderSize+greHeaderSize {
+		return 0, DECAP_ERR_TRUNCATED
+	}
+	// 仅保存最外层的隧道信息
+	if t.Tier == 0 {
+		t.saveUnderlay(packet, l2Len, underlayIpv6)
+		t.Type = TUNNEL_TYPE_NVGRE
+		t.Id = BigEndian.Uint32(l3Packet[ipHeaderSize+calcGreKeyOffset(flags):]) >> 8 // 低8位为FlowID
+	}
+
+	t.Tier++
+	// 内层为以太网帧
+	return greHeaderSize + ipHeaderSize, nil
+}
+
+func (t *TunnelInfo) DecapsulatePlainGre(packet []byte, l2Len int, flags, greProtocolType uint16, ipHeaderSize int, underlayIpv6 bool) (int, error) {
+	if flags&GRE_FLAGS_VER_MASK != 0 { // Version 1为PPTP使用的增强GRE, 内层不是IP
+		return 0, DECAP_ERR_BAD_TUNNEL_HEADER
+	}
+	greHeaderSize := calcGreHeaderSize(flags)
+	l3Packet := packet[l2Len:]
+	if len(l3Packet) < ipHeaderSize+greHeaderSize {
+		return 0, DECAP_ERR_TRUNCATED
+	}
+	// 仅保存最外层的隧道信息
+	if t.Tier == 0 {
+		t.saveUnderlay(packet, l2Len, underlayIpv6)
+		t.Type = TUNNEL_TYPE_GRE
+		t.IPPayload = true
+		t.Id = 0 // 没有Key时隧道ID为0
+		if flags&GRE_FLAGS_KEY_MASK != 0 {
+			t.Id = BigEndian.Uint32(l3Packet[ipHeaderSize+calcGreKeyOffset(flags):])
+		}
+	}
+	t.Tier++
+
+	return relocateL2Header(packet, l2Len, ipHeaderSize+greHeaderSize, greProtocolType == LE_IPV6_PROTO_TYPE_I), nil
+}
+
+// 与IPIP相同，去除隧道头，将l2层头放在overlay ip头前，overlayOffset为overlay ip头从L3开始的偏移
+func relocateL2Header(packet []byte, l2Len, overlayOffset int, overlayIpv6 bool) int {
+	// 偏移计算：overlay ip头开始位置(l2Len + overlayOffset) - l2层长度(l2Len)
+	start := overlayOffset
+	copy(packet[start:], packet[:l2Len])
+	if !overlayIpv6 {
+		BigEndian.PutUint16(packet[start+l2Len-2:], uint16(EthernetTypeIPv4))
+	} else {
+		BigEndian.PutUint16(packet[start+l2Len-2:], uint16(EthernetTypeIPv6))
+	}
+	// l2已经做过解析，这个去除掉已经解析的l2长度
+	return start - l2Len
+}
+
+// STT: 伪装为目的端口7471的TCP报文, TCP头之后为18字节STT头和内层以太网帧.
+// 一个STT帧可能被分为多个分段, 仅首个分段(TCP序列号低16位的分段偏移为0)携带STT头,
+// 后续分段设置Fragment并返回DECAP_ERR_FRAGMENT, 不能当作普通TCP报文解析
+func (t *TunnelInfo) DecapsulateStt(packet []byte, l2Len, ipHeaderSize int, underlayIpv6 bool) (int, error) {
+	l3Packet := packet[l2Len:]
+	if len(l3Packet) < ipHeaderSize+MIN_TCP_HEADER_SIZE {
+		return 0, DECAP_ERR_TOO_SHORT
+	}
+	tcp := l3Packet[ipHeaderSize:]
+	dstPort := *(*uint16)(unsafe.Pointer(&tcp[TCP_DPORT_OFFSET]))
+	if dstPort != LE_STT_TCP_DPORT {
+		return 0, DECAP_ERR_UNSUPPORTED_PROTOCOL
+	}
+	tcpHeaderSize := int(tcp[TCP_DATA_OFFSET_OFFSET]>>4) << 2
+	if tcpHeaderSize < MIN_TCP_HEADER_SIZE {
+		return 0, DECAP_ERR_BAD_TUNNEL_HEADER
+	}
+	if BigEndian.Uint16(tcp[STT_FRAG_OFFSET_OFFSET:]) != 0 {
+		t.Fragment = true
+		atomic.AddUint64(&decapsulateCounter.DecapSttContinued, 1)
+		return 0, DECAP_ERR_FRAGMENT
+	}
+	if len(tcp) < tcpHeaderSize+STT_HEADER_SIZE+ETH_HEADER_SIZE {
+		return 0, DECAP_ERR_TRUNCATED
+	}
+	stt := tcp[tcpHeaderSize:]
+	if stt[STT_VERSION_OFFSET] != STT_VERSION {
+		return 0, DECAP_ERR_BAD_TUNNEL_HEADER
+	}
+
+	// 仅保存最外层的隧道信息
+	if t.Tier == 0 {
+		t.saveUnderlay(packet, l2Len, underlayIpv6)
+		t.Type = TUNNEL_TYPE_STT
+		t.ContextId = BigEndian.Uint64(stt[STT_CONTEXT_ID_OFFSET:])
+		t.Id = uint32(t.ContextId)
+	}
+	t.Tier++
+
+	// return offset start from L3
+	return ipHeaderSize + tcpHeaderSize + STT_HEADER_SIZE, nil
+}
+
+// VXLAN-GPE: 根据Next Protocol确定内层为以太网帧还是IP报文, 未知的协议不解析
+func (t *TunnelInfo) DecapsulateVxlanGpe(packet []byte, l2Len, ipHeaderSize int, underlayIpv6 bool) (int, error) {
+	l3Packet := packet[l2Len:]
+	if len(l3Packet) < ipHeaderSize+UDP_HEADER_SIZE {
+		return 0, DECAP_ERR_TOO_SHORT
+	}
+	dstPort := *(*uint16)(unsafe.Pointer(&l3Packet[ipHeaderSize+UDP_DPORT_OFFSET]))
+	if udpTunnelType(dstPort) != TUNNEL_TYPE_VXLAN_GPE {
+		return 0, DECAP_ERR_UNSUPPORTED_PROTOCOL
+	}
+	if len(l3Packet) < ipHeaderSize+UDP_HEADER_SIZE+VXLAN_HEADER_SIZE {
+		return 0, DECAP_ERR_TRUNCATED
+	}
+	gpe := l3Packet[ipHeaderSize+UDP_HEADER_SIZE:]
+	flags := gpe[VXLAN_FLAGS_OFFSET]
+	if flags&VXLAN_FLAGS == 0 || flags&VXLAN_GPE_FLAGS_VER_MASK != 0 {
+		return 0, DECAP_ERR_BAD_VXLAN_FLAGS
+	}
+	nextProtocol := uint8(VXLAN_GPE_NEXT_PROTOCOL_ETHERNET) // 未设置P位时内层为以太网帧
+	if flags&VXLAN_GPE_FLAGS_P != 0 {
+		nextProtocol = gpe[VXLAN_GPE_NEXT_PROTOCOL_OFFSET]
+	}
+	if nextProtocol != VXLAN_GPE_NEXT_PROTOCOL_IPV4 &&
+		nextProtocol != VXLAN_GPE_NEXT_PROTOCOL_IPV6 &&
+		nextProtocol != VXLAN_GPE_NEXT_PROTOCOL_ETHERNET {
+		return 0, DECAP_ERR_UNSUPPORTED_PROTOCOL
+	}
+
+	// 仅保存最外层的隧道信息
+	if t.Tier == 0 {
+		t.saveUnderlay(packet, l2Len, underlayIpv6)
+		t.saveUdpPorts(l3Packet[ipHeaderSize:])
+		t.Type = TUNNEL_TYPE_VXLAN_GPE
+		t.IPPayload = nextProtocol != VXLAN_GPE_NEXT_PROTOCOL_ETHERNET
+		t.Id = BigEndian.Uint32(gpe[VXLAN_VNI_OFFSET:]) >> 8
+	}
+	t.Tier++
+
+	overlayOffset := ipHeaderSize + UDP_HEADER_SIZE + VXLAN_HEADER_SIZE
+	if nextProtocol == VXLAN_GPE_NEXT_PROTOCOL_ETHERNET {
+		// return offset start from L3
+		return overlayOffset, nil
+	}
+	return relocateL2Header(packet, l2Len, overlayOffset, nextProtocol == VXLAN_GPE_NEXT_PROTOCOL_IPV6), nil
+}
+
+// CAPWAP数据通道: AP发往控制器的目的端口和控制器发往AP的源端口为5247, 仅解析负载为802.3帧的报文,
+// 加密(DTLS), Keep-Alive和原生802.11负载的报文不解析. Radio MAC和Wireless Specific Information包括在HLEN中
+func (t *TunnelInfo) DecapsulateCapwap(packet []byte, l2Len, ipHeaderSize int, underlayIpv6 bool) (int, error) {
+	l3Packet := packet[l2Len:]
+	if len(l3Packet) < ipHeaderSize+UDP_HEADER_SIZE {
+		return 0, DECAP_ERR_TOO_SHORT
+	}
+	udp := l3Packet[ipHeaderSize:]
+	srcPort := *(*uint16)(unsafe.Pointer(&udp[UDP_SPORT_OFFSET]))
+	dstPort := *(*uint16)(unsafe.Pointer(&udp[UDP_DPORT_OFFSET]))
+	if srcPort != LE_CAPWAP_DATA_UDP_PORT && dstPort != LE_CAPWAP_DATA_UDP_PORT {
+		return 0, DECAP_ERR_UNSUPPORTED_PROTOCOL
+	}
+	if len(udp) < UDP_HEADER_SIZE+CAPWAP_HEADER_MIN_SIZE {
+		return 0, DECAP_ERR_TRUNCATED
+	}
+	capwap := udp[UDP_HEADER_SIZE:]
+	if preamble := capwap[CAPWAP_PREAMBLE_OFFSET]; preamble>>4 != 0 {
+		return 0, DECAP_ERR_BAD_TUNNEL_HEADER
+	} else if preamble != 0 { // DTLS
+		return 0, DECAP_ERR_UNSUPPORTED_PROTOCOL
+	}
+	header := BigEndian.Uint32(capwap)
+	if header&(CAPWAP_FLAG_K|CAPWAP_FLAG_T) != 0 {
+		return 0, DECAP_ERR_UNSUPPORTED_PROTOCOL
+	}
+	if header&CAPWAP_FLAG_F != 0 && BigEndian.Uint16(capwap[CAPWAP_FRAG_OFFSET_OFFSET:])>>3 != 0 {
+		t.Fragment = true
+		return 0, DECAP_ERR_FRAGMENT
+	}
+	headerSize := int(header>>CAPWAP_HLEN_SHIFT&CAPWAP_HLEN_MASK) << 2
+	if headerSize < CAPWAP_HEADER_MIN_SIZE {
+		return 0, DECAP_ERR_BAD_TUNNEL_HEADER
+	}
+	if len(capwap) < headerSize+ETH_HEADER_SIZE {
+		return 0, DECAP_ERR_TRUNCATED
+	}
+	// Radio MAC和Wireless Specific Information均以1字节长度开始, 填充到4字节对齐, 必须位于HLEN之内
+	optionEnd := CAPWAP_HEADER_MIN_SIZE
+	for _, flag := range [...]uint32{CAPWAP_FLAG_M, CAPWAP_FLAG_W} {
+		if header&flag == 0 {
+			continue
+		}
+		if optionEnd >= headerSize {
+			return 0, DECAP_ERR_OPTION_OVERRUN
+		}
+		optionEnd += (1 + int(capwap[optionEnd]) + 3) &^ 3
+	}
+	if optionEnd > headerSize {
+		return 0, DECAP_ERR_OPTION_OVERRUN
+	}
+
+	// 仅保存最外层的隧道信息
+	if t.Tier == 0 {
+		t.saveUnderlay(packet, l2Len, underlayIpv6)
+		t.saveUdpPorts(l3Packet[ipHeaderSize:])
+		t.Type = TUNNEL_TYPE_CAPWAP
+		t.Id = 0
+	}
+	t.Tier++
+
+	// return offset start from L3
+	return ipHeaderSize + UDP_HEADER_SIZE + headerSize, nil
+}
+
+// 校验GTP-U头并返回包括可选字段和扩展头在内的长度, 扩展头超出Length字段声明的长度时返回DECAP_ERR_OPTION_OVERRUN
+func gtpuHeaderSize(gtpu []byte) (int, error) {
+	if len(gtpu) < GTPU_HEADER_SIZE {
+		return 0, DECAP_ERR_TRUNCATED
+	}
+	flags := gtpu[GTPU_FLAGS_OFFSET]
+	if flags>>5 != GTPU_VERSION || flags&GTPU_FLAGS_PT == 0 {
+		return 0, DECAP_ERR_BAD_TUNNEL_HEADER
+	}
+	if gtpu[GTPU_MSG_TYPE_OFFSET] != GTPU_MSG_TYPE_GPDU {
+		return 0, DECAP_ERR_UNSUPPORTED_PROTOCOL
+	}
+	if flags&GTPU_FLAGS_OPTIONAL == 0 {
+		return GTPU_HEADER_SIZE, nil
+	}
+	declared := GTPU_HEADER_SIZE + int(BigEndian.Uint16(gtpu[GTPU_LENGTH_OFFSET:]))
+	size := GTPU_HEADER_SIZE + GTPU_OPTIONAL_SIZE
+	if size > declared {
+		return 0, DECAP_ERR_OPTION_OVERRUN
+	}
+	if len(gtpu) < size {
+		return 0, DECAP_ERR_TRUNCATED
+	}
+	// 未设置E位时Next Extension Header Type无意义
+	if flags&GTPU_FLAGS_E == 0 {
+		return size, nil
+	}
+	for i := 0; gtpu[size-1] != 0; i++ {
+		if i == _GTPU_EXT_HEADER_LIMIT {
+			return 0, DECAP_ERR_UNSUPPORTED_PROTOCOL
+		}
+		if len(gtpu) <= size {
+			return 0, DECAP_ERR_TRUNCATED
+		}
+		extSize := int(gtpu[size]) * GTPU_EXT_LEN_UNIT
+		if extSize == 0 {
+			return 0, DECAP_ERR_BAD_TUNNEL_HEADER
+		}
+		size += extSize
+		if size > declared {
+			return 0, DECAP_ERR_OPTION_OVERRUN
+		}
+		if len(gtpu) < size {
+			return 0, DECAP_ERR_TRUNCATED
+		}
+	}
+	return size, nil
+}
+
+// GTP-U: 仅解析承载用户数据的G-PDU, 负载为不带L2头的IPv4或IPv6报文.
+// 可选字段和扩展头(如5G的PDU Session Container)均跳过, 不解析其内容
+func (t *TunnelInfo) DecapsulateGtpu(packet []byte, l2Len, ipHeaderSize int, underlayIpv6 bool) (int, error) {
+	l3Packet := packet[l2Len:]
+	if len(l3Packet) < ipHeaderSize+UDP_HEADER_SIZE {
+		return 0, DECAP_ERR_TOO_SHORT
+	}
+	dstPort := *(*uint16)(unsafe.Pointer(&l3Packet[ipHeaderSize+UDP_DPORT_OFFSET]))
+	if udpTunnelType(dstPort) != TUNNEL_TYPE_GTPU {
+		return 0, DECAP_ERR_UNSUPPORTED_PROTOCOL
+	}
+	gtpu := l3Packet[ipHeaderSize+UDP_HEADER_SIZE:]
+	gtpuSize, err := gtpuHeaderSize(gtpu)
+	if err != nil {
+		return 0, err
+	}
+	if len(gtpu) <= gtpuSize {
+		return 0, DECAP_ERR_TRUNCATED
+	}
+	var overlayIpv6 bool
+	switch gtpu[gtpuSize] >> 4 {
+	case 4:
+	case 6:
+		overlayIpv6 = true
+	default:
+		return 0, DECAP_ERR_UNSUPPORTED_PROTOCOL
+	}
+
+	// 仅保存最外层的隧道信息
+	if t.Tier == 0 {
+		t.saveUnderlay(packet, l2Len, underlayIpv6)
+		t.saveUdpPorts(l3Packet[ipHeaderSize:])
+		t.Type = TUNNEL_TYPE_GTPU
+		t.IPPayload = true
+		t.Id = BigEndian.Uint32(gtpu[GTPU_TEID_OFFSET:])
+	}
+	t.Tier++
+
+	return relocateL2Header(packet, l2Len, ipHeaderSize+UDP_HEADER_SIZE+gtpuSize, overlayIpv6), nil
+}
+
+var udpTunnelTypes = NewTunnelTypeBitmap(TUNNEL_TYPE_VXLAN, TUNNEL_TYPE_GENEVE, TUNNEL_TYPE_VXLAN_GPE, TUNNEL_TYPE_CAPWAP, TUNNEL_TYPE_GTPU)
+
+// 按目的端口查表确定隧道类型后只尝试该类型, 其次尝试按源或目的端口识别的CAPWAP, 均不匹配时返回最具体的原因
+func (t *TunnelInfo) decapsulateUdp(packet []byte, l2Len, ipHeaderSize int, underlayIpv6 bool, tunnelTypeBitmap TunnelTypeBitmap) (int, error) {
+	if (tunnelTypeBitmap & udpTunnelTypes).IsEmpty() {
+		return 0, DECAP_ERR_DISABLED
+	}
+	l3Packet := packet[l2Len:]
+	if len(l3Packet) < ipHeaderSize+UDP_HEADER_SIZE {
+		return 0, DECAP_ERR_TOO_SHORT
+	}
+	tunnelType := udpTunnelType(*(*uint16)(unsafe.Pointer(&l3Packet[ipHeaderSize+UDP_DPORT_OFFSET])))
+	var err error = DECAP_ERR_UNSUPPORTED_PROTOCOL
+	if tunnelType != TUNNEL_TYPE_NONE && tunnelTypeBitmap.Has(tunnelType) {
+		offset := 0
+		switch tunnelType {
+		case TUNNEL_TYPE_VXLAN:
+			if underlayIpv6 {
+				offset, err = t.Decapsulate6Vxlan(packet, l2Len, ipHeaderSize)
+			} else {
+				offset, err = t.DecapsulateVxlan(packet, l2Len)
+			}
+		case TUNNEL_TYPE_GENEVE:
+			offset, err = t.DecapsulateGeneve(packet, l2Len, ipHeaderSize, underlayIpv6)
+		case TUNNEL_TYPE_VXLAN_GPE:
+			offset, err = t.DecapsulateVxlanGpe(packet, l2Len, ipHeaderSize, underlayIpv6)
+		case TUNNEL_TYPE_GTPU:
+			offset, err = t.DecapsulateGtpu(packet, l2Len, ipHeaderSize, underlayIpv6)
+		}
+		if err == nil {
+			return offset, nil
+		}
+	}
+	if tunnelTypeBitmap.Has(TUNNEL_TYPE_CAPWAP) {
+		offset, e := t.DecapsulateCapwap(packet, l2Len, ipHeaderSize, underlayIpv6)
+		if e == nil {
+			return offset, nil
+		}
+		err = moreSpecificDecapError(err, e)
+	}
+	return 0, err
+}
+
+// ipHeaderSize为underlay ip头长度, IPv6时包括扩展头
+func (t *TunnelInfo) DecapsulateGre(packet []byte, l2Len, ipHeaderSize int, underlayIpv6 bool, tunnelTypeBitmap TunnelTypeBitmap) (int, error) {
+	l3Packet := packet[l2Len:]
+	if len(l3Packet) < ipHeaderSize+GRE_HEADER_SIZE {
+		return 0, DECAP_ERR_TOO_SHORT
+	}
 	flags := BigEndian.Uint16(l3Packet[ipHeaderSize+GRE_FLAGS_OFFSET:])
 	greProtocolType := *(*uint16)(unsafe.Pointer(&l3Packet[ipHeaderSize+GRE_PROTOCOL_OFFSET]))
+	isIPPayload := greProtocolType == LE_IPV4_PROTO_TYPE_I || greProtocolType == LE_IPV6_PROTO_TYPE_I
 	if tunnelTypeBitmap.Has(TUNNEL_TYPE_ERSPAN_OR_TEB) &&
 		(greProtocolType == LE_ERSPAN_PROTO_TYPE_II || greProtocolType == LE_ERSPAN_PROTO_TYPE_III) { // ERSPAN
-		return t.DecapsulateErspan(packet, l2Len, flags, greProtocolType, ipHeaderSize)
-	} else if tunnelTypeBitmap.Has(TUNNEL_TYPE_TENCENT_GRE) &&
-		(greProtocolType == LE_IPV4_PROTO_TYPE_I || greProtocolType == LE_IPV6_PROTO_TYPE_I) {
-		return t.DecapsulateTencentGre(packet, l2Len, flags, greProtocolType, ipHeaderSize)
-	} else if tunnelTypeBitmap.Has(TUNNEL_TYPE_ERSPAN_OR_TEB) &&
-		greProtocolType == LE_TEB_PROTO {
-		return t.DecapsulateTeb(packet, l2Len, flags, greProtocolType, ipHeaderSize)
+		return t.DecapsulateErspan(packet, l2Len, flags, greProtocolType, ipHeaderSize, underlayIpv6)
+	} else if tunnelTypeBitmap.Has(TUNNEL_TYPE_TENCENT_GRE) && isIPPayload {
+		// 腾讯GRE必须携带Key, 不匹配时继续尝试标准GRE. 被截断时标准GRE同样无法解析
+		if offset, err := t.DecapsulateTencentGre(packet, l2Len, flags, greProtocolType, ipHeaderSize, underlayIpv6); err == nil || err == DECAP_ERR_TRUNCATED || !tunnelTypeBitmap.Has(TUNNEL_TYPE_GRE) {
+			return offset, err
+		}
+	} else if greProtocolType == LE_TEB_PROTO {
+		// NVGRE与VMware的TEB封装格式相同无法区分, 同时开启时保持原有的TEB解析,
+		// 需要按NVGRE解析(VSID作为隧道ID)时调用方需关闭ERSPAN_OR_TEB
+		if tunnelTypeBitmap.Has(TUNNEL_TYPE_ERSPAN_OR_TEB) {
+			return t.DecapsulateTeb(packet, l2Len, flags, greProtocolType, ipHeaderSize, underlayIpv6)
+		}
+		if tunnelTypeBitmap.Has(TUNNEL_TYPE_NVGRE) {
+			return t.DecapsulateNvgre(packet, l2Len, flags, ipHeaderSize, underlayIpv6)
+		}
+		return 0, DECAP_ERR_DISABLED
+	}
+	if tunnelTypeBitmap.Has(TUNNEL_TYPE_GRE) && isIPPayload {
+		return t.DecapsulatePlainGre(packet, l2Len, flags, greProtocolType, ipHeaderSize, underlayIpv6)
+	}
+	return 0, DECAP_ERR_UNSUPPORTED_PROTOCOL
+}
+
+// 隧道头被截断的报文单独计数, 以便与非隧道报文区分. 仅在DecapsulateE和Decapsulate6E返回前调用,
+// 避免依次尝试多种隧道时重复计数
+func countTruncated(offset int, err error) (int, error) {
+	if err == DECAP_ERR_TRUNCATED {
+		atomic.AddUint64(&decapsulateCounter.DecapTruncated, 1)
 	}
-	return 0
+	return offset, err
 }
 
+// 剥离IPv4 underlay的隧道, 返回值从L3头开始计算, packet[l2Len+offset:]即为内层L2头,
+// 负载为IP的隧道(IPIP, GRE等)会将外层L2头移到内层IP头前, 因此同样指向L2头.
+// 非隧道报文返回0且不修改TunnelInfo, 外层为非首片时仅设置Fragment. IPIP的偏移可能为0或负数, 是否剥离了隧道应以Tier判断.
+// Tier在多次调用间累加用于剥离多层隧道, 因此不会清除已有字段, 复用TunnelInfo解析新报文前需要调用Reset.
+// packet的长度必须是实际采集到的长度(snaplen截断后的caplen)而不是原始报文长度, 隧道头被截断时返回DECAP_ERR_TRUNCATED.
+// 不关心原因的调用方使用该函数, 排查隧道未被识别的原因时使用DecapsulateE.
+// l2Len必须包括VLAN标签, 外层以太网头后可能带VLAN(如经过trunk口的镜像流量)时应使用DecapsulateFrame
 func (t *TunnelInfo) Decapsulate(packet []byte, l2Len int, tunnelTypeBitmap TunnelTypeBitmap) int {
+	offset, _ := t.DecapsulateE(packet, l2Len, tunnelTypeBitmap)
+	return offset
+}
+
+// 与Decapsulate相同, 未剥离隧道时返回DecapsulateError说明原因, 依次尝试多种隧道时为最具体的原因
+func (t *TunnelInfo) DecapsulateE(packet []byte, l2Len int, tunnelTypeBitmap TunnelTypeBitmap) (int, error) {
+	tunnelTypeBitmap &= GetEnabledTunnelTypes()
 	if tunnelTypeBitmap.IsEmpty() {
-		return 0
+		return 0, DECAP_ERR_DISABLED
 	}
-	if t.Tier == _TUNNEL_TIER_LIMIT {
-		return 0
+	if t.Tier >= _TUNNEL_TIER_LIMIT {
+		return 0, DECAP_ERR_DEPTH_EXCEEDED
+	}
+	// 此处仅保证外层IP头完整, 各隧道在读取UDP/GRE等头部及隧道头前自行检查剩余长度,
+	// 使截断的报文与非隧道报文能够区分
+	if l2Len < 0 || l2Len > len(packet) {
+		return 0, DECAP_ERR_TOO_SHORT
 	}
-	// 通过ERSPANIII_HEADER_SIZE(12 bytes)+ERSPANIII_SUBHEADER_SIZE(8 bytes)判断，保证不会数组越界
+	// 对切片本身检查长度, 编译器可据此消除之后常量下标的边界检查
 	l3Packet := packet[l2Len:]
-	if len(l3Packet) < IP_HEADER_SIZE+GRE_HEADER_SIZE+ERSPANIII_HEADER_SIZE+ERSPANIII_SUBHEADER_SIZE {
-		return 0
+	if len(l3Packet) < IP_HEADER_SIZE {
+		return 0, DECAP_ERR_TOO_SHORT
 	}
 
-	offset := 0
 	protocol := IPProtocol(l3Packet[OFFSET_IP_PROTOCOL-ETH_HEADER_SIZE])
-	if protocol == IPProtocolUDP {
-		if tunnelTypeBitmap.Has(TUNNEL_TYPE_VXLAN) {
-			offset = t.DecapsulateVxlan(packet, l2Len)
+	// 非首片不包含UDP/GRE等隧道头, 若继续解析会被当作普通报文, 需要调用方区分
+	if BigEndian.Uint16(l3Packet[IP_FRAG_OFFSET:])&IP_FRAG_OFFSET_MASK != 0 {
+		switch protocol {
+		case IPProtocolUDP, IPProtocolGRE, IPProtocolIPv4, IPProtocolIPv6:
+			t.Fragment = true
+			atomic.AddUint64(&decapsulateCounter.DecapFragmented, 1)
+			return 0, DECAP_ERR_FRAGMENT
 		}
-	} else if protocol == IPProtocolGRE {
-		offset = t.DecapsulateGre(packet, l2Len, tunnelTypeBitmap)
-	} else if protocol == IPProtocolIPv4 {
-		if tunnelTypeBitmap.Has(TUNNEL_TYPE_IPIP) {
-			offset = t.DecapsulateIPIP(packet, l2Len, false, false)
+	}
+	ipHeaderSize := int((l3Packet[IP_IHL_OFFSET] & 0xf) << 2)
+	if ipHeaderSize < IP_HEADER_SIZE {
+		return 0, DECAP_ERR_BAD_IP_HEADER
+	}
+	switch protocol {
+	case IPProtocolUDP:
+		return countTruncated(t.decapsulateUdp(packet, l2Len, ipHeaderSize, false, tunnelTypeBitmap))
+	case IPProtocolGRE:
+		return countTruncated(t.DecapsulateGre(packet, l2Len, ipHeaderSize, false, tunnelTypeBitmap))
+	case IPProtocolTCP:
+		if tunnelTypeBitmap.Has(TUNNEL_TYPE_STT) {
+			return countTruncated(t.DecapsulateStt(packet, l2Len, ipHeaderSize, false))
 		}
-	} else if protocol == IPProtocolIPv6 {
+		return 0, DECAP_ERR_DISABLED
+	case IPProtocolIPv4, IPProtocolIPv6:
 		if tunnelTypeBitmap.Has(TUNNEL_TYPE_IPIP) {
-			offset = t.DecapsulateIPIP(packet, l2Len, false, true)
+			return countTruncated(t.DecapsulateIPIP(packet, l2Len, false, protocol == IPProtocolIPv6))
 		}
+		return 0, DECAP_ERR_DISABLED
 	}
-
-	return offset
+	return 0, DECAP_ERR_UNSUPPORTED_PROTOCOL
 }
 
-func (t *TunnelInfo) Decapsulate6Vxlan(packet []byte, l2Len int) int {
+// ipHeaderSize为包括扩展头在内的IPv6头长度
+func (t *TunnelInfo) Decapsulate6Vxlan(packet []byte, l2Len, ipHeaderSize int) (int, error) {
 	l3Packet := packet[l2Len:]
-	if len(l3Packet) < OFFSET_VXLAN_FLAGS+VXLAN_HEADER_SIZE {
-		return 0
+	if len(l3Packet) < ipHeaderSize+UDP_HEADER_SIZE {
+		return 0, DECAP_ERR_TOO_SHORT
 	}
-	dstPort := *(*uint16)(unsafe.Pointer(&l3Packet[IP6_HEADER_SIZE+UDP_DPORT_OFFSET]))
-	if dstPort != LE_VXLAN_PROTO_UDP_DPORT &&
-		dstPort != LE_VXLAN_PROTO_UDP_DPORT2 &&
-		dstPort != LE_VXLAN_PROTO_UDP_DPORT3 {
-		return 0
+	udp := l3Packet[ipHeaderSize : ipHeaderSize+UDP_HEADER_SIZE]
+	dstPort := *(*uint16)(unsafe.Pointer(&udp[UDP_DPORT_OFFSET]))
+	if !isVxlanPort(dstPort) {
+		return 0, DECAP_ERR_UNSUPPORTED_PROTOCOL
 	}
-	if l3Packet[IP6_HEADER_SIZE+UDP_HEADER_SIZE+VXLAN_FLAGS_OFFSET] != VXLAN_FLAGS {
-		return 0
+	if len(l3Packet) < ipHeaderSize+UDP_HEADER_SIZE+VXLAN_HEADER_SIZE {
+		return 0, DECAP_ERR_TRUNCATED
+	}
+	vxlan := l3Packet[ipHeaderSize+UDP_HEADER_SIZE : ipHeaderSize+UDP_HEADER_SIZE+VXLAN_HEADER_SIZE]
+	if !isVxlanHeaderValid(vxlan) {
+		return 0, DECAP_ERR_BAD_VXLAN_FLAGS
 	}
 
 	// 仅保存最外层的隧道信息
 	if t.Tier == 0 {
-		t.Src = IPv4Int(BigEndian.Uint32(l3Packet[IP6_SIP_OFFSET:]))
-		t.Dst = IPv4Int(BigEndian.Uint32(l3Packet[IP6_DIP_OFFSET:]))
-		t.MacSrc = BigEndian.Uint32(packet[OFFSET_SA_LOW4B:])
-		t.MacDst = BigEndian.Uint32(packet[OFFSET_DA_LOW4B:])
+		t.saveUnderlay(packet, l2Len, true)
+		t.saveUdpPorts(udp)
 		t.Type = TUNNEL_TYPE_VXLAN
-		t.Id = BigEndian.Uint32(l3Packet[IP6_HEADER_SIZE+UDP_HEADER_SIZE+VXLAN_VNI_OFFSET:]) >> 8
-		t.IsIPv6 = true
+		t.Id = BigEndian.Uint32(vxlan[VXLAN_VNI_OFFSET:]) >> 8
 	}
 	t.Tier++
 
 	// return offset start from L3
-	return IP6_HEADER_SIZE + UDP_HEADER_SIZE + VXLAN_HEADER_SIZE
+	return ipHeaderSize + UDP_HEADER_SIZE + VXLAN_HEADER_SIZE, nil
 }
 
+// 剥离IPv6 underlay的隧道, 返回值含义与Decapsulate相同
 func (t *TunnelInfo) Decapsulate6(packet []byte, l2Len int, tunnelTypeBitmap TunnelTypeBitmap) int {
+	offset, _ := t.Decapsulate6E(packet, l2Len, tunnelTypeBitmap)
+	return offset
+}
+
+// 与Decapsulate6相同, 未剥离隧道时返回DecapsulateError说明原因
+func (t *TunnelInfo) Decapsulate6E(packet []byte, l2Len int, tunnelTypeBitmap TunnelTypeBitmap) (int, error) {
+	tunnelTypeBitmap &= GetEnabledTunnelTypes()
 	if tunnelTypeBitmap.IsEmpty() {
-		return 0
+		return 0, DECAP_ERR_DISABLED
 	}
-	if t.Tier == _TUNNEL_TIER_LIMIT {
-		return 0
+	if t.Tier >= _TUNNEL_TIER_LIMIT {
+		return 0, DECAP_ERR_DEPTH_EXCEEDED
 	}
 
+	// 与DecapsulateE相同, 此处仅保证外层IPv6基本头完整
+	if l2Len < 0 || l2Len > len(packet) {
+		return 0, DECAP_ERR_TOO_SHORT
+	}
+	// 对切片本身检查长度, 编译器可据此消除之后常量下标的边界检查
 	l3Packet := packet[l2Len:]
-	// 通过ERSPANIII_HEADER_SIZE(12 bytes)+ERSPANIII_SUBHEADER_SIZE(8 bytes)判断，保证不会数组越界
-	if len(l3Packet) < IP6_HEADER_SIZE+GRE_HEADER_SIZE+ERSPANIII_HEADER_SIZE+ERSPANIII_SUBHEADER_SIZE {
+	if len(l3Packet) < IP6_HEADER_SIZE {
+		return 0, DECAP_ERR_TOO_SHORT
+	}
+	protocol, ipHeaderSize, fragmentProtocol := ip6HeaderSizeFragment(l3Packet)
+	if ipHeaderSize == 0 {
+		if protocol == IPProtocolIPv6Fragment {
+			// 与IPv4相同, 仅可能承载隧道的非首片设置Fragment
+			switch fragmentProtocol {
+			case IPProtocolUDP, IPProtocolGRE, IPProtocolIPv4, IPProtocolIPv6:
+				t.Fragment = true
+				atomic.AddUint64(&decapsulateCounter.DecapFragmented, 1)
+			}
+			return 0, DECAP_ERR_FRAGMENT
+		}
+		return 0, DECAP_ERR_BAD_IP_HEADER
+	}
+	if ipHeaderSize > len(l3Packet) { // 扩展头被截断, 无法确定上层协议
+		return 0, DECAP_ERR_TOO_SHORT
+	}
+	switch protocol {
+	case IPProtocolUDP:
+		return countTruncated(t.decapsulateUdp(packet, l2Len, ipHeaderSize, true, tunnelTypeBitmap))
+	case IPProtocolGRE:
+		return countTruncated(t.DecapsulateGre(packet, l2Len, ipHeaderSize, true, tunnelTypeBitmap))
+	case IPProtocolTCP:
+		if tunnelTypeBitmap.Has(TUNNEL_TYPE_STT) {
+			return countTruncated(t.DecapsulateStt(packet, l2Len, ipHeaderSize, true))
+		}
+		return 0, DECAP_ERR_DISABLED
+	case IPProtocolIPv4, IPProtocolIPv6:
+		if ipHeaderSize != IP6_HEADER_SIZE { // IPIP不支持带扩展头的IPv6 underlay
+			return 0, DECAP_ERR_UNSUPPORTED_PROTOCOL
+		}
+		if tunnelTypeBitmap.Has(TUNNEL_TYPE_IPIP) {
+			return countTruncated(t.DecapsulateIPIP(packet, l2Len, true, protocol == IPProtocolIPv6))
+		}
+		return 0, DECAP_ERR_DISABLED
+	}
+	return 0, DECAP_ERR_UNSUPPORTED_PROTOCOL
+}
+
+// 解析以太网头, 最多跳过MAX_VLAN_TAGS层802.1Q/802.1ad VLAN, 返回上层协议, 以太网头长度(即Decapsulate所需的l2Len)
+// 和由外向内的VLAN ID, 没有VLAN时对应位置为0. 数据不足时长度为0, VLAN超过MAX_VLAN_TAGS层时返回的上层协议为VLAN
+func ParseL2Header(packet []byte) (EthernetType, int, [MAX_VLAN_TAGS]uint16) {
+	var vlans [MAX_VLAN_TAGS]uint16
+	size := ETH_HEADER_SIZE
+	for i := 0; ; i++ {
+		if len(packet) < size {
+			return 0, 0, vlans
+		}
+		ethType := EthernetType(BigEndian.Uint16(packet[size-ETH_TYPE_LEN:]))
+		if i == MAX_VLAN_TAGS || (ethType != EthernetTypeDot1Q && ethType != EthernetTypeQinQ) {
+			return ethType, size, vlans
+		}
+		if len(packet) < size+VLAN_HEADER_SIZE {
+			return 0, 0, vlans
+		}
+		vlans[i] = BigEndian.Uint16(packet[size:]) & VLAN_ID_MASK
+		size += VLAN_HEADER_SIZE
+	}
+}
+
+// 跳过MPLS标签栈, packet[l2Len:]为以太网类型0x8847/0x8848之后的标签栈, 根据栈底标签后的第一个半字节推断负载类型.
+// 返回负载类型和包括标签栈在内的L2长度, 可以直接传给Decapsulate/Decapsulate6, 栈底标签记录在MplsLabel中.
+// 伪线等负载不是IP的报文, 以及标签过多或数据不足的报文返回0
+func (t *TunnelInfo) SkipMplsLabels(packet []byte, l2Len int) (EthernetType, int) {
+	if l2Len < 0 {
+		return 0, 0
+	}
+	for i := 0; i < MPLS_LABEL_LIMIT; i++ {
+		offset := l2Len + i*MPLS_LABEL_SIZE
+		if len(packet) < offset+MPLS_LABEL_SIZE {
+			return 0, 0
+		}
+		label := BigEndian.Uint32(packet[offset:])
+		if label&MPLS_BOTTOM_OF_STACK == 0 {
+			continue
+		}
+		t.MplsLabel = label >> MPLS_LABEL_SHIFT
+		t.HasMpls = true
+		offset += MPLS_LABEL_SIZE
+		if len(packet) <= offset {
+			return 0, 0
+		}
+		// 伪线的控制字首个半字节为0, 其后的以太网帧暂不识别
+		switch packet[offset] >> 4 {
+		case 4:
+			return EthernetTypeIPv4, offset
+		case 6:
+			return EthernetTypeIPv6, offset
+		default:
+			return 0, 0
+		}
+	}
+	return 0, 0
+}
+
+// 从完整的以太网帧开始剥离隧道, 跳过最多MAX_VLAN_TAGS层VLAN定位外层IP头, 剥离了最外层隧道时
+// 在OuterMacSrc和OuterMacDst中记录外层完整MAC. 返回内层L2头在frame中的位置, 未剥离隧道时为0.
+// 已经解析过L2头的调用方仍使用Decapsulate/Decapsulate6
+func (t *TunnelInfo) DecapsulateFrame(frame []byte, tunnelTypeBitmap TunnelTypeBitmap) int {
+	ethType, l2Len, _ := ParseL2Header(frame)
+	if ethType != EthernetTypeIPv4 && ethType != EthernetTypeIPv6 {
 		return 0
 	}
+	// IPIP等隧道会把L2头移到内层, 需要在剥离前读取
+	macSrc, macDst := MacIntFromBytes(frame[OFFSET_SA:]), MacIntFromBytes(frame[OFFSET_DA:])
+	tier := t.Tier
 	offset := 0
-	protocol := IPProtocol(l3Packet[IP6_PROTO_OFFSET])
-	if protocol == IPProtocolUDP {
-		if tunnelTypeBitmap.Has(TUNNEL_TYPE_VXLAN) {
-			offset = t.Decapsulate6Vxlan(packet, l2Len)
+	if ethType == EthernetTypeIPv4 {
+		offset = t.Decapsulate(frame, l2Len, tunnelTypeBitmap)
+	} else {
+		offset = t.Decapsulate6(frame, l2Len, tunnelTypeBitmap)
+	}
+	if t.Tier == tier {
+		return 0
+	}
+	if tier == 0 {
+		t.OuterMacSrc, t.OuterMacDst = macSrc, macDst
+	}
+	return l2Len + offset
+}
+
+// 逐层剥离隧道, 最多剥离maxDepth层, maxDepth不大于0时为DEFAULT_TUNNEL_DEPTH, 且不超过TUNNEL_LAYER_MAX.
+// TunnelInfo中除Layers外的字段为最外层隧道信息, 与Decapsulate一致, Tier为剥离的层数, 每层信息由外向内记录在Layers中.
+// 返回值和Decapsulate一样从最外层L3开始计算, 指向最内层L2头
+func (t *TunnelInfo) DecapsulateAll(packet []byte, l2Len int, ipv6 bool, tunnelTypeBitmap TunnelTypeBitmap, maxDepth int) int {
+	if maxDepth <= 0 {
+		maxDepth = DEFAULT_TUNNEL_DEPTH
+	} else if maxDepth > TUNNEL_LAYER_MAX {
+		maxDepth = TUNNEL_LAYER_MAX
+	}
+	if l2Len < 0 || l2Len > len(packet) {
+		return 0
+	}
+
+	// 当前层L2头和L3头在packet中的位置, 以及最内层L2头的位置
+	l2Start, l3Start, inner := 0, l2Len, 0
+	depth := 0
+	for depth < maxDepth {
+		layer := TunnelInfo{}
+		offset := 0
+		if ipv6 {
+			offset = layer.Decapsulate6(packet[l2Start:], l3Start-l2Start, tunnelTypeBitmap)
+		} else {
+			offset = layer.Decapsulate(packet[l2Start:], l3Start-l2Start, tunnelTypeBitmap)
 		}
-	} else if protocol == IPProtocolIPv4 {
-		if tunnelTypeBitmap.Has(TUNNEL_TYPE_IPIP) {
-			offset = t.DecapsulateIPIP(packet, l2Len, true, false)
+		if layer.Tier == 0 {
+			if depth == 0 {
+				t.Fragment = layer.Fragment
+			}
+			break
 		}
-	} else if protocol == IPProtocolIPv6 {
-		if tunnelTypeBitmap.Has(TUNNEL_TYPE_IPIP) {
-			offset = t.DecapsulateIPIP(packet, l2Len, true, true)
+		if depth == 0 {
+			layer.MplsLabel, layer.HasMpls = t.MplsLabel, t.HasMpls
+			*t = layer
 		}
+		t.Layers[depth] = TunnelLayer{Src: layer.Src, Dst: layer.Dst, Id: layer.Id, Type: layer.Type, IsIPv6: layer.IsIPv6, IPPayload: layer.IPPayload}
+		depth++
+		inner = l3Start + offset
+
+		ethType, innerL2Len, _ := ParseL2Header(packet[inner:])
+		if ethType != EthernetTypeIPv4 && ethType != EthernetTypeIPv6 {
+			break
+		}
+		// 内层L3头必须位于当前L3头之后, 防止异常报文导致原地循环
+		if innerL2Len == 0 || inner+innerL2Len <= l3Start {
+			break
+		}
+		l2Start, l3Start, ipv6 = inner, inner+innerL2Len, ethType == EthernetTypeIPv6
+	}
+	if depth == 0 {
+		return 0
 	}
+	t.Tier = uint8(depth)
+	return inner - l2Len
+}
 
-	return offset
+// 复用TunnelInfo解析下一个报文前需要调用, 避免残留上一个报文的隧道信息
+func (t *TunnelInfo) Reset() {
+	*t = TunnelInfo{}
 }
 
 func (t *TunnelInfo) Valid() bool {
 	return t.Type != TUNNEL_TYPE_NONE
 }
 
-func (t *TunnelInfo) DecapsulateIPIP(packet []byte, l2Len int, underlayIpv6, overlayIpv6 bool) int {
+func (t *TunnelInfo) DecapsulateIPIP(packet []byte, l2Len int, underlayIpv6, overlayIpv6 bool) (int, error) {
 	l3Packet := packet[l2Len:]
 	underlayIpHeaderSize := int((l3Packet[IP_IHL_OFFSET] & 0xf) << 2)
 	if underlayIpv6 { // underlay网络为IPv6时不支持Options字段
 		underlayIpHeaderSize = IP6_HEADER_SIZE
 	}
+	if underlayIpHeaderSize < IP_HEADER_SIZE {
+		return 0, DECAP_ERR_BAD_IP_HEADER
+	}
+	// 负载需要是完整且版本匹配的IP头, 避免将截断或伪装的报文识别为隧道
+	overlayIpHeaderSize, overlayVersion := IP_HEADER_SIZE, byte(4)
+	if overlayIpv6 {
+		overlayIpHeaderSize, overlayVersion = IP6_HEADER_SIZE, 6
+	}
+	if len(l3Packet) < underlayIpHeaderSize+overlayIpHeaderSize {
+		return 0, DECAP_ERR_TRUNCATED
+	}
+	if l3Packet[underlayIpHeaderSize]>>4 != overlayVersion {
+		return 0, DECAP_ERR_BAD_IP_HEADER
+	}
 
 	if t.Tier == 0 {
-		if underlayIpv6 {
-			t.Src = BigEndian.Uint32(l3Packet[IP6_SIP_OFFSET:])
-			t.Dst = BigEndian.Uint32(l3Packet[IP6_DIP_OFFSET:])
-			t.MacSrc = BigEndian.Uint32(packet[OFFSET_SA_LOW4B:])
-			t.MacDst = BigEndian.Uint32(packet[OFFSET_DA_LOW4B:])
-			t.IsIPv6 = true
-		} else {
-			t.Src = BigEndian.Uint32(l3Packet[OFFSET_SIP-ETH_HEADER_SIZE:])
-			t.Dst = BigEndian.Uint32(l3Packet[OFFSET_DIP-ETH_HEADER_SIZE:])
-			t.MacSrc = BigEndian.Uint32(packet[OFFSET_SA_LOW4B:])
-			t.MacDst = BigEndian.Uint32(packet[OFFSET_DA_LOW4B:])
-		}
+		t.saveUnderlay(packet, l2Len, underlayIpv6)
 		t.Type = TUNNEL_TYPE_IPIP
+		t.IPPayload = true
 		t.Id = 0
 	}
 	t.Tier++
@@ -440,5 +1651,5 @@ func (t *TunnelInfo) DecapsulateIPIP(packet []byte, l2Len int, underlayIpv6, ove
 		BigEndian.PutUint16(packet[start+l2Len-2:], uint16(EthernetTypeIPv6))
 	}
 	// l2已经做过解析，这个去除掉已经解析的l2长度
-	return start - l2Len
+	return start - l2Len, nil
 }
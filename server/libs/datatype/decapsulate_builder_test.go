@@ -0,0 +1,258 @@
+/*
+ * Copyright (c) 2024 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package datatype
+
+import (
+	. "encoding/binary"
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+
+	. "github.com/google/gopacket/layers"
+)
+
+// 构造测试报文的各层头部, 只填写解析隧道需要的字段. 长度字段在buildPacket拼接后根据其后的数据补全,
+// 需要异常长度时在拼接后修改或截断
+type testLayer struct {
+	header []byte
+	fixup  func(header []byte, payloadLen int)
+}
+
+func buildPacket(layers ...testLayer) []byte {
+	var packet []byte
+	for _, l := range layers {
+		packet = append(packet, l.header...)
+	}
+	offset := 0
+	for _, l := range layers {
+		if l.fixup != nil {
+			l.fixup(packet[offset:offset+len(l.header)], len(packet)-offset-len(l.header))
+		}
+		offset += len(l.header)
+	}
+	return packet
+}
+
+// 以十六进制描述的原始字节, 可以包含空格, 用于构造保留位、异常标志等难以用参数表达的头部
+func hexLayer(s string) testLayer {
+	header, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		panic(err)
+	}
+	return testLayer{header: header}
+}
+
+func ethLayer(ethType EthernetType) testLayer {
+	header := make([]byte, ETH_HEADER_SIZE)
+	copy(header, []byte{0x02, 0, 0, 0, 0, 0x02, 0x02, 0, 0, 0, 0, 0x01})
+	BigEndian.PutUint16(header[OFFSET_ETH_TYPE:], uint16(ethType))
+	return testLayer{header: header}
+}
+
+// optionLen为IP选项的字节数, 必须是4的倍数
+func ipv4Layer(protocol IPProtocol, src, dst string, optionLen int) testLayer {
+	header := make([]byte, IP_HEADER_SIZE+optionLen)
+	header[0] = 0x40 | byte(len(header)>>2)
+	header[IP_TTL_OFFSET] = 64
+	header[OFFSET_IP_PROTOCOL-ETH_HEADER_SIZE] = byte(protocol)
+	copy(header[OFFSET_SIP-ETH_HEADER_SIZE:], net.ParseIP(src).To4())
+	copy(header[OFFSET_DIP-ETH_HEADER_SIZE:], net.ParseIP(dst).To4())
+	return testLayer{header: header, fixup: func(header []byte, payloadLen int) {
+		BigEndian.PutUint16(header[2:], uint16(len(header)+payloadLen))
+	}}
+}
+
+func ipv6Layer(nextHeader IPProtocol, src, dst string) testLayer {
+	header := make([]byte, IP6_HEADER_SIZE)
+	header[0] = 0x60
+	header[6] = byte(nextHeader)
+	header[7] = 64
+	copy(header[8:], net.ParseIP(src))
+	copy(header[24:], net.ParseIP(dst))
+	return testLayer{header: header, fixup: func(header []byte, payloadLen int) {
+		BigEndian.PutUint16(header[4:], uint16(payloadLen))
+	}}
+}
+
+func udpLayer(srcPort, dstPort uint16) testLayer {
+	header := make([]byte, UDP_HEADER_SIZE)
+	BigEndian.PutUint16(header[UDP_SPORT_OFFSET:], srcPort)
+	BigEndian.PutUint16(header[UDP_DPORT_OFFSET:], dstPort)
+	return testLayer{header: header, fixup: func(header []byte, payloadLen int) {
+		BigEndian.PutUint16(header[UDP_LEN_OFFSET:], uint16(len(header)+payloadLen))
+	}}
+}
+
+func vxlanLayer(vni uint32) testLayer {
+	header := make([]byte, VXLAN_HEADER_SIZE)
+	header[VXLAN_FLAGS_OFFSET] = VXLAN_FLAGS
+	BigEndian.PutUint32(header[VXLAN_VNI_OFFSET:], vni<<8)
+	return testLayer{header: header}
+}
+
+// 可选字段依次为Checksum, Key和Sequence, 由flags决定是否存在
+func greLayer(flags uint16, protocol EthernetType, key uint32) testLayer {
+	header := make([]byte, GRE_HEADER_SIZE, GRE_HEADER_SIZE+12)
+	BigEndian.PutUint16(header[GRE_FLAGS_OFFSET:], flags)
+	BigEndian.PutUint16(header[GRE_PROTOCOL_OFFSET:], uint16(protocol))
+	if flags&GRE_FLAGS_CSUM_MASK != 0 {
+		header = append(header, 0, 0, 0, 0)
+	}
+	if flags&GRE_FLAGS_KEY_MASK != 0 {
+		header = append(header, byte(key>>24), byte(key>>16), byte(key>>8), byte(key))
+	}
+	if flags&GRE_FLAGS_SEQ_MASK != 0 {
+		header = append(header, 0, 0, 0, 1)
+	}
+	return testLayer{header: header}
+}
+
+// 修改某层头部中的一个字节, 用于构造异常字段
+func setByte(l testLayer, offset int, value byte) testLayer {
+	l.header = append([]byte{}, l.header...)
+	l.header[offset] = value
+	return l
+}
+
+type builtDecapsulateCase struct {
+	name      string
+	packet    []byte
+	ipv6      bool
+	bitmap    TunnelTypeBitmap
+	offset    int // 从L3开始的偏移, 与Decapsulate返回值一致
+	err       error
+	tunnel    TunnelType
+	id        uint32
+	ipPayload bool
+	fragment  bool
+}
+
+func builtDecapsulateCases() []builtDecapsulateCase {
+	const src, dst = "10.0.0.1", "10.0.0.2"
+	const src6, dst6 = "fd00::1", "fd00::2"
+	innerFrame := func() []testLayer {
+		return []testLayer{ethLayer(EthernetTypeIPv4), ipv4Layer(IPProtocolTCP, "192.168.0.1", "192.168.0.2", 0)}
+	}
+	vxlan := func(outer ...testLayer) []byte {
+		return buildPacket(append(outer, innerFrame()...)...)
+	}
+	vxlanPacket := vxlan(ethLayer(EthernetTypeIPv4), ipv4Layer(IPProtocolUDP, src, dst, 0), udpLayer(49152, 4789), vxlanLayer(123))
+	grePacket := func(flags uint16, protocol EthernetType, inner ...testLayer) []byte {
+		return buildPacket(append([]testLayer{ethLayer(EthernetTypeIPv4), ipv4Layer(IPProtocolGRE, src, dst, 0), greLayer(flags, protocol, 0x12345)}, inner...)...)
+	}
+	innerIPv4 := ipv4Layer(IPProtocolTCP, "192.168.0.1", "192.168.0.2", 0)
+	genevePacket := func(geneve ...testLayer) []byte {
+		return buildPacket(append([]testLayer{ethLayer(EthernetTypeIPv4), ipv4Layer(IPProtocolUDP, src, dst, 0), udpLayer(49152, 6081)}, geneve...)...)
+	}
+	nonFirstFragment := ipv4Layer(IPProtocolUDP, src, dst, 0)
+	nonFirstFragment = setByte(nonFirstFragment, IP_FRAG_OFFSET, 0x20) // MF
+	nonFirstFragment = setByte(nonFirstFragment, IP_FRAG_OFFSET+1, 185)
+	firstFragment := setByte(ipv4Layer(IPProtocolUDP, src, dst, 0), IP_FRAG_OFFSET, 0x20)
+
+	vxlanBitmap := NewTunnelTypeBitmap(TUNNEL_TYPE_VXLAN)
+	greBitmap := NewTunnelTypeBitmap(TUNNEL_TYPE_GRE)
+	return []builtDecapsulateCase{
+		{name: "vxlan", packet: vxlanPacket, bitmap: vxlanBitmap, offset: 36, tunnel: TUNNEL_TYPE_VXLAN, id: 123},
+		{name: "vxlan-ip-options", packet: vxlan(ethLayer(EthernetTypeIPv4), ipv4Layer(IPProtocolUDP, src, dst, 8), udpLayer(49152, 4789), vxlanLayer(123)),
+			bitmap: vxlanBitmap, offset: 44, tunnel: TUNNEL_TYPE_VXLAN, id: 123},
+		// 只有VXLAN头而没有内层帧时仍然剥离, 偏移指向报文末尾
+		{name: "vxlan-header-only", packet: vxlanPacket[:ETH_HEADER_SIZE+36], bitmap: vxlanBitmap, offset: 36, tunnel: TUNNEL_TYPE_VXLAN, id: 123},
+		{name: "vxlan-header-cut", packet: vxlanPacket[:ETH_HEADER_SIZE+35], bitmap: vxlanBitmap, err: DECAP_ERR_TRUNCATED},
+		{name: "udp-header-cut", packet: vxlanPacket[:ETH_HEADER_SIZE+27], bitmap: vxlanBitmap, err: DECAP_ERR_TOO_SHORT},
+		{name: "ip-header-cut", packet: vxlanPacket[:ETH_HEADER_SIZE+19], bitmap: vxlanBitmap, err: DECAP_ERR_TOO_SHORT},
+		{name: "vxlan-no-i-flag", packet: vxlan(ethLayer(EthernetTypeIPv4), ipv4Layer(IPProtocolUDP, src, dst, 0), udpLayer(49152, 4789), hexLayer("00 00 00 00 00 00 7b 00")),
+			bitmap: vxlanBitmap, err: DECAP_ERR_BAD_VXLAN_FLAGS},
+		// 非严格模式下只检查Flags字节, 保留字段不为0时仍然剥离
+		{name: "vxlan-reserved-set", packet: vxlan(ethLayer(EthernetTypeIPv4), ipv4Layer(IPProtocolUDP, src, dst, 0), udpLayer(49152, 4789), hexLayer("08 ff ff ff 00 00 7b ff")),
+			bitmap: vxlanBitmap, offset: 36, tunnel: TUNNEL_TYPE_VXLAN, id: 123},
+		{name: "ihl-too-small", packet: vxlan(ethLayer(EthernetTypeIPv4), setByte(ipv4Layer(IPProtocolUDP, src, dst, 0), 0, 0x44), udpLayer(49152, 4789), vxlanLayer(123)),
+			bitmap: vxlanBitmap, err: DECAP_ERR_BAD_IP_HEADER},
+		// 首片包含完整的隧道头, 只有非首片才无法解析
+		{name: "first-fragment", packet: vxlan(ethLayer(EthernetTypeIPv4), firstFragment, udpLayer(49152, 4789), vxlanLayer(123)),
+			bitmap: vxlanBitmap, offset: 36, tunnel: TUNNEL_TYPE_VXLAN, id: 123},
+		{name: "non-first-fragment", packet: vxlan(ethLayer(EthernetTypeIPv4), nonFirstFragment, udpLayer(49152, 4789), vxlanLayer(123)),
+			bitmap: vxlanBitmap, err: DECAP_ERR_FRAGMENT, fragment: true},
+		{name: "ip6-vxlan", packet: vxlan(ethLayer(EthernetTypeIPv6), ipv6Layer(IPProtocolUDP, src6, dst6), udpLayer(49152, 4789), vxlanLayer(456)),
+			ipv6: true, bitmap: vxlanBitmap, offset: 56, tunnel: TUNNEL_TYPE_VXLAN, id: 456},
+		// Hop-by-Hop扩展头只有Next Header和长度两个字节
+		{name: "ip6-ext-header-cut", packet: buildPacket(ethLayer(EthernetTypeIPv6), ipv6Layer(IPProtocolIPv6HopByHop, src6, dst6), hexLayer("11 00")),
+			ipv6: true, bitmap: vxlanBitmap, err: DECAP_ERR_TOO_SHORT},
+		// 剥离GRE后外层L2头移到内层IP头前, 偏移为GRE头末尾减去L2头长度
+		{name: "gre-key", packet: grePacket(GRE_FLAGS_KEY_MASK, EthernetTypeIPv4, innerIPv4),
+			bitmap: greBitmap, offset: IP_HEADER_SIZE + 8 - ETH_HEADER_SIZE, tunnel: TUNNEL_TYPE_GRE, id: 0x12345, ipPayload: true},
+		{name: "gre-csum-key-seq", packet: grePacket(GRE_FLAGS_CSUM_MASK|GRE_FLAGS_KEY_MASK|GRE_FLAGS_SEQ_MASK, EthernetTypeIPv4, innerIPv4),
+			bitmap: greBitmap, offset: IP_HEADER_SIZE + 16 - ETH_HEADER_SIZE, tunnel: TUNNEL_TYPE_GRE, id: 0x12345, ipPayload: true},
+		{name: "gre-key-cut", packet: grePacket(GRE_FLAGS_KEY_MASK, EthernetTypeIPv4)[:ETH_HEADER_SIZE+IP_HEADER_SIZE+6],
+			bitmap: greBitmap, err: DECAP_ERR_TRUNCATED},
+		// Version 1为PPTP
+		{name: "gre-version-1", packet: grePacket(GRE_FLAGS_KEY_MASK|1, EthernetTypeIPv4, innerIPv4),
+			bitmap: greBitmap, err: DECAP_ERR_BAD_TUNNEL_HEADER},
+		{name: "gre-ppp", packet: grePacket(GRE_FLAGS_KEY_MASK, EthernetTypePPP, innerIPv4),
+			bitmap: greBitmap, err: DECAP_ERR_UNSUPPORTED_PROTOCOL},
+		{name: "ipip", packet: buildPacket(ethLayer(EthernetTypeIPv4), ipv4Layer(IPProtocolIPv4, src, dst, 0), innerIPv4),
+			bitmap: NewTunnelTypeBitmap(TUNNEL_TYPE_IPIP), offset: IP_HEADER_SIZE - ETH_HEADER_SIZE, tunnel: TUNNEL_TYPE_IPIP, ipPayload: true},
+		// 协议号为IPv4但负载是IPv6头
+		{name: "ipip-version-mismatch", packet: buildPacket(ethLayer(EthernetTypeIPv4), ipv4Layer(IPProtocolIPv4, src, dst, 0), ipv6Layer(IPProtocolTCP, src6, dst6)),
+			bitmap: NewTunnelTypeBitmap(TUNNEL_TYPE_IPIP), err: DECAP_ERR_BAD_IP_HEADER},
+		// Opt Len为2, 选项为一个4字节数据的TLV
+		{name: "geneve-option", packet: buildPacket(append([]testLayer{ethLayer(EthernetTypeIPv4), ipv4Layer(IPProtocolUDP, src, dst, 0), udpLayer(49152, 6081),
+			hexLayer("02 00 65 58 00 01 c8 00"), hexLayer("01 02 03 01 aa bb cc dd")}, innerFrame()...)...),
+			bitmap: NewTunnelTypeBitmap(TUNNEL_TYPE_GENEVE), offset: 44, tunnel: TUNNEL_TYPE_GENEVE, id: 456},
+		// UDP长度覆盖了选项, 但抓包时被截断
+		{name: "geneve-option-cut", packet: genevePacket(hexLayer("02 00 65 58 00 01 c8 00"), hexLayer("01 02 03 01 aa bb cc dd"))[:ETH_HEADER_SIZE+40],
+			bitmap: NewTunnelTypeBitmap(TUNNEL_TYPE_GENEVE), err: DECAP_ERR_TRUNCATED},
+		// 声明的选项超出了UDP长度
+		{name: "geneve-option-overrun", packet: genevePacket(hexLayer("02 00 65 58 00 01 c8 00")),
+			bitmap: NewTunnelTypeBitmap(TUNNEL_TYPE_GENEVE), err: DECAP_ERR_OPTION_OVERRUN},
+	}
+}
+
+func TestDecapsulateBuilt(t *testing.T) {
+	for _, tc := range builtDecapsulateCases() {
+		packet := append([]byte{}, tc.packet...) // 剥离IP负载的隧道会修改报文
+		actual := &TunnelInfo{}
+		var offset int
+		var err error
+		if tc.ipv6 {
+			offset, err = actual.Decapsulate6E(packet, ETH_HEADER_SIZE, tc.bitmap)
+		} else {
+			offset, err = actual.DecapsulateE(packet, ETH_HEADER_SIZE, tc.bitmap)
+		}
+		if offset != tc.offset || err != tc.err || actual.Type != tc.tunnel || actual.Id != tc.id ||
+			actual.IPPayload != tc.ipPayload || actual.Fragment != tc.fragment {
+			t.Errorf("%s: expect offset %d, err %v, %s id %d, ip payload %v, fragment %v, actual offset %d, err %v, %+v\n\tpacket %x",
+				tc.name, tc.offset, tc.err, tc.tunnel, tc.id, tc.ipPayload, tc.fragment, offset, err, actual, tc.packet)
+			continue
+		}
+		if tc.err != nil {
+			continue
+		}
+		if actual.Tier != 1 || actual.IsIPv6 != tc.ipv6 {
+			t.Errorf("%s: unexpected tunnel info %+v", tc.name, actual)
+		}
+		if src, dst := actual.underlay(); !tc.ipv6 && (src.String() != "10.0.0.1" || dst.String() != "10.0.0.2") ||
+			tc.ipv6 && (src.String() != "fd00::1" || dst.String() != "fd00::2") {
+			t.Errorf("%s: unexpected underlay %s -> %s", tc.name, src, dst)
+		}
+		// 偏移指向内层L2头, 内层为IPv4
+		if inner := ETH_HEADER_SIZE + offset; inner < len(packet) &&
+			(EthernetType(BigEndian.Uint16(packet[inner+OFFSET_ETH_TYPE:])) != EthernetTypeIPv4 || packet[inner+ETH_HEADER_SIZE]>>4 != 4) {
+			t.Errorf("%s: unexpected inner frame %x", tc.name, packet[inner:])
+		}
+	}
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright (c) 2024 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package datatype
+
+import "fmt"
+
+// DecapsulateE未剥离隧道的原因, 直接实现error接口, 返回错误时不分配内存
+type DecapsulateError uint8
+
+const (
+	DECAP_ERR_DISABLED             DecapsulateError = iota // 报文协议对应的隧道类型均未开启
+	DECAP_ERR_DEPTH_EXCEEDED                               // 已剥离的隧道层数达到上限
+	DECAP_ERR_TOO_SHORT                                    // 数据长度不足以包含外层IP头或UDP/TCP/GRE头, 无法判断是否为隧道
+	DECAP_ERR_BAD_IP_HEADER                                // IHL非法, IPv6扩展头不合法, 或IPIP内层IP头版本不符
+	DECAP_ERR_FRAGMENT                                     // 外层IP或STT为非首片, 不包含隧道头
+	DECAP_ERR_UNSUPPORTED_PROTOCOL                         // IP协议, 端口或GRE协议类型不属于已开启的隧道
+	DECAP_ERR_BAD_VXLAN_FLAGS                              // VXLAN或VXLAN-GPE的标志不合法
+	DECAP_ERR_BAD_ERSPAN_VERSION                           // ERSPAN头的版本号与GRE协议类型不符
+	DECAP_ERR_OPTION_OVERRUN                               // Geneve选项或GTP-U扩展头长度超出报文或与声明的长度不符
+	DECAP_ERR_BAD_TUNNEL_HEADER                            // 其它隧道头字段不合法, 如GRE版本, STT版本等
+	DECAP_ERR_TRUNCATED                                    // 已识别出隧道类型, 但隧道头或内层IP头被截断, 通常由于snaplen过小
+
+	DECAP_ERR_MAX
+)
+
+var decapsulateErrorString = [DECAP_ERR_MAX]string{
+	DECAP_ERR_DISABLED:             "disabled",
+	DECAP_ERR_DEPTH_EXCEEDED:       "depth-exceeded",
+	DECAP_ERR_TOO_SHORT:            "too-short",
+	DECAP_ERR_BAD_IP_HEADER:        "bad-ip-header",
+	DECAP_ERR_FRAGMENT:             "fragment",
+	DECAP_ERR_UNSUPPORTED_PROTOCOL: "unsupported-protocol",
+	DECAP_ERR_BAD_VXLAN_FLAGS:      "bad-vxlan-flags",
+	DECAP_ERR_BAD_ERSPAN_VERSION:   "bad-erspan-version",
+	DECAP_ERR_OPTION_OVERRUN:       "option-overrun",
+	DECAP_ERR_BAD_TUNNEL_HEADER:    "bad-tunnel-header",
+	DECAP_ERR_TRUNCATED:            "truncated",
+}
+
+func (e DecapsulateError) String() string {
+	if e < DECAP_ERR_MAX {
+		return decapsulateErrorString[e]
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(e))
+}
+
+func (e DecapsulateError) Error() string {
+	return "decapsulate: " + e.String()
+}
+
+// GRE协议类型为ERSPAN但版本号不是对应的1(Type II)或2(Type III)时返回, 值为报文中的版本号.
+// 属于DECAP_ERR_BAD_ERSPAN_VERSION, 可以用errors.Is判断
+type ErspanVersionError uint8
+
+func (e ErspanVersionError) Error() string {
+	return fmt.Sprintf("decapsulate: unsupported ERSPAN version %d", uint8(e))
+}
+
+func (e ErspanVersionError) Unwrap() error {
+	return DECAP_ERR_BAD_ERSPAN_VERSION
+}
+
+// 依次尝试多种隧道时保留更具体的原因: 未开启优先级最低, 其次为协议或端口不匹配
+func moreSpecificDecapError(prev, err error) error {
+	if prev == DECAP_ERR_DISABLED || err != DECAP_ERR_UNSUPPORTED_PROTOCOL {
+		return err
+	}
+	return prev
+}
@@ -0,0 +1,163 @@
+/*
+ * Copyright (c) 2024 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package datatype
+
+import (
+	. "encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/google/gopacket"
+	. "github.com/google/gopacket/layers"
+)
+
+// 与ExplainDecapsulate相同, 输入为gopacket解析的报文, 从packet.Data()的以太网头开始
+func ExplainDecapsulatePacket(packet gopacket.Packet, tunnelTypeBitmap TunnelTypeBitmap) (TunnelInfo, []byte, []string) {
+	return ExplainDecapsulate(packet.Data(), tunnelTypeBitmap)
+}
+
+// 用于编写测试和排查现场抓包, 不用于热路径. 从完整的以太网帧开始按DecapsulateAll的方式逐层剥离隧道,
+// 返回隧道信息, 剥离后从最内层L2头开始的帧(未剥离隧道时为整个帧), 以及每层的判断过程,
+// 例如"eth IPv4 → IPv4 proto UDP → UDP dport 4789 → VXLAN flags 0x08 ok → vxlan 1.1.1.1->2.2.2.2 vni 123".
+// 不修改frame. 负载为IP的隧道会把L2头移到内层IP头前, 返回的内层帧位于副本中, 不能用frame按偏移截取
+func ExplainDecapsulate(frame []byte, tunnelTypeBitmap TunnelTypeBitmap) (TunnelInfo, []byte, []string) {
+	// 负载为IP的隧道会移动L2头, 在副本上剥离
+	packet := append([]byte{}, frame...)
+	info := TunnelInfo{}
+	trace := []string{}
+	l2Start, inner, depth := 0, 0, 0
+	for depth < TUNNEL_LAYER_MAX {
+		ethType, l2Len, vlans := ParseL2Header(packet[l2Start:])
+		steps := []string{explainL2(ethType, l2Len, vlans)}
+		if ethType != EthernetTypeIPv4 && ethType != EthernetTypeIPv6 {
+			trace = append(trace, strings.Join(append(steps, "not IP"), " → "))
+			break
+		}
+		l3Start := l2Start + l2Len
+		steps = append(steps, explainL3(packet[l3Start:], ethType == EthernetTypeIPv6)...)
+
+		layer := TunnelInfo{}
+		var offset int
+		var err error
+		if ethType == EthernetTypeIPv6 {
+			offset, err = layer.Decapsulate6E(packet[l2Start:], l2Len, tunnelTypeBitmap)
+		} else {
+			offset, err = layer.DecapsulateE(packet[l2Start:], l2Len, tunnelTypeBitmap)
+		}
+		if err != nil {
+			if depth == 0 {
+				info.Fragment = layer.Fragment
+			}
+			trace = append(trace, strings.Join(append(steps, err.Error()), " → "))
+			break
+		}
+		if detail := explainTunnelHeader(packet[l3Start:], layer.Type, ethType == EthernetTypeIPv6); detail != "" {
+			steps = append(steps, detail)
+		}
+		src, dst := layer.underlay()
+		steps = append(steps, tunnelSummary(layer.Type, src, dst, uint64(layer.Id)))
+		trace = append(trace, strings.Join(steps, " → "))
+
+		if depth == 0 {
+			info = layer
+			info.OuterMacSrc, info.OuterMacDst = MacIntFromBytes(frame[OFFSET_SA:]), MacIntFromBytes(frame[OFFSET_DA:])
+		}
+		info.Layers[depth] = TunnelLayer{Src: layer.Src, Dst: layer.Dst, Id: layer.Id, Type: layer.Type, IsIPv6: layer.IsIPv6, IPPayload: layer.IPPayload}
+		depth++
+		// 与DecapsulateAll相同, 内层L3头必须位于当前L3头之后
+		next := l3Start + offset
+		if _, innerL2Len, _ := ParseL2Header(packet[next:]); innerL2Len == 0 || next+innerL2Len <= l3Start {
+			inner = next
+			break
+		}
+		l2Start, inner = next, next
+	}
+	if depth == 0 {
+		return info, packet, trace
+	}
+	info.Tier = uint8(depth)
+	return info, packet[inner:], trace
+}
+
+func explainL2(ethType EthernetType, l2Len int, vlans [MAX_VLAN_TAGS]uint16) string {
+	if l2Len == 0 {
+		return "eth too-short"
+	}
+	step := "eth"
+	for i := 0; i < (l2Len-ETH_HEADER_SIZE)/VLAN_HEADER_SIZE; i++ {
+		step += fmt.Sprintf(" vlan %d", vlans[i])
+	}
+	return step + " " + ethType.String()
+}
+
+// 说明外层IP头和传输层头中用于判断隧道类型的字段
+func explainL3(l3Packet []byte, ipv6 bool) []string {
+	protocol, ipHeaderSize := IPProtocol(0), 0
+	if ipv6 {
+		if len(l3Packet) < IP6_HEADER_SIZE {
+			return nil
+		}
+		protocol, ipHeaderSize = ip6HeaderSize(l3Packet)
+		if ipHeaderSize == 0 {
+			return []string{fmt.Sprintf("IPv6 ext header %s", protocol)}
+		}
+	} else {
+		if len(l3Packet) < IP_HEADER_SIZE {
+			return nil
+		}
+		protocol = IPProtocol(l3Packet[OFFSET_IP_PROTOCOL-ETH_HEADER_SIZE])
+		ipHeaderSize = int(l3Packet[IP_IHL_OFFSET]&0xf) << 2
+	}
+	version := "IPv4"
+	if ipv6 {
+		version = "IPv6"
+	}
+	steps := []string{fmt.Sprintf("%s proto %s", version, protocol)}
+	if ipHeaderSize < IP_HEADER_SIZE || ipHeaderSize > len(l3Packet) {
+		return steps
+	}
+	l4 := l3Packet[ipHeaderSize:]
+	switch protocol {
+	case IPProtocolUDP:
+		if len(l4) >= UDP_HEADER_SIZE {
+			steps = append(steps, fmt.Sprintf("UDP sport %d dport %d", BigEndian.Uint16(l4[UDP_SPORT_OFFSET:]), BigEndian.Uint16(l4[UDP_DPORT_OFFSET:])))
+		}
+	case IPProtocolTCP:
+		if len(l4) >= TCP_DPORT_OFFSET+2 {
+			steps = append(steps, fmt.Sprintf("TCP dport %d", BigEndian.Uint16(l4[TCP_DPORT_OFFSET:])))
+		}
+	case IPProtocolGRE:
+		if len(l4) >= GRE_HEADER_SIZE {
+			steps = append(steps, fmt.Sprintf("GRE flags 0x%04x proto 0x%04x", BigEndian.Uint16(l4[GRE_FLAGS_OFFSET:]), BigEndian.Uint16(l4[GRE_PROTOCOL_OFFSET:])))
+		}
+	}
+	return steps
+}
+
+// 剥离成功后补充说明VXLAN的标志位, 其它隧道的关键字段已体现在tunnelSummary中
+func explainTunnelHeader(l3Packet []byte, tunnelType TunnelType, ipv6 bool) string {
+	if tunnelType != TUNNEL_TYPE_VXLAN {
+		return ""
+	}
+	ipHeaderSize := 0
+	if ipv6 {
+		_, ipHeaderSize = ip6HeaderSize(l3Packet)
+	} else {
+		ipHeaderSize = int(l3Packet[IP_IHL_OFFSET]&0xf) << 2
+	}
+	return fmt.Sprintf("VXLAN flags 0x%02x ok", l3Packet[ipHeaderSize+UDP_HEADER_SIZE+VXLAN_FLAGS_OFFSET])
+}
@@ -0,0 +1,240 @@
+/*
+ * Copyright (c) 2024 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package datatype
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+
+	"github.com/deepflowio/deepflow/server/libs/testutil"
+)
+
+// 本目录下的每个pcap都需要在testdata/golden中有同名的json文件, 记录每帧剥离隧道的期望结果.
+// 新增隧道类型时放入pcap, 执行 go test -run TestDecapsulateGolden -update-golden 生成json, 检查无误后提交
+var updateGolden = flag.Bool("update-golden", false, "regenerate testdata/golden from pcaps")
+
+const goldenDir = "testdata/golden"
+
+type goldenFrame struct {
+	Frame     int             `json:"frame"`           // 从1开始, 与wireshark一致
+	Count     int             `json:"count,omitempty"` // 从Frame开始连续多帧结果相同时合并记录
+	Offset    int             `json:"offset"`          // 最内层L2头在帧中的位置, 未剥离隧道时为0
+	Error     string          `json:"error,omitempty"` // 未剥离隧道时最外层的解析结果
+	Fragment  bool            `json:"fragment,omitempty"`
+	MplsLabel *uint32         `json:"mpls_label,omitempty"` // 外层MPLS栈底标签
+	IPPayload bool            `json:"ip_payload,omitempty"`
+	Tunnel    json.RawMessage `json:"tunnel,omitempty"`
+	Erspan    *ErspanMeta     `json:"erspan,omitempty"` // 仅ERSPAN III
+}
+
+// NVGRE与VMware的TEB无法区分, 默认按TEB解析, 仅NVGRE的pcap关闭ERSPAN_OR_TEB
+var goldenBitmaps = map[string]TunnelTypeBitmap{
+	"nvgre.pcap": AllTunnelTypes() &^ NewTunnelTypeBitmap(TUNNEL_TYPE_ERSPAN_OR_TEB),
+}
+
+func decapsulateGolden(index int, frame []byte, bitmap TunnelTypeBitmap) goldenFrame {
+	result := goldenFrame{Frame: index + 1}
+	tunnel := &TunnelInfo{}
+	ethType, l2Len, _ := ParseL2Header(frame)
+	if ethType == layers.EthernetTypeMPLSUnicast || ethType == layers.EthernetTypeMPLSMulticast {
+		ethType, l2Len = tunnel.SkipMplsLabels(frame, l2Len)
+		if tunnel.HasMpls {
+			result.MplsLabel = &tunnel.MplsLabel
+		}
+	}
+	if ethType != layers.EthernetTypeIPv4 && ethType != layers.EthernetTypeIPv6 {
+		result.Error = "not ip"
+		return result
+	}
+	ipv6 := ethType == layers.EthernetTypeIPv6
+	offset := tunnel.DecapsulateAll(frame, l2Len, ipv6, bitmap, TUNNEL_LAYER_MAX)
+	if tunnel.Tier == 0 {
+		outer := &TunnelInfo{}
+		var err error
+		if ipv6 {
+			_, err = outer.Decapsulate6E(frame, l2Len, bitmap)
+		} else {
+			_, err = outer.DecapsulateE(frame, l2Len, bitmap)
+		}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		result.Fragment = tunnel.Fragment
+		return result
+	}
+	result.Offset = l2Len + offset
+	result.IPPayload = tunnel.IPPayload
+	result.Tunnel, _ = json.Marshal(tunnel)
+	if tunnel.Erspan.Valid {
+		result.Erspan = &tunnel.Erspan
+	}
+	return result
+}
+
+// 合并结果相同的连续帧, 避免大量重复帧撑大json
+func mergeGoldenFrames(frames []goldenFrame) []goldenFrame {
+	var merged []goldenFrame
+	for _, frame := range frames {
+		if n := len(merged); n > 0 && sameGoldenResult(merged[n-1], frame) {
+			if merged[n-1].Count == 0 {
+				merged[n-1].Count = 1
+			}
+			merged[n-1].Count++
+			continue
+		}
+		merged = append(merged, frame)
+	}
+	return merged
+}
+
+func sameGoldenResult(a, b goldenFrame) bool {
+	a.Frame, a.Count = 0, 0
+	b.Frame, b.Count = 0, 0
+	return reflect.DeepEqual(a, b)
+}
+
+// 逐字段比较反序列化后的json, 返回不一致字段的路径
+func diffGolden(path string, expected, actual interface{}) []string {
+	switch e := expected.(type) {
+	case map[string]interface{}:
+		a, ok := actual.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := []string{}
+		for k := range e {
+			keys = append(keys, k)
+		}
+		for k := range a {
+			if _, ok := e[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		var diffs []string
+		for _, k := range keys {
+			diffs = append(diffs, diffGolden(path+"."+k, e[k], a[k])...)
+		}
+		return diffs
+	case []interface{}:
+		a, ok := actual.([]interface{})
+		if !ok || len(a) != len(e) {
+			break
+		}
+		var diffs []string
+		for i := range e {
+			diffs = append(diffs, diffGolden(fmt.Sprintf("%s[%d]", path, i), e[i], a[i])...)
+		}
+		return diffs
+	}
+	if reflect.DeepEqual(expected, actual) {
+		return nil
+	}
+	format := func(v interface{}) string {
+		if v == nil {
+			return "<none>"
+		}
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+	return []string{fmt.Sprintf("%s expect %s, actual %s", strings.TrimPrefix(path, "."), format(expected), format(actual))}
+}
+
+func TestDecapsulateGolden(t *testing.T) {
+	pcaps, _ := filepath.Glob("*.pcap")
+	if len(pcaps) == 0 {
+		t.Fatal("no pcap found")
+	}
+	for _, pcap := range pcaps {
+		golden := filepath.Join(goldenDir, strings.TrimSuffix(pcap, ".pcap")+".json")
+		frames, err := testutil.LoadPcap(pcap, nil)
+		if err != nil {
+			t.Errorf("%s: %s", pcap, err)
+			continue
+		}
+		bitmap, ok := goldenBitmaps[pcap]
+		if !ok {
+			bitmap = AllTunnelTypes()
+		}
+		results := make([]goldenFrame, 0, len(frames))
+		for i, frame := range frames {
+			results = append(results, decapsulateGolden(i, frame.Data, bitmap))
+		}
+
+		if *updateGolden {
+			data, _ := json.MarshalIndent(mergeGoldenFrames(results), "", "  ")
+			if err := os.WriteFile(golden, append(data, '\n'), 0644); err != nil {
+				t.Error(err)
+			}
+			continue
+		}
+		expectedData, err := os.ReadFile(golden)
+		if err != nil {
+			t.Errorf("%s: missing expectation %s, run with -update-golden to generate it", pcap, golden)
+			continue
+		}
+		var merged []map[string]interface{}
+		if err := json.Unmarshal(expectedData, &merged); err != nil {
+			t.Errorf("%s: %s", golden, err)
+			continue
+		}
+		var expected, actual []interface{}
+		for _, frame := range merged {
+			count, _ := frame["count"].(float64)
+			if count == 0 {
+				count = 1
+			}
+			delete(frame, "count")
+			for i := 0; i < int(count); i++ {
+				expanded := make(map[string]interface{}, len(frame))
+				for k, v := range frame {
+					expanded[k] = v
+				}
+				expanded["frame"] = frame["frame"].(float64) + float64(i)
+				expected = append(expected, expanded)
+			}
+		}
+		data, _ := json.Marshal(results)
+		json.Unmarshal(data, &actual)
+		if len(expected) != len(actual) {
+			t.Errorf("%s: expect %d frames, actual %d", pcap, len(expected), len(actual))
+			continue
+		}
+		for i := range expected {
+			for _, diff := range diffGolden("", expected[i], actual[i]) {
+				t.Errorf("%s frame %d: %s", pcap, i+1, diff)
+			}
+		}
+	}
+
+	// 不能有找不到pcap的json
+	goldens, _ := filepath.Glob(filepath.Join(goldenDir, "*.json"))
+	for _, golden := range goldens {
+		if _, err := os.Stat(strings.TrimSuffix(filepath.Base(golden), ".json") + ".pcap"); err != nil {
+			t.Errorf("%s: no matching pcap", golden)
+		}
+	}
+}
@@ -17,43 +17,39 @@
 package datatype
 
 import (
+	"bytes"
 	. "encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/bits"
 	"net"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/google/gopacket"
 	. "github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcapgo"
+
+	pb "github.com/deepflowio/deepflow/message/trident"
+	"github.com/deepflowio/deepflow/server/libs/testutil"
 )
 
 type PacketLen = int
 
 func loadPcap(file string) ([]RawPacket, []PacketLen) {
-	var f *os.File
-	cwd, _ := os.Getwd()
-	if strings.Contains(cwd, "datatype") {
-		f, _ = os.Open(file)
-	} else { // dlv
-		f, _ = os.Open("datatype/" + file)
+	if cwd, _ := os.Getwd(); !strings.Contains(cwd, "datatype") { // dlv
+		file = "datatype/" + file
 	}
-	defer f.Close()
-
-	r, _ := pcapgo.NewReader(f)
+	frames, _ := testutil.LoadPcap(file, &testutil.PcapOptions{Snaplen: 128})
 	var packets []RawPacket
 	var packetLens []PacketLen
-	for {
-		packet, ci, err := r.ReadPacketData()
-		if err != nil || packet == nil {
-			break
-		}
-		packetLens = append(packetLens, ci.Length)
-		if len(packet) > 128 {
-			packets = append(packets, packet[:128])
-		} else {
-			packets = append(packets, packet)
-		}
+	for _, frame := range frames {
+		packets = append(packets, frame.Data)
+		packetLens = append(packetLens, frame.Length)
 	}
 	return packets, packetLens
 }
@@ -68,6 +64,7 @@ func TestDecapsulateErspanI(t *testing.T) {
 		Id:     0,
 		Type:   TUNNEL_TYPE_ERSPAN_OR_TEB,
 		Tier:   1,
+		Ttl:    61,
 	}
 
 	packets, _ := loadPcap("decapsulate_erspan1.pcap")
@@ -100,6 +97,7 @@ func TestDecapsulateErspanII(t *testing.T) {
 		Id:     100,
 		Type:   TUNNEL_TYPE_ERSPAN_OR_TEB,
 		Tier:   1,
+		Ttl:    254,
 	}
 
 	packets, _ := loadPcap("decapsulate_test.pcap")
@@ -124,6 +122,100 @@ func TestDecapsulateErspanII(t *testing.T) {
 	}
 }
 
+func TestDecapsulateErspanTypes(t *testing.T) {
+	bitmap := NewTunnelTypeBitmap(TUNNEL_TYPE_ERSPAN_OR_TEB)
+	packets, _ := loadPcap("erspan-types.pcap")
+	testCases := []struct {
+		name           string
+		packet         RawPacket
+		id             uint32
+		expectedOffset int
+		erspan         ErspanMeta
+	}{
+		{"erspan1", packets[0], 0, IP_HEADER_SIZE + GRE_HEADER_SIZE, ErspanMeta{}},
+		{"erspan1-key", packets[1], 0, IP_HEADER_SIZE + GRE_HEADER_SIZE + GRE_KEY_LEN, ErspanMeta{}},
+		{"erspan2", packets[2], 0x177, IP_HEADER_SIZE + GRE_HEADER_SIZE + GRE_SEQ_LEN + ERSPANII_HEADER_SIZE, ErspanMeta{}},
+		{"erspan3-egress", packets[3], 0x155, IP_HEADER_SIZE + GRE_HEADER_SIZE + GRE_SEQ_LEN + ERSPANIII_HEADER_SIZE,
+			ErspanMeta{Valid: true, Vlan: 100, Cos: 5, HardwareId: 7, Egress: true, Timestamp: 0x1234}},
+		{"erspan3-subheader", packets[4], 0x155, IP_HEADER_SIZE + GRE_HEADER_SIZE + GRE_SEQ_LEN + ERSPANIII_HEADER_SIZE + ERSPANIII_SUBHEADER_SIZE,
+			ErspanMeta{Valid: true, Vlan: 100, Cos: 5, HardwareId: 7, Subheader: true, Timestamp: 0x1234}},
+	}
+	for _, tc := range testCases {
+		expected := &TunnelInfo{
+			Src:    IPv4Int(BigEndian.Uint32(net.ParseIP("10.50.0.1").To4())),
+			Dst:    IPv4Int(BigEndian.Uint32(net.ParseIP("10.50.0.2").To4())),
+			MacSrc: 0x0c000002,
+			MacDst: 0x0c000001,
+			Id:     tc.id,
+			Type:   TUNNEL_TYPE_ERSPAN_OR_TEB,
+			Tier:   1,
+			Ttl:    64,
+			Erspan: tc.erspan,
+		}
+		l2Len := 14
+		actual := &TunnelInfo{}
+		offset := actual.Decapsulate(tc.packet, l2Len, bitmap)
+		if !reflect.DeepEqual(expected, actual) || offset != tc.expectedOffset ||
+			EthernetType(BigEndian.Uint16(tc.packet[l2Len+offset+OFFSET_ETH_TYPE:])) != EthernetTypeIPv4 {
+			t.Errorf("%s: %+v\n actual: %+v, expectedOffset:%v, offset:%v",
+				tc.name, expected, actual, tc.expectedOffset, offset)
+		}
+	}
+}
+
+// 版本号未知的ERSPAN头不解析, 也不残留部分填写的字段
+func TestErspanUnknownVersion(t *testing.T) {
+	bitmap := NewTunnelTypeBitmap(TUNNEL_TYPE_ERSPAN_OR_TEB)
+	packets, _ := loadPcap("erspan-types.pcap")
+	versionOffset := ETH_HEADER_SIZE + IP_HEADER_SIZE + GRE_HEADER_SIZE + GRE_SEQ_LEN + ERSPAN_VERSION_OFFSET
+	for _, base := range []RawPacket{packets[2], packets[3]} { // Type II和Type III
+		for _, version := range []uint8{0, 3, 7, 15} {
+			packet := append(RawPacket{}, base...)
+			packet[versionOffset] = packet[versionOffset]&0xf | version<<4
+			actual := &TunnelInfo{}
+			offset, err := actual.DecapsulateE(packet, ETH_HEADER_SIZE, bitmap)
+			expected := fmt.Sprintf("decapsulate: unsupported ERSPAN version %d", version)
+			if offset != 0 || err == nil || err.Error() != expected || !errors.Is(err, DECAP_ERR_BAD_ERSPAN_VERSION) {
+				t.Errorf("version %d: expect %s, actual offset %d, %v", version, expected, offset, err)
+			}
+			if *actual != (TunnelInfo{}) {
+				t.Errorf("version %d: tunnel info modified %+v", version, actual)
+			}
+		}
+	}
+}
+
+func TestErspanTimestamp(t *testing.T) {
+	bitmap := NewTunnelTypeBitmap(TUNNEL_TYPE_ERSPAN_OR_TEB)
+	packets, _ := loadPcap("erspan-types.pcap")
+	flagsOffset := 14 + IP_HEADER_SIZE + GRE_HEADER_SIZE + GRE_SEQ_LEN + ERSPANIII_FLAGS_OFFSET
+	testCases := []struct {
+		name        string
+		packet      RawPacket
+		granularity ErspanGranularity
+		duration    time.Duration
+		ok          bool
+	}{
+		{"erspan2", packets[2], ERSPAN_GRA_100US, 0, false},
+		{"100us", packets[3], ERSPAN_GRA_100US, 0x1234 * 100 * time.Microsecond, true},
+		{"100ns", packets[3], ERSPAN_GRA_100NS, 0x1234 * 100 * time.Nanosecond, true},
+		{"ieee1588", packets[3], ERSPAN_GRA_IEEE1588, 0x1234 * time.Nanosecond, true},
+		{"user-defined", packets[3], ERSPAN_GRA_USER, 0, false},
+	}
+	for _, tc := range testCases {
+		packet := append(RawPacket{}, tc.packet...)
+		packet[flagsOffset] |= uint8(tc.granularity) << ERSPANIII_GRA_SHIFT
+		actual := &TunnelInfo{}
+		actual.Decapsulate(packet, 14, bitmap)
+		if actual.Erspan.Granularity != tc.granularity {
+			t.Errorf("%s: expect granularity %d, actual %d", tc.name, tc.granularity, actual.Erspan.Granularity)
+		}
+		if duration, ok := actual.Erspan.TimestampDuration(); duration != tc.duration || ok != tc.ok {
+			t.Errorf("%s: expect %v %v, actual %v %v", tc.name, tc.duration, tc.ok, duration, ok)
+		}
+	}
+}
+
 func TestDecapsulateIII(t *testing.T) {
 	bitmap := NewTunnelTypeBitmap(TUNNEL_TYPE_ERSPAN_OR_TEB)
 	expected := &TunnelInfo{
@@ -134,6 +226,8 @@ func TestDecapsulateIII(t *testing.T) {
 		Id:     0,
 		Type:   TUNNEL_TYPE_ERSPAN_OR_TEB,
 		Tier:   1,
+		Ttl:    64,
+		Erspan: ErspanMeta{Valid: true},
 	}
 
 	packets, _ := loadPcap("decapsulate_test.pcap")
@@ -152,13 +246,16 @@ func TestDecapsulateIII(t *testing.T) {
 func TestDecapsulateVxlan(t *testing.T) {
 	bitmap := NewTunnelTypeBitmap(TUNNEL_TYPE_VXLAN)
 	expected := &TunnelInfo{
-		Src:    IPv4Int(BigEndian.Uint32(net.ParseIP("172.16.1.103").To4())),
-		Dst:    IPv4Int(BigEndian.Uint32(net.ParseIP("172.20.1.171").To4())),
-		MacSrc: 0xafda7679,
-		MacDst: 0x3ddd88c3,
-		Id:     123,
-		Type:   TUNNEL_TYPE_VXLAN,
-		Tier:   1,
+		Src:     IPv4Int(BigEndian.Uint32(net.ParseIP("172.16.1.103").To4())),
+		Dst:     IPv4Int(BigEndian.Uint32(net.ParseIP("172.20.1.171").To4())),
+		MacSrc:  0xafda7679,
+		MacDst:  0x3ddd88c3,
+		Id:      123,
+		Type:    TUNNEL_TYPE_VXLAN,
+		Tier:    1,
+		Ttl:     64,
+		SrcPort: 49152,
+		DstPort: 4789,
 	}
 
 	packets, _ := loadPcap("decapsulate_test.pcap")
@@ -174,16 +271,1025 @@ func TestDecapsulateVxlan(t *testing.T) {
 	}
 }
 
+func TestDecapsulateOffset(t *testing.T) {
+	testPackets, _ := loadPcap("decapsulate_test.pcap")
+	erspanPackets, _ := loadPcap("erspan-types.pcap")
+	tcpPacket := make([]byte, 128)
+	BigEndian.PutUint16(tcpPacket[OFFSET_ETH_TYPE:], uint16(EthernetTypeIPv4))
+	tcpPacket[ETH_HEADER_SIZE] = 0x45
+	tcpPacket[OFFSET_IP_PROTOCOL] = byte(IPProtocolTCP)
+
+	bitmap := NewTunnelTypeBitmap(TUNNEL_TYPE_VXLAN, TUNNEL_TYPE_ERSPAN_OR_TEB, TUNNEL_TYPE_IPIP, TUNNEL_TYPE_GRE)
+	greSize := GRE_HEADER_SIZE + GRE_SEQ_LEN
+	testCases := []struct {
+		name           string
+		packet         RawPacket
+		id             uint32
+		expectedOffset int
+	}{
+		{"vxlan", testPackets[2], 123, IP_HEADER_SIZE + UDP_HEADER_SIZE + VXLAN_HEADER_SIZE},
+		{"erspan2", erspanPackets[2], 0x177, IP_HEADER_SIZE + greSize + ERSPANII_HEADER_SIZE},
+		{"erspan3", erspanPackets[3], 0x155, IP_HEADER_SIZE + greSize + ERSPANIII_HEADER_SIZE},
+		{"erspan3-subheader", erspanPackets[4], 0x155, IP_HEADER_SIZE + greSize + ERSPANIII_HEADER_SIZE + ERSPANIII_SUBHEADER_SIZE},
+		{"tcp", tcpPacket, 0, 0},
+	}
+	for _, tc := range testCases {
+		l2Len := 14
+		actual := &TunnelInfo{}
+		offset := actual.Decapsulate(tc.packet, l2Len, bitmap)
+		if offset != tc.expectedOffset || actual.Id != tc.id || actual.Valid() != (tc.expectedOffset != 0) {
+			t.Errorf("%s: expectedOffset: %v, offset: %v, actual: %+v", tc.name, tc.expectedOffset, offset, actual)
+			continue
+		}
+		// 偏移指向内层以太网头, 其后紧跟内层IP头
+		if offset != 0 && (EthernetType(BigEndian.Uint16(tc.packet[l2Len+offset+OFFSET_ETH_TYPE:])) != EthernetTypeIPv4 ||
+			tc.packet[l2Len+offset+ETH_HEADER_SIZE]>>4 != 4) {
+			t.Errorf("%s: offset does not point to inner frame: %x", tc.name, tc.packet[l2Len+offset:])
+		}
+	}
+}
+
+func TestDecapsulateIPPayload(t *testing.T) {
+	load := func(file string, index int) RawPacket {
+		packets, _ := loadPcap(file)
+		return append(RawPacket{}, packets[index]...)
+	}
+	testCases := []struct {
+		name      string
+		packet    RawPacket
+		l2Len     int
+		ipPayload bool
+	}{
+		{"vxlan", load("decapsulate_test.pcap", 2), 14, false},
+		{"erspan2", load("erspan-types.pcap", 2), 14, false},
+		{"erspan3", load("erspan-types.pcap", 3), 14, false},
+		{"teb", load("vmware-gre-teb.pcap", 0), 14, false},
+		{"nvgre", load("nvgre.pcap", 0), 14, false},
+		{"geneve", load("geneve.pcap", 0), 14, false},
+		{"stt", load("stt.pcap", 0), 14, false},
+		{"capwap", load("capwap.pcap", 0), 14, false},
+		{"vxlan-gpe-ethernet", load("vxlan-gpe.pcap", 0), 14, false},
+		{"vxlan-gpe-ipv4", load("vxlan-gpe.pcap", 1), 14, true},
+		{"ipip", load("ipip.pcap", 0), 18, true},
+		{"gre", load("gre.pcap", 2), 14, true},
+		{"tencent-gre", load("tencent-gre.pcap", 0), 14, true},
+	}
+	for _, tc := range testCases {
+		actual := &TunnelInfo{}
+		offset := actual.Decapsulate(tc.packet, tc.l2Len, AllTunnelTypes())
+		if actual.Tier != 1 || actual.IPPayload != tc.ipPayload {
+			t.Errorf("%s: expect ip payload %v, actual %+v", tc.name, tc.ipPayload, actual)
+			continue
+		}
+		// 无论负载类型, 偏移都指向可以直接解析的L2头
+		ethType, l2Len, _ := ParseL2Header(tc.packet[tc.l2Len+offset:])
+		version := byte(4)
+		if ethType == EthernetTypeIPv6 {
+			version = 6
+		}
+		if (ethType != EthernetTypeIPv4 && ethType != EthernetTypeIPv6) || tc.packet[tc.l2Len+offset+l2Len]>>4 != version {
+			t.Errorf("%s: offset %d does not point to inner L2 header: %x", tc.name, offset, tc.packet[tc.l2Len+offset:])
+		}
+	}
+}
+
+func TestTunnelInfoString(t *testing.T) {
+	src := IPv4Int(BigEndian.Uint32(net.ParseIP("172.16.1.103").To4()))
+	dst := IPv4Int(BigEndian.Uint32(net.ParseIP("172.20.1.171").To4()))
+	testCases := []struct {
+		tunnelType TunnelType
+		id         uint32
+		expected   string
+	}{
+		{TUNNEL_TYPE_VXLAN, 123, "vxlan 172.16.1.103->172.20.1.171 vni 123"},
+		{TUNNEL_TYPE_IPIP, 0, "ipip 172.16.1.103->172.20.1.171"},
+		{TUNNEL_TYPE_TENCENT_GRE, 66181, "tencent-gre 172.16.1.103->172.20.1.171 key 66181"},
+		{TUNNEL_TYPE_ERSPAN_OR_TEB, 100, "erspan-teb 172.16.1.103->172.20.1.171 id 100"},
+		{TUNNEL_TYPE_GRE, 0x12345, "gre 172.16.1.103->172.20.1.171 key 74565"},
+		{TUNNEL_TYPE_NVGRE, 0x5001, "nvgre 172.16.1.103->172.20.1.171 vsid 20481"},
+		{TUNNEL_TYPE_GENEVE, 291, "geneve 172.16.1.103->172.20.1.171 vni 291"},
+		{TUNNEL_TYPE_VXLAN_GPE, 42, "vxlan-gpe 172.16.1.103->172.20.1.171 vni 42"},
+		{TUNNEL_TYPE_STT, 0x1234, "stt 172.16.1.103->172.20.1.171 context 4294971956"},
+		{TUNNEL_TYPE_CAPWAP, 0, "capwap 172.16.1.103->172.20.1.171"},
+	}
+	if len(testCases) != bits.OnesCount16(uint16(AllTunnelTypes())) {
+		t.Errorf("expect a test case for every tunnel type")
+	}
+	for _, tc := range testCases {
+		info := TunnelInfo{Src: src, Dst: dst, MacSrc: 0xafda7679, MacDst: 0x3ddd88c3, Id: tc.id, Type: tc.tunnelType, Tier: 1, Ttl: 64}
+		if tc.tunnelType == TUNNEL_TYPE_STT { // 输出完整的64位Context ID
+			info.ContextId = 1<<32 | uint64(tc.id)
+		}
+		expected := tc.expected + ", mac afda7679->3ddd88c3, tier 1, ttl 64, tos 0"
+		if actual := info.String(); actual != expected {
+			t.Errorf("%s: expect %s, actual %s", tc.tunnelType, expected, actual)
+		}
+		if actual := fmt.Sprintf("%v", &info); actual != expected {
+			t.Errorf("%s: expect %s, actual %s", tc.tunnelType, expected, actual)
+		}
+	}
+	udp := TunnelInfo{Src: src, Dst: dst, Id: 123, Type: TUNNEL_TYPE_VXLAN, Tier: 1, Ttl: 64, SrcPort: 49152, DstPort: 4789}
+	if actual := udp.String(); actual != "vxlan 172.16.1.103->172.20.1.171 vni 123, port 49152->4789, mac 00000000->00000000, tier 1, ttl 64, tos 0" {
+		t.Errorf("unexpected udp tunnel string %s", actual)
+	}
+	if actual := (TunnelInfo{}).String(); actual != "none" {
+		t.Errorf("expect none for zero value, actual %s", actual)
+	}
+	if actual := TunnelType(100).Name(); actual != "unknown-100" {
+		t.Errorf("unexpected name for unknown tunnel type %s", actual)
+	}
+
+	// 多层隧道依次输出内层, IPv6仅输出地址的后四个字节
+	info := TunnelInfo{Src: src, Dst: dst, Id: 100, Type: TUNNEL_TYPE_GRE, Tier: 2}
+	info.Layers[0] = TunnelLayer{Src: src, Dst: dst, Id: 100, Type: TUNNEL_TYPE_GRE}
+	info.Layers[1] = TunnelLayer{Src: 0x0a000001, Dst: 0x0a000002, Id: 200, Type: TUNNEL_TYPE_VXLAN, IsIPv6: true}
+	expected := "gre 172.16.1.103->172.20.1.171 key 100, mac 00000000->00000000, tier 2, ttl 0, tos 0 | vxlan ::a00:1->::a00:2 vni 200"
+	if actual := info.String(); actual != expected {
+		t.Errorf("expect %s, actual %s", expected, actual)
+	}
+}
+
+func TestTunnelInfoMarshalJSON(t *testing.T) {
+	info := &TunnelInfo{
+		Src:    IPv4Int(BigEndian.Uint32(net.ParseIP("172.16.1.103").To4())),
+		Dst:    IPv4Int(BigEndian.Uint32(net.ParseIP("172.20.1.171").To4())),
+		MacSrc: 0xafda7679,
+		MacDst: 0x3ddd88c3,
+		Id:     123,
+		Type:   TUNNEL_TYPE_VXLAN,
+		Tier:   1,
+		Ttl:    64,
+	}
+	expected := `{"type":"vxlan","src":"172.16.1.103","dst":"172.20.1.171","mac_src":"afda7679","mac_dst":"3ddd88c3","id":123,"tier":1,"ttl":64,"tos":0}`
+	if actual, err := json.Marshal(info); err != nil || string(actual) != expected {
+		t.Errorf("expect %s, actual %s, %v", expected, actual, err)
+	}
+	info.SrcPort, info.DstPort = 49152, 4789
+	expected = expected[:len(expected)-1] + `,"src_port":49152,"dst_port":4789}`
+	if actual, err := json.Marshal(info); err != nil || string(actual) != expected {
+		t.Errorf("expect %s, actual %s, %v", expected, actual, err)
+	}
+
+	info = &TunnelInfo{Type: TUNNEL_TYPE_GENEVE, Id: 291, Tier: 1, IsIPv6: true}
+	copy(info.Src6[:], net.ParseIP("2001:db8::1"))
+	copy(info.Dst6[:], net.ParseIP("2001:db8::2"))
+	info.Layers[0] = TunnelLayer{Type: TUNNEL_TYPE_GENEVE, Id: 291, IsIPv6: true}
+	output := &struct {
+		Type   string `json:"type"`
+		Src    string `json:"src"`
+		Dst    string `json:"dst"`
+		Layers []struct {
+			Type string `json:"type"`
+		} `json:"layers"`
+	}{}
+	if actual, err := json.Marshal(info); err != nil || json.Unmarshal(actual, output) != nil ||
+		output.Type != "geneve" || output.Src != "2001:db8::1" || output.Dst != "2001:db8::2" || len(output.Layers) != 1 {
+		t.Errorf("unexpected ipv6 tunnel json %s, %v", actual, err)
+	}
+}
+
+func TestSkipMplsLabels(t *testing.T) {
+	packets, _ := loadPcap("mpls.pcap")
+	testCases := []struct {
+		name    string
+		packet  RawPacket
+		ethType EthernetType
+		labels  int
+		label   uint32
+		hasMpls bool
+	}{
+		{"1-label", packets[0], EthernetTypeIPv4, 1, 16001, true},
+		{"2-labels", packets[1], EthernetTypeIPv6, 2, 24002, true},
+		{"3-labels", packets[2], EthernetTypeIPv4, 3, 100, true},
+		{"pseudowire", packets[4], 0, 0, 300, true},
+		{"too-many-labels", packets[5], 0, 0, 0, false},
+		{"truncated", packets[0][:ETH_HEADER_SIZE+2], 0, 0, 0, false},
+	}
+	for _, tc := range testCases {
+		actual := &TunnelInfo{}
+		ethType, l2Len := actual.SkipMplsLabels(tc.packet, ETH_HEADER_SIZE)
+		expectedL2Len := 0
+		if tc.labels > 0 {
+			expectedL2Len = ETH_HEADER_SIZE + tc.labels*MPLS_LABEL_SIZE
+		}
+		if ethType != tc.ethType || l2Len != expectedL2Len || actual.MplsLabel != tc.label || actual.HasMpls != tc.hasMpls {
+			t.Errorf("%s: expect %s %d label %d, actual %s %d %+v", tc.name, tc.ethType, expectedL2Len, tc.label, ethType, l2Len, actual)
+		}
+	}
+
+	// 跳过标签栈后继续解析隧道
+	actual := &TunnelInfo{}
+	_, l2Len := actual.SkipMplsLabels(packets[3], ETH_HEADER_SIZE)
+	offset := actual.Decapsulate(packets[3], l2Len, NewTunnelTypeBitmap(TUNNEL_TYPE_VXLAN))
+	if l2Len != ETH_HEADER_SIZE+2*MPLS_LABEL_SIZE || offset != IP_HEADER_SIZE+UDP_HEADER_SIZE+VXLAN_HEADER_SIZE ||
+		actual.Type != TUNNEL_TYPE_VXLAN || actual.Id != 500 || actual.MplsLabel != 24003 {
+		t.Errorf("unexpected vxlan over mpls: %+v, offset %d", actual, offset)
+	}
+	if !strings.HasSuffix(actual.String(), ", mpls label 24003") {
+		t.Errorf("unexpected string %s", actual)
+	}
+
+	packets, _ = loadPcap("mpls.pcap")
+	actual = &TunnelInfo{}
+	_, l2Len = actual.SkipMplsLabels(packets[3], ETH_HEADER_SIZE)
+	if actual.DecapsulateAll(packets[3], l2Len, false, NewTunnelTypeBitmap(TUNNEL_TYPE_VXLAN), 0); actual.Id != 500 || actual.MplsLabel != 24003 {
+		t.Errorf("mpls label should be kept by DecapsulateAll: %+v", actual)
+	}
+}
+
+func TestParseL2Header(t *testing.T) {
+	packets, _ := loadPcap("qinq-vxlan.pcap")
+	untagged := append(RawPacket{}, packets[0][:ETH_HEADER_SIZE]...)
+	BigEndian.PutUint16(untagged[OFFSET_ETH_TYPE:], uint16(EthernetTypeIPv4))
+	testCases := []struct {
+		name    string
+		packet  RawPacket
+		ethType EthernetType
+		l2Len   int
+		vlans   [MAX_VLAN_TAGS]uint16
+	}{
+		{"qinq", packets[0], EthernetTypeIPv4, ETH_HEADER_SIZE + 2*VLAN_HEADER_SIZE, [MAX_VLAN_TAGS]uint16{100, 200}},
+		{"dot1q", packets[1], EthernetTypeIPv4, ETH_HEADER_SIZE + VLAN_HEADER_SIZE, [MAX_VLAN_TAGS]uint16{200}},
+		{"untagged", untagged, EthernetTypeIPv4, ETH_HEADER_SIZE, [MAX_VLAN_TAGS]uint16{}},
+		{"truncated", packets[0][:ETH_HEADER_SIZE+2], 0, 0, [MAX_VLAN_TAGS]uint16{}},
+	}
+	for _, tc := range testCases {
+		ethType, l2Len, vlans := ParseL2Header(tc.packet)
+		if ethType != tc.ethType || l2Len != tc.l2Len || vlans != tc.vlans {
+			t.Errorf("%s: expect %s %d %v, actual %s %d %v", tc.name, tc.ethType, tc.l2Len, tc.vlans, ethType, l2Len, vlans)
+		}
+	}
+}
+
+func TestDecapsulateQinQVxlan(t *testing.T) {
+	bitmap := NewTunnelTypeBitmap(TUNNEL_TYPE_VXLAN)
+	expected := &TunnelInfo{
+		Src:     IPv4Int(BigEndian.Uint32(net.ParseIP("10.80.0.1").To4())),
+		Dst:     IPv4Int(BigEndian.Uint32(net.ParseIP("10.80.0.2").To4())),
+		MacSrc:  0x3e000102,
+		MacDst:  0x3e000101,
+		Id:      700,
+		Type:    TUNNEL_TYPE_VXLAN,
+		Tier:    1,
+		Ttl:     64,
+		SrcPort: 50000,
+		DstPort: 4789,
+	}
+	packets, _ := loadPcap("qinq-vxlan.pcap")
+	for i, packet := range packets {
+		_, l2Len, _ := ParseL2Header(packet)
+		actual := &TunnelInfo{}
+		offset := actual.Decapsulate(packet, l2Len, bitmap)
+		expectedOffset := IP_HEADER_SIZE + UDP_HEADER_SIZE + VXLAN_HEADER_SIZE
+		if !reflect.DeepEqual(expected, actual) || offset != expectedOffset ||
+			EthernetType(BigEndian.Uint16(packet[l2Len+offset+OFFSET_ETH_TYPE:])) != EthernetTypeIPv4 {
+			t.Errorf("packet %d: \n\ttunnel: %+v\n\tactual: %+v\n\toffset: %v\n\tactual: %v\n",
+				i, expected, actual, expectedOffset, offset)
+		}
+	}
+}
+
+func TestDecapsulateFrame(t *testing.T) {
+	qinqPackets, _ := loadPcap("qinq-vxlan.pcap")
+	ipipPackets, _ := loadPcap("ipip.pcap")
+	bitmap := NewTunnelTypeBitmap(TUNNEL_TYPE_VXLAN, TUNNEL_TYPE_IPIP)
+	plain := append(RawPacket{}, qinqPackets[1]...)
+	BigEndian.PutUint16(plain[ETH_HEADER_SIZE+VLAN_HEADER_SIZE+IP_HEADER_SIZE+UDP_DPORT_OFFSET:], 53)
+	testCases := []struct {
+		name     string
+		packet   RawPacket
+		expected int
+		macSrc   MacInt
+		macDst   MacInt
+	}{
+		{"qinq-vxlan", qinqPackets[0], ETH_HEADER_SIZE + VLAN_HEADER_SIZE*2 + IP_HEADER_SIZE + UDP_HEADER_SIZE + VXLAN_HEADER_SIZE, 0x00163e000102, 0x00163e000101},
+		{"vlan-vxlan", qinqPackets[1], ETH_HEADER_SIZE + VLAN_HEADER_SIZE + IP_HEADER_SIZE + UDP_HEADER_SIZE + VXLAN_HEADER_SIZE, 0x00163e000102, 0x00163e000101},
+		{"vlan-ipip", ipipPackets[0], IP_HEADER_SIZE, 0xc4a4027dc643, 0x52540027e67d}, // 外层L2头移到内层IP头前
+		{"not-tunnel", plain, 0, 0, 0},
+		{"short", qinqPackets[0][:ETH_HEADER_SIZE], 0, 0, 0},
+	}
+	for _, tc := range testCases {
+		packet := append(RawPacket{}, tc.packet...)
+		actual := &TunnelInfo{}
+		offset := actual.DecapsulateFrame(packet, bitmap)
+		if offset != tc.expected || actual.OuterMacSrc != tc.macSrc || actual.OuterMacDst != tc.macDst {
+			t.Errorf("%s: expect offset %d mac %012x->%012x, actual %d %+v", tc.name, tc.expected, tc.macSrc, tc.macDst, offset, actual)
+			continue
+		}
+		if ethType, _, _ := ParseL2Header(packet[offset:]); offset != 0 && (ethType != EthernetTypeIPv4 || actual.Tier != 1) {
+			t.Errorf("%s: unexpected inner frame %x, tunnel %+v", tc.name, packet[offset:], actual)
+		}
+	}
+
+	// 已剥离过外层时不覆盖外层MAC
+	actual := &TunnelInfo{}
+	actual.DecapsulateFrame(append(RawPacket{}, qinqPackets[0]...), bitmap)
+	outer := *actual
+	if offset := actual.DecapsulateFrame(append(RawPacket{}, ipipPackets[0]...), bitmap); offset == 0 ||
+		actual.OuterMacSrc != outer.OuterMacSrc || actual.Tier != 2 {
+		t.Errorf("unexpected second tier %d %+v", offset, actual)
+	}
+}
+
+// 镜像流量经过trunk口时外层以太网头后带VLAN, 与未带VLAN的同一ERSPAN会话结果应一致
+func TestDecapsulateFrameVlanErspan(t *testing.T) {
+	packets, _ := loadPcap("erspan-types.pcap")
+	bitmap := NewTunnelTypeBitmap(TUNNEL_TYPE_ERSPAN_OR_TEB)
+	untagged := packets[3]
+	withTags := func(tpids ...EthernetType) RawPacket {
+		packet := append(RawPacket{}, untagged[:ETH_HEADER_SIZE-ETH_TYPE_LEN]...)
+		for i, tpid := range tpids {
+			var tag [VLAN_HEADER_SIZE]byte
+			BigEndian.PutUint16(tag[:], uint16(tpid))
+			BigEndian.PutUint16(tag[2:], uint16(100+i))
+			packet = append(packet, tag[:]...)
+		}
+		return append(packet, untagged[ETH_HEADER_SIZE-ETH_TYPE_LEN:]...)
+	}
+
+	expected := &TunnelInfo{}
+	expectedOffset := expected.DecapsulateFrame(append(RawPacket{}, untagged...), bitmap)
+	if expectedOffset != ETH_HEADER_SIZE+IP_HEADER_SIZE+GRE_HEADER_SIZE+GRE_SEQ_LEN+ERSPANIII_HEADER_SIZE || expected.Id != 0x155 {
+		t.Fatalf("untagged: unexpected offset %d, tunnel %+v", expectedOffset, expected)
+	}
+	testCases := []struct {
+		name   string
+		packet RawPacket
+		vlans  int
+	}{
+		{"dot1q", withTags(EthernetTypeDot1Q), 1},
+		{"qinq", withTags(EthernetTypeQinQ, EthernetTypeDot1Q), 2},
+		{"dot1q-dot1q", withTags(EthernetTypeDot1Q, EthernetTypeDot1Q), 2},
+	}
+	for _, tc := range testCases {
+		actual := &TunnelInfo{}
+		offset := actual.DecapsulateFrame(tc.packet, bitmap)
+		if offset != expectedOffset+tc.vlans*VLAN_HEADER_SIZE || !reflect.DeepEqual(expected, actual) {
+			t.Errorf("%s: expect offset %d %+v\n\tactual %d %+v", tc.name, expectedOffset+tc.vlans*VLAN_HEADER_SIZE, expected, offset, actual)
+		}
+		// 按未带VLAN的L2长度调用Decapsulate时外层IP头位置错误, 无法剥离
+		if offset := (&TunnelInfo{}).Decapsulate(tc.packet, ETH_HEADER_SIZE, bitmap); offset != 0 {
+			t.Errorf("%s: expect fixed l2Len to fail, actual offset %d", tc.name, offset)
+		}
+	}
+}
+
+func TestExplainDecapsulate(t *testing.T) {
+	bitmap := AllTunnelTypes()
+	// 与DecapsulateAll的结果一致, 且不修改输入
+	files, _ := filepath.Glob("*.pcap")
+	for _, file := range files {
+		packets, _ := loadPcap(file)
+		for i, packet := range packets {
+			input := append(RawPacket{}, packet...)
+			info, inner, trace := ExplainDecapsulate(input, bitmap)
+			if !bytes.Equal(input, packet) || len(trace) == 0 {
+				t.Errorf("%s[%d]: input modified or empty trace %q", file, i, trace)
+			}
+			// 负载为IP的隧道剥离后L2头被移动, 内层帧应与DecapsulateAll处理后的报文一致
+			expected := TunnelInfo{}
+			decapsulated := append(RawPacket{}, packet...)
+			expectedOffset := 0
+			if ethType, l2Len, _ := ParseL2Header(packet); ethType == EthernetTypeIPv4 || ethType == EthernetTypeIPv6 {
+				if expectedOffset = expected.DecapsulateAll(decapsulated, l2Len, ethType == EthernetTypeIPv6, bitmap, TUNNEL_LAYER_MAX); expected.Tier > 0 {
+					expectedOffset += l2Len
+					expected.OuterMacSrc, expected.OuterMacDst = MacIntFromBytes(packet[OFFSET_SA:]), MacIntFromBytes(packet[OFFSET_DA:])
+				}
+			}
+			if info != expected || !bytes.Equal(inner, decapsulated[expectedOffset:]) {
+				t.Errorf("%s[%d]: expect %+v %x\n\tactual %+v %x", file, i, expected, decapsulated[expectedOffset:], info, inner)
+			}
+		}
+	}
+
+	packets, _ := loadPcap("decapsulate_test.pcap")
+	testCases := []struct {
+		name   string
+		packet RawPacket
+		bitmap TunnelTypeBitmap
+		trace  []string
+	}{
+		{"vxlan", packets[2], bitmap, []string{
+			"eth IPv4 → IPv4 proto UDP → UDP sport 49152 dport 4789 → VXLAN flags 0x08 ok → vxlan 172.16.1.103->172.20.1.171 vni 123",
+			"eth IPv4 → IPv4 proto ICMPv4 → decapsulate: unsupported-protocol"}},
+		{"vxlan-disabled", packets[2], NewTunnelTypeBitmap(TUNNEL_TYPE_GENEVE), []string{
+			"eth IPv4 → IPv4 proto UDP → UDP sport 49152 dport 4789 → decapsulate: unsupported-protocol"}},
+		{"short", packets[2][:ETH_HEADER_SIZE-1], bitmap, []string{"eth too-short → not IP"}},
+	}
+	for _, tc := range testCases {
+		_, _, trace := ExplainDecapsulatePacket(gopacket.NewPacket(tc.packet, LayerTypeEthernet, gopacket.Default), tc.bitmap)
+		if !reflect.DeepEqual(trace, tc.trace) {
+			t.Errorf("%s: expect %q\n\tactual %q", tc.name, tc.trace, trace)
+		}
+	}
+}
+
+func TestDecapsulateFragment(t *testing.T) {
+	bitmap := NewTunnelTypeBitmap(TUNNEL_TYPE_VXLAN, TUNNEL_TYPE_GRE, TUNNEL_TYPE_ERSPAN_OR_TEB)
+	packets, _ := loadPcap("ip-fragment.pcap")
+	GetDecapsulateCounter()
+	testCases := []struct {
+		name     string
+		packet   RawPacket
+		tunnel   TunnelType
+		fragment bool
+	}{
+		{"first-fragment", packets[0], TUNNEL_TYPE_VXLAN, false},
+		{"udp-fragment", packets[1], TUNNEL_TYPE_NONE, true},
+		{"gre-fragment", packets[2], TUNNEL_TYPE_NONE, true},
+		{"tcp-fragment", packets[3], TUNNEL_TYPE_NONE, false},
+	}
+	for _, tc := range testCases {
+		actual := &TunnelInfo{}
+		offset := actual.Decapsulate(tc.packet, 14, bitmap)
+		if actual.Type != tc.tunnel || actual.Fragment != tc.fragment || (offset != 0) != (tc.tunnel != TUNNEL_TYPE_NONE) {
+			t.Errorf("%s: expect %s fragment %v, actual: %+v, offset %d", tc.name, tc.tunnel, tc.fragment, actual, offset)
+		}
+	}
+	if counter := GetDecapsulateCounter(); counter.DecapFragmented != 2 {
+		t.Errorf("expect 2 fragmented packets, found %+v", counter)
+	}
+	if counter := GetDecapsulateCounter(); counter.DecapFragmented != 0 {
+		t.Errorf("counter should be cleared after read, found %+v", counter)
+	}
+
+	actual := &TunnelInfo{}
+	actual.DecapsulateAll(packets[1], 14, false, bitmap, 0)
+	if !actual.Fragment || actual.Tier != 0 {
+		t.Errorf("expect fragment from DecapsulateAll, actual: %+v", actual)
+	}
+
+	// IPv6分段头中记录上层协议, 与IPv4相同仅可能承载隧道的非首片设置Fragment
+	ip6Fragment := func(protocol IPProtocol, fragmentOffset uint16) RawPacket {
+		packet := make(RawPacket, ETH_HEADER_SIZE+IP6_HEADER_SIZE+IP6_EXT_HEADER_MIN_SIZE+64)
+		BigEndian.PutUint16(packet[OFFSET_ETH_TYPE:], uint16(EthernetTypeIPv6))
+		ip6 := packet[ETH_HEADER_SIZE:]
+		ip6[0] = 0x60
+		BigEndian.PutUint16(ip6[4:], uint16(IP6_EXT_HEADER_MIN_SIZE+64))
+		ip6[IP6_PROTO_OFFSET] = byte(IPProtocolIPv6Fragment)
+		ip6[7] = 64
+		copy(ip6[8:], net.ParseIP("fd00::1"))
+		copy(ip6[24:], net.ParseIP("fd00::2"))
+		ip6[IP6_HEADER_SIZE+IP6_EXT_NEXT_HEADER_OFFSET] = byte(protocol)
+		BigEndian.PutUint16(ip6[IP6_HEADER_SIZE+IP6_FRAG_OFFSET_OFFSET:], fragmentOffset<<3)
+		return packet
+	}
+	GetDecapsulateCounter()
+	for _, tc := range []struct {
+		name     string
+		packet   RawPacket
+		err      error
+		fragment bool
+	}{
+		{"ip6-udp-fragment", ip6Fragment(IPProtocolUDP, 185), DECAP_ERR_FRAGMENT, true},
+		{"ip6-gre-fragment", ip6Fragment(IPProtocolGRE, 185), DECAP_ERR_FRAGMENT, true},
+		{"ip6-tcp-fragment", ip6Fragment(IPProtocolTCP, 185), DECAP_ERR_FRAGMENT, false},
+		{"ip6-first-fragment", ip6Fragment(IPProtocolUDP, 0), DECAP_ERR_UNSUPPORTED_PROTOCOL, false},
+	} {
+		actual := &TunnelInfo{}
+		if _, err := actual.Decapsulate6E(tc.packet, ETH_HEADER_SIZE, bitmap); err != tc.err || actual.Fragment != tc.fragment || actual.Tier != 0 {
+			t.Errorf("%s: expect %v fragment %v, actual %v %+v", tc.name, tc.err, tc.fragment, err, actual)
+		}
+	}
+	if counter := GetDecapsulateCounter(); counter.DecapFragmented != 2 {
+		t.Errorf("expect 2 fragmented ipv6 packets, found %+v", counter)
+	}
+	actual = &TunnelInfo{}
+	actual.DecapsulateAll(ip6Fragment(IPProtocolUDP, 185), ETH_HEADER_SIZE, true, bitmap, 0)
+	if !actual.Fragment || actual.Tier != 0 {
+		t.Errorf("expect ipv6 fragment from DecapsulateAll, actual: %+v", actual)
+	}
+}
+
+func TestVxlanPorts(t *testing.T) {
+	defer SetVxlanPorts(nil)
+	bitmap := NewTunnelTypeBitmap(TUNNEL_TYPE_VXLAN)
+	vxlanPacket := func(port uint16) []byte {
+		packet := make([]byte, 128)
+		packet[ETH_HEADER_SIZE+IP_IHL_OFFSET] = 0x45
+		packet[OFFSET_IP_PROTOCOL] = byte(IPProtocolUDP)
+		BigEndian.PutUint16(packet[OFFSET_DPORT:], port)
+		packet[OFFSET_VXLAN_FLAGS] = VXLAN_FLAGS
+		return packet
+	}
+
+	SetVxlanPorts([]uint16{8472, 48879})
+	if ports := GetVxlanPorts(); !reflect.DeepEqual(ports, []uint16{8472, 48879}) {
+		t.Errorf("unexpected vxlan ports %v", ports)
+	}
+	for port, expected := range map[uint16]bool{4789: false, 8472: true, 48879: true, 48880: false} {
+		actual := &TunnelInfo{}
+		if offset := actual.Decapsulate(vxlanPacket(port), ETH_HEADER_SIZE, bitmap); (offset != 0) != expected || actual.Valid() != expected {
+			t.Errorf("port %d: expect vxlan %v, actual: %+v", port, expected, actual)
+		}
+	}
+
+	SetVxlanPorts(nil)
+	if ports := GetVxlanPorts(); len(ports) != len(DEFAULT_VXLAN_PORTS) {
+		t.Errorf("expect default vxlan ports, found %v", ports)
+	}
+	actual := &TunnelInfo{}
+	if actual.Decapsulate(vxlanPacket(4789), ETH_HEADER_SIZE, bitmap); !actual.Valid() {
+		t.Errorf("expect vxlan on default port, actual: %+v", actual)
+	}
+}
+
+func TestUdpTunnelPorts(t *testing.T) {
+	defer SetUdpTunnelPorts(TUNNEL_TYPE_GENEVE, nil)
+	defer SetVxlanPorts(nil)
+	bitmap := NewTunnelTypeBitmap(TUNNEL_TYPE_VXLAN, TUNNEL_TYPE_GENEVE, TUNNEL_TYPE_VXLAN_GPE)
+	genevePackets, _ := loadPcap("geneve.pcap")
+	vxlanPackets, _ := loadPcap("decapsulate_test.pcap")
+	withPort := func(packet RawPacket, port uint16) RawPacket {
+		packet = append(RawPacket{}, packet...)
+		BigEndian.PutUint16(packet[OFFSET_DPORT:], port)
+		return packet
+	}
+	decapsulatedType := func(packet RawPacket) TunnelType {
+		actual := &TunnelInfo{}
+		actual.Decapsulate(packet, ETH_HEADER_SIZE, bitmap)
+		return actual.Type
+	}
+
+	if err := SetUdpTunnelPorts(TUNNEL_TYPE_GRE, []uint16{4789}); err == nil {
+		t.Error("expect error for non-udp tunnel type")
+	}
+	if ports := GetUdpTunnelPorts(TUNNEL_TYPE_VXLAN_GPE); !reflect.DeepEqual(ports, DEFAULT_VXLAN_GPE_PORTS) {
+		t.Errorf("unexpected vxlan-gpe ports %v", ports)
+	}
+	if ports := GetUdpTunnelPorts(TUNNEL_TYPE_GTPU); !reflect.DeepEqual(ports, DEFAULT_GTPU_PORTS) {
+		t.Errorf("unexpected gtpu ports %v", ports)
+	}
+
+	testCases := []struct {
+		name     string
+		tunnel   TunnelType
+		ports    []uint16
+		packet   RawPacket
+		expected TunnelType
+	}{
+		{"geneve-6082-default", TUNNEL_TYPE_GENEVE, nil, withPort(genevePackets[0], 6082), TUNNEL_TYPE_NONE},
+		{"geneve-6082", TUNNEL_TYPE_GENEVE, []uint16{6081, 6082}, withPort(genevePackets[0], 6082), TUNNEL_TYPE_GENEVE},
+		{"geneve-6081-kept", TUNNEL_TYPE_GENEVE, []uint16{6081, 6082}, genevePackets[0], TUNNEL_TYPE_GENEVE},
+		// 4789从VXLAN转给Geneve后立即生效
+		{"geneve-4789", TUNNEL_TYPE_GENEVE, []uint16{4789}, withPort(genevePackets[0], 4789), TUNNEL_TYPE_GENEVE},
+		{"vxlan-4789-moved", TUNNEL_TYPE_GENEVE, []uint16{4789}, vxlanPackets[2], TUNNEL_TYPE_NONE},
+		{"vxlan-8472-kept", TUNNEL_TYPE_GENEVE, []uint16{4789}, withPort(vxlanPackets[2], 8472), TUNNEL_TYPE_VXLAN},
+		{"geneve-6081-removed", TUNNEL_TYPE_GENEVE, []uint16{4789}, genevePackets[0], TUNNEL_TYPE_NONE},
+		// 再转回VXLAN
+		{"vxlan-4789-back", TUNNEL_TYPE_VXLAN, []uint16{4789}, vxlanPackets[2], TUNNEL_TYPE_VXLAN},
+		{"geneve-4789-moved", TUNNEL_TYPE_VXLAN, []uint16{4789}, withPort(genevePackets[0], 4789), TUNNEL_TYPE_NONE},
+	}
+	for _, tc := range testCases {
+		SetUdpTunnelPorts(tc.tunnel, tc.ports)
+		if actual := decapsulatedType(tc.packet); actual != tc.expected {
+			t.Errorf("%s: expect %s, actual %s", tc.name, tc.expected.Name(), actual.Name())
+		}
+	}
+	if ports := GetVxlanPorts(); !reflect.DeepEqual(ports, []uint16{4789}) {
+		t.Errorf("unexpected vxlan ports %v", ports)
+	}
+	if ports := GetUdpTunnelPorts(TUNNEL_TYPE_GENEVE); len(ports) != 0 {
+		t.Errorf("expect no geneve ports, actual %v", ports)
+	}
+	SetUdpTunnelPorts(TUNNEL_TYPE_GENEVE, nil)
+	if ports := GetUdpTunnelPorts(TUNNEL_TYPE_GENEVE); !reflect.DeepEqual(ports, DEFAULT_GENEVE_PORTS) {
+		t.Errorf("expect default geneve ports, actual %v", ports)
+	}
+}
+
+func TestDecapsulateVxlanSrcPort(t *testing.T) {
+	bitmap := NewTunnelTypeBitmap(TUNNEL_TYPE_VXLAN)
+	packets, _ := loadPcap("vxlan-sport.pcap")
+	testCases := []struct {
+		name           string
+		packet         RawPacket
+		expectedOffset int
+	}{
+		{"src-port-4789", packets[0], 0},
+		{"ip-options-look-like-dst-port", packets[1], 0},
+		{"ip-options", packets[2], IP_HEADER_SIZE + 4 + UDP_HEADER_SIZE + VXLAN_HEADER_SIZE},
+	}
+	for _, tc := range testCases {
+		actual := &TunnelInfo{}
+		offset := actual.Decapsulate(tc.packet, 14, bitmap)
+		if offset != tc.expectedOffset || actual.Valid() != (tc.expectedOffset != 0) {
+			t.Errorf("%s: expect offset %d, actual %d, %+v", tc.name, tc.expectedOffset, offset, actual)
+			continue
+		}
+		if offset != 0 && (actual.Id != 910 || EthernetType(BigEndian.Uint16(tc.packet[14+offset+OFFSET_ETH_TYPE:])) != EthernetTypeIPv4) {
+			t.Errorf("%s: unexpected tunnel %+v, overlay %x", tc.name, actual, tc.packet[14+offset:])
+		}
+	}
+}
+
+func TestVxlanStrict(t *testing.T) {
+	defer SetVxlanStrict(false)
+	bitmap := NewTunnelTypeBitmap(TUNNEL_TYPE_VXLAN)
+	vxlanPacket := func(offset int, value byte) []byte {
+		packet := make([]byte, 128)
+		packet[ETH_HEADER_SIZE+IP_IHL_OFFSET] = 0x45
+		packet[OFFSET_IP_PROTOCOL] = byte(IPProtocolUDP)
+		BigEndian.PutUint16(packet[OFFSET_DPORT:], 4789)
+		packet[OFFSET_VXLAN_FLAGS] = VXLAN_FLAGS
+		packet[OFFSET_VXLAN_FLAGS+offset] |= value
+		return packet
+	}
+	ip6Packets, _ := loadPcap("ip6-vxlan.pcap")
+	ip6Packet := func(offset int, value byte) []byte {
+		packet := append(RawPacket{}, ip6Packets[0]...)
+		packet[ETH_HEADER_SIZE+IP6_HEADER_SIZE+UDP_HEADER_SIZE+offset] |= value
+		return packet
+	}
+	testCases := []struct {
+		name       string
+		offset     int
+		value      byte
+		permissive bool
+		strict     bool
+	}{
+		{"valid", VXLAN_FLAGS_OFFSET, 0, true, true},
+		{"reserved-flag", VXLAN_FLAGS_OFFSET, 0x04, false, false},
+		{"reserved-after-flags", VXLAN_FLAGS_OFFSET + 2, 0x01, true, false},
+		{"reserved-after-vni", VXLAN_VNI_OFFSET + 3, 0x80, true, false},
+	}
+	for _, strict := range []bool{false, true} {
+		SetVxlanStrict(strict)
+		GetDecapsulateCounter()
+		suspects := uint64(0)
+		for _, tc := range testCases {
+			expected := tc.permissive
+			if strict {
+				expected = tc.strict
+				if !expected {
+					suspects += 2
+				}
+			}
+			actual := &TunnelInfo{}
+			if offset := actual.Decapsulate(vxlanPacket(tc.offset, tc.value), ETH_HEADER_SIZE, bitmap); (offset != 0) != expected || actual.Valid() != expected {
+				t.Errorf("%s strict %v: expect vxlan %v, actual: %+v", tc.name, strict, expected, actual)
+			}
+			actual = &TunnelInfo{}
+			if offset := actual.Decapsulate6(ip6Packet(tc.offset, tc.value), ETH_HEADER_SIZE, bitmap); (offset != 0) != expected || actual.Valid() != expected {
+				t.Errorf("%s strict %v: expect ipv6 vxlan %v, actual: %+v", tc.name, strict, expected, actual)
+			}
+		}
+		if counter := GetDecapsulateCounter(); counter.DecapSuspect != suspects {
+			t.Errorf("strict %v: expect %d suspects, found %+v", strict, suspects, counter)
+		}
+	}
+	if !IsVxlanStrict() {
+		t.Error("expect strict mode")
+	}
+}
+
+func TestVxlanVniReservedByte(t *testing.T) {
+	defer SetVxlanStrict(false)
+	ip6Packets, _ := loadPcap("ip6-vxlan.pcap")
+	vxlanPacket := func(vni uint32) RawPacket {
+		packet := make(RawPacket, 128)
+		packet[ETH_HEADER_SIZE+IP_IHL_OFFSET] = 0x45
+		packet[OFFSET_IP_PROTOCOL] = byte(IPProtocolUDP)
+		BigEndian.PutUint16(packet[OFFSET_DPORT:], 4789)
+		packet[OFFSET_VXLAN_FLAGS] = VXLAN_FLAGS
+		BigEndian.PutUint32(packet[OFFSET_VXLAN_VNI:], vni<<8|0xff) // 保留字节全为1
+		return packet
+	}
+	ip6Packet := func(vni uint32) RawPacket {
+		packet := append(RawPacket{}, ip6Packets[0]...)
+		BigEndian.PutUint32(packet[ETH_HEADER_SIZE+IP6_HEADER_SIZE+UDP_HEADER_SIZE+VXLAN_VNI_OFFSET:], vni<<8|0xff)
+		return packet
+	}
+	for _, vni := range []uint32{0, 123, 1<<24 - 1} {
+		for _, strict := range []bool{false, true} {
+			SetVxlanStrict(strict)
+			for i, packet := range []RawPacket{vxlanPacket(vni), ip6Packet(vni)} {
+				actual := &TunnelInfo{}
+				offset := 0
+				if i == 0 {
+					offset = actual.Decapsulate(packet, 14, NewTunnelTypeBitmap(TUNNEL_TYPE_VXLAN))
+				} else {
+					offset = actual.Decapsulate6(packet, 14, NewTunnelTypeBitmap(TUNNEL_TYPE_VXLAN))
+				}
+				// 严格模式下保留字节非0的报文不解析, 否则VNI只取24位
+				if strict {
+					if offset != 0 || actual.Valid() {
+						t.Errorf("vni %d packet %d: expect rejected in strict mode, actual %+v", vni, i, actual)
+					}
+				} else if offset == 0 || actual.Id != vni {
+					t.Errorf("vni %d packet %d: expect id %d, actual %+v", vni, i, vni, actual)
+				}
+			}
+		}
+	}
+}
+
+func TestEnabledTunnelTypes(t *testing.T) {
+	defer SetEnabledTunnelTypes(^TunnelTypeBitmap(0))
+	all := NewTunnelTypeBitmap(TUNNEL_TYPE_VXLAN, TUNNEL_TYPE_IPIP, TUNNEL_TYPE_TENCENT_GRE, TUNNEL_TYPE_ERSPAN_OR_TEB, TUNNEL_TYPE_GRE, TUNNEL_TYPE_NVGRE, TUNNEL_TYPE_GENEVE, TUNNEL_TYPE_VXLAN_GPE, TUNNEL_TYPE_STT, TUNNEL_TYPE_CAPWAP, TUNNEL_TYPE_GTPU)
+	load := func(file string, index int) RawPacket {
+		packets, _ := loadPcap(file)
+		return packets[index]
+	}
+	testCases := []struct {
+		tunnelType TunnelType
+		packet     RawPacket
+		l2Len      int
+		ipv6       bool
+	}{
+		{TUNNEL_TYPE_VXLAN, load("decapsulate_test.pcap", 2), 14, false},
+		{TUNNEL_TYPE_IPIP, load("ipip.pcap", 0), 18, false},
+		{TUNNEL_TYPE_TENCENT_GRE, load("tencent-gre.pcap", 0), 14, false},
+		{TUNNEL_TYPE_ERSPAN_OR_TEB, load("erspan-types.pcap", 2), 14, false},
+		{TUNNEL_TYPE_GRE, load("gre.pcap", 2), 14, false}, // 没有Key, 不会被识别为腾讯GRE
+		{TUNNEL_TYPE_NVGRE, load("nvgre.pcap", 0), 14, false},
+		{TUNNEL_TYPE_GENEVE, load("geneve.pcap", 0), 14, false},
+		{TUNNEL_TYPE_VXLAN_GPE, load("vxlan-gpe.pcap", 0), 14, false},
+		{TUNNEL_TYPE_STT, load("stt.pcap", 0), 14, false},
+		{TUNNEL_TYPE_VXLAN, load("ip6-vxlan.pcap", 0), 14, true},
+		{TUNNEL_TYPE_STT, load("stt.pcap", 2), 14, true},
+		{TUNNEL_TYPE_CAPWAP, load("capwap.pcap", 0), 14, false},
+		{TUNNEL_TYPE_CAPWAP, load("capwap.pcap", 9), 14, true},
+		{TUNNEL_TYPE_GTPU, load("gtpu.pcap", 0), 14, false},
+		{TUNNEL_TYPE_GTPU, load("gtpu.pcap", 6), 14, true},
+	}
+	decapsulate := func(packet RawPacket, l2Len int, ipv6 bool, bitmap TunnelTypeBitmap) (*TunnelInfo, int) {
+		actual := &TunnelInfo{}
+		packet = append(RawPacket{}, packet...)
+		if ipv6 {
+			return actual, actual.Decapsulate6(packet, l2Len, bitmap)
+		}
+		return actual, actual.Decapsulate(packet, l2Len, bitmap)
+	}
+	for _, tc := range testCases {
+		bit := NewTunnelTypeBitmap(tc.tunnelType)
+		callerBits := all
+		if tc.tunnelType == TUNNEL_TYPE_NVGRE { // 与TEB同时开启时按TEB解析
+			callerBits &^= NewTunnelTypeBitmap(TUNNEL_TYPE_ERSPAN_OR_TEB)
+		}
+		SetEnabledTunnelTypes(all)
+		if actual, _ := decapsulate(tc.packet, tc.l2Len, tc.ipv6, callerBits); actual.Type != tc.tunnelType {
+			t.Errorf("%s: expect tunnel when enabled, actual: %+v", tc.tunnelType.Name(), actual)
+		}
+		// 全局关闭时与调用方未指定该类型的结果完全一致
+		expected, expectedOffset := decapsulate(tc.packet, tc.l2Len, tc.ipv6, callerBits&^bit)
+		SetEnabledTunnelTypes(all &^ bit)
+		actual, offset := decapsulate(tc.packet, tc.l2Len, tc.ipv6, callerBits)
+		if actual.Type == tc.tunnelType || offset != expectedOffset || !reflect.DeepEqual(expected, actual) {
+			t.Errorf("%s: expect %+v offset %d when disabled, actual: %+v offset %d", tc.tunnelType.Name(), expected, expectedOffset, actual, offset)
+		}
+		// 只开启该类型时其余类型不影响结果
+		SetEnabledTunnelTypes(bit)
+		if actual, _ := decapsulate(tc.packet, tc.l2Len, tc.ipv6, callerBits); actual.Type != tc.tunnelType {
+			t.Errorf("%s: expect tunnel when only this type is enabled, actual: %+v", tc.tunnelType.Name(), actual)
+		}
+	}
+
+	SetEnabledTunnelTypes(all)
+	if enabled := UpdateEnabledTunnelTypes(0, NewTunnelTypeBitmap(TUNNEL_TYPE_VXLAN, TUNNEL_TYPE_STT)); enabled != all&^NewTunnelTypeBitmap(TUNNEL_TYPE_VXLAN, TUNNEL_TYPE_STT) || GetEnabledTunnelTypes() != enabled {
+		t.Errorf("unexpected enabled types %s", enabled.Names())
+	}
+	if enabled := UpdateEnabledTunnelTypes(NewTunnelTypeBitmap(TUNNEL_TYPE_STT), 0); enabled.Has(TUNNEL_TYPE_VXLAN) || !enabled.Has(TUNNEL_TYPE_STT) {
+		t.Errorf("unexpected enabled types %s", enabled.Names())
+	}
+	if AllTunnelTypes() != all {
+		t.Errorf("unexpected all tunnel types %s", AllTunnelTypes().Names())
+	}
+	if names := NewTunnelTypeBitmap(TUNNEL_TYPE_VXLAN, TUNNEL_TYPE_GRE).Names(); names != "vxlan,gre" {
+		t.Errorf("unexpected names %s", names)
+	}
+	for i := TUNNEL_TYPE_VXLAN; i <= TUNNEL_TYPE_GTPU; i++ {
+		if !all.Has(i) {
+			continue
+		}
+		if tunnelType, ok := TunnelTypeFromName(i.Name()); !ok || tunnelType != i {
+			t.Errorf("%s: unexpected type %d from name", i.Name(), tunnelType)
+		}
+	}
+	for _, name := range []string{"gtp-c", "", "unknown-5"} {
+		if _, ok := TunnelTypeFromName(name); ok {
+			t.Errorf("unknown name %q should not be found", name)
+		}
+	}
+}
+
+func TestTunnelTypeWireValues(t *testing.T) {
+	// agent上报的值(agent/src/common/decapsulate.rs)直接转换为TunnelType后输出, 不能与服务端独有的类型混淆
+	for _, tc := range []struct {
+		value    uint8
+		expected string
+	}{
+		{0, "none"},
+		{1, "VXLAN"},
+		{2, "IPIP"},
+		{3, "GRE"},
+		{4, "GENEVE"},
+		{5, "ERSPAN"},
+		{6, "TEB"},
+		{7, "unknown-7"},
+		{200, "unknown-200"}, // 超出范围的值不能panic
+	} {
+		if actual := TunnelType(tc.value).String(); actual != tc.expected {
+			t.Errorf("%d: expect %s, actual %s", tc.value, tc.expected, actual)
+		}
+	}
+	if TUNNEL_TYPE_GENEVE != TunnelType(pb.DecapType_DECAP_TYPE_GENEVE) {
+		t.Errorf("geneve should be the same as protobuf")
+	}
+	for _, tunnelType := range []TunnelType{TUNNEL_TYPE_ERSPAN, TUNNEL_TYPE_TEB} {
+		if AllTunnelTypes().Has(tunnelType) {
+			t.Errorf("%s should not be decapsulated", tunnelType)
+		}
+	}
+	for i := range tunnelTypeInfos {
+		if info := tunnelTypeInfos[i]; (info.name != "" && info.tip == "") || (info.idName != "" && info.name == "") {
+			t.Errorf("incomplete tunnel type %d: %+v", i, info)
+		}
+	}
+	if TUNNEL_TYPE_GTPU >= 32 {
+		t.Errorf("tunnel type %d exceeds TunnelTypeBitmap", TUNNEL_TYPE_GTPU)
+	}
+}
+
+func TestDecapsulateTruncated(t *testing.T) {
+	// 按snaplen截断时, 随长度增加结果依次为数据不足(TOO_SHORT), 隧道头被截断(TRUNCATED)和完整报文的结果,
+	// 截断的隧道不能被误判为其它原因, 达到隧道所需长度后结果与完整报文一致
+	GetDecapsulateCounter()
+	truncatedCount := uint64(0)
+	files, _ := filepath.Glob("*.pcap")
+	for _, file := range files {
+		packets, _ := loadPcap(file)
+		for i, packet := range packets {
+			ethType, l2Len, _ := ParseL2Header(packet)
+			if ethType != EthernetTypeIPv4 && ethType != EthernetTypeIPv6 {
+				continue
+			}
+			decapsulate := func(size int) (*TunnelInfo, int, error) {
+				actual := &TunnelInfo{}
+				truncated := append(RawPacket{}, packet[:size]...)
+				var offset int
+				var err error
+				if ethType == EthernetTypeIPv6 {
+					offset, err = actual.Decapsulate6E(truncated, l2Len, AllTunnelTypes())
+				} else {
+					offset, err = actual.DecapsulateE(truncated, l2Len, AllTunnelTypes())
+				}
+				if err == DECAP_ERR_TRUNCATED {
+					truncatedCount++
+				}
+				return actual, offset, err
+			}
+			expected, expectedOffset, expectedErr := decapsulate(len(packet))
+			stage := 0 // 0: TOO_SHORT, 1: TRUNCATED, 2: 与完整报文一致
+			for size := l2Len; size < len(packet); size++ {
+				actual, offset, err := decapsulate(size)
+				current := 2
+				switch {
+				case err == DECAP_ERR_TOO_SHORT && expectedErr != DECAP_ERR_TOO_SHORT:
+					current = 0
+				case err == DECAP_ERR_TRUNCATED && expectedErr != DECAP_ERR_TRUNCATED:
+					current = 1
+				case err != expectedErr:
+					t.Errorf("%s[%d] truncated to %d: expect %v or truncation, actual %v", file, i, size, expectedErr, err)
+					continue
+				}
+				if current < stage {
+					t.Errorf("%s[%d] truncated to %d: %v after a longer truncation was classified further", file, i, size, err)
+				}
+				stage = current
+				if current == 2 && (offset != expectedOffset || *actual != *expected) {
+					t.Errorf("%s[%d] truncated to %d: expect %d %+v, actual %d %+v", file, i, size, expectedOffset, expected, offset, actual)
+				} else if current < 2 && *actual != (TunnelInfo{Fragment: actual.Fragment}) {
+					t.Errorf("%s[%d] truncated to %d: partial tunnel info %+v", file, i, size, actual)
+				}
+			}
+			if expectedErr == nil && stage != 2 {
+				t.Errorf("%s[%d]: decapsulated at full length but not at any shorter length", file, i)
+			}
+		}
+	}
+	if counter := GetDecapsulateCounter(); counter.DecapTruncated != truncatedCount || truncatedCount == 0 {
+		t.Errorf("expect %d truncated, actual %d", truncatedCount, counter.DecapTruncated)
+	}
+
+	// 已识别出隧道类型后按截断处理, 未能判断隧道类型时为数据不足
+	vxlanPackets, _ := loadPcap("decapsulate_test.pcap")
+	genevePackets, _ := loadPcap("geneve.pcap")
+	testCases := []struct {
+		name     string
+		packet   RawPacket
+		expected error
+	}{
+		{"ip-header", vxlanPackets[2][:ETH_HEADER_SIZE+IP_HEADER_SIZE], DECAP_ERR_TOO_SHORT},
+		{"udp-header", vxlanPackets[2][:ETH_HEADER_SIZE+IP_HEADER_SIZE+UDP_HEADER_SIZE-1], DECAP_ERR_TOO_SHORT},
+		{"vxlan-header", vxlanPackets[2][:ETH_HEADER_SIZE+IP_HEADER_SIZE+UDP_HEADER_SIZE+VXLAN_HEADER_SIZE-1], DECAP_ERR_TRUNCATED},
+		{"geneve-header", genevePackets[1][:ETH_HEADER_SIZE+IP_HEADER_SIZE+UDP_HEADER_SIZE+GENEVE_HEADER_SIZE-1], DECAP_ERR_TRUNCATED},
+		{"geneve-option", genevePackets[1][:ETH_HEADER_SIZE+IP_HEADER_SIZE+UDP_HEADER_SIZE+GENEVE_HEADER_SIZE+4], DECAP_ERR_TRUNCATED},
+		{"geneve-opt-len-overrun", genevePackets[3], DECAP_ERR_OPTION_OVERRUN}, // UDP长度不足以包含选项, 不是截断
+	}
+	for _, tc := range testCases {
+		actual := &TunnelInfo{}
+		if _, err := actual.DecapsulateE(append(RawPacket{}, tc.packet...), ETH_HEADER_SIZE, AllTunnelTypes()); err != tc.expected {
+			t.Errorf("%s: expect %v, actual %v", tc.name, tc.expected, err)
+		}
+	}
+}
+
+func TestDecapsulateE(t *testing.T) {
+	all := AllTunnelTypes()
+	udpPacket := func(dstPort uint16) RawPacket {
+		packet := make(RawPacket, 128)
+		packet[ETH_HEADER_SIZE+IP_IHL_OFFSET] = 0x45
+		packet[OFFSET_IP_PROTOCOL] = byte(IPProtocolUDP)
+		BigEndian.PutUint16(packet[OFFSET_DPORT:], dstPort)
+		return packet
+	}
+	modify := func(packet RawPacket, offset int, value byte) RawPacket {
+		packet = append(RawPacket{}, packet...)
+		packet[offset] = value
+		return packet
+	}
+	vxlanPackets, _ := loadPcap("vxlan-sport.pcap")
+	erspanPackets, _ := loadPcap("erspan-types.pcap")
+	genevePackets, _ := loadPcap("geneve.pcap")
+	sttPackets, _ := loadPcap("stt.pcap")
+	ip6Packets, _ := loadPcap("ip6-vxlan.pcap")
+	icmpPacket := udpPacket(0)
+	icmpPacket[OFFSET_IP_PROTOCOL] = byte(IPProtocolICMPv4)
+	fragmentPacket := udpPacket(4789)
+	BigEndian.PutUint16(fragmentPacket[ETH_HEADER_SIZE+IP_FRAG_OFFSET:], 100)
+	testCases := []struct {
+		name     string
+		packet   RawPacket
+		ipv6     bool
+		bitmap   TunnelTypeBitmap
+		tier     uint8
+		expected error
+	}{
+		{"vxlan", vxlanPackets[2], false, all, 0, nil},
+		{"disabled", vxlanPackets[2], false, 0, 0, DECAP_ERR_DISABLED},
+		{"depth-exceeded", vxlanPackets[2], false, all, _TUNNEL_TIER_LIMIT, DECAP_ERR_DEPTH_EXCEEDED},
+		{"too-short", vxlanPackets[2][:ETH_HEADER_SIZE+IP_HEADER_SIZE], false, all, 0, DECAP_ERR_TOO_SHORT},
+		{"bad-ihl", modify(udpPacket(4789), ETH_HEADER_SIZE+IP_IHL_OFFSET, 0x44), false, all, 0, DECAP_ERR_BAD_IP_HEADER},
+		{"fragment", fragmentPacket, false, all, 0, DECAP_ERR_FRAGMENT},
+		{"icmp", icmpPacket, false, all, 0, DECAP_ERR_UNSUPPORTED_PROTOCOL},
+		{"udp-53", udpPacket(53), false, all, 0, DECAP_ERR_UNSUPPORTED_PROTOCOL},
+		{"udp-only-vxlan-disabled", udpPacket(53), false, NewTunnelTypeBitmap(TUNNEL_TYPE_GRE), 0, DECAP_ERR_DISABLED},
+		{"bad-vxlan-flags", udpPacket(4789), false, all, 0, DECAP_ERR_BAD_VXLAN_FLAGS},
+		{"bad-erspan-version", modify(erspanPackets[2], ETH_HEADER_SIZE+IP_HEADER_SIZE+GRE_HEADER_SIZE+GRE_SEQ_LEN, 0x20), false, all, 0, ErspanVersionError(2)},
+		{"geneve-option-overrun", genevePackets[2], false, all, 0, DECAP_ERR_OPTION_OVERRUN},
+		{"geneve-opt-len-overrun", modify(genevePackets[0], ETH_HEADER_SIZE+IP_HEADER_SIZE+UDP_HEADER_SIZE+GENEVE_VER_OPT_LEN_OFFSET, 0x3f), false, all, 0, DECAP_ERR_OPTION_OVERRUN},
+		{"stt-continued", sttPackets[1], false, all, 0, DECAP_ERR_FRAGMENT},
+		{"stt-bad-version", sttPackets[3], false, all, 0, DECAP_ERR_BAD_TUNNEL_HEADER},
+		{"tcp-stt-disabled", sttPackets[0], false, NewTunnelTypeBitmap(TUNNEL_TYPE_VXLAN), 0, DECAP_ERR_DISABLED},
+		{"ip6-vxlan", ip6Packets[0], true, all, 0, nil},
+		{"ip6-bad-vxlan-flags", modify(ip6Packets[0], ETH_HEADER_SIZE+IP6_HEADER_SIZE+UDP_HEADER_SIZE, 0), true, all, 0, DECAP_ERR_BAD_VXLAN_FLAGS},
+	}
+	for _, tc := range testCases {
+		var offset int
+		var err error
+		actual := &TunnelInfo{Tier: tc.tier}
+		if tc.ipv6 {
+			offset, err = actual.Decapsulate6E(append(RawPacket{}, tc.packet...), 14, tc.bitmap)
+		} else {
+			offset, err = actual.DecapsulateE(append(RawPacket{}, tc.packet...), 14, tc.bitmap)
+		}
+		if err != tc.expected {
+			t.Errorf("%s: expect %v, actual %v", tc.name, tc.expected, err)
+			continue
+		}
+		if (err == nil) != (actual.Tier == tc.tier+1) || (err != nil && offset != 0) {
+			t.Errorf("%s: error %v, offset %d, tunnel %+v", tc.name, err, offset, actual)
+		}
+		// Decapsulate与DecapsulateE的返回值必须一致
+		silent := &TunnelInfo{Tier: tc.tier}
+		silentOffset := 0
+		if tc.ipv6 {
+			silentOffset = silent.Decapsulate6(append(RawPacket{}, tc.packet...), 14, tc.bitmap)
+		} else {
+			silentOffset = silent.Decapsulate(append(RawPacket{}, tc.packet...), 14, tc.bitmap)
+		}
+		if silentOffset != offset || *silent != *actual {
+			t.Errorf("%s: Decapsulate %d %+v, DecapsulateE %d %+v", tc.name, silentOffset, silent, offset, actual)
+		}
+	}
+	if DECAP_ERR_BAD_VXLAN_FLAGS.Error() != "decapsulate: bad-vxlan-flags" || DECAP_ERR_MAX.String() != "unknown(11)" {
+		t.Errorf("unexpected error string %q %q", DECAP_ERR_BAD_VXLAN_FLAGS.Error(), DECAP_ERR_MAX.String())
+	}
+}
+
 func TestDecapsulateTencentGre(t *testing.T) {
 	bitmap := NewTunnelTypeBitmap(TUNNEL_TYPE_TENCENT_GRE)
 	expected := &TunnelInfo{
-		Src:    IPv4Int(BigEndian.Uint32(net.ParseIP("10.19.0.21").To4())),
-		Dst:    IPv4Int(BigEndian.Uint32(net.ParseIP("10.21.64.5").To4())),
-		MacSrc: 0xbffac801,
-		MacDst: 0x06246b71,
-		Id:     0x10285,
-		Type:   TUNNEL_TYPE_TENCENT_GRE,
-		Tier:   1,
+		Src:       IPv4Int(BigEndian.Uint32(net.ParseIP("10.19.0.21").To4())),
+		Dst:       IPv4Int(BigEndian.Uint32(net.ParseIP("10.21.64.5").To4())),
+		MacSrc:    0xbffac801,
+		MacDst:    0x06246b71,
+		Id:        0x10285,
+		Type:      TUNNEL_TYPE_TENCENT_GRE,
+		Tier:      1,
+		Ttl:       58,
+		IPPayload: true,
 	}
 	expectedOverlay := []byte{
 		0x00, 0x00, 0x00, 0x00, 0x02, 0x85,
@@ -218,6 +1324,7 @@ func TestDecapsulateTeb(t *testing.T) {
 		Id:     0x2000000,
 		Type:   TUNNEL_TYPE_ERSPAN_OR_TEB,
 		Tier:   1,
+		Ttl:    64,
 	}
 
 	packets, _ := loadPcap("vmware-gre-teb.pcap")
@@ -236,15 +1343,20 @@ func TestDecapsulateTeb(t *testing.T) {
 func TestDecapsulateIp6Vxlan(t *testing.T) {
 	bitmap := NewTunnelTypeBitmap(TUNNEL_TYPE_VXLAN)
 	expected := &TunnelInfo{
-		Src:    IPv4Int(BigEndian.Uint32(net.ParseIP("0.0.2.63").To4())),
-		Dst:    IPv4Int(BigEndian.Uint32(net.ParseIP("0.0.2.61").To4())),
-		MacSrc: 0x3e7eda7d,
-		MacDst: 0x3ebb1665,
-		Id:     27,
-		Type:   TUNNEL_TYPE_VXLAN,
-		Tier:   1,
-		IsIPv6: true,
+		Src:     IPv4Int(BigEndian.Uint32(net.ParseIP("0.0.2.63").To4())),
+		Dst:     IPv4Int(BigEndian.Uint32(net.ParseIP("0.0.2.61").To4())),
+		MacSrc:  0x3e7eda7d,
+		MacDst:  0x3ebb1665,
+		Id:      27,
+		Type:    TUNNEL_TYPE_VXLAN,
+		Tier:    1,
+		Ttl:     64,
+		IsIPv6:  true,
+		SrcPort: 40233,
+		DstPort: 4789,
 	}
+	copy(expected.Src6[:], net.ParseIP("2409:8086:8911:1901::23f"))
+	copy(expected.Dst6[:], net.ParseIP("2409:8086:8911:1901::23d"))
 	packets, _ := loadPcap("ip6-vxlan.pcap")
 	packet := packets[0]
 
@@ -259,15 +1371,170 @@ func TestDecapsulateIp6Vxlan(t *testing.T) {
 	}
 }
 
+func TestDecapsulateIp6Tunnel(t *testing.T) {
+	bitmap := NewTunnelTypeBitmap(TUNNEL_TYPE_VXLAN, TUNNEL_TYPE_ERSPAN_OR_TEB)
+	packets, _ := loadPcap("ip6-tunnel.pcap")
+	testCases := []struct {
+		name           string
+		packet         RawPacket
+		tunnelType     TunnelType
+		id             uint32
+		expectedOffset int
+		erspan         ErspanMeta
+	}{
+		{"erspan2", packets[0], TUNNEL_TYPE_ERSPAN_OR_TEB, 0x155, IP6_HEADER_SIZE + GRE_HEADER_SIZE + GRE_SEQ_LEN + ERSPANII_HEADER_SIZE, ErspanMeta{}},
+		{"erspan3-dest-opts", packets[1], TUNNEL_TYPE_ERSPAN_OR_TEB, 0x166, IP6_HEADER_SIZE + IP6_EXT_HEADER_MIN_SIZE + GRE_HEADER_SIZE + ERSPANIII_HEADER_SIZE, ErspanMeta{Valid: true}},
+		{"vxlan-hop-by-hop", packets[2], TUNNEL_TYPE_VXLAN, 12345, IP6_HEADER_SIZE + IP6_EXT_HEADER_MIN_SIZE + UDP_HEADER_SIZE + VXLAN_HEADER_SIZE, ErspanMeta{}},
+	}
+	for _, tc := range testCases {
+		expected := &TunnelInfo{
+			Src:    IPv4Int(BigEndian.Uint32(net.ParseIP("2001:db8::1")[12:])),
+			Dst:    IPv4Int(BigEndian.Uint32(net.ParseIP("2001:db8::2")[12:])),
+			MacSrc: 0x73000002,
+			MacDst: 0x73000001,
+			Id:     tc.id,
+			Type:   tc.tunnelType,
+			Tier:   1,
+			Ttl:    64,
+			Erspan: tc.erspan,
+			IsIPv6: true,
+		}
+		copy(expected.Src6[:], net.ParseIP("2001:db8::1"))
+		copy(expected.Dst6[:], net.ParseIP("2001:db8::2"))
+		if tc.tunnelType == TUNNEL_TYPE_VXLAN {
+			expected.SrcPort, expected.DstPort = 50000, 4789
+		}
+
+		l2Len := 14
+		actual := &TunnelInfo{}
+		offset := actual.Decapsulate6(tc.packet, l2Len, bitmap)
+		if !reflect.DeepEqual(expected, actual) || offset != tc.expectedOffset ||
+			EthernetType(BigEndian.Uint16(tc.packet[l2Len+offset+OFFSET_ETH_TYPE:])) != EthernetTypeIPv4 {
+			t.Errorf("%s: \n\ttunnel: %+v\n\tactual: %+v\n\toffset: %v\n\tactual: %v\n",
+				tc.name, expected, actual, tc.expectedOffset, offset)
+		}
+	}
+}
+
+func TestDecapsulateIp6Erspan(t *testing.T) {
+	bitmap := NewTunnelTypeBitmap(TUNNEL_TYPE_ERSPAN_OR_TEB)
+	packets, _ := loadPcap("ip6-erspan.pcap")
+	testCases := []struct {
+		name           string
+		packet         RawPacket
+		id             uint32
+		expectedOffset int
+		erspan         ErspanMeta
+	}{
+		{"erspan2", packets[0], 42, IP6_HEADER_SIZE + GRE_HEADER_SIZE + GRE_SEQ_LEN + ERSPANII_HEADER_SIZE, ErspanMeta{}},
+		{"erspan3", packets[1], 43, IP6_HEADER_SIZE + GRE_HEADER_SIZE + GRE_SEQ_LEN + ERSPANIII_HEADER_SIZE + ERSPANIII_SUBHEADER_SIZE,
+			ErspanMeta{Valid: true, Vlan: 10, HardwareId: 3, Egress: true, Subheader: true, Timestamp: 0x11223344}},
+	}
+	for _, tc := range testCases {
+		expected := &TunnelInfo{
+			Src:    IPv4Int(BigEndian.Uint32(net.ParseIP("2001:db8:10::1")[12:])),
+			Dst:    IPv4Int(BigEndian.Uint32(net.ParseIP("2001:db8:20::1")[12:])),
+			MacSrc: 0xfb000002,
+			MacDst: 0xfb000001,
+			Id:     tc.id,
+			Type:   TUNNEL_TYPE_ERSPAN_OR_TEB,
+			Tier:   1,
+			Ttl:    62,
+			Erspan: tc.erspan,
+			IsIPv6: true,
+		}
+		copy(expected.Src6[:], net.ParseIP("2001:db8:10::1"))
+		copy(expected.Dst6[:], net.ParseIP("2001:db8:20::1"))
+
+		l2Len := 14
+		actual := &TunnelInfo{}
+		offset := actual.Decapsulate6(tc.packet, l2Len, bitmap)
+		if !reflect.DeepEqual(expected, actual) || offset != tc.expectedOffset ||
+			EthernetType(BigEndian.Uint16(tc.packet[l2Len+offset+OFFSET_ETH_TYPE:])) != EthernetTypeIPv4 {
+			t.Errorf("%s: \n\ttunnel: %+v\n\tactual: %+v\n\toffset: %v\n\tactual: %v\n",
+				tc.name, expected, actual, tc.expectedOffset, offset)
+		}
+	}
+}
+
+func TestTunnelInfoReset(t *testing.T) {
+	// 新增字段时Reset同样需要清除
+	info := TunnelInfo{}
+	mutateEachField(reflect.ValueOf(&info).Elem(), "TunnelInfo", func(path string) {
+		reset := info
+		reset.Reset()
+		if reset != (TunnelInfo{}) {
+			t.Errorf("%s: not cleared by Reset, actual %+v", path, reset)
+		}
+	})
+
+	// 任意长度截断的报文解析失败时, 除Fragment外不能留下部分填写的字段
+	files, _ := filepath.Glob("*.pcap")
+	for _, file := range files {
+		packets, _ := loadPcap(file)
+		for i, packet := range packets {
+			for size := ETH_HEADER_SIZE; size <= len(packet); size++ {
+				for _, ipv6 := range []bool{false, true} {
+					actual := &TunnelInfo{}
+					truncated := append(RawPacket{}, packet[:size]...)
+					if ipv6 {
+						actual.Decapsulate6(truncated, ETH_HEADER_SIZE, AllTunnelTypes())
+					} else {
+						actual.Decapsulate(truncated, ETH_HEADER_SIZE, AllTunnelTypes())
+					}
+					if actual.Tier == 0 && *actual != (TunnelInfo{Fragment: actual.Fragment}) {
+						t.Errorf("%s[%d] truncated to %d: partial tunnel info %+v", file, i, size, actual)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestDecapsulateTtlTos(t *testing.T) {
+	ip6Packets, _ := loadPcap("ip6-vxlan.pcap")
+	ip6Packet := append(RawPacket{}, ip6Packets[0]...)
+	// Traffic Class 0xb8(DSCP EF), Hop Limit 3
+	ip6Packet[ETH_HEADER_SIZE] = 0x6b
+	ip6Packet[ETH_HEADER_SIZE+1] = ip6Packet[ETH_HEADER_SIZE+1]&0xf | 0x80
+	ip6Packet[ETH_HEADER_SIZE+IP6_HOP_LIMIT_OFFSET] = 3
+
+	actual := &TunnelInfo{}
+	actual.Decapsulate6(ip6Packet, 14, NewTunnelTypeBitmap(TUNNEL_TYPE_VXLAN))
+	if actual.Ttl != 3 || actual.Tos != 0xb8 {
+		t.Errorf("unexpected ipv6 underlay ttl/tos: %+v", actual)
+	}
+
+	// 复用TunnelInfo时, 非隧道报文不能残留上一个报文的TTL和TOS
+	actual.Reset()
+	tcpPacket := make([]byte, 128)
+	tcpPacket[ETH_HEADER_SIZE] = 0x45
+	tcpPacket[ETH_HEADER_SIZE+IP_TOS_OFFSET] = 0x28
+	tcpPacket[ETH_HEADER_SIZE+IP_TTL_OFFSET] = 64
+	tcpPacket[OFFSET_IP_PROTOCOL] = byte(IPProtocolTCP)
+	if actual.Decapsulate(tcpPacket, 14, NewTunnelTypeBitmap(TUNNEL_TYPE_VXLAN)); *actual != (TunnelInfo{}) {
+		t.Errorf("tunnel info should be reset, actual: %+v", actual)
+	}
+
+	packets, _ := loadPcap("ipip.pcap")
+	actual.Decapsulate(packets[0], 18, NewTunnelTypeBitmap(TUNNEL_TYPE_IPIP))
+	if actual.Ttl != 26 || actual.Tos>>2 != 36 { // DSCP AF42
+		t.Errorf("unexpected ipv4 underlay ttl/tos: %+v", actual)
+	}
+}
+
 func TestDecapsulateIpIp(t *testing.T) {
 	bitmap := NewTunnelTypeBitmap(TUNNEL_TYPE_IPIP)
 	expected := &TunnelInfo{
-		Src:    IPv4Int(BigEndian.Uint32(net.ParseIP("10.162.42.93").To4())),
-		Dst:    IPv4Int(BigEndian.Uint32(net.ParseIP("10.162.33.164").To4())),
-		MacSrc: 0x027dc643,
-		MacDst: 0x0027e67d,
-		Type:   TUNNEL_TYPE_IPIP,
-		Tier:   1,
+		Src:       IPv4Int(BigEndian.Uint32(net.ParseIP("10.162.42.93").To4())),
+		Dst:       IPv4Int(BigEndian.Uint32(net.ParseIP("10.162.33.164").To4())),
+		MacSrc:    0x027dc643,
+		MacDst:    0x0027e67d,
+		Type:      TUNNEL_TYPE_IPIP,
+		Tier:      1,
+		Ttl:       26,
+		Tos:       144,
+		IPPayload: true,
 	}
 	packets, _ := loadPcap("ipip.pcap")
 	packet := packets[0]
@@ -284,6 +1551,548 @@ func TestDecapsulateIpIp(t *testing.T) {
 	}
 }
 
+func TestDecapsulateIpIpProtocols(t *testing.T) {
+	bitmap := NewTunnelTypeBitmap(TUNNEL_TYPE_IPIP)
+	expected := &TunnelInfo{
+		Src:       IPv4Int(BigEndian.Uint32(net.ParseIP("10.60.0.1").To4())),
+		Dst:       IPv4Int(BigEndian.Uint32(net.ParseIP("10.60.0.2").To4())),
+		MacSrc:    0x3e000002,
+		MacDst:    0x3e000001,
+		Type:      TUNNEL_TYPE_IPIP,
+		Tier:      1,
+		Ttl:       64,
+		IPPayload: true,
+	}
+	packets, _ := loadPcap("ipip-6in4.pcap")
+	testCases := []struct {
+		name         string
+		packet       RawPacket
+		valid        bool
+		overlayProto EthernetType
+		ipVersion    byte
+	}{
+		{"ipip", packets[0], true, EthernetTypeIPv4, 4},
+		{"6in4", packets[1], true, EthernetTypeIPv6, 6},
+		{"truncated", packets[2], false, 0, 0},
+		{"lookalike", packets[3], false, 0, 0},
+	}
+	for _, tc := range testCases {
+		l2Len := 14
+		actual := &TunnelInfo{}
+		offset := actual.Decapsulate(tc.packet, l2Len, bitmap)
+		if !tc.valid {
+			if offset != 0 || *actual != (TunnelInfo{}) {
+				t.Errorf("%s: expect no tunnel, actual: %+v, offset %d", tc.name, actual, offset)
+			}
+			continue
+		}
+		// 内层IP头前放置了外层L2头
+		expectedOffset := IP_HEADER_SIZE - l2Len
+		overlay := tc.packet[l2Len+expectedOffset:]
+		if !reflect.DeepEqual(expected, actual) || offset != expectedOffset ||
+			EthernetType(BigEndian.Uint16(overlay[OFFSET_ETH_TYPE:])) != tc.overlayProto || overlay[ETH_HEADER_SIZE]>>4 != tc.ipVersion {
+			t.Errorf("%s: \n\ttunnel: %+v\n\tactual: %+v\n\toffset: %v\n\tactual: %v\n\toverlay: %x",
+				tc.name, expected, actual, expectedOffset, offset, overlay)
+		}
+	}
+}
+
+func TestDecapsulatePlainGre(t *testing.T) {
+	bitmap := NewTunnelTypeBitmap(TUNNEL_TYPE_GRE)
+	expected := &TunnelInfo{
+		Src:       IPv4Int(BigEndian.Uint32(net.ParseIP("10.10.0.1").To4())),
+		Dst:       IPv4Int(BigEndian.Uint32(net.ParseIP("10.10.0.2").To4())),
+		MacSrc:    0x3eabcdef,
+		MacDst:    0x3e123456,
+		Type:      TUNNEL_TYPE_GRE,
+		Tier:      1,
+		Ttl:       64,
+		IPPayload: true,
+	}
+	packets, _ := loadPcap("gre.pcap")
+	testCases := []struct {
+		name         string
+		packet       RawPacket
+		id           uint32
+		greSize      int
+		overlayProto EthernetType
+		ipVersion    byte
+	}{
+		{"key", packets[0], 0x12345, GRE_HEADER_SIZE + GRE_KEY_LEN, EthernetTypeIPv4, 4},
+		{"csum-key-seq", packets[1], 0x10001, GRE_HEADER_SIZE + GRE_CSUM_LEN + GRE_KEY_LEN + GRE_SEQ_LEN, EthernetTypeIPv4, 4},
+		{"minimal", packets[2], 0, GRE_HEADER_SIZE, EthernetTypeIPv6, 6},
+	}
+	for _, tc := range testCases {
+		l2Len := 14
+		expected.Id = tc.id
+		actual := &TunnelInfo{}
+		offset := actual.Decapsulate(tc.packet, l2Len, bitmap)
+		expectedOffset := IP_HEADER_SIZE + tc.greSize - l2Len
+		overlay := tc.packet[l2Len+expectedOffset:]
+		if !reflect.DeepEqual(expected, actual) || offset != expectedOffset ||
+			EthernetType(BigEndian.Uint16(overlay[OFFSET_ETH_TYPE:])) != tc.overlayProto || overlay[ETH_HEADER_SIZE]>>4 != tc.ipVersion {
+			t.Errorf("%s: \n\ttunnel: %+v\n\tactual: %+v\n\toffset: %v\n\tactual: %v\n\toverlay: %x",
+				tc.name, expected, actual, expectedOffset, offset, overlay)
+		}
+	}
+
+	// 同时开启腾讯GRE时, 没有Key的报文按标准GRE解析
+	packets, _ = loadPcap("gre.pcap")
+	actual := &TunnelInfo{}
+	actual.Decapsulate(packets[2], 14, NewTunnelTypeBitmap(TUNNEL_TYPE_TENCENT_GRE, TUNNEL_TYPE_GRE))
+	if actual.Type != TUNNEL_TYPE_GRE || actual.Id != 0 {
+		t.Errorf("expect plain GRE without key, actual: %+v", actual)
+	}
+}
+
+// 构造外层为IPv4的GRE报文, 可选字段依次为Checksum, Key和Sequence
+func buildGrePacket(flags, protocol uint16, key uint32, payload []byte) []byte {
+	packet := make([]byte, ETH_HEADER_SIZE+IP_HEADER_SIZE, 128)
+	BigEndian.PutUint16(packet[OFFSET_ETH_TYPE:], uint16(EthernetTypeIPv4))
+	packet[ETH_HEADER_SIZE] = 0x45
+	packet[ETH_HEADER_SIZE+IP_TTL_OFFSET] = 64
+	packet[OFFSET_IP_PROTOCOL] = byte(IPProtocolGRE)
+	packet = append(packet, byte(flags>>8), byte(flags), byte(protocol>>8), byte(protocol))
+	if flags&GRE_FLAGS_CSUM_MASK != 0 {
+		packet = append(packet, 0xde, 0xad, 0, 0)
+	}
+	if flags&GRE_FLAGS_KEY_MASK != 0 {
+		packet = append(packet, byte(key>>24), byte(key>>16), byte(key>>8), byte(key))
+	}
+	if flags&GRE_FLAGS_SEQ_MASK != 0 {
+		packet = append(packet, 0xff, 0xff, 0xff, 0xff)
+	}
+	packet = append(packet, payload...)
+	return append(packet, make([]byte, cap(packet)-len(packet))...)
+}
+
+func TestGreOptionalFields(t *testing.T) {
+	innerIp := make([]byte, IP_HEADER_SIZE)
+	innerIp[0] = 0x45
+	innerEth := make([]byte, ETH_HEADER_SIZE, ETH_HEADER_SIZE+IP_HEADER_SIZE)
+	BigEndian.PutUint16(innerEth[OFFSET_ETH_TYPE:], uint16(EthernetTypeIPv4))
+	innerEth = append(innerEth, innerIp...)
+	erspan2 := append([]byte{0x10, 0, 0x01, 0x55, 0, 0, 0, 0}, innerEth...)
+	erspan3 := append([]byte{0x20, 0, 0x01, 0x55, 0, 0, 0, 0, 0, 0, 0, 0}, innerEth...)
+
+	const key = 0x12345678
+	testCases := []struct {
+		name       string
+		protocol   uint16
+		payload    []byte
+		bitmap     TunnelTypeBitmap
+		tunnelType TunnelType
+		needKey    bool
+		id         func(flags uint16) uint32
+		size       func(greSize int) int // 从L3开始的内层L2头偏移
+	}{
+		{"erspan", uint16(EthernetTypeERSPAN), erspan2, NewTunnelTypeBitmap(TUNNEL_TYPE_ERSPAN_OR_TEB), TUNNEL_TYPE_ERSPAN_OR_TEB, false,
+			func(flags uint16) uint32 {
+				if flags&GRE_FLAGS_SEQ_MASK == 0 { // 没有Sequence时为ERSPAN I
+					return 0
+				}
+				return 0x155
+			},
+			nil},
+		{"erspan3", 0x22eb, erspan3, NewTunnelTypeBitmap(TUNNEL_TYPE_ERSPAN_OR_TEB), TUNNEL_TYPE_ERSPAN_OR_TEB, false,
+			func(uint16) uint32 { return 0x155 },
+			func(greSize int) int { return IP_HEADER_SIZE + greSize + ERSPANIII_HEADER_SIZE }},
+		{"plain-gre", uint16(EthernetTypeIPv4), innerIp, NewTunnelTypeBitmap(TUNNEL_TYPE_GRE), TUNNEL_TYPE_GRE, false,
+			func(flags uint16) uint32 {
+				if flags&GRE_FLAGS_KEY_MASK == 0 {
+					return 0
+				}
+				return key
+			},
+			func(greSize int) int { return IP_HEADER_SIZE + greSize - ETH_HEADER_SIZE }},
+		{"tencent-gre", uint16(EthernetTypeIPv4), innerIp, NewTunnelTypeBitmap(TUNNEL_TYPE_TENCENT_GRE), TUNNEL_TYPE_TENCENT_GRE, true,
+			func(uint16) uint32 { return key },
+			func(greSize int) int { return IP_HEADER_SIZE + greSize - ETH_HEADER_SIZE }},
+		{"teb", uint16(EthernetTypeTransparentEthernetBridging), innerEth, NewTunnelTypeBitmap(TUNNEL_TYPE_ERSPAN_OR_TEB), TUNNEL_TYPE_ERSPAN_OR_TEB, true,
+			func(uint16) uint32 { return key },
+			func(greSize int) int { return IP_HEADER_SIZE + greSize }},
+		{"nvgre", uint16(EthernetTypeTransparentEthernetBridging), innerEth, NewTunnelTypeBitmap(TUNNEL_TYPE_NVGRE), TUNNEL_TYPE_NVGRE, true,
+			func(uint16) uint32 { return key >> 8 },
+			func(greSize int) int { return IP_HEADER_SIZE + greSize }},
+	}
+	for _, tc := range testCases {
+		for i := 0; i < 8; i++ {
+			flags := uint16(0)
+			if i&1 != 0 {
+				flags |= GRE_FLAGS_CSUM_MASK
+			}
+			if i&2 != 0 {
+				flags |= GRE_FLAGS_KEY_MASK
+			}
+			if i&4 != 0 {
+				flags |= GRE_FLAGS_SEQ_MASK
+			}
+			greSize := GRE_HEADER_SIZE + bits.OnesCount(uint(i))*4
+			payload := tc.payload
+			if tc.protocol == uint16(EthernetTypeERSPAN) && flags&GRE_FLAGS_SEQ_MASK == 0 {
+				// ERSPAN I没有ERSPAN头, GRE头后直接是镜像的以太网帧
+				payload = innerEth
+			}
+			packet := buildGrePacket(flags, tc.protocol, key, payload)
+
+			l2Len := 14
+			actual := &TunnelInfo{}
+			offset := actual.Decapsulate(packet, l2Len, tc.bitmap)
+			if tc.needKey && flags&GRE_FLAGS_KEY_MASK == 0 {
+				if offset != 0 || actual.Valid() {
+					t.Errorf("%s flags %04x: expect no tunnel without key, actual: %+v", tc.name, flags, actual)
+				}
+				continue
+			}
+			expectedOffset := 0
+			if tc.size != nil {
+				expectedOffset = tc.size(greSize)
+			} else if flags&GRE_FLAGS_SEQ_MASK == 0 {
+				expectedOffset = IP_HEADER_SIZE + greSize + ERSPANI_HEADER_SIZE
+			} else {
+				expectedOffset = IP_HEADER_SIZE + greSize + ERSPANII_HEADER_SIZE
+			}
+			if actual.Type != tc.tunnelType || actual.Id != tc.id(flags) || offset != expectedOffset ||
+				EthernetType(BigEndian.Uint16(packet[l2Len+offset+OFFSET_ETH_TYPE:])) != EthernetTypeIPv4 ||
+				packet[l2Len+offset+ETH_HEADER_SIZE] != 0x45 {
+				t.Errorf("%s flags %04x: expect %s id %x offset %d, actual: %+v, offset %d",
+					tc.name, flags, tc.tunnelType, tc.id(flags), expectedOffset, actual, offset)
+			}
+		}
+	}
+}
+
+func TestDecapsulateNvgre(t *testing.T) {
+	// NVGRE与VMware的TEB无法区分, 需关闭ERSPAN_OR_TEB才按NVGRE解析
+	bitmap := NewTunnelTypeBitmap(TUNNEL_TYPE_NVGRE)
+	expected := &TunnelInfo{
+		Src:    IPv4Int(BigEndian.Uint32(net.ParseIP("10.20.0.1").To4())),
+		Dst:    IPv4Int(BigEndian.Uint32(net.ParseIP("10.20.0.2").To4())),
+		MacSrc: 0x5d0a0b0c,
+		MacDst: 0x5d010203,
+		Id:     0x5001,
+		Type:   TUNNEL_TYPE_NVGRE,
+		Tier:   1,
+		Ttl:    64,
+	}
+
+	// 第二个报文的FlowID不为0
+	packets, _ := loadPcap("nvgre.pcap")
+	for i, packet := range packets {
+		l2Len := 14
+		actual := &TunnelInfo{}
+		offset := actual.Decapsulate(packet, l2Len, bitmap)
+		expectedOffset := IP_HEADER_SIZE + GRE_HEADER_SIZE + GRE_KEY_LEN
+		if !reflect.DeepEqual(expected, actual) || offset != expectedOffset ||
+			EthernetType(BigEndian.Uint16(packet[l2Len+offset+OFFSET_ETH_TYPE:])) != EthernetTypeIPv4 {
+			t.Errorf("expectedNvgre %d: %+v\n actual: %+v, expectedOffset:%v, offset:%v",
+				i, expected, actual, expectedOffset, offset)
+		}
+	}
+
+	// 同时开启时保持原有的TEB解析, 隧道ID为完整的Key
+	bitmap.Add(TUNNEL_TYPE_ERSPAN_OR_TEB)
+	for i, packet := range packets {
+		actual := &TunnelInfo{}
+		actual.Decapsulate(packet, 14, bitmap)
+		key := BigEndian.Uint32(packet[14+IP_HEADER_SIZE+GRE_HEADER_SIZE:])
+		if actual.Type != TUNNEL_TYPE_ERSPAN_OR_TEB || actual.Id != key {
+			t.Errorf("expectedTeb %d: id %d, actual: %+v", i, key, actual)
+		}
+	}
+
+	// ERSPAN同样基于GRE, 开启NVGRE后不受影响
+	packets, _ = loadPcap("decapsulate_erspan1.pcap")
+	actual := &TunnelInfo{}
+	actual.Decapsulate(packets[0], 18, bitmap)
+	if actual.Type != TUNNEL_TYPE_ERSPAN_OR_TEB {
+		t.Errorf("expect ERSPAN, actual: %+v", actual)
+	}
+}
+
+func TestDecapsulateGeneve(t *testing.T) {
+	bitmap := NewTunnelTypeBitmap(TUNNEL_TYPE_VXLAN, TUNNEL_TYPE_GENEVE)
+	expected := &TunnelInfo{
+		Src:     IPv4Int(BigEndian.Uint32(net.ParseIP("10.30.0.1").To4())),
+		Dst:     IPv4Int(BigEndian.Uint32(net.ParseIP("10.30.0.2").To4())),
+		MacSrc:  0x3e445566,
+		MacDst:  0x3e112233,
+		Id:      0x123,
+		Type:    TUNNEL_TYPE_GENEVE,
+		Tier:    1,
+		Ttl:     64,
+		SrcPort: 50000,
+		DstPort: 6081,
+	}
+	packets, _ := loadPcap("geneve.pcap")
+	testCases := []struct {
+		name           string
+		packet         RawPacket
+		expectedOffset int
+	}{
+		{"no-option", packets[0], IP_HEADER_SIZE + UDP_HEADER_SIZE + GENEVE_HEADER_SIZE},
+		{"two-options", packets[1], IP_HEADER_SIZE + UDP_HEADER_SIZE + GENEVE_HEADER_SIZE + 20},
+		{"option-overflow", packets[2], 0},
+		{"opt-len-overflow", packets[3], 0},
+	}
+	for _, tc := range testCases {
+		l2Len := 14
+		actual := &TunnelInfo{}
+		offset := actual.Decapsulate(tc.packet, l2Len, bitmap)
+		if offset != tc.expectedOffset {
+			t.Errorf("%s: expectedOffset:%v, offset:%v", tc.name, tc.expectedOffset, offset)
+			continue
+		}
+		if offset == 0 {
+			if actual.Valid() {
+				t.Errorf("%s: malformed geneve should not be decapsulated, actual: %+v", tc.name, actual)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(expected, actual) ||
+			EthernetType(BigEndian.Uint16(tc.packet[l2Len+offset+OFFSET_ETH_TYPE:])) != EthernetTypeIPv4 {
+			t.Errorf("%s: \n\ttunnel: %+v\n\tactual: %+v", tc.name, expected, actual)
+		}
+	}
+}
+
+func TestDecapsulateVxlanGpe(t *testing.T) {
+	bitmap := NewTunnelTypeBitmap(TUNNEL_TYPE_VXLAN, TUNNEL_TYPE_VXLAN_GPE)
+	expected := &TunnelInfo{
+		Src:     IPv4Int(BigEndian.Uint32(net.ParseIP("10.40.0.1").To4())),
+		Dst:     IPv4Int(BigEndian.Uint32(net.ParseIP("10.40.0.2").To4())),
+		MacSrc:  0x21000002,
+		MacDst:  0x21000001,
+		Id:      0x2a,
+		Type:    TUNNEL_TYPE_VXLAN_GPE,
+		Tier:    1,
+		Ttl:     64,
+		SrcPort: 50000,
+		DstPort: 4790,
+	}
+	packets, _ := loadPcap("vxlan-gpe.pcap")
+	gpeSize := IP_HEADER_SIZE + UDP_HEADER_SIZE + VXLAN_HEADER_SIZE
+	testCases := []struct {
+		name           string
+		packet         RawPacket
+		expectedOffset int
+		overlayProto   EthernetType
+	}{
+		{"ethernet", packets[0], gpeSize, EthernetTypeIPv4},
+		{"ipv4", packets[1], gpeSize - ETH_HEADER_SIZE, EthernetTypeIPv4},
+		{"ipv6", packets[2], gpeSize - ETH_HEADER_SIZE, EthernetTypeIPv6},
+		{"nsh", packets[3], 0, 0},
+	}
+	for _, tc := range testCases {
+		l2Len := 14
+		// 内层为IP时偏移指向移入的外层L2头
+		expected.IPPayload = tc.expectedOffset == gpeSize-ETH_HEADER_SIZE
+		actual := &TunnelInfo{}
+		offset := actual.Decapsulate(tc.packet, l2Len, bitmap)
+		if offset != tc.expectedOffset {
+			t.Errorf("%s: expectedOffset:%v, offset:%v", tc.name, tc.expectedOffset, offset)
+			continue
+		}
+		if tc.expectedOffset == 0 {
+			if actual.Valid() {
+				t.Errorf("%s: unknown next protocol should not be decapsulated, actual: %+v", tc.name, actual)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(expected, actual) ||
+			EthernetType(BigEndian.Uint16(tc.packet[l2Len+offset+OFFSET_ETH_TYPE:])) != tc.overlayProto {
+			t.Errorf("%s: \n\ttunnel: %+v\n\tactual: %+v\n\toverlay: %x", tc.name, expected, actual, tc.packet[l2Len+offset:])
+		}
+	}
+}
+
+func TestDecapsulateStt(t *testing.T) {
+	bitmap := NewTunnelTypeBitmap(TUNNEL_TYPE_VXLAN, TUNNEL_TYPE_STT)
+	expected := &TunnelInfo{
+		Src:       IPv4Int(BigEndian.Uint32(net.ParseIP("10.50.0.1").To4())),
+		Dst:       IPv4Int(BigEndian.Uint32(net.ParseIP("10.50.0.2").To4())),
+		MacSrc:    0x56000002,
+		MacDst:    0x56000001,
+		Id:        0x1234,
+		Type:      TUNNEL_TYPE_STT,
+		Tier:      1,
+		Ttl:       64,
+		ContextId: 0x100001234,
+	}
+	expected6 := *expected
+	expected6.Src, expected6.Dst, expected6.IsIPv6 = 1, 2, true
+	copy(expected6.Src6[:], net.ParseIP("2001:db8:50::1"))
+	copy(expected6.Dst6[:], net.ParseIP("2001:db8:50::2"))
+	packets, _ := loadPcap("stt.pcap")
+	sttSize := MIN_TCP_HEADER_SIZE + STT_HEADER_SIZE
+	GetDecapsulateCounter()
+	testCases := []struct {
+		name           string
+		packet         RawPacket
+		ipv6           bool
+		expected       *TunnelInfo
+		expectedOffset int
+	}{
+		{"first-segment", packets[0], false, expected, IP_HEADER_SIZE + sttSize},
+		{"continued-segment", packets[1], false, &TunnelInfo{Fragment: true}, 0},
+		{"ipv6-underlay", packets[2], true, &expected6, IP6_HEADER_SIZE + sttSize},
+		{"unknown-version", packets[3], false, &TunnelInfo{}, 0},
+	}
+	for _, tc := range testCases {
+		actual := &TunnelInfo{}
+		offset := 0
+		if tc.ipv6 {
+			offset = actual.Decapsulate6(tc.packet, 14, bitmap)
+		} else {
+			offset = actual.Decapsulate(tc.packet, 14, bitmap)
+		}
+		if offset != tc.expectedOffset || !reflect.DeepEqual(tc.expected, actual) {
+			t.Errorf("%s: expected offset %d, actual %d\n\ttunnel: %+v\n\tactual: %+v", tc.name, tc.expectedOffset, offset, tc.expected, actual)
+			continue
+		}
+		if offset != 0 && EthernetType(BigEndian.Uint16(tc.packet[14+offset+OFFSET_ETH_TYPE:])) != EthernetTypeIPv4 {
+			t.Errorf("%s: unexpected overlay %x", tc.name, tc.packet[14+offset:])
+		}
+	}
+	if counter := GetDecapsulateCounter(); counter.DecapSttContinued != 1 || counter.DecapFragmented != 0 {
+		t.Errorf("expect 1 continued STT segment, found %+v", counter)
+	}
+
+	// 未开启STT时按普通TCP处理
+	actual := &TunnelInfo{}
+	if offset := actual.Decapsulate(packets[0], 14, NewTunnelTypeBitmap(TUNNEL_TYPE_VXLAN)); offset != 0 || actual.Valid() {
+		t.Errorf("STT should not be decapsulated when disabled, actual: %+v", actual)
+	}
+}
+
+func TestDecapsulateCapwap(t *testing.T) {
+	bitmap := NewTunnelTypeBitmap(TUNNEL_TYPE_VXLAN, TUNNEL_TYPE_GENEVE, TUNNEL_TYPE_CAPWAP)
+	expected := &TunnelInfo{
+		Src:    IPv4Int(BigEndian.Uint32(net.ParseIP("10.70.0.1").To4())),
+		Dst:    IPv4Int(BigEndian.Uint32(net.ParseIP("10.70.0.2").To4())),
+		MacSrc: 0x1e000002,
+		MacDst: 0x1e000001,
+		Type:   TUNNEL_TYPE_CAPWAP,
+		Tier:   1,
+		Ttl:    64,
+	}
+	packets, _ := loadPcap("capwap.pcap")
+	udpSize := IP_HEADER_SIZE + UDP_HEADER_SIZE
+	testCases := []struct {
+		name           string
+		packet         RawPacket
+		expectedOffset int
+		err            error
+		srcPort        uint16
+		dstPort        uint16
+	}{
+		{"802.3", packets[0], udpSize + CAPWAP_HEADER_MIN_SIZE, nil, 50000, 5247},
+		{"src-port-radio-mac", packets[1], udpSize + CAPWAP_HEADER_MIN_SIZE + 8, nil, 5247, 50000},
+		{"radio-mac-wireless-info", packets[2], udpSize + CAPWAP_HEADER_MIN_SIZE + 16, nil, 50000, 5247},
+		{"keepalive", packets[3], 0, DECAP_ERR_UNSUPPORTED_PROTOCOL, 0, 0},
+		{"control", packets[4], 0, DECAP_ERR_UNSUPPORTED_PROTOCOL, 0, 0},
+		{"dtls", packets[5], 0, DECAP_ERR_UNSUPPORTED_PROTOCOL, 0, 0},
+		{"native-802.11", packets[6], 0, DECAP_ERR_UNSUPPORTED_PROTOCOL, 0, 0},
+		{"fragment", packets[7], 0, DECAP_ERR_FRAGMENT, 0, 0},
+		{"radio-mac-overrun", packets[8], 0, DECAP_ERR_OPTION_OVERRUN, 0, 0},
+	}
+	for _, tc := range testCases {
+		l2Len := 14
+		expected.SrcPort, expected.DstPort = tc.srcPort, tc.dstPort
+		actual := &TunnelInfo{}
+		offset, err := actual.DecapsulateE(tc.packet, l2Len, bitmap)
+		if offset != tc.expectedOffset || err != tc.err {
+			t.Errorf("%s: expect offset %d err %v, actual %d %v", tc.name, tc.expectedOffset, tc.err, offset, err)
+			continue
+		}
+		if offset == 0 {
+			if actual.Valid() || actual.Fragment != (tc.err == DECAP_ERR_FRAGMENT) {
+				t.Errorf("%s: should not be decapsulated, actual: %+v", tc.name, actual)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(expected, actual) ||
+			EthernetType(BigEndian.Uint16(tc.packet[l2Len+offset+OFFSET_ETH_TYPE:])) != EthernetTypeIPv4 {
+			t.Errorf("%s: \n\ttunnel: %+v\n\tactual: %+v\n\toverlay: %x", tc.name, expected, actual, tc.packet[l2Len+offset:])
+		}
+	}
+
+	actual := &TunnelInfo{}
+	offset := actual.Decapsulate6(packets[9], 14, bitmap)
+	if offset != IP6_HEADER_SIZE+UDP_HEADER_SIZE+CAPWAP_HEADER_MIN_SIZE+8 || actual.Type != TUNNEL_TYPE_CAPWAP || !actual.IsIPv6 ||
+		EthernetType(BigEndian.Uint16(packets[9][14+offset+OFFSET_ETH_TYPE:])) != EthernetTypeIPv4 {
+		t.Errorf("ipv6: unexpected offset %d, tunnel %+v", offset, actual)
+	}
+}
+
+func TestDecapsulateGtpu(t *testing.T) {
+	bitmap := NewTunnelTypeBitmap(TUNNEL_TYPE_VXLAN, TUNNEL_TYPE_CAPWAP, TUNNEL_TYPE_GTPU)
+	packets, _ := loadPcap("gtpu.pcap")
+	udpSize := IP_HEADER_SIZE + UDP_HEADER_SIZE
+	testCases := []struct {
+		name           string
+		packet         RawPacket
+		expectedOffset int
+		err            error
+		teid           uint32
+		overlay        EthernetType
+	}{
+		// 负载为IP报文, L2头移到内层IP头之前
+		{"g-pdu", packets[0], udpSize + GTPU_HEADER_SIZE - ETH_HEADER_SIZE, nil, 0x1234, EthernetTypeIPv4},
+		{"sequence", packets[1], udpSize + GTPU_HEADER_SIZE + GTPU_OPTIONAL_SIZE - ETH_HEADER_SIZE, nil, 0x1235, EthernetTypeIPv4},
+		{"pdu-session-container", packets[2], udpSize + GTPU_HEADER_SIZE + GTPU_OPTIONAL_SIZE + 4 - ETH_HEADER_SIZE, nil, 0x1236, EthernetTypeIPv6},
+		{"echo-request", packets[3], 0, DECAP_ERR_UNSUPPORTED_PROTOCOL, 0, 0},
+		{"gtp-prime", packets[4], 0, DECAP_ERR_BAD_TUNNEL_HEADER, 0, 0},
+		{"extension-overrun", packets[5], 0, DECAP_ERR_OPTION_OVERRUN, 0, 0},
+		{"not-ip", packets[7], 0, DECAP_ERR_UNSUPPORTED_PROTOCOL, 0, 0},
+	}
+	for _, tc := range testCases {
+		l2Len := 14
+		packet := append(RawPacket{}, tc.packet...)
+		actual := &TunnelInfo{}
+		offset, err := actual.DecapsulateE(packet, l2Len, bitmap)
+		if offset != tc.expectedOffset || err != tc.err {
+			t.Errorf("%s: expect offset %d err %v, actual %d %v", tc.name, tc.expectedOffset, tc.err, offset, err)
+			continue
+		}
+		if offset == 0 {
+			if actual.Valid() {
+				t.Errorf("%s: should not be decapsulated, actual: %+v", tc.name, actual)
+			}
+			continue
+		}
+		if actual.Type != TUNNEL_TYPE_GTPU || actual.Id != tc.teid || !actual.IPPayload ||
+			actual.SrcPort != 2152 || actual.DstPort != 2152 ||
+			EthernetType(BigEndian.Uint16(packet[l2Len+offset+OFFSET_ETH_TYPE:])) != tc.overlay {
+			t.Errorf("%s: unexpected tunnel %+v, overlay %x", tc.name, actual, packet[l2Len+offset:])
+		}
+	}
+
+	// 关闭GTP-U或端口不是GTP-U时按普通UDP处理
+	actual := &TunnelInfo{}
+	if offset := actual.Decapsulate(append(RawPacket{}, packets[0]...), 14, NewTunnelTypeBitmap(TUNNEL_TYPE_VXLAN)); offset != 0 || actual.Valid() {
+		t.Errorf("GTP-U should not be decapsulated when disabled, actual: %+v", actual)
+	}
+	defer SetUdpTunnelPorts(TUNNEL_TYPE_GTPU, nil)
+	SetUdpTunnelPorts(TUNNEL_TYPE_GTPU, []uint16{2153})
+	if offset := actual.Decapsulate(append(RawPacket{}, packets[0]...), 14, bitmap); offset != 0 || actual.Valid() {
+		t.Errorf("GTP-U should not be decapsulated on port 2152, actual: %+v", actual)
+	}
+
+	actual = &TunnelInfo{}
+	packet := append(RawPacket{}, packets[6]...)
+	offset := actual.Decapsulate6(packet, 14, bitmap)
+	if offset != 0 || actual.Valid() {
+		t.Errorf("ipv6: GTP-U should not be decapsulated on port 2152, actual: %+v", actual)
+	}
+	SetUdpTunnelPorts(TUNNEL_TYPE_GTPU, nil)
+	offset = actual.Decapsulate6(packet, 14, bitmap)
+	if offset != IP6_HEADER_SIZE+UDP_HEADER_SIZE+GTPU_HEADER_SIZE-ETH_HEADER_SIZE || actual.Type != TUNNEL_TYPE_GTPU || !actual.IsIPv6 ||
+		EthernetType(BigEndian.Uint16(packet[14+offset+OFFSET_ETH_TYPE:])) != EthernetTypeIPv4 {
+		t.Errorf("ipv6: unexpected offset %d, tunnel %+v", offset, actual)
+	}
+}
+
 func TestDecapsulateAll(t *testing.T) {
 	bitmap := NewTunnelTypeBitmap(TUNNEL_TYPE_VXLAN, TUNNEL_TYPE_ERSPAN_OR_TEB)
 	tunnelMap := map[TunnelType]bool{TUNNEL_TYPE_VXLAN: false, TUNNEL_TYPE_ERSPAN_OR_TEB: false}
@@ -303,6 +2112,173 @@ func TestDecapsulateAll(t *testing.T) {
 	}
 }
 
+func TestDecapsulateAllLayers(t *testing.T) {
+	ip := func(s string) IPv4Int {
+		return IPv4Int(BigEndian.Uint32(net.ParseIP(s).To4()))
+	}
+	packets, _ := loadPcap("nested-tunnel.pcap")
+	testCases := []struct {
+		name           string
+		packet         RawPacket
+		bitmap         TunnelTypeBitmap
+		maxDepth       int
+		expected       *TunnelInfo
+		expectedOffset int
+		innerL2Len     int
+	}{
+		{
+			"vxlan-in-gre", append(RawPacket{}, packets[0]...), NewTunnelTypeBitmap(TUNNEL_TYPE_GRE, TUNNEL_TYPE_VXLAN), 0,
+			&TunnelInfo{
+				Src: ip("172.16.0.1"), Dst: ip("172.16.0.2"), MacSrc: 0x3eabcdef, MacDst: 0x3e123456, Id: 100, Type: TUNNEL_TYPE_GRE, Tier: 2, Ttl: 64, IPPayload: true,
+				Layers: [TUNNEL_LAYER_MAX]TunnelLayer{
+					{Src: ip("172.16.0.1"), Dst: ip("172.16.0.2"), Id: 100, Type: TUNNEL_TYPE_GRE, IPPayload: true},
+					{Src: ip("10.0.0.1"), Dst: ip("10.0.0.2"), Id: 200, Type: TUNNEL_TYPE_VXLAN},
+				},
+			},
+			// GRE将外层L2头移到内层IP前, 再加上VXLAN的偏移
+			IP_HEADER_SIZE + GRE_HEADER_SIZE + GRE_KEY_LEN + IP_HEADER_SIZE + UDP_HEADER_SIZE + VXLAN_HEADER_SIZE, ETH_HEADER_SIZE,
+		},
+		{
+			"vxlan-in-gre-depth-1", append(RawPacket{}, packets[0]...), NewTunnelTypeBitmap(TUNNEL_TYPE_GRE, TUNNEL_TYPE_VXLAN), 1,
+			&TunnelInfo{
+				Src: ip("172.16.0.1"), Dst: ip("172.16.0.2"), MacSrc: 0x3eabcdef, MacDst: 0x3e123456, Id: 100, Type: TUNNEL_TYPE_GRE, Tier: 1, Ttl: 64, IPPayload: true,
+				Layers: [TUNNEL_LAYER_MAX]TunnelLayer{
+					{Src: ip("172.16.0.1"), Dst: ip("172.16.0.2"), Id: 100, Type: TUNNEL_TYPE_GRE, IPPayload: true},
+				},
+			},
+			IP_HEADER_SIZE + GRE_HEADER_SIZE + GRE_KEY_LEN - ETH_HEADER_SIZE, ETH_HEADER_SIZE,
+		},
+		{
+			"ipip-in-vxlan-with-vlan", append(RawPacket{}, packets[1]...), NewTunnelTypeBitmap(TUNNEL_TYPE_VXLAN, TUNNEL_TYPE_IPIP), 0,
+			&TunnelInfo{
+				Src: ip("172.16.0.1"), Dst: ip("172.16.0.2"), MacSrc: 0x3eabcdef, MacDst: 0x3e123456, Id: 300, Type: TUNNEL_TYPE_VXLAN, Tier: 2, Ttl: 64, SrcPort: 50000, DstPort: 4789,
+				Layers: [TUNNEL_LAYER_MAX]TunnelLayer{
+					{Src: ip("172.16.0.1"), Dst: ip("172.16.0.2"), Id: 300, Type: TUNNEL_TYPE_VXLAN},
+					{Src: ip("10.0.1.1"), Dst: ip("10.0.1.2"), Type: TUNNEL_TYPE_IPIP, IPPayload: true},
+				},
+			},
+			IP_HEADER_SIZE + UDP_HEADER_SIZE + VXLAN_HEADER_SIZE + IP_HEADER_SIZE, ETH_HEADER_SIZE + VLAN_HEADER_SIZE,
+		},
+		{
+			"inner-tunnel-disabled", append(RawPacket{}, packets[0]...), NewTunnelTypeBitmap(TUNNEL_TYPE_GRE), 0,
+			&TunnelInfo{
+				Src: ip("172.16.0.1"), Dst: ip("172.16.0.2"), MacSrc: 0x3eabcdef, MacDst: 0x3e123456, Id: 100, Type: TUNNEL_TYPE_GRE, Tier: 1, Ttl: 64, IPPayload: true,
+				Layers: [TUNNEL_LAYER_MAX]TunnelLayer{
+					{Src: ip("172.16.0.1"), Dst: ip("172.16.0.2"), Id: 100, Type: TUNNEL_TYPE_GRE, IPPayload: true},
+				},
+			},
+			IP_HEADER_SIZE + GRE_HEADER_SIZE + GRE_KEY_LEN - ETH_HEADER_SIZE, ETH_HEADER_SIZE,
+		},
+	}
+	for _, tc := range testCases {
+		l2Len := 14
+		actual := &TunnelInfo{}
+		offset := actual.DecapsulateAll(tc.packet, l2Len, false, tc.bitmap, tc.maxDepth)
+		overlay := tc.packet[l2Len+offset:]
+		if !reflect.DeepEqual(tc.expected, actual) || offset != tc.expectedOffset ||
+			EthernetType(BigEndian.Uint16(overlay[tc.innerL2Len-ETH_TYPE_LEN:])) != EthernetTypeIPv4 || overlay[tc.innerL2Len]>>4 != 4 {
+			t.Errorf("%s: \n\ttunnel: %+v\n\tactual: %+v\n\toffset: %v\n\tactual: %v\n\toverlay: %x",
+				tc.name, tc.expected, actual, tc.expectedOffset, offset, overlay)
+		}
+	}
+
+	// 非隧道报文不修改隧道信息
+	actual := &TunnelInfo{}
+	packets, _ = loadPcap("gre.pcap")
+	if offset := actual.DecapsulateAll(packets[0], 14, false, NewTunnelTypeBitmap(TUNNEL_TYPE_VXLAN), 0); offset != 0 || *actual != (TunnelInfo{}) {
+		t.Errorf("expect no tunnel, actual: %+v, offset %d", actual, offset)
+	}
+}
+
+func TestDecapsulateAllDepthLimit(t *testing.T) {
+	// 10层IPIP嵌套, 每层都可以继续剥离
+	ipipChain := func() []byte {
+		packet := make([]byte, ETH_HEADER_SIZE+IP_HEADER_SIZE*12)
+		BigEndian.PutUint16(packet[OFFSET_ETH_TYPE:], uint16(EthernetTypeIPv4))
+		for i := 0; i < 10; i++ {
+			header := packet[ETH_HEADER_SIZE+i*IP_HEADER_SIZE:]
+			header[0] = 0x45
+			header[OFFSET_IP_PROTOCOL-ETH_HEADER_SIZE] = byte(IPProtocolIPv4)
+			BigEndian.PutUint32(header[OFFSET_SIP-ETH_HEADER_SIZE:], uint32(i+1))
+		}
+		return packet
+	}
+	bitmap := NewTunnelTypeBitmap(TUNNEL_TYPE_IPIP)
+	for _, tc := range []struct {
+		maxDepth, expectedTier int
+	}{{0, DEFAULT_TUNNEL_DEPTH}, {1, 1}, {3, 3}, {100, TUNNEL_LAYER_MAX}} {
+		l2Len := 14
+		actual := &TunnelInfo{}
+		offset := actual.DecapsulateAll(ipipChain(), l2Len, false, bitmap, tc.maxDepth)
+		if int(actual.Tier) != tc.expectedTier || offset != tc.expectedTier*IP_HEADER_SIZE-l2Len {
+			t.Errorf("maxDepth %d: expect %d layers, actual: %+v, offset %d", tc.maxDepth, tc.expectedTier, actual, offset)
+			continue
+		}
+		for i, layer := range actual.Layers {
+			if i < tc.expectedTier && (layer.Type != TUNNEL_TYPE_IPIP || layer.Src != IPv4Int(i+1)) || i >= tc.expectedTier && layer != (TunnelLayer{}) {
+				t.Errorf("maxDepth %d: unexpected layer %d %+v", tc.maxDepth, i, layer)
+			}
+		}
+	}
+
+	// 已经剥离到上限的TunnelInfo不再继续解析
+	actual := &TunnelInfo{}
+	actual.DecapsulateAll(ipipChain(), 14, false, bitmap, TUNNEL_LAYER_MAX)
+	if offset := actual.Decapsulate(ipipChain(), 14, bitmap); offset != 0 || actual.Tier != TUNNEL_LAYER_MAX {
+		t.Errorf("expect no further decapsulation, actual: %+v, offset %d", actual, offset)
+	}
+}
+
+func FuzzDecapsulate(f *testing.F) {
+	for _, file := range []string{"decapsulate_erspan1.pcap", "decapsulate_test.pcap", "tencent-gre.pcap", "vmware-gre-teb.pcap", "ipip.pcap", "gre.pcap", "nvgre.pcap", "geneve.pcap", "vxlan-gpe.pcap", "erspan-types.pcap", "nested-tunnel.pcap", "ipip-6in4.pcap", "mpls.pcap", "qinq-vxlan.pcap", "ip-fragment.pcap", "stt.pcap", "vxlan-sport.pcap", "capwap.pcap"} {
+		packets, _ := loadPcap(file)
+		for _, packet := range packets {
+			f.Add([]byte(packet), 14, false)
+			f.Add([]byte(packet), 18, false)
+		}
+	}
+	for _, file := range []string{"ip6-vxlan.pcap", "ip6-tunnel.pcap", "ip6-erspan.pcap"} {
+		packets, _ := loadPcap(file)
+		for _, packet := range packets {
+			f.Add([]byte(packet), 14, true)
+		}
+	}
+	for _, tc := range builtDecapsulateCases() {
+		f.Add(tc.packet, ETH_HEADER_SIZE, tc.ipv6)
+	}
+	f.Add([]byte{}, 0, false)
+	f.Add([]byte{}, 14, true)
+	f.Add(make([]byte, ETH_HEADER_SIZE+IP_HEADER_SIZE), 14, false)
+
+	bitmap := NewTunnelTypeBitmap(TUNNEL_TYPE_VXLAN, TUNNEL_TYPE_IPIP, TUNNEL_TYPE_TENCENT_GRE, TUNNEL_TYPE_ERSPAN_OR_TEB, TUNNEL_TYPE_GRE, TUNNEL_TYPE_NVGRE, TUNNEL_TYPE_GENEVE, TUNNEL_TYPE_VXLAN_GPE, TUNNEL_TYPE_STT, TUNNEL_TYPE_CAPWAP, TUNNEL_TYPE_GTPU)
+	f.Fuzz(func(t *testing.T, packet []byte, l2Len int, ipv6 bool) {
+		// 多层剥离同样不能越界
+		nested := &TunnelInfo{}
+		if offset := nested.DecapsulateAll(append([]byte{}, packet...), l2Len, ipv6, bitmap, TUNNEL_LAYER_MAX); nested.Tier != 0 && (l2Len+offset < 0 || l2Len+offset > len(packet)) {
+			t.Errorf("nested offset %d out of packet range, l2Len %d, packet len %d", offset, l2Len, len(packet))
+		}
+
+		tunnel := &TunnelInfo{}
+		offset := 0
+		if ipv6 {
+			offset = tunnel.Decapsulate6(packet, l2Len, bitmap)
+		} else {
+			offset = tunnel.Decapsulate(packet, l2Len, bitmap)
+		}
+		// 解析失败时除Fragment外不能修改隧道信息
+		if tunnel.Tier == 0 {
+			if offset != 0 || *tunnel != (TunnelInfo{Fragment: tunnel.Fragment}) {
+				t.Errorf("tunnel info should be unset for malformed packet, found %+v, offset %d", tunnel, offset)
+			}
+			return
+		}
+		// offset从L3开始计算, 指向内层L2头
+		if l2Len+offset < 0 || l2Len+offset > len(packet) {
+			t.Errorf("offset %d out of packet range, l2Len %d, packet len %d", offset, l2Len, len(packet))
+		}
+	})
+}
+
 func BenchmarkDecapsulateTCP(b *testing.B) {
 	bitmap := NewTunnelTypeBitmap(TUNNEL_TYPE_VXLAN)
 	packet := [256]byte{}
@@ -331,6 +2307,7 @@ func BenchmarkDecapsulateUDP4789(b *testing.B) {
 	bitmap := NewTunnelTypeBitmap(TUNNEL_TYPE_VXLAN)
 	packet := [256]byte{}
 	tunnel := &TunnelInfo{}
+	packet[IP_IHL_OFFSET] = 0x45
 	packet[OFFSET_IP_PROTOCOL-ETH_HEADER_SIZE] = byte(IPProtocolUDP)
 	packet[OFFSET_DPORT-ETH_HEADER_SIZE] = 4789 >> 8
 	packet[OFFSET_DPORT-ETH_HEADER_SIZE+1] = 4789 & 0xFF
@@ -345,6 +2322,7 @@ func BenchmarkDecapsulateVXLAN(b *testing.B) {
 	bitmap := NewTunnelTypeBitmap(TUNNEL_TYPE_VXLAN)
 	packet := [256]byte{}
 	tunnel := &TunnelInfo{}
+	packet[IP_IHL_OFFSET] = 0x45
 	packet[OFFSET_IP_PROTOCOL-ETH_HEADER_SIZE] = byte(IPProtocolUDP)
 	packet[OFFSET_DPORT-ETH_HEADER_SIZE] = 4789 >> 8
 	packet[OFFSET_DPORT-ETH_HEADER_SIZE+1] = 4789 & 0xFF
@@ -352,6 +2330,35 @@ func BenchmarkDecapsulateVXLAN(b *testing.B) {
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
+		tunnel.Tier = 0 // 每次都走完整的VXLAN解析, 而不是因Tier超限直接返回
 		tunnel.Decapsulate(packet[:], 0, bitmap)
 	}
 }
+
+func benchmarkDecapsulate(b *testing.B, file string, index, l2Len int, bitmap TunnelTypeBitmap, ipv6 bool) {
+	packets, _ := loadPcap(file)
+	packet := packets[index]
+	tunnel := &TunnelInfo{}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		*tunnel = TunnelInfo{}
+		if ipv6 {
+			tunnel.Decapsulate6(packet, l2Len, bitmap)
+		} else {
+			tunnel.Decapsulate(packet, l2Len, bitmap)
+		}
+	}
+}
+
+func BenchmarkDecapsulateErspanIPv4(b *testing.B) {
+	benchmarkDecapsulate(b, "decapsulate_erspan1.pcap", 0, 18, NewTunnelTypeBitmap(TUNNEL_TYPE_VXLAN, TUNNEL_TYPE_ERSPAN_OR_TEB), false)
+}
+
+func BenchmarkDecapsulateErspanIPv6(b *testing.B) {
+	benchmarkDecapsulate(b, "ip6-tunnel.pcap", 0, 14, NewTunnelTypeBitmap(TUNNEL_TYPE_VXLAN, TUNNEL_TYPE_ERSPAN_OR_TEB), true)
+}
+
+func BenchmarkDecapsulateVxlanIPv6(b *testing.B) {
+	benchmarkDecapsulate(b, "ip6-vxlan.pcap", 0, 14, NewTunnelTypeBitmap(TUNNEL_TYPE_VXLAN, TUNNEL_TYPE_ERSPAN_OR_TEB), true)
+}
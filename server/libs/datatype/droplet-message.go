@@ -19,6 +19,7 @@ package datatype
 import (
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 
 	"github.com/deepflowio/deepflow/server/libs/ckdb"
 )
@@ -164,6 +165,9 @@ func (h *BaseHeader) Encode(chunk []byte) {
 }
 
 func (h *BaseHeader) Decode(buf []byte) error {
+	if len(buf) < MESSAGE_HEADER_LEN {
+		return fmt.Errorf("buffer length %d is smaller than header length %d", len(buf), MESSAGE_HEADER_LEN)
+	}
 	h.FrameSize = binary.BigEndian.Uint32(buf[MESSAGE_FRAME_SIZE_OFFSET:])
 	h.Type = MessageType(buf[MESSAGE_TYPE_OFFSET])
 
@@ -192,7 +196,9 @@ type FlowHeaderOld struct {
 }
 
 const (
+	OLD_VERSION    = 0      // 旧版本(version <= v6.5.8)的包头没有该格式的版本号, 解码后Version置为OLD_VERSION
 	LATEST_VERSION = 0x8000 // v6.5 version
+	VERSION_MAX    = 0x80ff // 新格式包头的版本号范围为[LATEST_VERSION, VERSION_MAX]
 
 	VERSION_OFFSET   = 0
 	ENCODER_OFFSET   = VERSION_OFFSET + 2
@@ -202,6 +208,18 @@ const (
 	AGENTID_OFFSET   = RESERVED1_OFFSET + 2
 )
 
+// FlowHeader.Encoder的低7位为编码方式, 最高位为标志位
+const (
+	ENCODER_RAW = 0
+	ENCODER_LZ4 = 1 // payload为LZ4 block格式, 前LZ4_SIZE_LEN字节为解压后的长度(小端)
+
+	ENCODER_TYPE_MASK       = 0x7f
+	ENCODER_FLAG_HEADER_CRC = 0x80 // FlowHeader之后携带HEADER_CRC_LEN字节的包头CRC32(小端)
+
+	LZ4_SIZE_LEN   = 4
+	HEADER_CRC_LEN = 4
+)
+
 type FlowHeader struct {
 	Version   uint16 // start with 0x8000
 	Encoder   uint8  // Flag whether to use compression etc.
@@ -212,21 +230,63 @@ type FlowHeader struct {
 	Reserved2 uint8
 }
 
-func (h *FlowHeader) Decode(buf []byte) {
-	h.Version = binary.LittleEndian.Uint16(buf[VERSION_OFFSET:])
-	if h.Version == LATEST_VERSION {
-		h.Encoder = buf[ENCODER_OFFSET]
-		h.TeamID = binary.LittleEndian.Uint32(buf[TEAMID_OFFSET:])
-		h.OrgID = binary.LittleEndian.Uint16(buf[ORGID_OFFSET:])
-		// reserved1
-		h.AgentID = binary.LittleEndian.Uint16(buf[AGENTID_OFFSET:])
-		// reserved2
-	} else {
-		// decoding the header of the old version (version <= v6.5.8)
-		h.TeamID = ckdb.DEFAULT_TEAM_ID
-		h.OrgID = ckdb.DEFAULT_ORG_ID
-		h.AgentID = binary.LittleEndian.Uint16(buf[FLOW_VTAPID_OFFSET:])
+type UnknownVersionError struct {
+	Version uint16
+}
+
+func (e *UnknownVersionError) Error() string {
+	return fmt.Sprintf("unknown flow header version 0x%x, latest version is 0x%x", e.Version, LATEST_VERSION)
+}
+
+// 升级期间新旧版本的agent同时存在, 根据版本号选择对应的解码方式.
+// 旧版本包头的版本号为YYYYMMDD格式的uint32, 其低16位不会落在[LATEST_VERSION, VERSION_MAX]范围内,
+// 该范围内大于LATEST_VERSION的版本号来自更新的agent, 无法解码, 返回UnknownVersionError
+func (h *FlowHeader) Decode(buf []byte) error {
+	if len(buf) < FLOW_HEADER_LEN {
+		return fmt.Errorf("buffer length %d is smaller than flow header length %d", len(buf), FLOW_HEADER_LEN)
 	}
+	version := binary.LittleEndian.Uint16(buf[VERSION_OFFSET:])
+	switch {
+	case version == LATEST_VERSION:
+		h.decodeLatest(buf)
+	case version > LATEST_VERSION && version <= VERSION_MAX:
+		return &UnknownVersionError{version}
+	default:
+		h.decodeOld(buf)
+	}
+	return nil
+}
+
+func (h *FlowHeader) decodeLatest(buf []byte) {
+	h.Version = LATEST_VERSION
+	h.Encoder = buf[ENCODER_OFFSET]
+	h.TeamID = binary.LittleEndian.Uint32(buf[TEAMID_OFFSET:])
+	h.OrgID = binary.LittleEndian.Uint16(buf[ORGID_OFFSET:])
+	// reserved1
+	h.AgentID = binary.LittleEndian.Uint16(buf[AGENTID_OFFSET:])
+	// reserved2
+}
+
+// decoding the header of the old version (version <= v6.5.8)
+func (h *FlowHeader) decodeOld(buf []byte) {
+	h.Version = OLD_VERSION
+	h.Encoder = 0
+	h.TeamID = ckdb.DEFAULT_TEAM_ID
+	h.OrgID = ckdb.DEFAULT_ORG_ID
+	h.AgentID = binary.LittleEndian.Uint16(buf[FLOW_VTAPID_OFFSET:])
+}
+
+func (h *FlowHeader) EncoderType() uint8 {
+	return h.Encoder & ENCODER_TYPE_MASK
+}
+
+func (h *FlowHeader) HasHeaderCRC() bool {
+	return h.Encoder&ENCODER_FLAG_HEADER_CRC != 0
+}
+
+// 包头CRC32(IEEE)覆盖BaseHeader和FlowHeader, 防止UDP校验和关闭时损坏的包头被当作合法数据
+func HeaderCRC(baseHeader, flowHeader []byte) uint32 {
+	return crc32.Update(crc32.ChecksumIEEE(baseHeader[:MESSAGE_HEADER_LEN]), crc32.IEEETable, flowHeader[:FLOW_HEADER_LEN])
 }
 
 func (h *FlowHeader) Encode(chunk []byte) {
@@ -238,3 +298,48 @@ func (h *FlowHeader) Encode(chunk []byte) {
 	binary.LittleEndian.PutUint16(chunk[AGENTID_OFFSET:], h.AgentID)
 	// reserved2
 }
+
+// 按BaseHeader.Decode和FlowHeader.Decode的格式组装agent发送的消息, 供测试, 重放工具和模拟agent使用.
+// 消息内容由调用者按消息类型编码后依次Append, FlowHeader仅支持LATEST_VERSION
+type MessageEncoder struct {
+	Type       MessageType
+	FlowHeader FlowHeader // 仅HEADER_TYPE_LT_VTAP类型写入, Encoder带ENCODER_FLAG_HEADER_CRC时其后写入包头CRC
+
+	payload []byte
+}
+
+func (e *MessageEncoder) Append(record []byte) {
+	e.payload = append(e.payload, record...)
+}
+
+func (e *MessageEncoder) Reset() {
+	e.payload = e.payload[:0]
+}
+
+// 消息内容之前的包头长度
+func (e *MessageEncoder) HeaderLen() int {
+	if e.Type.HeaderType() != HEADER_TYPE_LT_VTAP {
+		return MESSAGE_HEADER_LEN
+	}
+	if e.FlowHeader.HasHeaderCRC() {
+		return MESSAGE_HEADER_LEN + FLOW_HEADER_LEN + HEADER_CRC_LEN
+	}
+	return MESSAGE_HEADER_LEN + FLOW_HEADER_LEN
+}
+
+// 将完整的消息追加到buf之后并返回, FrameSize为消息总长度
+func (e *MessageEncoder) Emit(buf []byte) []byte {
+	start, headerLen := len(buf), e.HeaderLen()
+	for i := 0; i < headerLen; i++ {
+		buf = append(buf, 0)
+	}
+	message := buf[start:]
+	(&BaseHeader{FrameSize: uint32(headerLen + len(e.payload)), Type: e.Type}).Encode(message)
+	if e.Type.HeaderType() == HEADER_TYPE_LT_VTAP {
+		e.FlowHeader.Encode(message[MESSAGE_HEADER_LEN:])
+		if e.FlowHeader.HasHeaderCRC() {
+			binary.LittleEndian.PutUint32(message[MESSAGE_HEADER_LEN+FLOW_HEADER_LEN:], HeaderCRC(message, message[MESSAGE_HEADER_LEN:]))
+		}
+	}
+	return append(buf, e.payload...)
+}
@@ -0,0 +1,209 @@
+/*
+ * Copyright (c) 2024 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package datatype
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+
+	"github.com/deepflowio/deepflow/server/libs/ckdb"
+)
+
+func TestFlowHeaderDecodeVersions(t *testing.T) {
+	// 旧版本: Version(4B, 20220117) | TeamID(4B) | OrgID(4B) | VTAPID(2B)
+	old := []byte{0xd5, 0x88, 0x34, 0x01, 0, 0, 0, 0, 0, 0, 0, 0, 0x0a, 0x00}
+	// 最新版本: Version(2B) | Encoder(1B) | TeamID(4B) | OrgID(2B) | Reserved1(2B) | AgentID(2B) | Reserved2(1B)
+	latest := []byte{0x00, 0x80, 0x01, 0x05, 0, 0, 0, 0x02, 0x00, 0, 0, 0x0b, 0x00, 0}
+	// 更新版本的agent
+	unknown := []byte{0x01, 0x80, 0x01, 0x05, 0, 0, 0, 0x02, 0x00, 0, 0, 0x0b, 0x00, 0}
+
+	h := &FlowHeader{}
+	if err := h.Decode(old); err != nil {
+		t.Fatal(err)
+	}
+	if h.Version != OLD_VERSION || h.AgentID != 10 || h.TeamID != ckdb.DEFAULT_TEAM_ID || h.OrgID != ckdb.DEFAULT_ORG_ID {
+		t.Errorf("unexpected old header %+v", h)
+	}
+
+	if err := h.Decode(latest); err != nil {
+		t.Fatal(err)
+	}
+	if h.Version != LATEST_VERSION || h.Encoder != 1 || h.TeamID != 5 || h.OrgID != 2 || h.AgentID != 11 {
+		t.Errorf("unexpected latest header %+v", h)
+	}
+
+	err := h.Decode(unknown)
+	if e, ok := err.(*UnknownVersionError); !ok || e.Version != LATEST_VERSION+1 {
+		t.Errorf("expect unknown version error, found %v", err)
+	}
+
+	chunk := make([]byte, FLOW_HEADER_LEN)
+	encoded := &FlowHeader{Version: LATEST_VERSION, Encoder: 1, TeamID: 5, OrgID: 2, AgentID: 11}
+	encoded.Encode(chunk)
+	if h.Decode(chunk); *h != *encoded {
+		t.Errorf("encode and decode mismatch, expect %+v, found %+v", encoded, h)
+	}
+}
+
+func TestHeaderCRC(t *testing.T) {
+	buf := make([]byte, MESSAGE_HEADER_LEN+FLOW_HEADER_LEN+HEADER_CRC_LEN)
+	(&BaseHeader{FrameSize: uint32(len(buf)), Type: MESSAGE_TYPE_METRICS}).Encode(buf)
+	flowHeader := &FlowHeader{Version: LATEST_VERSION, Encoder: ENCODER_LZ4 | ENCODER_FLAG_HEADER_CRC, AgentID: 3}
+	flowHeader.Encode(buf[MESSAGE_HEADER_LEN:])
+	crc := HeaderCRC(buf, buf[MESSAGE_HEADER_LEN:])
+	binary.LittleEndian.PutUint32(buf[MESSAGE_HEADER_LEN+FLOW_HEADER_LEN:], crc)
+
+	decoded := &FlowHeader{}
+	decoded.Decode(buf[MESSAGE_HEADER_LEN:])
+	if !decoded.HasHeaderCRC() || decoded.EncoderType() != ENCODER_LZ4 {
+		t.Errorf("unexpected encoder %x", decoded.Encoder)
+	}
+
+	buf[MESSAGE_HEADER_LEN+AGENTID_OFFSET] ^= 0x10
+	if HeaderCRC(buf, buf[MESSAGE_HEADER_LEN:]) == crc {
+		t.Error("crc should mismatch after header mangled")
+	}
+}
+
+func TestMessageEncoderRoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	buf := make([]byte, 0, 1024)
+	for i := 0; i < 1000; i++ {
+		encoder := &MessageEncoder{
+			Type: MessageType(rnd.Intn(int(MESSAGE_TYPE_MAX))),
+			FlowHeader: FlowHeader{
+				Version: LATEST_VERSION,
+				Encoder: uint8(rnd.Intn(256)),
+				TeamID:  rnd.Uint32(),
+				OrgID:   uint16(rnd.Uint32()),
+				AgentID: uint16(rnd.Uint32()),
+			},
+		}
+		var payload []byte
+		// HEADER_TYPE_LT的消息不能为空
+		for j := rnd.Intn(4) + 1; j > 0; j-- {
+			record := make([]byte, rnd.Intn(64)+1)
+			rnd.Read(record)
+			encoder.Append(record)
+			payload = append(payload, record...)
+		}
+		// 复用带有旧数据的buffer, 并在已有内容之后追加
+		prefix := rnd.Intn(3)
+		buf = encoder.Emit(buf[:prefix])
+		message := buf[prefix:]
+
+		base := &BaseHeader{}
+		if err := base.Decode(message); err != nil {
+			t.Fatalf("case %d type %s: %s", i, encoder.Type, err)
+		}
+		if base.Type != encoder.Type || int(base.FrameSize) != len(message) {
+			t.Errorf("case %d: unexpected base header %+v, message length %d", i, base, len(message))
+		}
+		if !bytes.Equal(message[encoder.HeaderLen():], payload) {
+			t.Errorf("case %d type %s: payload mismatch", i, encoder.Type)
+		}
+		if encoder.Type.HeaderType() != HEADER_TYPE_LT_VTAP {
+			if encoder.HeaderLen() != MESSAGE_HEADER_LEN {
+				t.Errorf("case %d type %s: unexpected header length %d", i, encoder.Type, encoder.HeaderLen())
+			}
+			continue
+		}
+		flow := &FlowHeader{}
+		if err := flow.Decode(message[MESSAGE_HEADER_LEN:]); err != nil {
+			t.Fatalf("case %d: %s", i, err)
+		}
+		if *flow != encoder.FlowHeader {
+			t.Errorf("case %d: expect flow header %+v, actual %+v", i, encoder.FlowHeader, *flow)
+		}
+		if flow.HasHeaderCRC() {
+			crc := binary.LittleEndian.Uint32(message[MESSAGE_HEADER_LEN+FLOW_HEADER_LEN:])
+			if crc != HeaderCRC(message, message[MESSAGE_HEADER_LEN:]) {
+				t.Errorf("case %d: header crc mismatch", i)
+			}
+		}
+	}
+
+	// Reset后复用
+	encoder := &MessageEncoder{Type: MESSAGE_TYPE_SYSLOG}
+	encoder.Append([]byte("old"))
+	encoder.Reset()
+	encoder.Append([]byte("new"))
+	if message := encoder.Emit(nil); string(message[MESSAGE_HEADER_LEN:]) != "new" {
+		t.Errorf("unexpected message %q", message)
+	}
+}
+
+func FuzzDecodeHeader(f *testing.F) {
+	latest := make([]byte, MESSAGE_HEADER_LEN+FLOW_HEADER_LEN)
+	(&BaseHeader{FrameSize: uint32(len(latest)), Type: MESSAGE_TYPE_METRICS}).Encode(latest)
+	(&FlowHeader{Version: LATEST_VERSION, AgentID: 1}).Encode(latest[MESSAGE_HEADER_LEN:])
+	f.Add(latest)
+	f.Add(latest[:MESSAGE_HEADER_LEN+1])
+	f.Add(latest[:MESSAGE_HEADER_LEN-1])
+	f.Add([]byte{})
+	// 各种包头类型, 以及旧版本和未知版本的FlowHeader
+	for _, messageType := range []MessageType{MESSAGE_TYPE_COMPRESS, MESSAGE_TYPE_SYSLOG, MESSAGE_TYPE_TAGGEDFLOW, MESSAGE_TYPE_MAX} {
+		buf := append([]byte{}, latest...)
+		(&BaseHeader{FrameSize: uint32(len(buf)), Type: messageType}).Encode(buf)
+		f.Add(buf)
+	}
+	for _, version := range []uint16{OLD_VERSION, LATEST_VERSION + 1, VERSION_MAX + 1} {
+		buf := append([]byte{}, latest...)
+		binary.LittleEndian.PutUint16(buf[MESSAGE_HEADER_LEN+VERSION_OFFSET:], version)
+		f.Add(buf)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		baseHeader, flowHeader := &BaseHeader{}, &FlowHeader{}
+		if err := baseHeader.Decode(data); err != nil {
+			return
+		}
+		// 解码成功的包头必须是合法的
+		if len(data) < MESSAGE_HEADER_LEN {
+			t.Fatalf("decoded header from %d bytes", len(data))
+		}
+		switch baseHeader.Type.HeaderType() {
+		case HEADER_TYPE_LT:
+			if baseHeader.FrameSize <= MESSAGE_HEADER_LEN {
+				t.Errorf("accepted frame size %d of type %d", baseHeader.FrameSize, baseHeader.Type)
+			}
+		case HEADER_TYPE_LT_NOCHECK:
+		case HEADER_TYPE_LT_VTAP:
+			if baseHeader.FrameSize < MESSAGE_HEADER_LEN+FLOW_HEADER_LEN {
+				t.Errorf("accepted frame size %d of type %d", baseHeader.FrameSize, baseHeader.Type)
+			}
+			err := flowHeader.Decode(data[MESSAGE_HEADER_LEN:])
+			if len(data) < MESSAGE_HEADER_LEN+FLOW_HEADER_LEN {
+				if err == nil {
+					t.Errorf("decoded flow header from %d bytes", len(data)-MESSAGE_HEADER_LEN)
+				}
+				return
+			}
+			version := binary.LittleEndian.Uint16(data[MESSAGE_HEADER_LEN+VERSION_OFFSET:])
+			if unknown := version > LATEST_VERSION && version <= VERSION_MAX; unknown != (err != nil) {
+				t.Errorf("version %x: unexpected error %v", version, err)
+			}
+			if err == nil && flowHeader.Version != LATEST_VERSION && flowHeader.Version != OLD_VERSION {
+				t.Errorf("unexpected decoded version %x", flowHeader.Version)
+			}
+		default:
+			t.Errorf("accepted invalid type %d", baseHeader.Type)
+		}
+	})
+}
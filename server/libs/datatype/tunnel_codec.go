@@ -0,0 +1,181 @@
+/*
+ * Copyright (c) 2024 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package datatype
+
+import (
+	. "encoding/binary"
+	"errors"
+)
+
+// TunnelInfo编码后的固定长度: Flags(1B) + Type(1B) + Tier(1B) + Ttl(1B) + Tos(1B) + Src/Dst/MacSrc/MacDst/Id(各4B)
+// + Src6/Dst6(各16B) + ContextId(8B) + MplsLabel(4B) + Erspan Vlan(2B) + Cos(1B) + HardwareId(1B)
+// + Timestamp(4B) + Granularity(1B) + Layers(每层14B) + OuterMacSrc/OuterMacDst(各6B) + SrcPort/DstPort(各2B)
+const (
+	TUNNEL_LAYER_ENCODED_SIZE = 4 + 4 + 4 + 1 + 1 // Src, Dst, Id, Type, IsIPv6
+	TUNNEL_INFO_ENCODED_SIZE  = 5 + 4*5 + 16*2 + 8 + 4 + 2 + 1 + 1 + 4 + 1 + TUNNEL_LAYER_ENCODED_SIZE*TUNNEL_LAYER_MAX + MAC_ADDR_LEN*2 + 2*2
+)
+
+// 编码中Flags字段各bit的含义
+const (
+	tunnelFlagIPv6 = 1 << iota
+	tunnelFlagMpls
+	tunnelFlagFragment
+	tunnelFlagErspan
+	tunnelFlagErspanEgress
+	tunnelFlagErspanSubheader
+	tunnelFlagIPPayload
+)
+
+var errTunnelInfoTooShort = errors.New("tunnel info buffer too short")
+
+func (t *TunnelInfo) Equal(other *TunnelInfo) bool {
+	return t.EqualWith(other, false)
+}
+
+// ignorePorts为true时不比较外层UDP端口. VXLAN等隧道的源端口是ECMP熵, 按隧道聚合流时应忽略
+func (t *TunnelInfo) EqualWith(other *TunnelInfo, ignorePorts bool) bool {
+	if !ignorePorts {
+		return *t == *other
+	}
+	a, b := *t, *other
+	a.SrcPort, a.DstPort, b.SrcPort, b.DstPort = 0, 0, 0, 0
+	return a == b
+}
+
+func (t *TunnelInfo) Hash() uint64 {
+	return t.HashWith(false)
+}
+
+// 对编码结果计算FNV-1a, 不同进程和版本间结果一致, 可用于分片. 不分配内存.
+// ignorePorts的含义与EqualWith相同
+func (t *TunnelInfo) HashWith(ignorePorts bool) uint64 {
+	var buf [TUNNEL_INFO_ENCODED_SIZE]byte
+	t.EncodeTo(buf[:])
+	if ignorePorts {
+		BigEndian.PutUint32(buf[TUNNEL_INFO_ENCODED_SIZE-4:], 0)
+	}
+	hash := uint64(14695981039346656037)
+	for _, b := range buf {
+		hash ^= uint64(b)
+		hash *= 1099511628211
+	}
+	return hash
+}
+
+func boolFlag(value bool, flag uint8) uint8 {
+	if value {
+		return flag
+	}
+	return 0
+}
+
+// 编码为TUNNEL_INFO_ENCODED_SIZE字节的大端序格式, 返回写入的长度. buf长度不足时panic
+func (t *TunnelInfo) EncodeTo(buf []byte) int {
+	_ = buf[TUNNEL_INFO_ENCODED_SIZE-1]
+	buf[0] = boolFlag(t.IsIPv6, tunnelFlagIPv6) | boolFlag(t.HasMpls, tunnelFlagMpls) | boolFlag(t.Fragment, tunnelFlagFragment) |
+		boolFlag(t.Erspan.Valid, tunnelFlagErspan) | boolFlag(t.Erspan.Egress, tunnelFlagErspanEgress) | boolFlag(t.Erspan.Subheader, tunnelFlagErspanSubheader) |
+		boolFlag(t.IPPayload, tunnelFlagIPPayload)
+	buf[1] = uint8(t.Type)
+	buf[2] = t.Tier
+	buf[3] = t.Ttl
+	buf[4] = t.Tos
+	BigEndian.PutUint32(buf[5:], uint32(t.Src))
+	BigEndian.PutUint32(buf[9:], uint32(t.Dst))
+	BigEndian.PutUint32(buf[13:], t.MacSrc)
+	BigEndian.PutUint32(buf[17:], t.MacDst)
+	BigEndian.PutUint32(buf[21:], t.Id)
+	copy(buf[25:], t.Src6[:])
+	copy(buf[41:], t.Dst6[:])
+	BigEndian.PutUint64(buf[57:], t.ContextId)
+	BigEndian.PutUint32(buf[65:], t.MplsLabel)
+	BigEndian.PutUint16(buf[69:], t.Erspan.Vlan)
+	buf[71] = t.Erspan.Cos
+	buf[72] = t.Erspan.HardwareId
+	BigEndian.PutUint32(buf[73:], t.Erspan.Timestamp)
+	buf[77] = uint8(t.Erspan.Granularity)
+	offset := 78
+	for i := range t.Layers {
+		layer := &t.Layers[i]
+		BigEndian.PutUint32(buf[offset:], uint32(layer.Src))
+		BigEndian.PutUint32(buf[offset+4:], uint32(layer.Dst))
+		BigEndian.PutUint32(buf[offset+8:], layer.Id)
+		buf[offset+12] = uint8(layer.Type)
+		buf[offset+13] = boolFlag(layer.IsIPv6, tunnelFlagIPv6) | boolFlag(layer.IPPayload, tunnelFlagIPPayload)
+		offset += TUNNEL_LAYER_ENCODED_SIZE
+	}
+	putMac(buf[offset:], t.OuterMacSrc)
+	putMac(buf[offset+MAC_ADDR_LEN:], t.OuterMacDst)
+	offset += MAC_ADDR_LEN * 2
+	BigEndian.PutUint16(buf[offset:], t.SrcPort)
+	BigEndian.PutUint16(buf[offset+2:], t.DstPort)
+	return offset + 4
+}
+
+func putMac(buf []byte, mac MacInt) {
+	BigEndian.PutUint16(buf, uint16(mac>>32))
+	BigEndian.PutUint32(buf[2:], uint32(mac))
+}
+
+// 从EncodeTo的结果解码, 覆盖TunnelInfo的所有字段
+func (t *TunnelInfo) Decode(buf []byte) error {
+	if len(buf) < TUNNEL_INFO_ENCODED_SIZE {
+		return errTunnelInfoTooShort
+	}
+	flags := buf[0]
+	t.IsIPv6 = flags&tunnelFlagIPv6 != 0
+	t.HasMpls = flags&tunnelFlagMpls != 0
+	t.Fragment = flags&tunnelFlagFragment != 0
+	t.Erspan.Valid = flags&tunnelFlagErspan != 0
+	t.Erspan.Egress = flags&tunnelFlagErspanEgress != 0
+	t.Erspan.Subheader = flags&tunnelFlagErspanSubheader != 0
+	t.IPPayload = flags&tunnelFlagIPPayload != 0
+	t.Type = TunnelType(buf[1])
+	t.Tier = buf[2]
+	t.Ttl = buf[3]
+	t.Tos = buf[4]
+	t.Src = IPv4Int(BigEndian.Uint32(buf[5:]))
+	t.Dst = IPv4Int(BigEndian.Uint32(buf[9:]))
+	t.MacSrc = BigEndian.Uint32(buf[13:])
+	t.MacDst = BigEndian.Uint32(buf[17:])
+	t.Id = BigEndian.Uint32(buf[21:])
+	copy(t.Src6[:], buf[25:])
+	copy(t.Dst6[:], buf[41:])
+	t.ContextId = BigEndian.Uint64(buf[57:])
+	t.MplsLabel = BigEndian.Uint32(buf[65:])
+	t.Erspan.Vlan = BigEndian.Uint16(buf[69:])
+	t.Erspan.Cos = buf[71]
+	t.Erspan.HardwareId = buf[72]
+	t.Erspan.Timestamp = BigEndian.Uint32(buf[73:])
+	t.Erspan.Granularity = ErspanGranularity(buf[77])
+	offset := 78
+	for i := range t.Layers {
+		layer := &t.Layers[i]
+		layer.Src = IPv4Int(BigEndian.Uint32(buf[offset:]))
+		layer.Dst = IPv4Int(BigEndian.Uint32(buf[offset+4:]))
+		layer.Id = BigEndian.Uint32(buf[offset+8:])
+		layer.Type = TunnelType(buf[offset+12])
+		layer.IsIPv6 = buf[offset+13]&tunnelFlagIPv6 != 0
+		layer.IPPayload = buf[offset+13]&tunnelFlagIPPayload != 0
+		offset += TUNNEL_LAYER_ENCODED_SIZE
+	}
+	t.OuterMacSrc = MacIntFromBytes(buf[offset:])
+	t.OuterMacDst = MacIntFromBytes(buf[offset+MAC_ADDR_LEN:])
+	offset += MAC_ADDR_LEN * 2
+	t.SrcPort = BigEndian.Uint16(buf[offset:])
+	t.DstPort = BigEndian.Uint16(buf[offset+2:])
+	return nil
+}
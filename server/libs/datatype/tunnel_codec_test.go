@@ -0,0 +1,115 @@
+/*
+ * Copyright (c) 2024 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package datatype
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// 依次修改TunnelInfo的每个字段(包括数组元素和嵌套结构体中的字段), 新增字段时无需修改测试
+func mutateEachField(value reflect.Value, path string, mutate func(path string)) {
+	switch value.Kind() {
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			mutateEachField(value.Field(i), path+"."+value.Type().Field(i).Name, mutate)
+		}
+	case reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			mutateEachField(value.Index(i), path+"["+strconv.Itoa(i)+"]", mutate)
+		}
+	case reflect.Bool:
+		value.SetBool(!value.Bool())
+		mutate(path)
+		value.SetBool(!value.Bool())
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		old := value.Uint()
+		value.SetUint(old ^ 1)
+		mutate(path)
+		value.SetUint(old)
+	default:
+		panic("unsupported field " + path)
+	}
+}
+
+func TestTunnelInfoEqualAndHash(t *testing.T) {
+	packets, _ := loadPcap("erspan-types.pcap")
+	base := TunnelInfo{}
+	base.DecapsulateAll(packets[3], 14, false, NewTunnelTypeBitmap(TUNNEL_TYPE_ERSPAN_OR_TEB), 0)
+	base.MplsLabel, base.HasMpls, base.ContextId = 100, true, 1<<40
+	baseHash := base.Hash()
+
+	mutated := base
+	count := 0
+	mutateEachField(reflect.ValueOf(&mutated).Elem(), "TunnelInfo", func(path string) {
+		count++
+		if mutated.Equal(&base) || base.Equal(&mutated) {
+			t.Errorf("%s: expect unequal", path)
+		}
+		if mutated.Hash() == baseHash {
+			t.Errorf("%s: expect different hash", path)
+		}
+		decoded := TunnelInfo{}
+		var buf [TUNNEL_INFO_ENCODED_SIZE]byte
+		if n := mutated.EncodeTo(buf[:]); n != TUNNEL_INFO_ENCODED_SIZE {
+			t.Errorf("%s: expect %d bytes encoded, found %d", path, TUNNEL_INFO_ENCODED_SIZE, n)
+		}
+		if err := decoded.Decode(buf[:]); err != nil || !decoded.Equal(&mutated) {
+			t.Errorf("%s: decode failed %v\n\texpect: %+v\n\tactual: %+v", path, err, mutated, decoded)
+		}
+	})
+	if count < TUNNEL_LAYER_MAX*5 {
+		t.Errorf("only %d fields mutated", count)
+	}
+	if !mutated.Equal(&base) || mutated.Hash() != baseHash {
+		t.Errorf("expect equal after restore")
+	}
+
+	// 忽略端口时仅端口不同的隧道相等
+	baseHashIgnorePorts := base.HashWith(true)
+	mutateEachField(reflect.ValueOf(&mutated).Elem(), "TunnelInfo", func(path string) {
+		portOnly := strings.HasSuffix(path, "Port")
+		if mutated.EqualWith(&base, true) != portOnly || (mutated.HashWith(true) == baseHashIgnorePorts) != portOnly {
+			t.Errorf("%s: expect equal ignoring ports %v", path, portOnly)
+		}
+	})
+
+	// Decode覆盖所有字段, 不残留之前的值
+	decoded := mutated
+	decoded.Tier, decoded.Layers[3].IsIPv6 = 0, true
+	var buf [TUNNEL_INFO_ENCODED_SIZE]byte
+	(&TunnelInfo{}).EncodeTo(buf[:])
+	if err := decoded.Decode(buf[:]); err != nil || decoded != (TunnelInfo{}) || decoded.Hash() == baseHash {
+		t.Errorf("unexpected decoded zero value %+v, %v", decoded, err)
+	}
+	if err := decoded.Decode(buf[:TUNNEL_INFO_ENCODED_SIZE-1]); err == nil {
+		t.Error("expect error for short buffer")
+	}
+}
+
+func BenchmarkTunnelInfoHash(b *testing.B) {
+	packets, _ := loadPcap("nested-tunnel.pcap")
+	tunnel := TunnelInfo{}
+	tunnel.DecapsulateAll(packets[0], 14, false, NewTunnelTypeBitmap(TUNNEL_TYPE_VXLAN, TUNNEL_TYPE_GRE, TUNNEL_TYPE_IPIP), TUNNEL_LAYER_MAX)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tunnel.Hash()
+	}
+}
@@ -129,7 +129,23 @@ func SendToServer(module ModuleId, operate ModuleOperate, args *bytes.Buffer) (*
 	return conn.(*net.UDPConn), recv, err
 }
 
-func SendToClient(conn *net.UDPConn, remote *net.UDPAddr, result uint32, args *bytes.Buffer) {
+// 仅发送命令不等待结果, 用于已建立的会话中客户端向服务端发送后续命令
+func SendOnly(conn *net.UDPConn, module ModuleId, operate ModuleOperate, args *bytes.Buffer) error {
+	sendBuffer := bytes.Buffer{}
+	msg := DebugMessage{Module: uint16(module), Operate: uint16(operate), Result: 0}
+	if args != nil {
+		msg.Args = args.Bytes()
+	}
+	encoder := gob.NewEncoder(&sendBuffer)
+	if err := encoder.Encode(msg); err != nil {
+		return err
+	}
+	_, err := conn.Write(sendBuffer.Bytes())
+	return err
+}
+
+// 返回发送失败的错误, 持续推送数据的命令可据此判断客户端是否已断开
+func SendToClient(conn *net.UDPConn, remote *net.UDPAddr, result uint32, args *bytes.Buffer) error {
 	buffer := bytes.Buffer{}
 	msg := DebugMessage{Module: 0, Result: result, Operate: 11}
 	if args != nil {
@@ -138,15 +154,15 @@ func SendToClient(conn *net.UDPConn, remote *net.UDPAddr, result uint32, args *b
 	encoder := gob.NewEncoder(&buffer)
 	if err := encoder.Encode(msg); err != nil {
 		log.Error(err)
-		return
+		return err
 	}
 
 	if buffer.Len() > UDP_MAXLEN {
 		log.Warningf("data.Len=%d buffer.Len=%d > %d", len(msg.Args), buffer.Len(), UDP_MAXLEN)
-		return
+		return errors.New("debug message too long")
 	}
-	conn.WriteToUDP(buffer.Bytes(), remote)
-	return
+	_, err := conn.WriteToUDP(buffer.Bytes(), remote)
+	return err
 }
 
 func process(conn *net.UDPConn) {
@@ -0,0 +1,51 @@
+/*
+ * Copyright (c) 2024 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pcap
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// pcap和pcapng文件的读取接口, pcapgo.Reader和pcapgo.NgReader均实现
+type Reader interface {
+	gopacket.PacketDataSource
+	LinkType() layers.LinkType
+}
+
+// 打开pcap或pcapng文件, 按文件头识别格式. 读取完毕后由调用者关闭返回的io.Closer
+func OpenFile(file string) (Reader, io.Closer, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	if reader, err := pcapgo.NewReader(f); err == nil {
+		return reader, f, nil
+	}
+	f.Seek(0, io.SeekStart)
+	reader, err := pcapgo.NewNgReader(f, pcapgo.DefaultNgReaderOptions)
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("%s is neither pcap nor pcapng", file)
+	}
+	return reader, f, nil
+}
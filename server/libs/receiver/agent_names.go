@@ -0,0 +1,218 @@
+/*
+ * Copyright (c) 2024 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package receiver
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AGENT_NAME_CACHE_SIZE   = 1 << 16 // 反向DNS缓存的agent IP数上限
+	AGENT_NAME_TTL          = 3600    // 反向DNS结果(包括失败)的缓存时间(秒)
+	AGENT_NAME_LOOKUP_QUEUE = 1024    // 等待解析的IP数上限, 超过时本次不解析
+)
+
+type agentNameEntry struct {
+	name   string // 为空表示解析失败
+	expire int64
+}
+
+// agent IP到主机名的映射, 用于日志和调试命令的输出. 静态文件中的名字优先, 其次为反向DNS.
+// 反向DNS在后台协程中解析, 查询时只读缓存, 未解析或解析失败时返回空
+type agentNameResolver struct {
+	static     map[string]string
+	file       string
+	reverseDNS bool
+	lookupAddr func(addr string) ([]string, error)
+
+	lock    sync.RWMutex
+	cache   map[string]agentNameEntry
+	pending map[string]bool // 已在lookups中等待解析的IP
+	lookups chan string
+	stop    chan struct{}
+	stopped sync.WaitGroup
+}
+
+// 与/etc/hosts格式相同: 每行为IP和主机名, 以空白分隔, #开始的内容为注释. 一个IP有多个名字时使用第一个
+func loadAgentNameFile(file string) (map[string]string, error) {
+	fp, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	names := make(map[string]string)
+	scanner := bufio.NewScanner(fp)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil || len(fields) < 2 {
+			return nil, fmt.Errorf("%s line %d: expect IP and hostname, actual %q", file, line, scanner.Text())
+		}
+		if _, ok := names[ip.String()]; !ok {
+			names[ip.String()] = fields[1]
+		}
+	}
+	return names, scanner.Err()
+}
+
+func newAgentNameResolver(reverseDNS bool, file string) (*agentNameResolver, error) {
+	r := &agentNameResolver{
+		static:     map[string]string{},
+		file:       file,
+		reverseDNS: reverseDNS,
+		lookupAddr: net.LookupAddr,
+		cache:      make(map[string]agentNameEntry),
+		pending:    make(map[string]bool),
+		lookups:    make(chan string, AGENT_NAME_LOOKUP_QUEUE),
+		stop:       make(chan struct{}),
+	}
+	if file != "" {
+		static, err := loadAgentNameFile(file)
+		if err != nil {
+			return nil, err
+		}
+		r.static = static
+	}
+	return r, nil
+}
+
+func (r *agentNameResolver) start() {
+	if !r.reverseDNS {
+		return
+	}
+	r.stopped.Add(1)
+	go r.run()
+}
+
+func (r *agentNameResolver) close() {
+	close(r.stop)
+	r.stopped.Wait()
+}
+
+// 不阻塞, 缓存过期时先返回过期的名字并在后台重新解析. 未开启解析(r为nil)时返回空
+func (r *agentNameResolver) name(ip net.IP) string {
+	if r == nil || ip == nil {
+		return ""
+	}
+	key := ip.String()
+	if name, ok := r.static[key]; ok || !r.reverseDNS {
+		return name
+	}
+	r.lock.RLock()
+	entry, ok := r.cache[key]
+	r.lock.RUnlock()
+	if ok && entry.expire > time.Now().Unix() {
+		return entry.name
+	}
+
+	r.lock.Lock()
+	if !r.pending[key] {
+		select {
+		case r.lookups <- key:
+			r.pending[key] = true
+		default:
+		}
+	}
+	r.lock.Unlock()
+	return entry.name
+}
+
+func (r *agentNameResolver) run() {
+	defer r.stopped.Done()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case key := <-r.lookups:
+			name := ""
+			if names, err := r.lookupAddr(key); err == nil && len(names) > 0 {
+				name = strings.TrimSuffix(names[0], ".")
+			}
+			r.store(key, name, time.Now().Unix()+AGENT_NAME_TTL)
+		}
+	}
+}
+
+func (r *agentNameResolver) store(key, name string, expire int64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.pending, key)
+	if _, ok := r.cache[key]; !ok && len(r.cache) >= AGENT_NAME_CACHE_SIZE {
+		// 先清除过期的条目, 仍然满时随机淘汰一个
+		now := time.Now().Unix()
+		for k, entry := range r.cache {
+			if entry.expire <= now {
+				delete(r.cache, k)
+			}
+		}
+		for k := range r.cache {
+			if len(r.cache) < AGENT_NAME_CACHE_SIZE {
+				break
+			}
+			delete(r.cache, k)
+		}
+	}
+	r.cache[key] = agentNameEntry{name: name, expire: expire}
+}
+
+// 日志中显示的agent, 主机名已知时为"IP(主机名)", 否则与原来一样只有IP
+func (r *agentNameResolver) displayName(ip net.IP) string {
+	return displayName(ip.String(), r.name(ip))
+}
+
+// 用于已经取得主机名的调试命令输出
+func displayName(ip, hostname string) string {
+	if hostname != "" {
+		return ip + "(" + hostname + ")"
+	}
+	return ip
+}
+
+// 同displayName, 带端口
+func (r *agentNameResolver) displayAddr(addr net.Addr) string {
+	if addr == nil {
+		return "<nil>"
+	}
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		if a != nil {
+			ip = a.IP
+		}
+	case *net.UDPAddr:
+		if a != nil {
+			ip = a.IP
+		}
+	}
+	if name := r.name(ip); name != "" {
+		return addr.String() + "(" + name + ")"
+	}
+	return addr.String()
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright (c) 2024 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package receiver
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAgentNameFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "agents")
+	os.WriteFile(file, []byte("# agents\n10.1.2.3 node-1 node-1.example.com\n\nfd00::0:1 node-2 # ipv6\n10.1.2.3 node-3\n"), 0644)
+	resolver, err := newAgentNameResolver(false, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver.start()
+	defer resolver.close()
+
+	for _, c := range []struct {
+		addr     net.Addr
+		expected string
+	}{
+		{&net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 30033}, "10.1.2.3:30033(node-1)"},
+		{&net.TCPAddr{IP: net.ParseIP("fd00::1"), Port: 30033}, "[fd00::1]:30033(node-2)"},
+		{&net.TCPAddr{IP: net.ParseIP("10.1.2.4"), Port: 30033}, "10.1.2.4:30033"},
+		{(*net.UDPAddr)(nil), "<nil>"},
+		{nil, "<nil>"},
+	} {
+		if name := resolver.displayAddr(c.addr); name != c.expected {
+			t.Errorf("expect %s, actual %s", c.expected, name)
+		}
+	}
+	if name := resolver.displayName(net.ParseIP("10.1.2.3")); name != "10.1.2.3(node-1)" {
+		t.Errorf("unexpected name %s", name)
+	}
+	// 未开启解析时只显示IP
+	var disabled *agentNameResolver
+	if name := disabled.displayAddr(&net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 30033}); name != "10.1.2.3:30033" {
+		t.Errorf("unexpected name %s", name)
+	}
+
+	os.WriteFile(file, []byte("10.1.2.3\n"), 0644)
+	if _, err := newAgentNameResolver(false, file); err == nil {
+		t.Error("expect error for line without hostname")
+	}
+}
+
+func TestAgentNameReverseDNS(t *testing.T) {
+	resolver, _ := newAgentNameResolver(true, "")
+	lookups := make(chan string, 10)
+	resolver.lookupAddr = func(addr string) ([]string, error) {
+		lookups <- addr
+		if addr == "10.1.2.3" {
+			return []string{"node-1.example.com."}, nil
+		}
+		return nil, errors.New("not found")
+	}
+	resolver.start()
+	defer resolver.close()
+
+	// 首次查询不等待解析结果
+	for _, ip := range []string{"10.1.2.3", "10.1.2.3", "10.1.2.4"} {
+		if name := resolver.name(net.ParseIP(ip)); name != "" {
+			t.Errorf("%s: name should not be resolved yet, actual %s", ip, name)
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if resolver.name(net.ParseIP("10.1.2.3")) != "" && resolver.name(net.ParseIP("10.1.2.4")) == "" && len(lookups) == 2 {
+			break
+		}
+	}
+	if name := resolver.name(net.ParseIP("10.1.2.3")); name != "node-1.example.com" {
+		t.Errorf("unexpected name %s", name)
+	}
+	// 解析失败也会缓存, 每个IP只解析一次
+	resolver.name(net.ParseIP("10.1.2.4"))
+	if len(lookups) != 2 {
+		t.Errorf("expect 2 lookups, actual %d", len(lookups))
+	}
+
+	// 过期后返回旧的名字, 同时重新解析
+	resolver.store("10.1.2.3", "node-1.example.com", time.Now().Unix()-1)
+	if name := resolver.name(net.ParseIP("10.1.2.3")); name != "node-1.example.com" {
+		t.Errorf("expired name should be returned, actual %s", name)
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(lookups) < 3 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+	}
+	if len(lookups) != 3 {
+		t.Errorf("expect 3 lookups, actual %d", len(lookups))
+	}
+}
+
+func TestAgentNamesPerReceiver(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "agents")
+	os.WriteFile(file, []byte("10.1.2.3 node-1\n"), 0644)
+	r1, err := NewReceiverWithConfig(ReceiverConfig{ListenPort: 30033, AgentNameFile: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := NewReceiverWithConfig(ReceiverConfig{ListenPort: 30034, AgentNameFile: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r2.Close()
+	r3, err := NewReceiverWithConfig(ReceiverConfig{ListenPort: 30035})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r3.Close()
+
+	// 关闭一个Receiver不影响其他Receiver的主机名解析
+	r1.Close()
+	ip := net.ParseIP("10.1.2.3")
+	if name := r2.agentNames.displayName(ip); name != "10.1.2.3(node-1)" {
+		t.Errorf("unexpected name %s", name)
+	}
+	if name := r3.agentNames.displayName(ip); name != "10.1.2.3" {
+		t.Errorf("unexpected name %s", name)
+	}
+}
@@ -0,0 +1,200 @@
+/*
+ * Copyright (c) 2024 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// 将在数据节点上tcpdump抓取的采集器UDP报文按原始间隔(或按倍速)重放到测试环境的数据节点, 例如:
+//
+//	replay -r agent.pcap -d 10.1.1.1:30033 -x 2 -s 127.0.0.2
+//
+// 包头有效的消息经datatype.MessageEncoder重新组装后发送, 与测试和模拟agent使用相同的编码
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/ip4defrag"
+	"github.com/google/gopacket/layers"
+
+	"github.com/deepflowio/deepflow/server/libs/datatype"
+	"github.com/deepflowio/deepflow/server/libs/pcap"
+)
+
+const DEFAULT_AGENT_PORT = 30033
+
+var pcapFile = flag.String("r", "", "pcap or pcapng file to replay")
+var target = flag.String("d", "", "destination address of the receiver, e.g. 10.1.1.1:30033")
+var agentPort = flag.Uint("p", DEFAULT_AGENT_PORT, "only replay UDP datagrams sent to this port")
+var sourceIP = flag.String("s", "", "local address to send from, receiver identifies agents by source IP")
+var speed = flag.Float64("x", 1, "replay speed factor, 2 halves the inter-packet gaps, 0 sends as fast as possible")
+var count = flag.Int("c", 0, "stop after sending this many datagrams, 0 for all")
+var agentID = flag.Int("a", -1, "rewrite the agent ID of messages with the latest header version, e.g. to replay one agent as another, -1 to keep")
+
+type replaySummary struct {
+	sent     int
+	bytes    int
+	invalid  int // 包头无法解析, 仍会发送
+	failed   int
+	skipped  int
+	duration time.Duration
+}
+
+func (s *replaySummary) String() string {
+	pps := 0.0
+	if s.duration > 0 {
+		pps = float64(s.sent) / s.duration.Seconds()
+	}
+	return fmt.Sprintf("sent %d datagrams (%d bytes, %d with invalid header), %d send failed, %d packets skipped, duration %s, %.1f pps",
+		s.sent, s.bytes, s.invalid, s.failed, s.skipped, s.duration, pps)
+}
+
+// 返回发往agentPort的UDP负载, 分片的IPv4报文在重组完成后返回
+func agentDatagram(packet gopacket.Packet, defragger *ip4defrag.IPv4Defragmenter) []byte {
+	if ip4, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4); ok && (ip4.Flags&layers.IPv4MoreFragments != 0 || ip4.FragOffset != 0) {
+		reassembled, err := defragger.DefragIPv4WithTimestamp(ip4, packet.Metadata().Timestamp)
+		if err != nil || reassembled == nil {
+			return nil
+		}
+		packet = gopacket.NewPacket(reassembled.Payload, reassembled.NextLayerType(), gopacket.Default)
+	}
+	udp, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if !ok || uint(udp.DstPort) != *agentPort {
+		return nil
+	}
+	return udp.Payload
+}
+
+// 按包头重新组装消息, 指定了agentID时改写FlowHeader中的agent ID, 包头CRC随之重新计算.
+// 旧版本包头, 无法解码的FlowHeader和长度与FrameSize不一致的消息返回nil, 由调用者原样发送
+func encodeDatagram(header *datatype.BaseHeader, datagram []byte, encoder *datatype.MessageEncoder, buf []byte) []byte {
+	if int(header.FrameSize) != len(datagram) {
+		return nil
+	}
+	encoder.Type = header.Type
+	encoder.FlowHeader = datatype.FlowHeader{}
+	if header.Type.HeaderType() == datatype.HEADER_TYPE_LT_VTAP {
+		if encoder.FlowHeader.Decode(datagram[datatype.MESSAGE_HEADER_LEN:]) != nil || encoder.FlowHeader.Version != datatype.LATEST_VERSION {
+			return nil
+		}
+		if *agentID >= 0 {
+			encoder.FlowHeader.AgentID = uint16(*agentID)
+		}
+	}
+	headerLen := encoder.HeaderLen()
+	if len(datagram) < headerLen {
+		return nil
+	}
+	encoder.Reset()
+	encoder.Append(datagram[headerLen:])
+	return encoder.Emit(buf[:0])
+}
+
+func replay(reader pcap.Reader, conn net.Conn) *replaySummary {
+	summary := &replaySummary{}
+	source := gopacket.NewPacketSource(reader, reader.LinkType())
+	source.DecodeOptions = gopacket.DecodeOptions{Lazy: true, NoCopy: true}
+	defragger := ip4defrag.NewIPv4Defragmenter()
+	header := &datatype.BaseHeader{}
+	encoder := &datatype.MessageEncoder{}
+	var buf []byte
+
+	var start, firstTimestamp time.Time
+	for *count <= 0 || summary.sent < *count {
+		packet, err := source.NextPacket()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			summary.skipped++
+			continue
+		}
+		datagram := agentDatagram(packet, defragger)
+		if datagram == nil {
+			summary.skipped++
+			continue
+		}
+
+		timestamp := packet.Metadata().Timestamp
+		if start.IsZero() {
+			start, firstTimestamp = time.Now(), timestamp
+		} else if *speed > 0 {
+			gap := time.Duration(float64(timestamp.Sub(firstTimestamp)) / *speed)
+			if wait := time.Until(start.Add(gap)); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+
+		if header.Decode(datagram) != nil {
+			summary.invalid++
+		} else if encoded := encodeDatagram(header, datagram, encoder, buf); encoded != nil {
+			datagram, buf = encoded, encoded
+		}
+		if _, err := conn.Write(datagram); err != nil {
+			summary.failed++
+			continue
+		}
+		summary.sent++
+		summary.bytes += len(datagram)
+	}
+	if !start.IsZero() {
+		summary.duration = time.Since(start)
+	}
+	return summary
+}
+
+func main() {
+	flag.Parse()
+	if *pcapFile == "" || *target == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *agentID > 0xffff {
+		fmt.Fprintf(os.Stderr, "invalid agent id %d\n", *agentID)
+		os.Exit(1)
+	}
+	remote, err := net.ResolveUDPAddr("udp", *target)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid destination %s: %s\n", *target, err)
+		os.Exit(1)
+	}
+	var local *net.UDPAddr
+	if *sourceIP != "" {
+		ip := net.ParseIP(*sourceIP)
+		if ip == nil {
+			fmt.Fprintf(os.Stderr, "invalid source ip %s\n", *sourceIP)
+			os.Exit(1)
+		}
+		local = &net.UDPAddr{IP: ip}
+	}
+	conn, err := net.DialUDP("udp", local, remote)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dial %s failed: %s\n", remote, err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+
+	reader, closer, err := pcap.OpenFile(*pcapFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer closer.Close()
+
+	fmt.Println(replay(reader, conn))
+}
@@ -17,7 +17,10 @@
 package receiver
 
 import (
+	"encoding/json"
 	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/spf13/cobra"
 
@@ -29,6 +32,204 @@ const (
 	TRIDENT_ADAPTER_STATUS_CMD = 40
 )
 
+// 0 ~ MESSAGE_TYPE_MAX-1 为各消息类型的状态查询命令
+const (
+	ADAPTER_CMD_STATUS = uint16(datatype.MESSAGE_TYPE_MAX) + iota
+	ADAPTER_CMD_ALL
+	ADAPTER_CMD_RESET_COUNTERS
+	ADAPTER_CMD_POOL
+	ADAPTER_CMD_WATCH // 仅用于JSON输出中标识命令, watch通过TRIDENT_ADAPTER_WATCH_CMD模块处理
+	ADAPTER_CMD_ERRORS
+	ADAPTER_CMD_RECORDS
+	ADAPTER_CMD_ERROR_TAP
+	ADAPTER_CMD_HEALTH
+	ADAPTER_CMD_CONFIG
+	ADAPTER_CMD_TENANTS
+	ADAPTER_CMD_MIRROR
+)
+
+// JSON输出的格式版本, 字段有不兼容的修改时需要增加
+const COMMAND_OUTPUT_VERSION = 1
+
+const (
+	CMD_ARG_JSON             = "json"
+	CMD_ARG_INCLUDE_LIFETIME = "include-lifetime"
+	CMD_ARG_TAP_ON           = "on" // error-tap和mirror共用
+	CMD_ARG_TAP_OFF          = "off"
+	CMD_ARG_TAP_FILE         = "file=" // 后接相对于ErrorTapDirectory的文件路径, 路径中不能包含空格
+	CMD_ARG_TAP_POLICY_DROPS = "policy-drops"
+	CMD_ARG_STALE            = "stale=" // 后接秒数
+	CMD_ARG_GONE             = "gone="  // 后接秒数
+	CMD_ARG_TENANT_RELOAD    = "reload"
+	CMD_ARG_TENANT_RULE      = "rule="   // 后接"网段=标签", 可以有多个
+	CMD_ARG_MIRROR_DEST      = "dest="   // 已不支持, 目标地址只能通过配置修改, 收到时返回错误
+	CMD_ARG_MIRROR_FILTER    = "filter=" // 后接网段或IP, 可以有多个
+)
+
+type commandArgs struct {
+	json            bool
+	includeLifetime bool
+	tapAction       string // CMD_ARG_TAP_ON, CMD_ARG_TAP_OFF或为空(仅查看状态)
+	tapFile         string
+	tapPolicyDrops  bool
+	staleAfter      uint32
+	goneAfter       uint32
+	tenantReload    bool
+	tenantRules     []string
+	mirrorDest      string
+	mirrorFilters   []string
+}
+
+// 客户端将选项以空格分隔的字符串传递给服务端
+func parseCommandArgs(arg string) *commandArgs {
+	args := &commandArgs{}
+	for _, field := range strings.Fields(arg) {
+		switch field {
+		case CMD_ARG_JSON:
+			args.json = true
+		case CMD_ARG_INCLUDE_LIFETIME:
+			args.includeLifetime = true
+		case CMD_ARG_TAP_ON, CMD_ARG_TAP_OFF:
+			args.tapAction = field
+		case CMD_ARG_TAP_POLICY_DROPS:
+			args.tapPolicyDrops = true
+		case CMD_ARG_TENANT_RELOAD:
+			args.tenantReload = true
+		default:
+			if strings.HasPrefix(field, CMD_ARG_TAP_FILE) {
+				args.tapFile = strings.TrimPrefix(field, CMD_ARG_TAP_FILE)
+			} else if strings.HasPrefix(field, CMD_ARG_STALE) {
+				args.staleAfter = parseSeconds(strings.TrimPrefix(field, CMD_ARG_STALE))
+			} else if strings.HasPrefix(field, CMD_ARG_GONE) {
+				args.goneAfter = parseSeconds(strings.TrimPrefix(field, CMD_ARG_GONE))
+			} else if strings.HasPrefix(field, CMD_ARG_TENANT_RULE) {
+				args.tenantRules = append(args.tenantRules, strings.TrimPrefix(field, CMD_ARG_TENANT_RULE))
+			} else if strings.HasPrefix(field, CMD_ARG_MIRROR_DEST) {
+				args.mirrorDest = strings.TrimPrefix(field, CMD_ARG_MIRROR_DEST)
+			} else if strings.HasPrefix(field, CMD_ARG_MIRROR_FILTER) {
+				args.mirrorFilters = append(args.mirrorFilters, strings.TrimPrefix(field, CMD_ARG_MIRROR_FILTER))
+			}
+		}
+	}
+	return args
+}
+
+// 无法解析时返回0, 即使用默认值
+func parseSeconds(value string) uint32 {
+	seconds, _ := strconv.ParseUint(value, 10, 32)
+	return uint32(seconds)
+}
+
+type CommandOutput struct {
+	Version int         `json:"version"`
+	Command uint16      `json:"command"`
+	Error   string      `json:"error,omitempty"`
+	Result  interface{} `json:"result,omitempty"`
+}
+
+type commandError string
+
+func (e commandError) String() string {
+	return string(e)
+}
+
+func marshalCommandOutput(op uint16, result fmt.Stringer) string {
+	output := &CommandOutput{Version: COMMAND_OUTPUT_VERSION, Command: op}
+	if err, ok := result.(commandError); ok {
+		output.Error = string(err)
+	} else {
+		output.Result = result
+	}
+	bytes, err := json.Marshal(output)
+	if err != nil {
+		return fmt.Sprintf(`{"version":%d,"command":%d,"error":%q}`, COMMAND_OUTPUT_VERSION, op, err.Error())
+	}
+	return string(bytes)
+}
+
+type StatusReports []*StatusReport
+
+func (r StatusReports) String() string {
+	if len(r) == 1 {
+		return r[0].String()
+	}
+	ret := ""
+	for _, report := range r {
+		ret += report.String()
+		ret += "\n"
+	}
+	return ret
+}
+
+type CounterReset struct {
+	Counter          *ReceiverCounter `json:"counter"` // reset前的计数值
+	IncludeLifetime  bool             `json:"include_lifetime"`
+	ClearedInstances int              `json:"cleared_instances"`
+}
+
+func (c *CounterReset) String() string {
+	status := fmt.Sprintf("Counters before reset:\n")
+	status += fmt.Sprintf("    %-18s %d\n", "Invalid", c.Counter.Invalid)
+	status += fmt.Sprintf("    %-18s %d\n", "Unregistered", c.Counter.Unregistered)
+	status += fmt.Sprintf("    %-18s %d\n", "RxPackets", c.Counter.RxPackets)
+	status += fmt.Sprintf("    %-18s %d\n", "MaxDelay", c.Counter.MaxDelay)
+	status += fmt.Sprintf("    %-18s %d\n", "MinDelay", c.Counter.MinDelay)
+	status += fmt.Sprintf("    %-18s %d\n", "UDPDropped", c.Counter.UDPDropped)
+	status += fmt.Sprintf("    %-18s %d\n", "UDPDisorder", c.Counter.UDPDisorder)
+	status += fmt.Sprintf("    %-18s %d\n", "UDPDisorderSize", c.Counter.UDPDisorderSize)
+	status += fmt.Sprintf("    %-18s %d\n", "NewBufferCount", c.Counter.NewBufferCount)
+	status += fmt.Sprintf("    %-18s %d\n", "UnknownVersion", c.Counter.UnknownVersion)
+	status += fmt.Sprintf("    %-18s %d\n", "HeaderCRCError", c.Counter.HeaderCRCError)
+	status += fmt.Sprintf("    %-18s %d\n", "RxPartial", c.Counter.RxPartial)
+	status += fmt.Sprintf("    %-18s %d\n", "RxHeartbeats", c.Counter.RxHeartbeats)
+	status += fmt.Sprintf("    %-18s %d\n", "RxLegacy", c.Counter.RxLegacy)
+	status += fmt.Sprintf("    %-18s %d\n", "TenantUnmatched", c.Counter.TenantUnmatched)
+	status += fmt.Sprintf("    %-18s %d\n", "CompressedBytes", c.Counter.CompressedBytes)
+	status += fmt.Sprintf("    %-18s %d\n", "DecompressedBytes", c.Counter.DecompressedBytes)
+	status += fmt.Sprintf("    %-18s %d\n", "DecompressFailed", c.Counter.DecompressFailed)
+	status += fmt.Sprintf("    %-18s %d\n", "RxRecords", c.Counter.RxRecords)
+	status += fmt.Sprintf("    %-18s %d\n", "PartialDecode", c.Counter.PartialDecode)
+	status += fmt.Sprintf("    %-18s %.2f\n", "AvgRecords", c.Counter.AvgRecords)
+	status += fmt.Sprintf("    %-18s %d\n", "Records1", c.Counter.Records1)
+	status += fmt.Sprintf("    %-18s %d\n", "Records2To10", c.Counter.Records2To10)
+	status += fmt.Sprintf("    %-18s %d\n", "Records11To50", c.Counter.Records11To50)
+	status += fmt.Sprintf("    %-18s %d\n", "Records51To200", c.Counter.Records51To200)
+	status += fmt.Sprintf("    %-18s %d\n", "RecordsOver200", c.Counter.RecordsOver200)
+	status += fmt.Sprintf("    %-18s %d\n", "StatsdFailed", c.Counter.StatsdFailed)
+	status += fmt.Sprintf("    %-18s %d\n", "UDPReadTimeout", c.Counter.UDPReadTimeout)
+	status += fmt.Sprintf("    %-18s %d\n", "RxRunts", c.Counter.RxRunts)
+	if c.IncludeLifetime {
+		status += fmt.Sprintf("Cleared %d agent status instances\n", c.ClearedInstances)
+	}
+	return status
+}
+
+type BufferPoolStats struct {
+	BufferSize     int    `json:"buffer_size"`
+	PoolSizePerCPU int    `json:"pool_size_per_cpu"` // 同时也是初始化时每个CPU预分配的数量
+	Outstanding    uint64 `json:"outstanding"`
+	Pooled         uint64 `json:"pooled"` // 估算值, GC时sync.Pool可能会释放部分buffer
+	Allocated      uint64 `json:"allocated"`
+	HighWaterMark  uint64 `json:"high_water_mark"`
+	Misses         uint64 `json:"misses"`
+}
+
+type BufferPoolStatsList []*BufferPoolStats
+
+func (l BufferPoolStatsList) String() string {
+	status := fmt.Sprintf("BufferSize PoolSizePerCPU Outstanding Pooled     Allocated  HighWaterMark Misses\n")
+	status += fmt.Sprintf("-------------------------------------------------------------------------------\n")
+	for _, s := range l {
+		bufferSize := fmt.Sprintf("%dK", s.BufferSize>>10)
+		if s.BufferSize == 0 {
+			bufferSize = "dynamic"
+		}
+		status += fmt.Sprintf("%-10s %-14d %-11d %-10d %-10d %-13d %d\n",
+			bufferSize, s.PoolSizePerCPU, s.Outstanding, s.Pooled, s.Allocated, s.HighWaterMark, s.Misses)
+	}
+	return status
+}
+
 // 客户端注册命令
 func RegisterTridentStatusCommand() *cobra.Command {
 	operates := []debug.CmdHelper{}
@@ -37,12 +238,116 @@ func RegisterTridentStatusCommand() *cobra.Command {
 	}
 	operates = append(operates, debug.CmdHelper{Cmd: "status", Helper: "show agent 'metrics' status"})
 	operates = append(operates, debug.CmdHelper{Cmd: "all", Helper: "show all status"})
+	operates = append(operates, debug.CmdHelper{Cmd: "reset-counters", Helper: "reset interval counters and show the values before reset"})
+	operates = append(operates, debug.CmdHelper{Cmd: "pool", Helper: "show receive buffer pool statistics"})
+	// watch不是简单命令, 占位以保证后续命令的序号与ADAPTER_CMD_*一致
+	operates = append(operates, debug.CmdHelper{})
+	operates = append(operates, debug.CmdHelper{Cmd: "errors", Helper: "show header decode errors by reason and the last error of each agent"})
+	operates = append(operates, debug.CmdHelper{Cmd: "records", Helper: "show the distribution of records per message of each agent"})
+	operates = append(operates, debug.CmdHelper{Cmd: "error-tap [on|off]", Helper: "show, enable or disable writing invalid datagrams to a rotating pcap file"})
+	operates = append(operates, debug.CmdHelper{Cmd: "health", Helper: "show agents grouped by active, stale and gone"})
+	operates = append(operates, debug.CmdHelper{Cmd: "config", Helper: "show the effective receiver config"})
+	operates = append(operates, debug.CmdHelper{Cmd: "tenants [PREFIX=LABEL ...]", Helper: "show the tenant of each agent, or replace the tenant rules with --reload"})
+	operates = append(operates, debug.CmdHelper{Cmd: "mirror [on|off]", Helper: "show, enable or disable mirroring received UDP datagrams to the configured mirror-destination"})
 
-	return debug.ClientRegisterSimple(TRIDENT_ADAPTER_STATUS_CMD,
-		debug.CmdHelper{
-			Cmd:    "adapter",
-			Helper: "show agent status",
+	var jsonOutput, includeLifetime, tapPolicyDrops bool
+	var tapFile string
+	var staleAfter, goneAfter uint32
+	var tenantReload bool
+	var mirrorFilters []string
+	command := &cobra.Command{
+		Use:   "adapter",
+		Short: "show agent status",
+		Run: func(cmd *cobra.Command, args []string) {
+			fmt.Printf("please run with arguments: ")
+			for _, operate := range operates {
+				if operate.Cmd == "" {
+					continue
+				}
+				fmt.Printf("\n    %-32s : %s", operate.Cmd, operate.Helper)
+			}
+			fmt.Println()
 		},
-		operates,
-	)
+	}
+	command.PersistentFlags().BoolVarP(&jsonOutput, "json", "j", false, "output in JSON format")
+
+	for i, operate := range operates {
+		if operate.Cmd == "" {
+			continue
+		}
+		op := i
+		sub := &cobra.Command{
+			Use:   operate.Cmd,
+			Short: operate.Helper,
+			Run: func(cmd *cobra.Command, args []string) {
+				options := []string{}
+				if jsonOutput {
+					options = append(options, CMD_ARG_JSON)
+				}
+				if includeLifetime {
+					options = append(options, CMD_ARG_INCLUDE_LIFETIME)
+				}
+				if uint16(op) == ADAPTER_CMD_ERROR_TAP {
+					if len(args) > 0 {
+						options = append(options, args[0])
+					}
+					if tapFile != "" {
+						options = append(options, CMD_ARG_TAP_FILE+tapFile)
+					}
+					if tapPolicyDrops {
+						options = append(options, CMD_ARG_TAP_POLICY_DROPS)
+					}
+				}
+				if uint16(op) == ADAPTER_CMD_HEALTH {
+					if staleAfter > 0 {
+						options = append(options, fmt.Sprintf("%s%d", CMD_ARG_STALE, staleAfter))
+					}
+					if goneAfter > 0 {
+						options = append(options, fmt.Sprintf("%s%d", CMD_ARG_GONE, goneAfter))
+					}
+				}
+				if uint16(op) == ADAPTER_CMD_TENANTS && tenantReload {
+					options = append(options, CMD_ARG_TENANT_RELOAD)
+					for _, rule := range args {
+						options = append(options, CMD_ARG_TENANT_RULE+rule)
+					}
+				}
+				if uint16(op) == ADAPTER_CMD_MIRROR {
+					if len(args) > 0 {
+						options = append(options, args[0])
+					}
+					for _, filter := range mirrorFilters {
+						options = append(options, CMD_ARG_MIRROR_FILTER+filter)
+					}
+				}
+				result, err := debug.CommmandGetResult(TRIDENT_ADAPTER_STATUS_CMD, op, strings.Join(options, " "))
+				if err != nil {
+					fmt.Println("Get result failed", err)
+					return
+				}
+				fmt.Println(result)
+			},
+		}
+		switch uint16(op) {
+		case ADAPTER_CMD_RESET_COUNTERS:
+			sub.Flags().BoolVar(&includeLifetime, CMD_ARG_INCLUDE_LIFETIME, false, "also clear the status of every agent")
+		case ADAPTER_CMD_ERROR_TAP:
+			sub.Args = cobra.MaximumNArgs(1)
+			sub.ValidArgs = []string{CMD_ARG_TAP_ON, CMD_ARG_TAP_OFF}
+			sub.Flags().StringVar(&tapFile, "file", "", "pcap file to write, relative to the configured error tap directory, default "+ERROR_TAP_DEFAULT_FILE_NAME)
+			sub.Flags().BoolVar(&tapPolicyDrops, CMD_ARG_TAP_POLICY_DROPS, false, "also capture messages dropped because no handler is registered")
+		case ADAPTER_CMD_HEALTH:
+			sub.Flags().Uint32Var(&staleAfter, "stale", 0, fmt.Sprintf("seconds without data before an agent is stale, default %d", AGENT_HEALTH_DEFAULT_STALE))
+			sub.Flags().Uint32Var(&goneAfter, "gone", 0, fmt.Sprintf("seconds without data before an agent is gone, default %d", AGENT_HEALTH_DEFAULT_GONE))
+		case ADAPTER_CMD_TENANTS:
+			sub.Flags().BoolVar(&tenantReload, CMD_ARG_TENANT_RELOAD, false, "replace the tenant rules with the arguments, no arguments to clear")
+		case ADAPTER_CMD_MIRROR:
+			sub.Args = cobra.MaximumNArgs(1)
+			sub.ValidArgs = []string{CMD_ARG_TAP_ON, CMD_ARG_TAP_OFF}
+			sub.Flags().StringSliceVar(&mirrorFilters, "filter", nil, "only mirror datagrams from these agent IPs or prefixes, default all")
+		}
+		command.AddCommand(sub)
+	}
+	command.AddCommand(registerWatchCommand(&jsonOutput))
+	return command
 }
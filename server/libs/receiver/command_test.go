@@ -0,0 +1,204 @@
+/*
+ * Copyright (c) 2024 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package receiver
+
+import (
+	"encoding/json"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/deepflowio/deepflow/server/libs/datatype"
+)
+
+func newTestReceiver() *Receiver {
+	r := &Receiver{
+		counter:     &ReceiverCounter{},
+		status:      &AdapterStatus{},
+		warningLogs: newRateLimitedLogger(1, LOG_INTERVAL, LOG_LIMIT_KEYS),
+		legacyLogs:  newRateLimitedLogger(1, LEGACY_WARNING_INTERVAL, LOG_LIMIT_KEYS),
+	}
+	r.status.init()
+	r.DropDetection.Init("receiver", DROP_DETECT_WINDOW_SIZE)
+	return r
+}
+
+type statusOutput struct {
+	Version int             `json:"version"`
+	Command uint16          `json:"command"`
+	Error   string          `json:"error"`
+	Result  []*StatusReport `json:"result"`
+}
+
+func TestStatusCommandJSON(t *testing.T) {
+	r := newTestReceiver()
+	now := uint32(1700000000)
+	r.status.Update(now, datatype.MESSAGE_TYPE_METRICS, 3, 1, datatype.LATEST_VERSION, datatype.ENCODER_RAW, net.ParseIP("10.1.1.1"), 0, now-2, UDP)
+	r.status.Update(now, datatype.MESSAGE_TYPE_METRICS, 4, 1, datatype.LATEST_VERSION, datatype.ENCODER_RAW, net.ParseIP("10.1.1.2"), 0, now-1, TCP)
+	r.status.Update(now, datatype.MESSAGE_TYPE_SYSLOG, 0, 1, datatype.OLD_VERSION, datatype.ENCODER_RAW, net.ParseIP("10.1.1.3"), 0, 0, UDP)
+
+	for op := uint16(0); op <= ADAPTER_CMD_ALL; op++ {
+		output := &statusOutput{}
+		if err := json.Unmarshal([]byte(r.HandleSimpleCommand(op, CMD_ARG_JSON)), output); err != nil {
+			t.Fatalf("command %d: unmarshal failed: %s", op, err)
+		}
+		if output.Version != COMMAND_OUTPUT_VERSION || output.Command != op || output.Error != "" {
+			t.Errorf("command %d: unexpected envelope %+v", op, output)
+		}
+		expectReports := 1
+		if op == ADAPTER_CMD_ALL {
+			expectReports = int(datatype.MESSAGE_TYPE_MAX)
+		}
+		if len(output.Result) != expectReports {
+			t.Errorf("command %d: expect %d reports, found %d", op, expectReports, len(output.Result))
+		}
+	}
+
+	output := &statusOutput{}
+	json.Unmarshal([]byte(r.HandleSimpleCommand(ADAPTER_CMD_STATUS, CMD_ARG_JSON)), output)
+	items := output.Result[0].Items
+	if len(items) != 2 || items[0].VTAPID != 3 || items[0].TridentIP != "10.1.1.1" || items[1].Type != "TCP" || items[0].LastDelay != 2 {
+		t.Errorf("unexpected metrics status %+v", items)
+	}
+
+	output = &statusOutput{}
+	json.Unmarshal([]byte(r.HandleSimpleCommand(uint16(datatype.MESSAGE_TYPE_SYSLOG), CMD_ARG_JSON)), output)
+	if output.Result[0].WithVtap || len(output.Result[0].Items) != 1 || output.Result[0].Items[0].TridentIP != "10.1.1.3" {
+		t.Errorf("unexpected syslog status %+v", output.Result[0])
+	}
+}
+
+func TestStatusCommandText(t *testing.T) {
+	r := newTestReceiver()
+	if result := r.HandleSimpleCommand(ADAPTER_CMD_STATUS, ""); result != r.status.GetStatus(datatype.MESSAGE_TYPE_METRICS) {
+		t.Errorf("unexpected text output %s", result)
+	}
+	output := &statusOutput{}
+	if err := json.Unmarshal([]byte(r.HandleSimpleCommand(ADAPTER_CMD_ALL+100, CMD_ARG_JSON)), output); err != nil || output.Error == "" {
+		t.Errorf("expect error for unknown command, found %+v, %v", output, err)
+	}
+}
+
+func TestResetCounters(t *testing.T) {
+	r := newTestReceiver()
+	now := uint32(1700000000)
+	r.status.Update(now, datatype.MESSAGE_TYPE_METRICS, 3, 1, datatype.LATEST_VERSION, datatype.ENCODER_RAW, net.ParseIP("10.1.1.1"), 0, now, UDP)
+	r.counter.RxPackets = 100
+	r.counter.Invalid = 2
+	r.counter.UDPReadTimeout = 5
+	r.counter.RxRunts = 7
+
+	output := &struct {
+		Version int           `json:"version"`
+		Result  *CounterReset `json:"result"`
+	}{}
+	if err := json.Unmarshal([]byte(r.HandleSimpleCommand(ADAPTER_CMD_RESET_COUNTERS, CMD_ARG_JSON)), output); err != nil {
+		t.Fatalf("unmarshal failed: %s", err)
+	}
+	if output.Result.Counter.RxPackets != 100 || output.Result.Counter.Invalid != 2 || output.Result.IncludeLifetime {
+		t.Errorf("unexpected counter before reset %+v", output.Result)
+	}
+	text := output.Result.String()
+	for _, line := range []string{"UDPReadTimeout     5\n", "RxRunts            7\n"} {
+		if !strings.Contains(text, line) {
+			t.Errorf("text output misses %q:\n%s", line, text)
+		}
+	}
+	// 每个计数器都需要在文本输出中显示
+	counterType := reflect.TypeOf(ReceiverCounter{})
+	for i := 0; i < counterType.NumField(); i++ {
+		if name := counterType.Field(i).Name; !strings.Contains(text, "    "+name+" ") {
+			t.Errorf("text output misses counter %s", name)
+		}
+	}
+	if counter := r.GetCounter().(*ReceiverCounter); counter.RxPackets != 0 || counter.Invalid != 0 {
+		t.Errorf("counter is not reset %+v", counter)
+	}
+	if len(r.status.GetStatusReport(datatype.MESSAGE_TYPE_METRICS).Items) != 1 {
+		t.Error("agent status should be kept without include-lifetime")
+	}
+
+	reset := r.resetCounters(true)
+	if reset.ClearedInstances != 1 || len(r.status.GetStatusReport(datatype.MESSAGE_TYPE_METRICS).Items) != 0 {
+		t.Errorf("agent status is not cleared, %+v", reset)
+	}
+}
+
+func TestBufferPoolStats(t *testing.T) {
+	before := GetBufferPoolStats()
+	buf, _ := AcquireRecvBuffer(RECV_BUFSIZE_8K, TCP)
+	stats := GetBufferPoolStats()[1]
+	if stats.Outstanding != before[1].Outstanding+1 || stats.HighWaterMark < stats.Outstanding {
+		t.Errorf("unexpected pool stats after acquire %+v", stats)
+	}
+	ReleaseRecvBuffer(buf)
+	if stats = GetBufferPoolStats()[1]; stats.Outstanding != before[1].Outstanding {
+		t.Errorf("unexpected pool stats after release %+v", stats)
+	}
+
+	buf, isNew := AcquireRecvBuffer(RECV_BUFSIZE_512K+1, TCP)
+	if stats = GetBufferPoolStats()[len(recvBufferPools)-1]; !isNew || stats.Misses != before[len(recvBufferPools)-1].Misses+1 {
+		t.Errorf("unexpected dynamic pool stats %+v", stats)
+	}
+	ReleaseRecvBuffer(buf)
+
+	output := &struct {
+		Result BufferPoolStatsList `json:"result"`
+	}{}
+	r := newTestReceiver()
+	if err := json.Unmarshal([]byte(r.HandleSimpleCommand(ADAPTER_CMD_POOL, CMD_ARG_JSON)), output); err != nil || len(output.Result) != len(recvBufferPools) {
+		t.Errorf("unexpected pool output %+v, %v", output, err)
+	}
+}
+
+func TestHeaderVersionRestart(t *testing.T) {
+	r := newTestReceiver()
+	now := uint32(1700000000)
+	r.status.Update(now, datatype.MESSAGE_TYPE_METRICS, 3, 1, datatype.OLD_VERSION, datatype.ENCODER_RAW, net.ParseIP("10.1.1.1"), 0, now, UDP)
+	r.status.Update(now+1, datatype.MESSAGE_TYPE_METRICS, 3, 1, datatype.OLD_VERSION, datatype.ENCODER_RAW, net.ParseIP("10.1.1.1"), 0, now+1, UDP)
+	items := r.status.GetStatusReport(datatype.MESSAGE_TYPE_METRICS).Items
+	if items[0].Restarts != 0 || items[0].FirstLocalTimestamp != now {
+		t.Errorf("unexpected status %+v", items[0])
+	}
+
+	r.status.Update(now+2, datatype.MESSAGE_TYPE_METRICS, 3, 1, datatype.LATEST_VERSION, datatype.ENCODER_RAW, net.ParseIP("10.1.1.1"), 0, now+2, UDP)
+	items = r.status.GetStatusReport(datatype.MESSAGE_TYPE_METRICS).Items
+	if items[0].Restarts != 1 || items[0].HeaderVersion != datatype.LATEST_VERSION || items[0].FirstLocalTimestamp != now+2 {
+		t.Errorf("version change should be treated as restart, %+v", items[0])
+	}
+}
+
+func TestVersionSummary(t *testing.T) {
+	r := newTestReceiver()
+	now := uint32(1700000000)
+	r.status.Update(now, datatype.MESSAGE_TYPE_METRICS, 1, 1, datatype.LATEST_VERSION, datatype.ENCODER_LZ4|datatype.ENCODER_FLAG_HEADER_CRC, net.ParseIP("10.1.1.1"), 0, now, TCP)
+	r.status.Update(now, datatype.MESSAGE_TYPE_METRICS, 1, 1, datatype.LATEST_VERSION, datatype.ENCODER_LZ4|datatype.ENCODER_FLAG_HEADER_CRC, net.ParseIP("10.1.1.1"), 0, now, TCP)
+	r.status.Update(now, datatype.MESSAGE_TYPE_METRICS, 2, 1, datatype.LATEST_VERSION, datatype.ENCODER_RAW, net.ParseIP("10.1.1.2"), 0, now, TCP)
+	r.status.Update(now, datatype.MESSAGE_TYPE_METRICS, 3, 1, datatype.OLD_VERSION, datatype.ENCODER_RAW, net.ParseIP("10.1.1.3"), 0, now, UDP)
+
+	report := r.status.GetStatusReport(datatype.MESSAGE_TYPE_METRICS)
+	if len(report.Versions) != 2 || report.Versions[0].HeaderVersion != datatype.LATEST_VERSION || report.Versions[0].Agents != 2 || report.Versions[1].Agents != 1 {
+		t.Errorf("unexpected version summary %+v", report.Versions)
+	}
+	if item := report.Items[0]; item.Encoder != "lz4" || !item.HeaderCRC || item.CompressedPackets != 2 {
+		t.Errorf("unexpected agent capabilities %+v", item)
+	}
+	if !strings.HasPrefix(report.String(), "Header versions: 2 agents 0x8000, 1 agents old\n") {
+		t.Errorf("unexpected text output %s", report.String())
+	}
+}
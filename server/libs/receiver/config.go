@@ -0,0 +1,169 @@
+/*
+ * Copyright (c) 2024 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package receiver
+
+import (
+	"fmt"
+	"strings"
+)
+
+// 与ingester配置的默认值一致
+const (
+	DEFAULT_LISTEN_PORT       = 20033
+	DEFAULT_UDP_READ_BUFFER   = 64 << 20
+	DEFAULT_TCP_READ_BUFFER   = 4 << 20
+	DEFAULT_TCP_READER_BUFFER = 1 << 20
+)
+
+// Receiver的配置, 为0的字段在Validate时取默认值
+type ReceiverConfig struct {
+	ListenPort           int      `json:"listen_port"`         // 同一端口同时监听TCP和UDP, 只监听一种时调用SetServerType
+	UDPReadBuffer        int      `json:"udp_read_buffer"`     // UDP socket的内核接收buffer
+	TCPReadBuffer        int      `json:"tcp_read_buffer"`     // 每个TCP连接的内核接收buffer
+	TCPReaderBuffer      int      `json:"tcp_reader_buffer"`   // 每个TCP连接的用户态读buffer
+	HeaderCRCRequired    bool     `json:"header_crc_required"` // 丢弃不带包头CRC的消息
+	LegacyHeaderDisabled bool     `json:"legacy_header_disabled"`
+	AgentStaleAfter      uint32   `json:"agent_stale_after"` // 秒, 见SetAgentHealthThresholds
+	AgentGoneAfter       uint32   `json:"agent_gone_after"`
+	TenantRules          []string `json:"tenant_rules,omitempty"`       // "网段=标签", 见SetTenantRules
+	MirrorDestination    string   `json:"mirror_destination,omitempty"` // HOST:PORT, 为空时不转发, 见EnableMirror
+	MirrorFilters        []string `json:"mirror_filters,omitempty"`
+	StatsdAddress        string   `json:"statsd_address,omitempty"` // HOST:PORT, 为空时不推送, 见SetStatsdReporter
+	AgentNameReverseDNS  bool     `json:"agent_name_reverse_dns"`   // 日志和调试命令中显示agent的主机名, 见agentNameResolver
+	AgentNameFile        string   `json:"agent_name_file,omitempty"`
+	ErrorTapDirectory    string   `json:"error_tap_directory"` // ctl开启error tap时pcap文件所在的目录
+}
+
+// config命令的输出, 为运行中实际生效的配置
+type ReceiverConfigReport struct {
+	ReceiverConfig
+	ServerType string `json:"server_type"`
+}
+
+// 为0的字段取默认值, 拒绝无效的配置
+func (c *ReceiverConfig) Validate() error {
+	if c.ListenPort == 0 {
+		c.ListenPort = DEFAULT_LISTEN_PORT
+	}
+	if c.ListenPort < 0 || c.ListenPort > 65535 {
+		return fmt.Errorf("invalid listen port %d", c.ListenPort)
+	}
+	for _, buffer := range []struct {
+		name  string
+		value *int
+		init  int
+	}{
+		{"udp read buffer", &c.UDPReadBuffer, DEFAULT_UDP_READ_BUFFER},
+		{"tcp read buffer", &c.TCPReadBuffer, DEFAULT_TCP_READ_BUFFER},
+		{"tcp reader buffer", &c.TCPReaderBuffer, DEFAULT_TCP_READER_BUFFER},
+	} {
+		if *buffer.value == 0 {
+			*buffer.value = buffer.init
+		}
+		if *buffer.value < 0 {
+			return fmt.Errorf("invalid %s %d", buffer.name, *buffer.value)
+		}
+	}
+	if c.AgentStaleAfter == 0 {
+		c.AgentStaleAfter = AGENT_HEALTH_DEFAULT_STALE
+	}
+	if c.AgentGoneAfter == 0 {
+		c.AgentGoneAfter = AGENT_HEALTH_DEFAULT_GONE
+	}
+	if c.AgentGoneAfter <= c.AgentStaleAfter {
+		return fmt.Errorf("agent gone threshold %ds must be greater than stale threshold %ds", c.AgentGoneAfter, c.AgentStaleAfter)
+	}
+	if c.ErrorTapDirectory == "" {
+		c.ErrorTapDirectory = ERROR_TAP_DEFAULT_DIRECTORY
+	}
+	if _, err := newTenantTable(c.TenantRules, 0); err != nil {
+		return err
+	}
+	if c.MirrorDestination == "" && len(c.MirrorFilters) > 0 {
+		return fmt.Errorf("mirror filters %v are set without mirror destination", c.MirrorFilters)
+	}
+	for _, filter := range c.MirrorFilters {
+		if _, err := parseIPNet(filter); err != nil {
+			return fmt.Errorf("invalid mirror filter %q: %s", filter, err)
+		}
+	}
+	return nil
+}
+
+func (c *ReceiverConfigReport) String() string {
+	status := fmt.Sprintf("Effective receiver config:\n")
+	status += fmt.Sprintf("    %-22s %d\n", "ListenPort", c.ListenPort)
+	status += fmt.Sprintf("    %-22s %s\n", "ServerType", c.ServerType)
+	status += fmt.Sprintf("    %-22s %d\n", "UDPReadBuffer", c.UDPReadBuffer)
+	status += fmt.Sprintf("    %-22s %d\n", "TCPReadBuffer", c.TCPReadBuffer)
+	status += fmt.Sprintf("    %-22s %d\n", "TCPReaderBuffer", c.TCPReaderBuffer)
+	status += fmt.Sprintf("    %-22s %v\n", "HeaderCRCRequired", c.HeaderCRCRequired)
+	status += fmt.Sprintf("    %-22s %v\n", "LegacyHeaderDisabled", c.LegacyHeaderDisabled)
+	status += fmt.Sprintf("    %-22s %d\n", "AgentStaleAfter", c.AgentStaleAfter)
+	status += fmt.Sprintf("    %-22s %d\n", "AgentGoneAfter", c.AgentGoneAfter)
+	status += fmt.Sprintf("    %-22s %s\n", "TenantRules", strings.Join(c.TenantRules, ","))
+	status += fmt.Sprintf("    %-22s %s\n", "MirrorDestination", c.MirrorDestination)
+	status += fmt.Sprintf("    %-22s %s\n", "MirrorFilters", strings.Join(c.MirrorFilters, ","))
+	status += fmt.Sprintf("    %-22s %s\n", "StatsdAddress", c.StatsdAddress)
+	status += fmt.Sprintf("    %-22s %v\n", "AgentNameReverseDNS", c.AgentNameReverseDNS)
+	status += fmt.Sprintf("    %-22s %s\n", "AgentNameFile", c.AgentNameFile)
+	status += fmt.Sprintf("    %-22s %s\n", "ErrorTapDirectory", c.ErrorTapDirectory)
+	return status
+}
+
+// 从运行中的Receiver读取配置, 包括启动后通过Set*修改的部分
+func (r *Receiver) effectiveConfig() *ReceiverConfigReport {
+	staleAfter, goneAfter := r.agentHealthThresholds()
+	var tenantRules []string
+	if tenants := r.loadTenantTable(); tenants != nil {
+		tenantRules = tenants.ruleStrings()
+	}
+	var mirrorDestination string
+	var mirrorFilters []string
+	if m := r.loadMirror(); m != nil {
+		mirrorDestination, mirrorFilters = m.destination.String(), m.filterStrings()
+	}
+	var statsdAddress string
+	if reporter := r.loadStatsdReporter(); reporter != nil {
+		statsdAddress = reporter.address.String()
+	}
+	var agentNameReverseDNS bool
+	var agentNameFile string
+	if r.agentNames != nil {
+		agentNameReverseDNS, agentNameFile = r.agentNames.reverseDNS, r.agentNames.file
+	}
+	return &ReceiverConfigReport{
+		ReceiverConfig: ReceiverConfig{
+			ListenPort:           r.UDPAddress.Port,
+			UDPReadBuffer:        r.UDPReadBuffer,
+			TCPReadBuffer:        r.TCPReadBuffer,
+			TCPReaderBuffer:      r.TCPReaderBuffer,
+			HeaderCRCRequired:    r.headerCRCRequired,
+			LegacyHeaderDisabled: r.legacyHeaderDisabled,
+			AgentStaleAfter:      staleAfter,
+			AgentGoneAfter:       goneAfter,
+			TenantRules:          tenantRules,
+			MirrorDestination:    mirrorDestination,
+			MirrorFilters:        mirrorFilters,
+			StatsdAddress:        statsdAddress,
+			AgentNameReverseDNS:  agentNameReverseDNS,
+			AgentNameFile:        agentNameFile,
+			ErrorTapDirectory:    r.errorTapDirectory,
+		},
+		ServerType: r.serverType.String(),
+	}
+}
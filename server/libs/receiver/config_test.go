@@ -0,0 +1,113 @@
+/*
+ * Copyright (c) 2024 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package receiver
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestReceiverConfigValidate(t *testing.T) {
+	defaults := ReceiverConfig{
+		ListenPort:        DEFAULT_LISTEN_PORT,
+		UDPReadBuffer:     DEFAULT_UDP_READ_BUFFER,
+		TCPReadBuffer:     DEFAULT_TCP_READ_BUFFER,
+		TCPReaderBuffer:   DEFAULT_TCP_READER_BUFFER,
+		AgentStaleAfter:   AGENT_HEALTH_DEFAULT_STALE,
+		AgentGoneAfter:    AGENT_HEALTH_DEFAULT_GONE,
+		ErrorTapDirectory: ERROR_TAP_DEFAULT_DIRECTORY,
+	}
+	custom := ReceiverConfig{
+		ListenPort:        30033,
+		UDPReadBuffer:     1 << 20,
+		TCPReadBuffer:     1 << 16,
+		TCPReaderBuffer:   1 << 16,
+		HeaderCRCRequired: true,
+		AgentStaleAfter:   10,
+		AgentGoneAfter:    20,
+		TenantRules:       []string{"10.0.0.0/8=bu-a"},
+		ErrorTapDirectory: "/tmp/deepflow",
+	}
+	for _, c := range []struct {
+		name     string
+		config   ReceiverConfig
+		expected ReceiverConfig
+		invalid  bool
+	}{
+		{"empty", ReceiverConfig{}, defaults, false},
+		{"custom", custom, custom, false},
+		{"negative-port", ReceiverConfig{ListenPort: -1}, ReceiverConfig{}, true},
+		{"port-overflow", ReceiverConfig{ListenPort: 65536}, ReceiverConfig{}, true},
+		{"negative-udp-buffer", ReceiverConfig{UDPReadBuffer: -1}, ReceiverConfig{}, true},
+		{"negative-tcp-buffer", ReceiverConfig{TCPReadBuffer: -1}, ReceiverConfig{}, true},
+		{"negative-reader-buffer", ReceiverConfig{TCPReaderBuffer: -1}, ReceiverConfig{}, true},
+		{"gone-before-stale", ReceiverConfig{AgentStaleAfter: 400}, ReceiverConfig{}, true},
+		{"invalid-tenant-rule", ReceiverConfig{TenantRules: []string{"10.0.0.0/33=bu-a"}}, ReceiverConfig{}, true},
+		{"mirror-filter-without-destination", ReceiverConfig{MirrorFilters: []string{"10.0.0.0/8"}}, ReceiverConfig{}, true},
+		{"invalid-mirror-filter", ReceiverConfig{MirrorDestination: "127.0.0.1:20033", MirrorFilters: []string{"10.0.0.0/33"}}, ReceiverConfig{}, true},
+	} {
+		err := c.config.Validate()
+		if c.invalid {
+			if err == nil {
+				t.Errorf("%s: expect error, actual %+v", c.name, c.config)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(c.config, c.expected) {
+			t.Errorf("%s: expect %+v, actual %+v, err %v", c.name, c.expected, c.config, err)
+		}
+	}
+}
+
+func TestReceiverConfigCommand(t *testing.T) {
+	r, err := NewReceiverWithConfig(ReceiverConfig{ListenPort: 30033, HeaderCRCRequired: true, TenantRules: []string{"10.0.0.0/8=bu-a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetServerType(UDP)
+	r.SetLegacyHeaderDisabled(true)
+	r.SetAgentHealthThresholds(10, 20)
+	r.SetTenantRules([]string{"10.0.0.0/8=bu-a", "10.1.0.0/16=bu-b"})
+
+	output := &struct {
+		Result *ReceiverConfigReport `json:"result"`
+	}{}
+	if err := json.Unmarshal([]byte(r.HandleSimpleCommand(ADAPTER_CMD_CONFIG, CMD_ARG_JSON)), output); err != nil {
+		t.Fatal(err)
+	}
+	// 输出默认值填充以及启动后修改的结果
+	expected := ReceiverConfig{
+		ListenPort:           30033,
+		UDPReadBuffer:        DEFAULT_UDP_READ_BUFFER,
+		TCPReadBuffer:        DEFAULT_TCP_READ_BUFFER,
+		TCPReaderBuffer:      DEFAULT_TCP_READER_BUFFER,
+		HeaderCRCRequired:    true,
+		LegacyHeaderDisabled: true,
+		AgentStaleAfter:      10,
+		AgentGoneAfter:       20,
+		TenantRules:          []string{"10.1.0.0/16=bu-b", "10.0.0.0/8=bu-a"},
+		ErrorTapDirectory:    ERROR_TAP_DEFAULT_DIRECTORY,
+	}
+	if !reflect.DeepEqual(output.Result.ReceiverConfig, expected) || output.Result.ServerType != "UDP" {
+		t.Errorf("unexpected config %+v", output.Result)
+	}
+
+	if _, err := NewReceiverWithConfig(ReceiverConfig{UDPReadBuffer: -1}); err == nil {
+		t.Error("expect error for invalid config")
+	}
+}
@@ -0,0 +1,396 @@
+/*
+ * Copyright (c) 2024 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package receiver
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+const (
+	ERROR_TAP_RING_SIZE          = 1024 // 等待写入的报文数上限, 写入跟不上时丢弃新的报文
+	ERROR_TAP_DEFAULT_DIRECTORY  = "/var/log/deepflow"
+	ERROR_TAP_DEFAULT_FILE_NAME  = "receiver-errors.pcap"
+	ERROR_TAP_DEFAULT_FILE       = ERROR_TAP_DEFAULT_DIRECTORY + "/" + ERROR_TAP_DEFAULT_FILE_NAME
+	ERROR_TAP_DEFAULT_FILE_SIZE  = 16 << 20 // 单个文件的大小上限
+	ERROR_TAP_DEFAULT_FILE_COUNT = 5        // 包括正在写入的文件在内最多保留的文件数
+	ERROR_TAP_SNAPLEN            = 65535
+)
+
+// 写入pcap的一个数据报, 数据是从接收buffer复制的, 不受buffer回收的影响
+type errorTapRecord struct {
+	timestamp time.Time
+	ip        net.IP
+	port      int
+	data      []byte
+}
+
+// 将包头解码失败(可选包括因未注册处理函数而丢弃)的UDP数据报写入按大小和个数轮转的pcap文件.
+// 接收线程只向有界的ring中投递, 由后台协程写文件, ring满时丢弃该报文, 不会阻塞接收
+type errorTap struct {
+	file        string
+	policyDrops bool // 是否同时记录未注册处理函数而丢弃的消息
+	maxFileSize int64
+	maxFiles    int
+	localIP     net.IP // 伪造的UDP头中的目的地址和端口
+	localPort   int
+
+	records chan *errorTapRecord
+	stop    chan struct{}
+	stopped sync.WaitGroup
+
+	captured uint64 // 已写入文件的报文数
+	dropped  uint64 // 因ring满或写文件失败而丢弃的报文数
+	rotated  uint64 // 已轮转的文件数
+
+	errLock sync.Mutex
+	lastErr string
+
+	// 以下字段仅由写入协程访问
+	writer   *pcapgo.Writer
+	buffered *bufio.Writer
+	fp       *os.File
+	size     int64
+}
+
+func newErrorTap(file string, policyDrops bool, maxFileSize int64, maxFiles int, localAddr *net.UDPAddr) *errorTap {
+	tap := &errorTap{
+		file:        file,
+		policyDrops: policyDrops,
+		maxFileSize: maxFileSize,
+		maxFiles:    maxFiles,
+		localIP:     net.IPv4zero,
+		records:     make(chan *errorTapRecord, ERROR_TAP_RING_SIZE),
+		stop:        make(chan struct{}),
+	}
+	if localAddr != nil {
+		if localAddr.IP != nil {
+			tap.localIP = localAddr.IP
+		}
+		tap.localPort = localAddr.Port
+	}
+	return tap
+}
+
+// 打开文件并启动写入协程, 文件无法创建时返回错误
+func (t *errorTap) start() error {
+	if err := t.open(); err != nil {
+		return err
+	}
+	t.stopped.Add(1)
+	go t.run()
+	return nil
+}
+
+// 由接收线程调用, 不阻塞
+func (t *errorTap) capture(now time.Time, addr *net.UDPAddr, packet []byte) {
+	if addr == nil {
+		return
+	}
+	record := &errorTapRecord{timestamp: now, ip: append(net.IP(nil), addr.IP...), port: addr.Port, data: append([]byte(nil), packet...)}
+	select {
+	case t.records <- record:
+	default:
+		atomic.AddUint64(&t.dropped, 1)
+	}
+}
+
+// 停止写入协程并关闭文件, ring中尚未写入的报文直接丢弃
+func (t *errorTap) close() {
+	close(t.stop)
+	t.stopped.Wait()
+}
+
+func (t *errorTap) run() {
+	defer t.stopped.Done()
+	defer t.closeFile()
+	for {
+		select {
+		case <-t.stop:
+			return
+		case record := <-t.records:
+			if err := t.write(record); err != nil {
+				atomic.AddUint64(&t.dropped, 1)
+				t.setError(err)
+			}
+			// ring中暂时没有更多报文时刷新, 使文件内容及时可读
+			if len(t.records) == 0 && t.buffered != nil {
+				t.buffered.Flush()
+			}
+		}
+	}
+}
+
+func (t *errorTap) setError(err error) {
+	t.errLock.Lock()
+	t.lastErr = err.Error()
+	t.errLock.Unlock()
+}
+
+func (t *errorTap) open() error {
+	fp, err := os.OpenFile(t.file, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	t.fp = fp
+	t.buffered = bufio.NewWriter(fp)
+	t.writer = pcapgo.NewWriter(t.buffered)
+	if err := t.writer.WriteFileHeader(ERROR_TAP_SNAPLEN, layers.LinkTypeRaw); err != nil {
+		t.closeFile()
+		return err
+	}
+	t.size = 24 // pcap文件头长度
+	return nil
+}
+
+func (t *errorTap) closeFile() {
+	if t.fp == nil {
+		return
+	}
+	t.buffered.Flush()
+	t.fp.Close()
+	t.fp, t.buffered, t.writer = nil, nil, nil
+}
+
+// 与logrotate相同, file.1为最近轮转的文件, 超过maxFiles的最旧文件被覆盖
+func (t *errorTap) rotate() error {
+	t.closeFile()
+	for i := t.maxFiles - 1; i > 0; i-- {
+		from := t.file
+		if i > 1 {
+			from = fmt.Sprintf("%s.%d", t.file, i-1)
+		}
+		if _, err := os.Stat(from); err != nil {
+			continue
+		}
+		if err := os.Rename(from, fmt.Sprintf("%s.%d", t.file, i)); err != nil {
+			return err
+		}
+	}
+	atomic.AddUint64(&t.rotated, 1)
+	return t.open()
+}
+
+func (t *errorTap) write(record *errorTapRecord) error {
+	data, err := t.encapsulate(record)
+	if err != nil {
+		return err
+	}
+	// 之前打开文件失败时重新打开, 不轮转
+	if t.fp == nil {
+		if err := t.open(); err != nil {
+			return err
+		}
+	}
+	// 每条记录包括16字节的记录头
+	if t.size+int64(16+len(data)) > t.maxFileSize {
+		if err := t.rotate(); err != nil {
+			return err
+		}
+	}
+	ci := gopacket.CaptureInfo{Timestamp: record.timestamp, CaptureLength: len(data), Length: len(data)}
+	if err := t.writer.WritePacket(ci, data); err != nil {
+		return err
+	}
+	t.size += int64(16 + len(data))
+	atomic.AddUint64(&t.captured, 1)
+	return nil
+}
+
+// 添加伪造的IP和UDP头, 源地址和端口为发送方的真实地址, 目的为本地监听的地址和端口
+func (t *errorTap) encapsulate(record *errorTapRecord) ([]byte, error) {
+	return encapsulateUDP(record.ip, record.port, t.localIP, t.localPort, record.data)
+}
+
+// 伪造IP和UDP头, 使抓到的数据报可以用wireshark查看或用cmd/replay重放. 目的地址与源地址的IP版本不同时置为全0
+func encapsulateUDP(srcIP net.IP, srcPort int, dstIP net.IP, dstPort int, data []byte) ([]byte, error) {
+	udp := &layers.UDP{SrcPort: layers.UDPPort(srcPort), DstPort: layers.UDPPort(dstPort)}
+	var ip gopacket.SerializableLayer
+	if ip4 := srcIP.To4(); ip4 != nil {
+		dst := dstIP.To4()
+		if dst == nil {
+			dst = net.IPv4zero.To4()
+		}
+		ipv4 := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: ip4, DstIP: dst}
+		udp.SetNetworkLayerForChecksum(ipv4)
+		ip = ipv4
+	} else {
+		dst := dstIP.To16()
+		if dst == nil || dstIP.To4() != nil {
+			dst = net.IPv6zero
+		}
+		ipv6 := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolUDP, SrcIP: srcIP, DstIP: dst}
+		udp.SetNetworkLayerForChecksum(ipv6)
+		ip = ipv6
+	}
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buffer, options, ip, udp, gopacket.Payload(data)); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+type ErrorTapStatus struct {
+	Enabled     bool   `json:"enabled"`
+	File        string `json:"file,omitempty"`
+	PolicyDrops bool   `json:"policy_drops"`
+	MaxFileSize int64  `json:"max_file_size,omitempty"`
+	MaxFiles    int    `json:"max_files,omitempty"`
+	Captured    uint64 `json:"captured"`
+	Dropped     uint64 `json:"dropped"`
+	Rotated     uint64 `json:"rotated"`
+	LastError   string `json:"last_error,omitempty"`
+}
+
+func (t *errorTap) status() *ErrorTapStatus {
+	t.errLock.Lock()
+	lastErr := t.lastErr
+	t.errLock.Unlock()
+	return &ErrorTapStatus{
+		Enabled:     true,
+		File:        t.file,
+		PolicyDrops: t.policyDrops,
+		MaxFileSize: t.maxFileSize,
+		MaxFiles:    t.maxFiles,
+		Captured:    atomic.LoadUint64(&t.captured),
+		Dropped:     atomic.LoadUint64(&t.dropped),
+		Rotated:     atomic.LoadUint64(&t.rotated),
+		LastError:   lastErr,
+	}
+}
+
+func (s *ErrorTapStatus) String() string {
+	if !s.Enabled {
+		return "error tap is disabled"
+	}
+	status := fmt.Sprintf("error tap is enabled, writing to %s (%d bytes x %d files)\n", s.File, s.MaxFileSize, s.MaxFiles)
+	status += fmt.Sprintf("    %-12s %v\n", "PolicyDrops", s.PolicyDrops)
+	status += fmt.Sprintf("    %-12s %d\n", "Captured", s.Captured)
+	status += fmt.Sprintf("    %-12s %d\n", "Dropped", s.Dropped)
+	status += fmt.Sprintf("    %-12s %d\n", "Rotated", s.Rotated)
+	if s.LastError != "" {
+		status += fmt.Sprintf("    %-12s %s\n", "LastError", s.LastError)
+	}
+	return status
+}
+
+// 开启error tap, 已开启时以新的参数重新开启. file为空时使用ERROR_TAP_DEFAULT_FILE
+func (r *Receiver) EnableErrorTap(file string, policyDrops bool) error {
+	if file == "" {
+		file = ERROR_TAP_DEFAULT_FILE
+	}
+	r.errorTapLock.Lock()
+	defer r.errorTapLock.Unlock()
+	// 先关闭旧的error tap, 避免两个协程同时写同一个文件
+	r.stopErrorTap()
+	tap := newErrorTap(file, policyDrops, ERROR_TAP_DEFAULT_FILE_SIZE, ERROR_TAP_DEFAULT_FILE_COUNT, r.UDPAddress)
+	if err := tap.start(); err != nil {
+		return err
+	}
+	r.errorTap.Store(tap)
+	log.Infof("receiver error tap enabled, writing to %s", file)
+	return nil
+}
+
+func (r *Receiver) DisableErrorTap() {
+	r.errorTapLock.Lock()
+	defer r.errorTapLock.Unlock()
+	if r.stopErrorTap() {
+		log.Info("receiver error tap disabled")
+	}
+}
+
+// 调用方需持有errorTapLock, 返回是否关闭了已开启的error tap
+func (r *Receiver) stopErrorTap() bool {
+	tap := r.loadErrorTap()
+	if tap == nil {
+		return false
+	}
+	r.errorTap.Store((*errorTap)(nil))
+	tap.close()
+	return true
+}
+
+func (r *Receiver) loadErrorTap() *errorTap {
+	tap, _ := r.errorTap.Load().(*errorTap)
+	return tap
+}
+
+// ctl命令没有认证, 指定的文件只能位于配置的ErrorTapDirectory之下, 不能是绝对路径或包含..
+func errorTapPath(directory, name string) (string, error) {
+	if name == "" {
+		name = ERROR_TAP_DEFAULT_FILE_NAME
+	}
+	if filepath.IsAbs(name) {
+		return "", fmt.Errorf("file %s must be relative to %s", name, directory)
+	}
+	for _, element := range strings.Split(filepath.ToSlash(name), "/") {
+		if element == ".." {
+			return "", fmt.Errorf("file %s must not contain ..", name)
+		}
+	}
+	return filepath.Join(directory, name), nil
+}
+
+func (r *Receiver) handleErrorTapCommand(args *commandArgs) fmt.Stringer {
+	switch args.tapAction {
+	case CMD_ARG_TAP_ON:
+		file, err := errorTapPath(r.errorTapDirectory, args.tapFile)
+		if err != nil {
+			return commandError(fmt.Sprintf("enable error tap failed: %s", err))
+		}
+		if err := r.EnableErrorTap(file, args.tapPolicyDrops); err != nil {
+			return commandError(fmt.Sprintf("enable error tap failed: %s", err))
+		}
+	case CMD_ARG_TAP_OFF:
+		r.DisableErrorTap()
+	}
+	return r.errorTapStatus()
+}
+
+func (r *Receiver) errorTapStatus() *ErrorTapStatus {
+	if tap := r.loadErrorTap(); tap != nil {
+		return tap.status()
+	}
+	return &ErrorTapStatus{}
+}
+
+// 包头解码失败的数据报
+func (r *Receiver) tapInvalid(remoteAddr *net.UDPAddr, packet []byte) {
+	if tap := r.loadErrorTap(); tap != nil {
+		tap.capture(time.Now(), remoteAddr, packet)
+	}
+}
+
+// 因未注册处理函数而丢弃的数据报, 仅在开启policyDrops时记录
+func (r *Receiver) tapPolicyDrop(remoteAddr *net.UDPAddr, packet []byte) {
+	if tap := r.loadErrorTap(); tap != nil && tap.policyDrops {
+		tap.capture(time.Now(), remoteAddr, packet)
+	}
+}
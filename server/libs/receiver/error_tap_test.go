@@ -0,0 +1,223 @@
+/*
+ * Copyright (c) 2024 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package receiver
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+type tappedDatagram struct {
+	ip      string
+	port    int
+	dstPort int
+	payload []byte
+}
+
+func readErrorTapFile(t *testing.T, file string) []tappedDatagram {
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	reader, err := pcapgo.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reader.LinkType() != layers.LinkTypeRaw {
+		t.Errorf("%s: unexpected link type %s", file, reader.LinkType())
+	}
+	var datagrams []tappedDatagram
+	for {
+		data, _, err := reader.ReadPacketData()
+		if err != nil {
+			break
+		}
+		firstLayer := layers.LayerTypeIPv4
+		if data[0]>>4 == 6 {
+			firstLayer = layers.LayerTypeIPv6
+		}
+		packet := gopacket.NewPacket(data, firstLayer, gopacket.Default)
+		udp, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+		if !ok {
+			t.Errorf("%s: no UDP layer in %x", file, data)
+			continue
+		}
+		datagrams = append(datagrams, tappedDatagram{
+			ip:      packet.NetworkLayer().NetworkFlow().Src().String(),
+			port:    int(udp.SrcPort),
+			dstPort: int(udp.DstPort),
+			payload: udp.Payload,
+		})
+	}
+	return datagrams
+}
+
+func waitCaptured(t *testing.T, tap *errorTap, expected uint64) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if atomic.LoadUint64(&tap.captured)+atomic.LoadUint64(&tap.dropped) >= expected {
+			return
+		}
+	}
+	t.Fatalf("timeout waiting for %d datagrams, status %+v", expected, tap.status())
+}
+
+func TestErrorTapWrite(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "errors.pcap")
+	tap := newErrorTap(file, false, ERROR_TAP_DEFAULT_FILE_SIZE, ERROR_TAP_DEFAULT_FILE_COUNT, &net.UDPAddr{Port: 30033})
+	if err := tap.start(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []tappedDatagram{
+		{"10.1.2.3", 40000, 30033, []byte("bad header")},
+		{"fd00::3", 40001, 30033, []byte{1, 2, 3}},
+		{"10.1.2.4", 40002, 30033, []byte{}},
+	}
+	for _, d := range expected {
+		tap.capture(time.Now(), &net.UDPAddr{IP: net.ParseIP(d.ip), Port: d.port}, d.payload)
+	}
+	waitCaptured(t, tap, uint64(len(expected)))
+	tap.close()
+
+	actual := readErrorTapFile(t, file)
+	if len(actual) != len(expected) {
+		t.Fatalf("expect %d datagrams, actual %d", len(expected), len(actual))
+	}
+	for i := range expected {
+		e, a := expected[i], actual[i]
+		if e.ip != a.ip || e.port != a.port || e.dstPort != a.dstPort || !bytes.Equal(e.payload, a.payload) {
+			t.Errorf("datagram %d: expect %+v, actual %+v", i, e, a)
+		}
+	}
+}
+
+func TestErrorTapRotate(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "errors.pcap")
+	// 每条记录16+20+8+100字节, 每个文件最多3条
+	tap := newErrorTap(file, false, 24+3*144, 3, nil)
+	if err := tap.start(); err != nil {
+		t.Fatal(err)
+	}
+	addr := &net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 40000}
+	for i := 0; i < 10; i++ {
+		tap.capture(time.Now(), addr, bytes.Repeat([]byte{byte(i)}, 100))
+		waitCaptured(t, tap, uint64(i+1))
+	}
+	tap.close()
+
+	// 最新的文件包含最后一条, file.1和file.2各包含之前的3条, 更早的已被覆盖
+	for i, expected := range []struct {
+		name  string
+		first byte
+		count int
+	}{
+		{file, 9, 1},
+		{file + ".1", 6, 3},
+		{file + ".2", 3, 3},
+	} {
+		datagrams := readErrorTapFile(t, expected.name)
+		if len(datagrams) != expected.count || datagrams[0].payload[0] != expected.first {
+			t.Errorf("file %d: expect %d datagrams starting from %d, actual %+v", i, expected.count, expected.first, datagrams)
+		}
+	}
+	if _, err := os.Stat(file + ".3"); err == nil {
+		t.Errorf("%s.3 should not exist", file)
+	}
+	if status := tap.status(); status.Captured != 10 || status.Rotated != 3 || status.Dropped != 0 {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
+
+func TestErrorTapNonBlocking(t *testing.T) {
+	// 未启动写入协程时ring满后直接丢弃
+	tap := newErrorTap(filepath.Join(t.TempDir(), "errors.pcap"), false, ERROR_TAP_DEFAULT_FILE_SIZE, ERROR_TAP_DEFAULT_FILE_COUNT, nil)
+	addr := &net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 40000}
+	for i := 0; i < ERROR_TAP_RING_SIZE+10; i++ {
+		tap.capture(time.Now(), addr, []byte{1})
+	}
+	if status := tap.status(); status.Dropped != 10 || status.Captured != 0 {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
+
+func TestErrorTapCommand(t *testing.T) {
+	r := newTestReceiver()
+	r.UDPAddress = &net.UDPAddr{Port: 30033}
+	r.errorTapDirectory = t.TempDir()
+	file := filepath.Join(r.errorTapDirectory, "errors.pcap")
+	addr := &net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 40000}
+
+	if status := r.handleAdapterCommand(ADAPTER_CMD_ERROR_TAP, parseCommandArgs("")).(*ErrorTapStatus); status.Enabled {
+		t.Errorf("error tap should be disabled by default")
+	}
+	// 未开启时不记录
+	r.tapInvalid(addr, []byte("dropped"))
+
+	status, ok := r.handleAdapterCommand(ADAPTER_CMD_ERROR_TAP, parseCommandArgs("on file=errors.pcap")).(*ErrorTapStatus)
+	if !ok || !status.Enabled || status.File != file || status.PolicyDrops {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	r.tapInvalid(addr, []byte("invalid"))
+	r.tapPolicyDrop(addr, []byte("policy"))
+	waitCaptured(t, r.loadErrorTap(), 1)
+
+	// 重新开启时替换原来的参数
+	if status := r.handleAdapterCommand(ADAPTER_CMD_ERROR_TAP, parseCommandArgs("on policy-drops file=errors.pcap.2")).(*ErrorTapStatus); !status.PolicyDrops {
+		t.Errorf("unexpected status %+v", status)
+	}
+	r.tapPolicyDrop(addr, []byte("policy"))
+	waitCaptured(t, r.loadErrorTap(), 1)
+
+	if status := r.handleAdapterCommand(ADAPTER_CMD_ERROR_TAP, parseCommandArgs("off")).(*ErrorTapStatus); status.Enabled {
+		t.Errorf("error tap should be disabled")
+	}
+	r.tapInvalid(addr, []byte("dropped"))
+
+	for name, expected := range map[string]string{file: "invalid", file + ".2": "policy"} {
+		datagrams := readErrorTapFile(t, name)
+		if len(datagrams) != 1 || string(datagrams[0].payload) != expected {
+			t.Errorf("%s: expect only %q, actual %+v", name, expected, datagrams)
+		}
+	}
+
+	if _, ok := r.handleAdapterCommand(ADAPTER_CMD_ERROR_TAP, parseCommandArgs("on file=errors.pcap/not-exist")).(commandError); !ok {
+		t.Error("expect error for invalid file")
+	}
+	// ctl中指定的文件不能位于ErrorTapDirectory之外
+	outside := filepath.Join(t.TempDir(), "outside")
+	os.WriteFile(outside, []byte("keep"), 0644)
+	for _, name := range []string{outside, "../outside", "sub/../../outside", "..", "/etc/passwd"} {
+		if _, ok := r.handleAdapterCommand(ADAPTER_CMD_ERROR_TAP, parseCommandArgs("on file="+name)).(commandError); !ok {
+			t.Errorf("%s: expect error for file outside %s", name, r.errorTapDirectory)
+		}
+	}
+	if data, _ := os.ReadFile(outside); string(data) != "keep" {
+		t.Errorf("file outside %s should not be touched", r.errorTapDirectory)
+	}
+	if status := r.errorTapStatus(); status.Enabled {
+		t.Errorf("error tap should stay disabled, %+v", status)
+	}
+}
@@ -0,0 +1,205 @@
+/*
+ * Copyright (c) 2024 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package receiver
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/deepflowio/deepflow/server/libs/datatype"
+)
+
+const (
+	HEADER_ERROR_DUMP_LEN      = 64
+	HEADER_ERROR_DUMP_INTERVAL = 60   // 每个agent每分钟最多保存一次出错数据
+	HEADER_ERROR_MAX_AGENTS    = 1024 // 最多记录的agent数, 防止异常流量导致内存增长
+)
+
+type HeaderErrorReason uint8
+
+const (
+	REASON_TRUNCATED       HeaderErrorReason = iota // 数据长度不足以解码包头
+	REASON_UNKNOWN_TYPE                             // 未知的消息类型
+	REASON_UNKNOWN_VERSION                          // 包头版本比当前支持的最新版本还新
+	REASON_HEADER_CRC                               // 包头CRC校验失败, 或要求校验时包头未携带CRC
+	REASON_FRAME_SIZE                               // FrameSize与包头长度不符或超过上限
+	REASON_LEGACY_DISABLED                          // 已配置禁止旧版本包头的agent接入
+
+	REASON_MAX
+)
+
+var headerErrorReasonString = [REASON_MAX]string{
+	REASON_TRUNCATED:       "truncated",
+	REASON_UNKNOWN_TYPE:    "unknown-type",
+	REASON_UNKNOWN_VERSION: "unknown-version",
+	REASON_HEADER_CRC:      "header-crc",
+	REASON_FRAME_SIZE:      "frame-size",
+	REASON_LEGACY_DISABLED: "legacy-disabled",
+}
+
+func (r HeaderErrorReason) String() string {
+	if r < REASON_MAX {
+		return headerErrorReasonString[r]
+	}
+	return fmt.Sprintf("unknown-reason-%d", r)
+}
+
+// 包头解码失败的原因和详细错误
+type HeaderError struct {
+	Reason HeaderErrorReason
+	Err    error
+}
+
+func (e *HeaderError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Reason, e.Err)
+}
+
+func newHeaderError(reason HeaderErrorReason, err error) *HeaderError {
+	return &HeaderError{Reason: reason, Err: err}
+}
+
+// 某个agent最后一次包头解码失败的信息
+type LastHeaderError struct {
+	IP            string `json:"ip"`
+	Reason        string `json:"reason"`
+	Error         string `json:"error"`
+	Timestamp     uint32 `json:"timestamp"`
+	Count         uint64 `json:"count"`
+	Dump          string `json:"dump,omitempty"` // 出错数据前HEADER_ERROR_DUMP_LEN字节的hexdump
+	DumpTimestamp uint32 `json:"dump_timestamp,omitempty"`
+}
+
+// 包头解码失败是低频路径, 直接加锁记录
+type headerErrors struct {
+	sync.Mutex
+	counts [REASON_MAX]uint64
+	agents map[string]*LastHeaderError
+}
+
+func (h *headerErrors) record(now uint32, ip net.IP, err *HeaderError, data ...[]byte) {
+	h.Lock()
+	defer h.Unlock()
+	h.counts[err.Reason]++
+
+	key := ip.String()
+	last, ok := h.agents[key]
+	if !ok {
+		if h.agents == nil {
+			h.agents = make(map[string]*LastHeaderError)
+		}
+		if len(h.agents) >= HEADER_ERROR_MAX_AGENTS {
+			return
+		}
+		last = &LastHeaderError{IP: key}
+		h.agents[key] = last
+	}
+	last.Reason = err.Reason.String()
+	last.Error = err.Err.Error()
+	last.Timestamp = now
+	last.Count++
+	if last.DumpTimestamp == 0 || now-last.DumpTimestamp >= HEADER_ERROR_DUMP_INTERVAL {
+		dump := make([]byte, 0, HEADER_ERROR_DUMP_LEN)
+		for _, d := range data {
+			if n := HEADER_ERROR_DUMP_LEN - len(dump); len(d) > n {
+				d = d[:n]
+			}
+			dump = append(dump, d...)
+		}
+		last.Dump = hex.Dump(dump)
+		last.DumpTimestamp = now
+	}
+}
+
+func (h *headerErrors) report() *HeaderErrorReport {
+	h.Lock()
+	defer h.Unlock()
+	report := &HeaderErrorReport{
+		Counts: make([]*HeaderErrorCount, 0, REASON_MAX),
+		Agents: make([]*LastHeaderError, 0, len(h.agents)),
+	}
+	for i := HeaderErrorReason(0); i < REASON_MAX; i++ {
+		report.Counts = append(report.Counts, &HeaderErrorCount{Reason: i.String(), Count: h.counts[i]})
+	}
+	for _, last := range h.agents {
+		copied := *last
+		report.Agents = append(report.Agents, &copied)
+	}
+	sort.Slice(report.Agents, func(i, j int) bool {
+		return report.Agents[i].Timestamp > report.Agents[j].Timestamp
+	})
+	return report
+}
+
+func (h *headerErrors) reset() {
+	h.Lock()
+	h.counts = [REASON_MAX]uint64{}
+	h.agents = nil
+	h.Unlock()
+}
+
+type HeaderErrorCount struct {
+	Reason string `json:"reason"`
+	Count  uint64 `json:"count"`
+}
+
+// 启动以来各原因的包头错误数, 以及各agent最后一次的错误
+type HeaderErrorReport struct {
+	Counts []*HeaderErrorCount `json:"counts"`
+	Agents []*LastHeaderError  `json:"agents"`
+}
+
+func (r *HeaderErrorReport) String() string {
+	status := fmt.Sprintf("Reason          Count\n")
+	status += fmt.Sprintf("---------------------\n")
+	for _, c := range r.Counts {
+		status += fmt.Sprintf("%-15s %d\n", c.Reason, c.Count)
+	}
+	for _, agent := range r.Agents {
+		status += fmt.Sprintf("\n%s last error at %s, count %d, %s: %s\n",
+			agent.IP, time.Unix(int64(agent.Timestamp), 0).Format("2006-01-02 15:04:05"), agent.Count, agent.Reason, agent.Error)
+		if agent.Dump != "" {
+			status += fmt.Sprintf("first %d bytes captured at %s:\n%s", HEADER_ERROR_DUMP_LEN,
+				time.Unix(int64(agent.DumpTimestamp), 0).Format("2006-01-02 15:04:05"), agent.Dump)
+		}
+	}
+	return status
+}
+
+// BaseHeader.Decode在数据长度足够时已解析出Type, 据此区分未知类型和FrameSize错误
+func headerErrorFromBaseDecode(header *datatype.BaseHeader, size int, err error) *HeaderError {
+	if size < datatype.MESSAGE_HEADER_LEN {
+		return newHeaderError(REASON_TRUNCATED, err)
+	}
+	if header.Type >= datatype.MESSAGE_TYPE_MAX {
+		return newHeaderError(REASON_UNKNOWN_TYPE, err)
+	}
+	return newHeaderError(REASON_FRAME_SIZE, err)
+}
+
+var errLegacyHeaderDisabled = errors.New("legacy header format is disabled")
+
+func headerErrorFromDecode(err error) *HeaderError {
+	if _, ok := err.(*datatype.UnknownVersionError); ok {
+		return newHeaderError(REASON_UNKNOWN_VERSION, err)
+	}
+	return newHeaderError(REASON_TRUNCATED, err)
+}
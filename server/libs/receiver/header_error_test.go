@@ -0,0 +1,94 @@
+/*
+ * Copyright (c) 2024 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package receiver
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/deepflowio/deepflow/server/libs/datatype"
+)
+
+func TestDecodeUDPHeaderReason(t *testing.T) {
+	r := newTestReceiver()
+	metrics := encodeUDPHeader(datatype.MESSAGE_TYPE_METRICS, 100, 0)
+	unknownVersion := encodeUDPHeader(datatype.MESSAGE_TYPE_METRICS, 100, 0)
+	unknownVersion[datatype.MESSAGE_HEADER_LEN] = 0x01 // Version: LATEST_VERSION + 1
+	cases := []struct {
+		name   string
+		packet []byte
+		reason HeaderErrorReason
+	}{
+		{"truncated base header", metrics[:datatype.MESSAGE_HEADER_LEN-1], REASON_TRUNCATED},
+		{"truncated flow header", metrics[:datatype.MESSAGE_HEADER_LEN+1], REASON_TRUNCATED},
+		{"unknown message type", encodeUDPHeader(datatype.MESSAGE_TYPE_MAX, 100, 0), REASON_UNKNOWN_TYPE},
+		{"unknown version", unknownVersion, REASON_UNKNOWN_VERSION},
+		{"crc flag without crc", encodeUDPHeader(datatype.MESSAGE_TYPE_METRICS, 100, datatype.ENCODER_FLAG_HEADER_CRC), REASON_HEADER_CRC},
+	}
+	for _, c := range cases {
+		err := r.decodeUDPHeader(c.packet, &udpHeader{})
+		if err == nil || err.Reason != c.reason {
+			t.Errorf("%s: expect reason %s, found %v", c.name, c.reason, err)
+		}
+	}
+}
+
+func TestHeaderErrorReport(t *testing.T) {
+	r := newTestReceiver()
+	now := uint32(1700000000)
+	ip := net.ParseIP("10.1.1.1")
+	data := make([]byte, HEADER_ERROR_DUMP_LEN+10)
+	data[0] = 0xab
+	r.headerErrors.record(now, ip, newHeaderError(REASON_HEADER_CRC, errHeaderCRC), data[:10], data[10:])
+	data[0] = 0xcd
+	r.headerErrors.record(now+1, ip, newHeaderError(REASON_UNKNOWN_TYPE, errHeaderCRC), data)
+	r.headerErrors.record(now, net.ParseIP("10.1.1.2"), newHeaderError(REASON_TRUNCATED, errHeaderCRC), data[:4])
+
+	report := r.headerErrors.report()
+	if report.Counts[REASON_HEADER_CRC].Count != 1 || report.Counts[REASON_UNKNOWN_TYPE].Count != 1 || report.Counts[REASON_TRUNCATED].Count != 1 {
+		t.Errorf("unexpected counts %+v", report.Counts)
+	}
+	if len(report.Agents) != 2 {
+		t.Fatalf("unexpected agents %+v", report.Agents)
+	}
+	last := report.Agents[0]
+	if last.IP != "10.1.1.1" || last.Reason != "unknown-type" || last.Count != 2 || last.DumpTimestamp != now {
+		t.Errorf("unexpected last error %+v", last)
+	}
+	// 一分钟内不重新采集出错数据, 且最多采集HEADER_ERROR_DUMP_LEN字节
+	if !strings.HasPrefix(last.Dump, "00000000  ab") || strings.Count(last.Dump, "\n") != HEADER_ERROR_DUMP_LEN/16 {
+		t.Errorf("unexpected dump\n%s", last.Dump)
+	}
+	r.headerErrors.record(now+HEADER_ERROR_DUMP_INTERVAL, ip, newHeaderError(REASON_UNKNOWN_TYPE, errHeaderCRC), data)
+	if last = r.headerErrors.report().Agents[0]; !strings.HasPrefix(last.Dump, "00000000  cd") {
+		t.Errorf("dump should be captured again after interval\n%s", last.Dump)
+	}
+
+	output := &struct {
+		Result *HeaderErrorReport `json:"result"`
+	}{}
+	if err := json.Unmarshal([]byte(r.HandleSimpleCommand(ADAPTER_CMD_ERRORS, CMD_ARG_JSON)), output); err != nil || len(output.Result.Counts) != int(REASON_MAX) {
+		t.Errorf("unexpected errors output %+v, %v", output, err)
+	}
+
+	r.resetCounters(true)
+	if report = r.headerErrors.report(); len(report.Agents) != 0 || report.Counts[REASON_TRUNCATED].Count != 0 {
+		t.Errorf("header errors should be cleared with include-lifetime, %+v", report)
+	}
+}
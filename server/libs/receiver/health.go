@@ -0,0 +1,285 @@
+/*
+ * Copyright (c) 2024 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package receiver
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deepflowio/deepflow/server/libs/datatype"
+)
+
+const (
+	AGENT_HEALTH_DEFAULT_STALE  = 60  // 超过该时间(秒)未收到任何数据的agent为stale
+	AGENT_HEALTH_DEFAULT_GONE   = 300 // 超过该时间(秒)未收到任何数据的agent为gone
+	AGENT_HEALTH_CHECK_INTERVAL = 10  // 检查agent状态变化的间隔(秒)
+)
+
+type AgentState uint8
+
+const (
+	AGENT_STATE_ACTIVE AgentState = iota
+	AGENT_STATE_STALE
+	AGENT_STATE_GONE
+)
+
+func (s AgentState) String() string {
+	switch s {
+	case AGENT_STATE_ACTIVE:
+		return "active"
+	case AGENT_STATE_STALE:
+		return "stale"
+	case AGENT_STATE_GONE:
+		return "gone"
+	}
+	return "unknown"
+}
+
+// 携带vtapID的agent以orgID和vtapID区分, 否则以IP区分
+type agentHealthKey struct {
+	orgID  uint16
+	vtapID uint16
+	ip     string
+}
+
+type agentHealthTracker struct {
+	sync.Mutex
+	staleAfter uint32 // 为0时使用默认值
+	goneAfter  uint32
+
+	// 以下字段仅由定时协程访问
+	lastCheck int64
+	states    map[agentHealthKey]AgentState
+}
+
+type AgentHealthItem struct {
+	VTAPID          uint16   `json:"vtap_id,omitempty"`
+	OrgID           uint16   `json:"org_id,omitempty"`
+	IP              string   `json:"ip"`
+	Hostname        string   `json:"hostname,omitempty"` // 开启主机名解析且已解析时有效
+	LastSeen        uint32   `json:"last_seen"`          // 所有消息类型中最后一次收到数据的本地时间
+	LastRecvFromNow uint32   `json:"last_recv_from_now"`
+	MsgTypes        []string `json:"msg_types"`
+
+	state AgentState
+	key   agentHealthKey
+}
+
+// 按最后一次收到数据的时间将agent分为active, stale和gone
+type AgentHealthReport struct {
+	StaleAfter uint32             `json:"stale_after"`
+	GoneAfter  uint32             `json:"gone_after"`
+	Active     []*AgentHealthItem `json:"active"`
+	Stale      []*AgentHealthItem `json:"stale"`
+	Gone       []*AgentHealthItem `json:"gone"`
+}
+
+func agentState(lastRecvFromNow, staleAfter, goneAfter uint32) AgentState {
+	switch {
+	case lastRecvFromNow >= goneAfter:
+		return AGENT_STATE_GONE
+	case lastRecvFromNow >= staleAfter:
+		return AGENT_STATE_STALE
+	}
+	return AGENT_STATE_ACTIVE
+}
+
+// 汇总所有消息类型的agent状态. 不带vtapID的消息(如syslog)如果与某个agent的IP相同, 计入该agent
+func (s *AdapterStatus) agentHealth(now, staleAfter, goneAfter uint32) *AgentHealthReport {
+	agents := make(map[agentHealthKey]*AgentHealthItem)
+	msgTypes := make(map[agentHealthKey]map[datatype.MessageType]bool)
+	add := func(status *Status) {
+		key := agentHealthKey{ip: status.ip.String()}
+		if status.VTAPID != 0 {
+			key = agentHealthKey{orgID: status.orgId, vtapID: status.VTAPID}
+		}
+		item, ok := agents[key]
+		if !ok {
+			item = &AgentHealthItem{VTAPID: status.VTAPID, OrgID: status.orgId, IP: status.ip.String(), key: key}
+			agents[key] = item
+			msgTypes[key] = make(map[datatype.MessageType]bool)
+		}
+		if status.LastLocalTimestamp > item.LastSeen {
+			item.LastSeen = status.LastLocalTimestamp
+			item.IP = status.ip.String()
+		}
+		msgTypes[key][status.msgType] = true
+	}
+	for i := 0; i < int(datatype.MESSAGE_TYPE_MAX); i++ {
+		s.UDPStatusLocks[i].Lock()
+		for _, status := range s.UDPStatusFlow[i] {
+			add(status)
+		}
+		for _, status := range s.UDPStatusOthers[i] {
+			add(status)
+		}
+		s.UDPStatusLocks[i].Unlock()
+
+		s.TCPStatusLocks[i].RLock()
+		for _, status := range s.TCPStatusFlow[i] {
+			add(status)
+		}
+		for _, status := range s.TCPStatusOthers[i] {
+			add(status)
+		}
+		s.TCPStatusLocks[i].RUnlock()
+	}
+
+	vtapByIP := make(map[string]agentHealthKey)
+	for key, item := range agents {
+		if key.vtapID != 0 {
+			vtapByIP[item.IP] = key
+		}
+	}
+	for key, item := range agents {
+		if key.vtapID != 0 {
+			continue
+		}
+		vtapKey, ok := vtapByIP[key.ip]
+		if !ok {
+			continue
+		}
+		vtapItem := agents[vtapKey]
+		if item.LastSeen > vtapItem.LastSeen {
+			vtapItem.LastSeen = item.LastSeen
+		}
+		for msgType := range msgTypes[key] {
+			msgTypes[vtapKey][msgType] = true
+		}
+		delete(agents, key)
+	}
+
+	// 空的分组输出为[]而不是null
+	report := &AgentHealthReport{StaleAfter: staleAfter, GoneAfter: goneAfter, Active: []*AgentHealthItem{}, Stale: []*AgentHealthItem{}, Gone: []*AgentHealthItem{}}
+	for key, item := range agents {
+		for msgType := range msgTypes[key] {
+			item.MsgTypes = append(item.MsgTypes, msgType.String())
+		}
+		sort.Strings(item.MsgTypes)
+		item.Hostname = s.agentNames.name(net.ParseIP(item.IP))
+		if now > item.LastSeen {
+			item.LastRecvFromNow = now - item.LastSeen
+		}
+		item.state = agentState(item.LastRecvFromNow, staleAfter, goneAfter)
+		switch item.state {
+		case AGENT_STATE_ACTIVE:
+			report.Active = append(report.Active, item)
+		case AGENT_STATE_STALE:
+			report.Stale = append(report.Stale, item)
+		default:
+			report.Gone = append(report.Gone, item)
+		}
+	}
+	for _, items := range [][]*AgentHealthItem{report.Active, report.Stale, report.Gone} {
+		sort.Slice(items, func(i, j int) bool {
+			a, b := items[i].key, items[j].key
+			if a.orgID != b.orgID {
+				return a.orgID < b.orgID
+			}
+			if a.vtapID != b.vtapID {
+				return a.vtapID < b.vtapID
+			}
+			return a.ip < b.ip
+		})
+	}
+	return report
+}
+
+func (r *AgentHealthReport) String() string {
+	status := fmt.Sprintf("Agents: %d active, %d stale (no data for %ds), %d gone (no data for %ds)\n",
+		len(r.Active), len(r.Stale), r.StaleAfter, len(r.Gone), r.GoneAfter)
+	status += fmt.Sprintf("State  VTAPID OrgID IP                                       LastSeen            LastRecvFromNow MsgTypes\n")
+	status += fmt.Sprintf("--------------------------------------------------------------------------------------------------------\n")
+	for _, group := range []struct {
+		state string
+		items []*AgentHealthItem
+	}{{"gone", r.Gone}, {"stale", r.Stale}, {"active", r.Active}} {
+		for _, item := range group.items {
+			status += fmt.Sprintf("%-6s %-6d %-5d %-40s %-19.19s %-15d %s\n",
+				group.state, item.VTAPID, item.OrgID, displayName(item.IP, item.Hostname), time.Unix(int64(item.LastSeen), 0), item.LastRecvFromNow, strings.Join(item.MsgTypes, ","))
+		}
+	}
+	return status
+}
+
+// 修改判断agent为stale和gone的阈值(秒), 为0时使用默认值
+func (r *Receiver) SetAgentHealthThresholds(staleAfter, goneAfter uint32) error {
+	if staleAfter == 0 {
+		staleAfter = AGENT_HEALTH_DEFAULT_STALE
+	}
+	if goneAfter == 0 {
+		goneAfter = AGENT_HEALTH_DEFAULT_GONE
+	}
+	if goneAfter <= staleAfter {
+		return fmt.Errorf("gone threshold %ds must be greater than stale threshold %ds", goneAfter, staleAfter)
+	}
+	r.agentHealth.Lock()
+	r.agentHealth.staleAfter, r.agentHealth.goneAfter = staleAfter, goneAfter
+	r.agentHealth.Unlock()
+	return nil
+}
+
+func (r *Receiver) agentHealthThresholds() (uint32, uint32) {
+	r.agentHealth.Lock()
+	defer r.agentHealth.Unlock()
+	if r.agentHealth.staleAfter == 0 {
+		return AGENT_HEALTH_DEFAULT_STALE, AGENT_HEALTH_DEFAULT_GONE
+	}
+	return r.agentHealth.staleAfter, r.agentHealth.goneAfter
+}
+
+// 命令参数中的阈值仅对本次查询有效
+func (r *Receiver) handleHealthCommand(args *commandArgs) fmt.Stringer {
+	staleAfter, goneAfter := r.agentHealthThresholds()
+	if args.staleAfter > 0 {
+		staleAfter = args.staleAfter
+	}
+	if args.goneAfter > 0 {
+		goneAfter = args.goneAfter
+	}
+	if goneAfter <= staleAfter {
+		return commandError(fmt.Sprintf("gone threshold %ds must be greater than stale threshold %ds", goneAfter, staleAfter))
+	}
+	return r.status.agentHealth(uint32(r.timeNow), staleAfter, goneAfter)
+}
+
+// 由定时协程周期调用, 打印agent状态的变化. 首次出现的agent不打印, 状态被reset清除的agent不再跟踪
+func (r *Receiver) checkAgentHealth() {
+	staleAfter, goneAfter := r.agentHealthThresholds()
+	report := r.status.agentHealth(uint32(r.timeNow), staleAfter, goneAfter)
+	states := make(map[agentHealthKey]AgentState, len(r.agentHealth.states))
+	for _, items := range [][]*AgentHealthItem{report.Active, report.Stale, report.Gone} {
+		for _, item := range items {
+			states[item.key] = item.state
+			last, ok := r.agentHealth.states[item.key]
+			if !ok || last == item.state {
+				continue
+			}
+			logf := log.Warningf
+			if item.state == AGENT_STATE_ACTIVE {
+				logf = log.Infof
+			}
+			logf("agent health changed: vtap %d org %d ip %s %s -> %s, last seen %ds ago",
+				item.VTAPID, item.OrgID, displayName(item.IP, item.Hostname), last, item.state, item.LastRecvFromNow)
+		}
+	}
+	r.agentHealth.states = states
+}
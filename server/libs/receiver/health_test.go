@@ -0,0 +1,133 @@
+/*
+ * Copyright (c) 2024 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package receiver
+
+import (
+	"encoding/json"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/deepflowio/deepflow/server/libs/datatype"
+)
+
+func healthVtapIDs(items []*AgentHealthItem) []uint16 {
+	ids := []uint16{}
+	for _, item := range items {
+		ids = append(ids, item.VTAPID)
+	}
+	return ids
+}
+
+func TestAgentHealth(t *testing.T) {
+	r := newTestReceiver()
+	r.timeNow = 1700000000
+	now := uint32(r.timeNow)
+	update := func(msgType datatype.MessageType, vtapID uint16, ip string, lastSeen uint32, serverType ServerType) {
+		r.status.Update(lastSeen, msgType, vtapID, 1, datatype.LATEST_VERSION, datatype.ENCODER_RAW, net.ParseIP(ip), 0, lastSeen, serverType)
+	}
+	update(datatype.MESSAGE_TYPE_METRICS, 1, "10.1.1.1", now-5, UDP)
+	update(datatype.MESSAGE_TYPE_METRICS, 2, "10.1.1.2", now-100, UDP)
+	// 不同消息类型以最新的为准
+	update(datatype.MESSAGE_TYPE_TAGGEDFLOW, 2, "10.1.1.2", now-70, TCP)
+	update(datatype.MESSAGE_TYPE_METRICS, 3, "10.1.1.3", now-400, TCP)
+	// syslog不带vtapID, 以IP计入vtap 3
+	update(datatype.MESSAGE_TYPE_SYSLOG, 0, "10.1.1.3", now-30, UDP)
+	update(datatype.MESSAGE_TYPE_SYSLOG, 0, "10.1.1.100", now-400, UDP)
+
+	report := r.handleAdapterCommand(ADAPTER_CMD_HEALTH, parseCommandArgs("")).(*AgentHealthReport)
+	if report.StaleAfter != AGENT_HEALTH_DEFAULT_STALE || report.GoneAfter != AGENT_HEALTH_DEFAULT_GONE {
+		t.Errorf("unexpected thresholds %+v", report)
+	}
+	if ids := healthVtapIDs(report.Active); !reflect.DeepEqual(ids, []uint16{1, 3}) {
+		t.Errorf("unexpected active agents %v", ids)
+	}
+	if ids := healthVtapIDs(report.Stale); !reflect.DeepEqual(ids, []uint16{2}) {
+		t.Errorf("unexpected stale agents %v", ids)
+	}
+	if len(report.Gone) != 1 || report.Gone[0].IP != "10.1.1.100" || report.Gone[0].LastRecvFromNow != 400 {
+		t.Errorf("unexpected gone agents %+v", report.Gone)
+	}
+	if item := report.Active[1]; item.LastSeen != now-30 || !reflect.DeepEqual(item.MsgTypes, []string{"metrics", "syslog"}) {
+		t.Errorf("syslog should be merged into vtap 3, %+v", item)
+	}
+	if item := report.Stale[0]; item.LastRecvFromNow != 70 || !reflect.DeepEqual(item.MsgTypes, []string{"l4_log", "metrics"}) {
+		t.Errorf("unexpected stale agent %+v", item)
+	}
+
+	// 命令参数覆盖阈值
+	report = r.handleAdapterCommand(ADAPTER_CMD_HEALTH, parseCommandArgs("stale=10 gone=80")).(*AgentHealthReport)
+	if len(report.Active) != 1 || len(report.Stale) != 2 || len(report.Gone) != 1 {
+		t.Errorf("unexpected report with custom thresholds %+v", report)
+	}
+	if _, ok := r.handleAdapterCommand(ADAPTER_CMD_HEALTH, parseCommandArgs("stale=100 gone=80")).(commandError); !ok {
+		t.Error("expect error when gone threshold is not greater than stale threshold")
+	}
+	if err := r.SetAgentHealthThresholds(100, 50); err == nil {
+		t.Error("expect error for invalid thresholds")
+	}
+
+	r.status.reset()
+	output := &struct {
+		Result *AgentHealthReport `json:"result"`
+	}{}
+	if err := json.Unmarshal([]byte(r.HandleSimpleCommand(ADAPTER_CMD_HEALTH, CMD_ARG_JSON)), output); err != nil ||
+		output.Result.Active == nil || len(output.Result.Active)+len(output.Result.Stale)+len(output.Result.Gone) != 0 {
+		t.Errorf("unexpected empty report %+v, %v", output.Result, err)
+	}
+}
+
+func TestAgentHealthTransition(t *testing.T) {
+	r := newTestReceiver()
+	r.SetAgentHealthThresholds(10, 20)
+	r.timeNow = 1700000000
+	update := func(vtapID uint16) {
+		r.status.Update(uint32(r.timeNow), datatype.MESSAGE_TYPE_METRICS, vtapID, 1, datatype.LATEST_VERSION, datatype.ENCODER_RAW, net.ParseIP("10.1.1.1"), 0, uint32(r.timeNow), UDP)
+	}
+	update(1)
+	update(2)
+	for _, step := range []struct {
+		elapsed  int64
+		refresh  []uint16
+		expected map[uint16]AgentState
+	}{
+		{0, nil, map[uint16]AgentState{1: AGENT_STATE_ACTIVE, 2: AGENT_STATE_ACTIVE}},
+		{10, []uint16{2}, map[uint16]AgentState{1: AGENT_STATE_STALE, 2: AGENT_STATE_ACTIVE}},
+		{10, nil, map[uint16]AgentState{1: AGENT_STATE_GONE, 2: AGENT_STATE_STALE}},
+		{5, []uint16{1}, map[uint16]AgentState{1: AGENT_STATE_ACTIVE, 2: AGENT_STATE_STALE}},
+	} {
+		r.timeNow += step.elapsed
+		for _, vtapID := range step.refresh {
+			update(vtapID)
+		}
+		r.checkAgentHealth()
+		states := map[uint16]AgentState{}
+		for key, state := range r.agentHealth.states {
+			states[key.vtapID] = state
+		}
+		if !reflect.DeepEqual(states, step.expected) {
+			t.Errorf("after %d seconds expect %v, actual %v", step.elapsed, step.expected, states)
+		}
+	}
+
+	// reset后不再跟踪
+	r.status.reset()
+	r.checkAgentHealth()
+	if len(r.agentHealth.states) != 0 {
+		t.Errorf("states should be cleared after reset, %v", r.agentHealth.states)
+	}
+}
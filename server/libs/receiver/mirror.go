@@ -0,0 +1,267 @@
+/*
+ * Copyright (c) 2024 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package receiver
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	MIRROR_RING_SIZE = 4096 // 等待发送的数据报数上限, 发送跟不上时丢弃新的数据报
+)
+
+// 将收到的UDP数据报原样转发到另一个地址, 用于迁移时同时向新旧两套ingester发送数据.
+// 接收线程只复制数据报并投递到有界的ring中, 由后台协程通过独立的socket发送, ring满时丢弃副本, 不影响正常接收.
+// TCP收到的消息大小可能超过UDP的上限, 不转发.
+// 转发使用本机的socket, 目标看到的源IP都是本ingester: 包头中的agent ID不受影响, 但目标上按IP区分的状态
+// (vtapID为0的消息), 丢包检测和主机名都会合并到本机IP上. 伪造源IP需要raw socket和额外的权限, 不支持.
+// 目标地址只能通过配置修改, 防止通过没有认证的ctl命令把ingester变成UDP反射器
+type mirror struct {
+	destination *net.UDPAddr
+	filters     []*net.IPNet // 只转发这些网段的agent发送的数据报, 为空时转发所有
+
+	conn    *net.UDPConn
+	packets chan []byte
+	stop    chan struct{}
+	stopped sync.WaitGroup
+
+	mirrored   uint64 // 已发送的数据报数
+	dropped    uint64 // 因ring满而丢弃的数据报数
+	sendFailed uint64
+
+	errLock sync.Mutex
+	lastErr string
+}
+
+func newMirror(destination string, filters []string) (*mirror, error) {
+	addr, err := net.ResolveUDPAddr("udp", destination)
+	if err != nil {
+		return nil, err
+	}
+	if addr.Port == 0 {
+		return nil, fmt.Errorf("mirror destination %s has no port", destination)
+	}
+	m := &mirror{
+		destination: addr,
+		packets:     make(chan []byte, MIRROR_RING_SIZE),
+		stop:        make(chan struct{}),
+	}
+	for _, filter := range filters {
+		network, err := parseIPNet(filter)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mirror filter %q: %s", filter, err)
+		}
+		m.filters = append(m.filters, network)
+	}
+	return m, nil
+}
+
+// 创建发送socket并启动发送协程
+func (m *mirror) start() error {
+	conn, err := net.DialUDP("udp", nil, m.destination)
+	if err != nil {
+		return err
+	}
+	m.conn = conn
+	m.stopped.Add(1)
+	go m.run()
+	return nil
+}
+
+// 停止发送协程并关闭socket, ring中尚未发送的数据报直接丢弃
+func (m *mirror) close() {
+	close(m.stop)
+	m.stopped.Wait()
+}
+
+func (m *mirror) match(ip net.IP) bool {
+	if len(m.filters) == 0 {
+		return true
+	}
+	for _, filter := range m.filters {
+		if filter.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// 由接收线程调用, 不阻塞
+func (m *mirror) capture(ip net.IP, packet []byte) {
+	if !m.match(ip) {
+		return
+	}
+	select {
+	case m.packets <- append([]byte(nil), packet...):
+	default:
+		atomic.AddUint64(&m.dropped, 1)
+	}
+}
+
+func (m *mirror) run() {
+	defer m.stopped.Done()
+	defer m.conn.Close()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case packet := <-m.packets:
+			if _, err := m.conn.Write(packet); err != nil {
+				atomic.AddUint64(&m.sendFailed, 1)
+				m.errLock.Lock()
+				m.lastErr = err.Error()
+				m.errLock.Unlock()
+				continue
+			}
+			atomic.AddUint64(&m.mirrored, 1)
+		}
+	}
+}
+
+func (m *mirror) filterStrings() []string {
+	filters := make([]string, 0, len(m.filters))
+	for _, filter := range m.filters {
+		filters = append(filters, filter.String())
+	}
+	return filters
+}
+
+type MirrorStatus struct {
+	Enabled     bool     `json:"enabled"`
+	Destination string   `json:"destination,omitempty"`
+	Filters     []string `json:"filters,omitempty"`
+	Mirrored    uint64   `json:"mirrored"`
+	Dropped     uint64   `json:"dropped"`
+	SendFailed  uint64   `json:"send_failed"`
+	LastError   string   `json:"last_error,omitempty"`
+}
+
+func (m *mirror) status() *MirrorStatus {
+	m.errLock.Lock()
+	lastErr := m.lastErr
+	m.errLock.Unlock()
+	return &MirrorStatus{
+		Enabled:     true,
+		Destination: m.destination.String(),
+		Filters:     m.filterStrings(),
+		Mirrored:    atomic.LoadUint64(&m.mirrored),
+		Dropped:     atomic.LoadUint64(&m.dropped),
+		SendFailed:  atomic.LoadUint64(&m.sendFailed),
+		LastError:   lastErr,
+	}
+}
+
+func (s *MirrorStatus) String() string {
+	if !s.Enabled {
+		return "mirror is disabled"
+	}
+	status := fmt.Sprintf("mirror is enabled, sending UDP datagrams to %s\n", s.Destination)
+	filters := "all agents"
+	if len(s.Filters) > 0 {
+		filters = strings.Join(s.Filters, ",")
+	}
+	status += fmt.Sprintf("    %-12s %s\n", "Filters", filters)
+	status += fmt.Sprintf("    %-12s %d\n", "Mirrored", s.Mirrored)
+	status += fmt.Sprintf("    %-12s %d\n", "Dropped", s.Dropped)
+	status += fmt.Sprintf("    %-12s %d\n", "SendFailed", s.SendFailed)
+	if s.LastError != "" {
+		status += fmt.Sprintf("    %-12s %s\n", "LastError", s.LastError)
+	}
+	return status
+}
+
+// 开启转发, 已开启时以新的参数重新开启. filters为网段或IP, 为空时转发所有agent的数据报
+func (r *Receiver) EnableMirror(destination string, filters []string) error {
+	m, err := newMirror(destination, filters)
+	if err != nil {
+		return err
+	}
+	r.mirrorLock.Lock()
+	defer r.mirrorLock.Unlock()
+	r.stopMirror()
+	if err := m.start(); err != nil {
+		return err
+	}
+	r.mirror.Store(m)
+	log.Infof("receiver mirror enabled, sending to %s", m.destination)
+	return nil
+}
+
+func (r *Receiver) DisableMirror() {
+	r.mirrorLock.Lock()
+	defer r.mirrorLock.Unlock()
+	if r.stopMirror() {
+		log.Info("receiver mirror disabled")
+	}
+}
+
+// 调用方需持有mirrorLock, 返回是否关闭了已开启的转发
+func (r *Receiver) stopMirror() bool {
+	m := r.loadMirror()
+	if m == nil {
+		return false
+	}
+	r.mirror.Store((*mirror)(nil))
+	m.close()
+	return true
+}
+
+func (r *Receiver) loadMirror() *mirror {
+	m, _ := r.mirror.Load().(*mirror)
+	return m
+}
+
+func (r *Receiver) mirrorStatus() *MirrorStatus {
+	if m := r.loadMirror(); m != nil {
+		return m.status()
+	}
+	return &MirrorStatus{}
+}
+
+// ctl只能开关转发到配置的目标地址, 未指定过滤条件时使用配置的过滤条件
+func (r *Receiver) handleMirrorCommand(args *commandArgs) fmt.Stringer {
+	switch args.tapAction {
+	case CMD_ARG_TAP_ON:
+		if args.mirrorDest != "" {
+			return commandError("mirror destination can only be changed in the config")
+		}
+		if r.mirrorDestination == "" {
+			return commandError("mirror destination is not configured")
+		}
+		filters := args.mirrorFilters
+		if len(filters) == 0 {
+			filters = r.mirrorFilters
+		}
+		if err := r.EnableMirror(r.mirrorDestination, filters); err != nil {
+			return commandError(fmt.Sprintf("enable mirror failed: %s", err))
+		}
+	case CMD_ARG_TAP_OFF:
+		r.DisableMirror()
+	}
+	return r.mirrorStatus()
+}
+
+// 由UDP接收线程调用, 未开启时只有一次原子读
+func (r *Receiver) mirrorDatagram(ip net.IP, packet []byte) {
+	if m := r.loadMirror(); m != nil {
+		m.capture(ip, packet)
+	}
+}
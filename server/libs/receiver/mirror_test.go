@@ -0,0 +1,132 @@
+/*
+ * Copyright (c) 2024 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package receiver
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMirror(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	r := newTestReceiver()
+	r.mirrorDestination = conn.LocalAddr().String()
+	result := r.HandleSimpleCommand(ADAPTER_CMD_MIRROR, "on filter=10.1.0.0/16 filter=fd00::1")
+	if r.loadMirror() == nil {
+		t.Fatalf("mirror should be enabled, result %s", result)
+	}
+	defer r.DisableMirror()
+
+	for _, c := range []struct {
+		ip     string
+		packet string
+	}{
+		{"10.1.2.3", "packet1"},
+		{"10.2.2.3", "filtered"},
+		{"fd00::1", "packet2"},
+		{"fd00::2", "filtered"},
+	} {
+		r.mirrorDatagram(net.ParseIP(c.ip), []byte(c.packet))
+	}
+	buffer := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, expected := range []string{"packet1", "packet2"} {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buffer[:n]) != expected {
+			t.Errorf("expect %s, actual %s", expected, buffer[:n])
+		}
+	}
+
+	output := &struct {
+		Result *MirrorStatus `json:"result"`
+	}{}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if err := json.Unmarshal([]byte(r.HandleSimpleCommand(ADAPTER_CMD_MIRROR, CMD_ARG_JSON)), output); err != nil {
+			t.Fatal(err)
+		}
+		if output.Result.Mirrored == 2 {
+			break
+		}
+	}
+	if status := output.Result; !status.Enabled || status.Destination != conn.LocalAddr().String() ||
+		len(status.Filters) != 2 || status.Filters[1] != "fd00::1/128" || status.Mirrored != 2 || status.Dropped != 0 {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	r.HandleSimpleCommand(ADAPTER_CMD_MIRROR, CMD_ARG_TAP_OFF)
+	if r.loadMirror() != nil || r.mirrorStatus().Enabled {
+		t.Error("mirror should be disabled")
+	}
+
+	// 未指定过滤条件时使用配置的过滤条件
+	r.mirrorFilters = []string{"10.3.0.0/16"}
+	if status, ok := r.handleAdapterCommand(ADAPTER_CMD_MIRROR, parseCommandArgs("on")).(*MirrorStatus); !ok || !status.Enabled ||
+		status.Destination != conn.LocalAddr().String() || len(status.Filters) != 1 || status.Filters[0] != "10.3.0.0/16" {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
+
+func TestMirrorOverflow(t *testing.T) {
+	// 未启动发送协程, ring满后的数据报被丢弃
+	m, err := newMirror("127.0.0.1:20033", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := []byte("packet")
+	for i := 0; i < MIRROR_RING_SIZE+10; i++ {
+		m.capture(net.ParseIP("10.1.2.3"), packet)
+	}
+	// 投递的是副本, 接收buffer可以立即复用
+	packet[0] = 'x'
+	if status := m.status(); status.Dropped != 10 || len(m.packets) != MIRROR_RING_SIZE || string(<-m.packets) != "packet" {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
+
+func TestMirrorInvalid(t *testing.T) {
+	r := newTestReceiver()
+	// 未配置目标地址时无法开启
+	output := &CommandOutput{}
+	if err := json.Unmarshal([]byte(r.HandleSimpleCommand(ADAPTER_CMD_MIRROR, "json on")), output); err != nil || output.Error == "" {
+		t.Errorf("expect error without configured destination, actual %+v", output)
+	}
+	// 目标地址只能通过配置修改
+	r.mirrorDestination = "127.0.0.1:20033"
+	for _, arg := range []string{
+		"on dest=127.0.0.1:20034",
+		"on dest=127.0.0.1:20033",
+		"on filter=10.1.0.0/33",
+	} {
+		output := &CommandOutput{}
+		if err := json.Unmarshal([]byte(r.HandleSimpleCommand(ADAPTER_CMD_MIRROR, "json "+arg)), output); err != nil || output.Error == "" {
+			t.Errorf("%s: expect error, actual %+v", arg, output)
+		}
+	}
+	if r.loadMirror() != nil {
+		t.Error("mirror should not be enabled")
+	}
+}
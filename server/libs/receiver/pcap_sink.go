@@ -0,0 +1,358 @@
+/*
+ * Copyright (c) 2024 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package receiver
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+
+	"github.com/deepflowio/deepflow/server/libs/datatype"
+	"github.com/deepflowio/deepflow/server/libs/queue"
+)
+
+const (
+	PCAP_SINK_RING_SIZE             = 4096 // 等待写入的消息数上限, 写入跟不上时丢弃新的消息
+	PCAP_SINK_DEFAULT_FILE_SIZE     = 64 << 20
+	PCAP_SINK_DEFAULT_ROTATE        = time.Hour
+	PCAP_SINK_DEFAULT_SYNC_INTERVAL = 10 * time.Second
+	PCAP_SINK_DEFAULT_DISK_BUDGET   = 1 << 30
+	PCAP_SINK_FILE_TIME_FORMAT      = "20060102-150405.000000000"
+)
+
+type PcapSinkConfig struct {
+	Directory      string
+	MaxFileSize    int64         // 单个文件的大小上限, 超过后轮转
+	RotateInterval time.Duration // 单个文件的写入时长上限, 超过后轮转
+	SyncInterval   time.Duration // 定期刷新并fsync正在写入的文件
+	DiskBudget     int64         // 目录中该消息类型所有文件的总大小上限, 轮转时删除最旧的文件
+	LocalAddr      *net.UDPAddr  // 伪造的UDP头中的目的地址和端口, 通常为接收端监听的地址, 便于用cmd/replay重放
+}
+
+type PcapSinkCounter struct {
+	Written     uint64 `statsd:"written,count"`
+	Bytes       uint64 `statsd:"bytes,count"`
+	Dropped     uint64 `statsd:"dropped,count"` // ring满时丢弃的消息数
+	WriteFailed uint64 `statsd:"write_failed,count"`
+	Rotated     uint64 `statsd:"rotated,count"`
+	Deleted     uint64 `statsd:"deleted,count"` // 超出磁盘预算而删除的文件数
+}
+
+// 将接收到的消息写入按大小和时长轮转的pcap文件, 用于小规模部署时留存原始数据以便事后分析.
+// 实现queue.MultiQueueWriter, 可直接作为RegistHandler的输出队列; next不为nil时同时转发给下游队列.
+// 消息按包头格式还原后加上伪造的IP/UDP头写入, 时间戳为接收时间, 可用cmd/replay重放.
+// Put时复制消息内容, 未转发时随即释放RecvBuffer; 写文件由后台协程完成, 不阻塞接收线程
+type PcapSink struct {
+	msgType datatype.MessageType
+	config  PcapSinkConfig
+	next    queue.MultiQueueWriter
+
+	records chan *errorTapRecord
+	stop    chan struct{}
+	stopped sync.WaitGroup
+	closed  uint32
+
+	counter PcapSinkCounter
+
+	errLock sync.Mutex
+	lastErr string
+
+	// 以下字段仅由写入协程访问
+	writer   *pcapgo.Writer
+	buffered *bufio.Writer
+	fp       *os.File
+	size     int64
+	openTime time.Time
+}
+
+func NewPcapSink(msgType datatype.MessageType, config PcapSinkConfig, next queue.MultiQueueWriter) (*PcapSink, error) {
+	if config.Directory == "" {
+		return nil, fmt.Errorf("pcap sink directory is not set")
+	}
+	if config.MaxFileSize <= 0 {
+		config.MaxFileSize = PCAP_SINK_DEFAULT_FILE_SIZE
+	}
+	if config.RotateInterval <= 0 {
+		config.RotateInterval = PCAP_SINK_DEFAULT_ROTATE
+	}
+	if config.SyncInterval <= 0 {
+		config.SyncInterval = PCAP_SINK_DEFAULT_SYNC_INTERVAL
+	}
+	if config.DiskBudget <= 0 {
+		config.DiskBudget = PCAP_SINK_DEFAULT_DISK_BUDGET
+	}
+	if config.LocalAddr == nil {
+		config.LocalAddr = &net.UDPAddr{}
+	}
+	if err := os.MkdirAll(config.Directory, 0755); err != nil {
+		return nil, err
+	}
+	s := &PcapSink{
+		msgType: msgType,
+		config:  config,
+		next:    next,
+		records: make(chan *errorTapRecord, PCAP_SINK_RING_SIZE),
+		stop:    make(chan struct{}),
+	}
+	// 启动前遗留的文件同样计入磁盘预算
+	s.enforceDiskBudget()
+	s.stopped.Add(1)
+	go s.run()
+	return s, nil
+}
+
+func (s *PcapSink) Put(key queue.HashKey, items ...interface{}) error {
+	for _, item := range items {
+		s.capture(item)
+	}
+	if s.next != nil {
+		return s.next.Put(key, items...)
+	}
+	return nil
+}
+
+func (s *PcapSink) Puts(keys []queue.HashKey, items []interface{}) error {
+	for _, item := range items {
+		s.capture(item)
+	}
+	if s.next != nil {
+		return s.next.Puts(keys, items)
+	}
+	return nil
+}
+
+func (s *PcapSink) Len(key queue.HashKey) int {
+	if s.next != nil {
+		return s.next.Len(key)
+	}
+	return len(s.records)
+}
+
+// 停止写入协程并关闭文件, ring中尚未写入的消息直接丢弃
+func (s *PcapSink) Close() error {
+	if !atomic.CompareAndSwapUint32(&s.closed, 0, 1) {
+		return nil
+	}
+	close(s.stop)
+	s.stopped.Wait()
+	if s.next != nil {
+		return s.next.Close()
+	}
+	return nil
+}
+
+func (s *PcapSink) Closed() bool {
+	return atomic.LoadUint32(&s.closed) == 1
+}
+
+func (s *PcapSink) GetCounter() interface{} {
+	return &PcapSinkCounter{
+		Written:     atomic.SwapUint64(&s.counter.Written, 0),
+		Bytes:       atomic.SwapUint64(&s.counter.Bytes, 0),
+		Dropped:     atomic.SwapUint64(&s.counter.Dropped, 0),
+		WriteFailed: atomic.SwapUint64(&s.counter.WriteFailed, 0),
+		Rotated:     atomic.SwapUint64(&s.counter.Rotated, 0),
+		Deleted:     atomic.SwapUint64(&s.counter.Deleted, 0),
+	}
+}
+
+func (s *PcapSink) LastError() string {
+	s.errLock.Lock()
+	defer s.errLock.Unlock()
+	return s.lastErr
+}
+
+func (s *PcapSink) setError(err error) {
+	s.errLock.Lock()
+	s.lastErr = err.Error()
+	s.errLock.Unlock()
+}
+
+// 由接收线程调用, 不阻塞. 队列的flush标记(nil)等非RecvBuffer的元素直接忽略
+func (s *PcapSink) capture(item interface{}) {
+	buffer, ok := item.(*RecvBuffer)
+	if !ok || buffer == nil {
+		return
+	}
+	encoder := &datatype.MessageEncoder{
+		Type: s.msgType,
+		FlowHeader: datatype.FlowHeader{
+			Version: datatype.LATEST_VERSION,
+			Encoder: buffer.Encoder,
+			TeamID:  buffer.TeamID,
+			OrgID:   buffer.OrgID,
+			AgentID: buffer.VtapID,
+		},
+	}
+	encoder.Append(buffer.Payload())
+	// buffer.IP指向buffer自己的存储, buffer释放或由下游释放后会被下一个消息复用, 需要复制
+	record := &errorTapRecord{timestamp: time.Unix(int64(buffer.Timestamp), 0), ip: append(net.IP(nil), buffer.IP...), data: encoder.Emit(nil)}
+	if buffer.Timestamp == 0 {
+		record.timestamp = time.Now()
+	}
+	if record.ip == nil {
+		record.ip = net.IPv4zero
+	}
+	if s.next == nil {
+		ReleaseRecvBuffer(buffer)
+	}
+	select {
+	case s.records <- record:
+	default:
+		atomic.AddUint64(&s.counter.Dropped, 1)
+	}
+}
+
+func (s *PcapSink) run() {
+	defer s.stopped.Done()
+	defer s.closeFile()
+	ticker := time.NewTicker(s.config.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C:
+			if s.fp == nil {
+				continue
+			}
+			if now.Sub(s.openTime) >= s.config.RotateInterval {
+				s.rotate()
+			} else if err := s.sync(); err != nil {
+				atomic.AddUint64(&s.counter.WriteFailed, 1)
+				s.setError(err)
+			}
+		case record := <-s.records:
+			if err := s.write(record); err != nil {
+				atomic.AddUint64(&s.counter.WriteFailed, 1)
+				s.setError(err)
+			}
+		}
+	}
+}
+
+func (s *PcapSink) filePrefix() string {
+	return filepath.Join(s.config.Directory, s.msgType.String()+"-")
+}
+
+func (s *PcapSink) open() error {
+	s.openTime = time.Now()
+	fp, err := os.OpenFile(s.filePrefix()+s.openTime.Format(PCAP_SINK_FILE_TIME_FORMAT)+".pcap", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	s.fp = fp
+	s.buffered = bufio.NewWriter(fp)
+	s.writer = pcapgo.NewWriter(s.buffered)
+	if err := s.writer.WriteFileHeader(ERROR_TAP_SNAPLEN, layers.LinkTypeRaw); err != nil {
+		s.closeFile()
+		return err
+	}
+	s.size = 24 // pcap文件头长度
+	return nil
+}
+
+func (s *PcapSink) sync() error {
+	if err := s.buffered.Flush(); err != nil {
+		return err
+	}
+	return s.fp.Sync()
+}
+
+func (s *PcapSink) closeFile() {
+	if s.fp == nil {
+		return
+	}
+	s.sync()
+	s.fp.Close()
+	s.fp, s.buffered, s.writer = nil, nil, nil
+}
+
+// 关闭当前文件, 新文件在下一个消息到达时创建, 避免空闲时产生空文件
+func (s *PcapSink) rotate() {
+	s.closeFile()
+	atomic.AddUint64(&s.counter.Rotated, 1)
+	s.enforceDiskBudget()
+}
+
+// 文件名以创建时间结尾, 按文件名排序即为创建顺序, 从最旧的文件开始删除直到总大小不超过预算.
+// 仅在没有正在写入的文件时调用, 因此实际占用最多超出预算MaxFileSize
+func (s *PcapSink) enforceDiskBudget() {
+	files, err := filepath.Glob(s.filePrefix() + "*.pcap")
+	if err != nil {
+		return
+	}
+	sort.Strings(files)
+	sizes := make([]int64, len(files))
+	total := int64(0)
+	for i, file := range files {
+		if info, err := os.Stat(file); err == nil {
+			sizes[i] = info.Size()
+			total += sizes[i]
+		}
+	}
+	for i, file := range files {
+		if total <= s.config.DiskBudget {
+			return
+		}
+		if err := os.Remove(file); err != nil {
+			s.setError(err)
+			continue
+		}
+		total -= sizes[i]
+		atomic.AddUint64(&s.counter.Deleted, 1)
+	}
+}
+
+func (s *PcapSink) write(record *errorTapRecord) error {
+	data, err := encapsulateUDP(record.ip, 0, s.config.LocalAddr.IP, s.config.LocalAddr.Port, record.data)
+	if err != nil {
+		return err
+	}
+	if len(data) > ERROR_TAP_SNAPLEN {
+		return fmt.Errorf("message length %d exceeds snaplen %d", len(data), ERROR_TAP_SNAPLEN)
+	}
+	// 每条记录包括16字节的记录头
+	if s.fp != nil && (s.size+int64(16+len(data)) > s.config.MaxFileSize || time.Since(s.openTime) >= s.config.RotateInterval) {
+		s.rotate()
+	}
+	if s.fp == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	ci := gopacket.CaptureInfo{Timestamp: record.timestamp, CaptureLength: len(data), Length: len(data)}
+	if err := s.writer.WritePacket(ci, data); err != nil {
+		// 写入失败后文件内容可能不完整, 关闭后在下一个消息时重新创建
+		s.closeFile()
+		return err
+	}
+	s.size += int64(16 + len(data))
+	atomic.AddUint64(&s.counter.Written, 1)
+	atomic.AddUint64(&s.counter.Bytes, uint64(len(data)))
+	return nil
+}
@@ -0,0 +1,226 @@
+/*
+ * Copyright (c) 2024 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package receiver
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/deepflowio/deepflow/server/libs/datatype"
+	"github.com/deepflowio/deepflow/server/libs/queue"
+)
+
+func newSinkBuffer(ip string, vtapID uint16, payload []byte) *RecvBuffer {
+	buffer, _ := AcquireRecvBuffer(RECV_BUFSIZE_2K, UDP)
+	buffer.Begin = datatype.MESSAGE_HEADER_LEN + datatype.FLOW_HEADER_LEN
+	buffer.End = buffer.Begin + copy(buffer.Buffer[buffer.Begin:], payload)
+	buffer.IP = net.ParseIP(ip)
+	buffer.VtapID = vtapID
+	buffer.OrgID = 1
+	buffer.Timestamp = 1700000000
+	return buffer
+}
+
+func waitSinkWritten(t *testing.T, s *PcapSink, expected uint64) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if atomic.LoadUint64(&s.counter.Written)+atomic.LoadUint64(&s.counter.WriteFailed)+atomic.LoadUint64(&s.counter.Dropped) >= expected {
+			return
+		}
+	}
+	t.Fatalf("timeout waiting for %d messages, counter %+v", expected, s.counter)
+}
+
+func sinkFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "metrics-*.pcap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestPcapSinkWrite(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewPcapSink(datatype.MESSAGE_TYPE_METRICS, PcapSinkConfig{Directory: dir, LocalAddr: &net.UDPAddr{Port: 30033}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put(0, newSinkBuffer("10.1.2.3", 3, []byte("record1")), nil)
+	s.Puts([]queue.HashKey{0, 0}, []interface{}{newSinkBuffer("fd00::3", 4, []byte("record2")), newSinkBuffer("10.1.2.4", 5, []byte("record3"))})
+	waitSinkWritten(t, s, 3)
+	s.Close()
+
+	files := sinkFiles(t, dir)
+	if len(files) != 1 {
+		t.Fatalf("expect 1 file, actual %v", files)
+	}
+	// 写入的是完整的消息, 可以按接收端的方式重新解码
+	datagrams := readErrorTapFile(t, files[0])
+	for i, expected := range []struct {
+		ip      string
+		vtapID  uint16
+		payload string
+	}{
+		{"10.1.2.3", 3, "record1"},
+		{"fd00::3", 4, "record2"},
+		{"10.1.2.4", 5, "record3"},
+	} {
+		if i >= len(datagrams) {
+			t.Fatalf("expect 3 datagrams, actual %d", len(datagrams))
+		}
+		d := datagrams[i]
+		header := &udpHeader{}
+		if err := newTestReceiver().decodeUDPHeader(d.payload, header); err != nil {
+			t.Errorf("datagram %d: %v", i, err)
+			continue
+		}
+		if d.ip != expected.ip || d.dstPort != 30033 || header.flow.AgentID != expected.vtapID || header.flow.OrgID != 1 ||
+			string(d.payload[header.headerLen:header.end]) != expected.payload {
+			t.Errorf("datagram %d: unexpected %+v, header %+v", i, d, header.flow)
+		}
+	}
+	if counter := s.GetCounter().(*PcapSinkCounter); counter.Written != 3 || counter.WriteFailed != 0 || counter.Dropped != 0 {
+		t.Errorf("unexpected counter %+v", counter)
+	}
+}
+
+func TestPcapSinkRotate(t *testing.T) {
+	dir := t.TempDir()
+	// 遗留的旧文件最先被删除
+	oldFile := filepath.Join(dir, "metrics-20000101-000000.000000000.pcap")
+	os.WriteFile(oldFile, make([]byte, 1000), 0644)
+	otherType := filepath.Join(dir, "l4_log-20000101-000000.000000000.pcap")
+	os.WriteFile(otherType, make([]byte, 1000), 0644)
+
+	// 每条记录16+20+8+19+100字节, 每个文件最多3条, 预算可容纳2个完整的文件
+	s, err := NewPcapSink(datatype.MESSAGE_TYPE_METRICS, PcapSinkConfig{Directory: dir, MaxFileSize: 24 + 3*163, DiskBudget: 2 * (24 + 3*163)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(oldFile); err != nil {
+		t.Errorf("old file should be kept within budget: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		s.Put(0, newSinkBuffer("10.1.2.3", 3, bytes.Repeat([]byte{byte(i)}, 100)))
+		waitSinkWritten(t, s, uint64(i+1))
+		// 保证文件名中的创建时间不同
+		time.Sleep(time.Millisecond)
+	}
+	s.Close()
+
+	if _, err := os.Stat(oldFile); err == nil {
+		t.Error("old file should be deleted")
+	}
+	if _, err := os.Stat(otherType); err != nil {
+		t.Error("files of other message types should not be deleted")
+	}
+	// 轮转3次, 共4个文件(3+3+3+1), 最后一次轮转时删除遗留文件和第一个文件
+	files := sinkFiles(t, dir)
+	if len(files) != 3 {
+		t.Fatalf("expect 3 files, actual %v", files)
+	}
+	for i, expected := range []struct {
+		first byte
+		count int
+	}{{3, 3}, {6, 3}, {9, 1}} {
+		datagrams := readErrorTapFile(t, files[i])
+		if len(datagrams) != expected.count || datagrams[0].payload[len(datagrams[0].payload)-1] != expected.first {
+			t.Errorf("file %s: expect %d datagrams starting from %d, actual %d", files[i], expected.count, expected.first, len(datagrams))
+		}
+	}
+	if counter := s.GetCounter().(*PcapSinkCounter); counter.Written != 10 || counter.Rotated != 3 || counter.Deleted != 2 {
+		t.Errorf("unexpected counter %+v", counter)
+	}
+}
+
+func TestPcapSinkForward(t *testing.T) {
+	next := queue.NewOverwriteQueues("test-pcap-sink", 1, 4)
+	s, err := NewPcapSink(datatype.MESSAGE_TYPE_METRICS, PcapSinkConfig{Directory: t.TempDir()}, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer := newSinkBuffer("10.1.2.3", 3, []byte("record1"))
+	s.Put(0, buffer)
+	waitSinkWritten(t, s, 1)
+	// 转发时buffer由下游的消费线程释放
+	if s.Len(0) != 1 || next.Get(0).(*RecvBuffer) != buffer || string(buffer.Payload()) != "record1" || buffer.VtapID != 3 {
+		t.Errorf("buffer should be forwarded untouched, %+v", buffer)
+	}
+	ReleaseRecvBuffer(buffer)
+	s.Close()
+	if !s.Closed() {
+		t.Error("sink should be closed")
+	}
+}
+
+// 下游释放buffer后buffer被下一个消息复用, 已经放入ring的消息不受影响
+func TestPcapSinkBufferReuse(t *testing.T) {
+	dir := t.TempDir()
+	next := queue.NewOverwriteQueues("test-pcap-sink-reuse", 1, 4)
+	s, err := NewPcapSink(datatype.MESSAGE_TYPE_METRICS, PcapSinkConfig{Directory: dir, LocalAddr: &net.UDPAddr{Port: 30033}}, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer := newSinkBuffer("", 3, []byte("record1"))
+	buffer.setIP(net.ParseIP("10.1.2.3"))
+	s.Put(0, buffer)
+	next.Get(0)
+	buffer.setIP(net.ParseIP("10.1.2.4"))
+	waitSinkWritten(t, s, 1)
+	s.Close()
+	ReleaseRecvBuffer(buffer)
+
+	files := sinkFiles(t, dir)
+	if len(files) != 1 {
+		t.Fatalf("expect 1 file, actual %v", files)
+	}
+	if datagrams := readErrorTapFile(t, files[0]); len(datagrams) != 1 || datagrams[0].ip != "10.1.2.3" {
+		t.Errorf("unexpected datagrams %+v", datagrams)
+	}
+}
+
+func TestPcapSinkWriteFailed(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "sink")
+	s, err := NewPcapSink(datatype.MESSAGE_TYPE_METRICS, PcapSinkConfig{Directory: dir}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 目录被替换为文件后无法创建pcap, 只计数不影响后续的消息
+	os.Remove(dir)
+	os.WriteFile(dir, nil, 0644)
+	s.Put(0, newSinkBuffer("10.1.2.3", 3, []byte("record1")))
+	waitSinkWritten(t, s, 1)
+	os.Remove(dir)
+	os.Mkdir(dir, 0755)
+	s.Put(0, newSinkBuffer("10.1.2.3", 3, []byte("record2")))
+	waitSinkWritten(t, s, 2)
+	s.Close()
+
+	if counter := s.GetCounter().(*PcapSinkCounter); counter.WriteFailed != 1 || counter.Written != 1 {
+		t.Errorf("unexpected counter %+v", counter)
+	}
+	if s.LastError() == "" {
+		t.Error("last error should be recorded")
+	}
+	if files := sinkFiles(t, dir); len(files) != 1 {
+		t.Errorf("expect 1 file, actual %v", files)
+	}
+}
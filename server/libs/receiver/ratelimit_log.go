@@ -0,0 +1,140 @@
+/*
+ * Copyright (c) 2024 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package receiver
+
+import (
+	"container/list"
+	"fmt"
+	"net"
+	"sync"
+)
+
+const (
+	LOG_LIMIT_KEYS = 4096 // 每个限速日志跟踪的key数上限, 超过时淘汰最久未打印的key
+)
+
+type logLimitEntry struct {
+	key        string
+	tokens     int64
+	lastRefill int64
+	suppressed uint64 // 上次打印后被丢弃的条数
+}
+
+// 按key限速的日志, 用于收包路径上每个消息都可能触发的告警. 每个key一个令牌桶,
+// 每interval秒补充burst个令牌, 被丢弃的条数附加在该key下一次打印的日志末尾.
+// key一般为agent IP加上告警的类别, 被淘汰的key丢弃的条数不再打印
+type rateLimitedLogger struct {
+	burst    int64
+	interval int64 // 秒
+	maxKeys  int
+
+	lock sync.Mutex
+	keys map[string]*list.Element
+	lru  *list.List // *logLimitEntry, 最近打印或丢弃的在前
+}
+
+func newRateLimitedLogger(burst int, interval int64, maxKeys int) *rateLimitedLogger {
+	if burst < 1 {
+		burst = 1
+	}
+	if interval < 1 {
+		interval = 1
+	}
+	return &rateLimitedLogger{
+		burst:    int64(burst),
+		interval: interval,
+		maxKeys:  maxKeys,
+		keys:     make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// 返回本次是否打印, 以及打印时此前被丢弃的条数. now为秒级时间, 收包协程中传入r.timeNow避免调用time.Now()
+func (l *rateLimitedLogger) allow(key string, now int64) (bool, uint64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.take(l.keys[key], key, now)
+}
+
+// 与allow相同, key为category加上ip的原始字节. 每个无效数据报都会调用, key已存在时不分配内存,
+// 调用者在返回true后再格式化日志内容
+func (l *rateLimitedLogger) allowIP(category string, ip net.IP, now int64) (bool, uint64) {
+	var buffer [64]byte
+	key := append(append(buffer[:0], category...), ip...)
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if elem := l.keys[string(key)]; elem != nil {
+		return l.take(elem, "", now)
+	}
+	return l.take(nil, string(key), now)
+}
+
+// elem为nil时以key新建条目
+func (l *rateLimitedLogger) take(elem *list.Element, key string, now int64) (bool, uint64) {
+	var entry *logLimitEntry
+	if elem != nil {
+		l.lru.MoveToFront(elem)
+		entry = elem.Value.(*logLimitEntry)
+		if elapsed := now - entry.lastRefill; elapsed >= l.interval {
+			periods := elapsed / l.interval
+			entry.tokens += periods * l.burst
+			if entry.tokens > l.burst {
+				entry.tokens = l.burst
+			}
+			entry.lastRefill += periods * l.interval
+		}
+	} else {
+		if l.lru.Len() >= l.maxKeys {
+			oldest := l.lru.Back()
+			l.lru.Remove(oldest)
+			delete(l.keys, oldest.Value.(*logLimitEntry).key)
+		}
+		entry = &logLimitEntry{key: key, tokens: l.burst, lastRefill: now}
+		l.keys[key] = l.lru.PushFront(entry)
+	}
+
+	if entry.tokens <= 0 {
+		entry.suppressed++
+		return false, 0
+	}
+	entry.tokens--
+	suppressed := entry.suppressed
+	entry.suppressed = 0
+	return true, suppressed
+}
+
+// 与log.Warningf相同, 超过限速时不打印
+func (l *rateLimitedLogger) Warningf(key string, now int64, format string, args ...interface{}) {
+	if ok, suppressed := l.allow(key, now); ok {
+		log.Warning(suppressedMessage(suppressed, format, args...))
+	}
+}
+
+// 与log.Infof相同, 超过限速时不打印
+func (l *rateLimitedLogger) Infof(key string, now int64, format string, args ...interface{}) {
+	if ok, suppressed := l.allow(key, now); ok {
+		log.Info(suppressedMessage(suppressed, format, args...))
+	}
+}
+
+func suppressedMessage(suppressed uint64, format string, args ...interface{}) string {
+	message := fmt.Sprintf(format, args...)
+	if suppressed > 0 {
+		message += fmt.Sprintf(" (suppressed %d similar)", suppressed)
+	}
+	return message
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright (c) 2024 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package receiver
+
+import (
+	"net"
+	"testing"
+)
+
+func TestRateLimitedLoggerSuppressed(t *testing.T) {
+	l := newRateLimitedLogger(2, 60, 16)
+	now := int64(1700000000)
+	for _, c := range []struct {
+		key        string
+		elapsed    int64
+		ok         bool
+		suppressed uint64
+	}{
+		{"a", 0, true, 0},
+		{"a", 1, true, 0},
+		{"a", 1, false, 0},
+		{"b", 0, true, 0}, // 各个key独立限速
+		{"a", 1, false, 0},
+		{"a", 1, false, 0},
+		{"a", 56, true, 3}, // 补充令牌后打印, 并带上丢弃的条数
+		{"a", 0, true, 0},
+		{"a", 0, false, 0},
+		{"a", 600, true, 1}, // 令牌不超过burst
+		{"a", 0, true, 0},
+		{"a", 0, false, 0},
+	} {
+		now += c.elapsed
+		if ok, suppressed := l.allow(c.key, now); ok != c.ok || suppressed != c.suppressed {
+			t.Errorf("%+v: actual %v %d", c, ok, suppressed)
+		}
+	}
+}
+
+func TestRateLimitedLoggerEviction(t *testing.T) {
+	l := newRateLimitedLogger(1, 60, 2)
+	now := int64(1700000000)
+	l.allow("a", now)
+	l.allow("a", now)
+	l.allow("b", now)
+	l.allow("a", now) // a最近使用, 满时淘汰b
+	l.allow("c", now)
+	if len(l.keys) != 2 || l.lru.Len() != 2 {
+		t.Fatalf("expect 2 keys, actual %d %d", len(l.keys), l.lru.Len())
+	}
+	if _, ok := l.keys["b"]; ok {
+		t.Error("b should be evicted")
+	}
+	if ok, _ := l.allow("a", now); ok {
+		t.Error("a should still be limited")
+	}
+	if entry := l.keys["a"].Value.(*logLimitEntry); entry.suppressed != 3 {
+		t.Errorf("expect 3 suppressed, actual %d", entry.suppressed)
+	}
+	// 被淘汰的key重新开始计数
+	if ok, suppressed := l.allow("b", now); !ok || suppressed != 0 {
+		t.Errorf("evicted key should be allowed, actual %v %d", ok, suppressed)
+	}
+}
+
+func TestRateLimitedLoggerAllowIP(t *testing.T) {
+	l := newRateLimitedLogger(1, 60, 16)
+	now := int64(1700000000)
+	a, b := net.ParseIP("10.1.1.1"), net.ParseIP("10.1.1.2")
+	for _, c := range []struct {
+		category string
+		ip       net.IP
+		ok       bool
+	}{
+		{"udp runt ", a, true},
+		{"udp runt ", a, false},
+		{"udp runt ", b, true},  // 各个IP独立限速
+		{"udp recv ", a, true},  // 各个类别独立限速
+		{"udp runt ", a, false}, // 恢复令牌前仍然限速
+	} {
+		if ok, _ := l.allowIP(c.category, c.ip, now); ok != c.ok {
+			t.Errorf("%+v: actual %v", c, ok)
+		}
+	}
+	if len(l.keys) != 3 {
+		t.Errorf("expect 3 keys, actual %d", len(l.keys))
+	}
+	if ok, suppressed := l.allowIP("udp runt ", a, now+60); !ok || suppressed != 2 {
+		t.Errorf("expect allowed with 2 suppressed, actual %v %d", ok, suppressed)
+	}
+	if allocs := testing.AllocsPerRun(100, func() { l.allowIP("udp runt ", a, now+60) }); allocs != 0 {
+		t.Errorf("existing key should not allocate, actual %.1f allocs", allocs)
+	}
+}
+
+func TestSuppressedMessage(t *testing.T) {
+	if message := suppressedMessage(0, "recv from %s", "10.1.1.1"); message != "recv from 10.1.1.1" {
+		t.Errorf("unexpected message %s", message)
+	}
+	if message := suppressedMessage(4312, "recv from %s", "10.1.1.1"); message != "recv from 10.1.1.1 (suppressed 4312 similar)" {
+		t.Errorf("unexpected message %s", message)
+	}
+}
@@ -19,6 +19,7 @@ package receiver
 import (
 	"bufio"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -30,6 +31,7 @@ import (
 	"time"
 
 	logging "github.com/op/go-logging"
+	"github.com/pierrec/lz4/v4"
 
 	"github.com/deepflowio/deepflow/server/libs/app"
 	"github.com/deepflowio/deepflow/server/libs/cache"
@@ -50,6 +52,7 @@ const (
 	RECV_BUFSIZE_512K         = 1 << 19 // 512k
 	RECV_BUFSIZE_MAX          = 1 << 24 // 16M, the maximum size of the PCAP packet will be greater than 8M
 	RECV_TIMEOUT              = 30 * time.Second
+	CLOSE_TIMEOUT             = 5 * time.Second // Close等待收包协程退出的最长时间
 	QUEUE_CACHE_FLUSH_TIMEOUT = 3
 	DROP_DETECT_WINDOW_SIZE   = 1024
 	QUEUE_BATCH_NUM           = 16
@@ -57,10 +60,15 @@ const (
 	RECORD_STATUS_TIMEOUT     = 30 // 每30秒记录下trident的活跃信息，platformData模块每分钟会上报trisolaris
 	SOCKET_READ_ERROR         = "maybe trident restart."
 	ONE_HOUR                  = 3600
+	LEGACY_WARNING_INTERVAL   = ONE_HOUR // 每个agent旧版本包头告警的打印间隔
 )
 
 var log = logging.MustGetLogger("receiver")
 
+// 放入消费队列的消息, 除payload外还携带从包头解析出的来源信息, 消费线程无需再解析包头.
+// 从队列取出后由消费线程负责释放: 解码完成后调用ReleaseRecvBuffer归还, 之后不能再访问Buffer;
+// 调用DecompressRecvBuffer成功时传入的buffer已被释放, 由返回的buffer代替.
+// 队列满时被覆盖的buffer由队列的OptionRelease释放
 type RecvBuffer struct {
 	Begin      int // 开始位置
 	End        int
@@ -70,6 +78,28 @@ type RecvBuffer struct {
 	TeamID     uint32
 	OrgID      uint16
 	SocketType ServerType
+	Encoder    uint8  // 取值为datatype.ENCODER_*, 为ENCODER_LZ4时需要先调用DecompressRecvBuffer
+	Truncated  bool   // UDP消息被截断, 只有前面完整的记录可以解码
+	Timestamp  uint32 // 接收时间(秒)
+	Tenant     string // 按agent IP匹配的租户标签, 未配置租户规则或未匹配时为空
+
+	receiver     *Receiver // 放入队列的Receiver, 消费线程的计数记在其上, 为nil时不计数
+	counterShard uint8     // 消费线程更新计数使用的分片, 由放入的队列决定, 见Receiver.consumerCounters
+	ipStorage    [net.IPv6len]byte
+}
+
+// 复制到buffer自己的存储中, UDP收包时地址对象会被下一个包复用, 不能直接引用
+func (b *RecvBuffer) setIP(ip net.IP) {
+	if ip == nil {
+		b.IP = nil
+		return
+	}
+	b.IP = append(b.ipStorage[:0], ip...)
+}
+
+// 去掉包头后的消息内容, 与Buffer共享内存
+func (r *RecvBuffer) Payload() []byte {
+	return r.Buffer[r.Begin:r.End]
 }
 
 // 实现空接口，仅用于队列调试打印
@@ -84,9 +114,27 @@ func (r *RecvBuffer) String() string {
 	return fmt.Sprintf("IP:%s %s\n", r.IP, string(r.Buffer))
 }
 
-func newBufferPool(bufferSize, poolSizePerCPU int) *pool.LockFreePool {
-	return pool.NewLockFreePool(
+// 在pool外层统计buffer的使用情况, 供调试命令查看
+type recvBufferPool struct {
+	*pool.LockFreePool
+
+	bufferSize     int
+	poolSizePerCPU int
+
+	inUse     uint64
+	highWater uint64
+	allocated uint64 // pool为空时新创建的buffer数量
+	misses    uint64 // pool中的buffer不够大, 需要重新分配内存的次数
+}
+
+func newBufferPool(bufferSize, poolSizePerCPU int) *recvBufferPool {
+	p := &recvBufferPool{
+		bufferSize:     bufferSize,
+		poolSizePerCPU: poolSizePerCPU,
+	}
+	p.LockFreePool = pool.NewLockFreePool(
 		func() interface{} {
+			atomic.AddUint64(&p.allocated, 1)
 			return &RecvBuffer{
 				Buffer: make([]byte, bufferSize),
 			}
@@ -95,9 +143,45 @@ func newBufferPool(bufferSize, poolSizePerCPU int) *pool.LockFreePool {
 		pool.OptionInitFullPoolSize(poolSizePerCPU),
 		pool.OptionCounterNameSuffix(fmt.Sprintf("_%dK", bufferSize>>10)),
 	)
+	p.allocated = 0 // NewLockFreePool会调用一次alloc用于获取类型, 不计入
+	return p
+}
+
+func (p *recvBufferPool) acquire() *RecvBuffer {
+	buf := p.Get().(*RecvBuffer)
+	inUse := atomic.AddUint64(&p.inUse, 1)
+	for {
+		highWater := atomic.LoadUint64(&p.highWater)
+		if inUse <= highWater || atomic.CompareAndSwapUint64(&p.highWater, highWater, inUse) {
+			break
+		}
+	}
+	return buf
+}
+
+func (p *recvBufferPool) release(b *RecvBuffer) {
+	atomic.AddUint64(&p.inUse, ^uint64(0))
+	p.Put(b)
+}
+
+func (p *recvBufferPool) stats() *BufferPoolStats {
+	inUse, allocated := atomic.LoadUint64(&p.inUse), atomic.LoadUint64(&p.allocated)
+	pooled := uint64(0)
+	if allocated > inUse {
+		pooled = allocated - inUse
+	}
+	return &BufferPoolStats{
+		BufferSize:     p.bufferSize,
+		PoolSizePerCPU: p.poolSizePerCPU,
+		Outstanding:    inUse,
+		Pooled:         pooled,
+		Allocated:      allocated,
+		HighWaterMark:  atomic.LoadUint64(&p.highWater),
+		Misses:         atomic.LoadUint64(&p.misses),
+	}
 }
 
-var recvBufferPools = []*pool.LockFreePool{
+var recvBufferPools = []*recvBufferPool{
 	newBufferPool(RECV_BUFSIZE_2K, 16),
 	newBufferPool(RECV_BUFSIZE_8K, 32),
 	newBufferPool(RECV_BUFSIZE_64K, 8),
@@ -107,6 +191,14 @@ var recvBufferPools = []*pool.LockFreePool{
 	newBufferPool(0, 8),
 }
 
+func GetBufferPoolStats() BufferPoolStatsList {
+	stats := make(BufferPoolStatsList, 0, len(recvBufferPools))
+	for _, p := range recvBufferPools {
+		stats = append(stats, p.stats())
+	}
+	return stats
+}
+
 func getBufferPoolIndex(length int) int {
 	for i, v := range []int{RECV_BUFSIZE_2K, RECV_BUFSIZE_8K, RECV_BUFSIZE_64K, RECV_BUFSIZE_256K, RECV_BUFSIZE_512K} {
 		if length <= v {
@@ -127,12 +219,13 @@ func minPowerOfTwo(v int) int {
 
 func AcquireRecvBuffer(length int, socketType ServerType) (*RecvBuffer, bool) {
 	isNew := false
-	index := getBufferPoolIndex(length)
-	buf := recvBufferPools[index].Get().(*RecvBuffer)
+	p := recvBufferPools[getBufferPoolIndex(length)]
+	buf := p.acquire()
 	buf.SocketType = socketType
 	if len(buf.Buffer) < length {
 		length = minPowerOfTwo(length)
 		buf.Buffer = make([]byte, length)
+		atomic.AddUint64(&p.misses, 1)
 		isNew = true
 	}
 
@@ -144,7 +237,140 @@ func ReleaseRecvBuffer(b *RecvBuffer) {
 	b.End = 0
 	b.IP = nil
 	b.VtapID = 0
-	recvBufferPools[getBufferPoolIndex(len(b.Buffer))].Put(b)
+	b.TeamID = 0
+	b.OrgID = 0
+	b.Encoder = datatype.ENCODER_RAW
+	b.Truncated = false
+	b.Timestamp = 0
+	b.Tenant = ""
+	b.receiver = nil
+	b.counterShard = 0
+	recvBufferPools[getBufferPoolIndex(len(b.Buffer))].release(b)
+}
+
+const (
+	COUNTER_SHARDS  = 64 // 消费线程计数的分片数, 不超过时每个队列的消费线程独占一个分片
+	CACHE_LINE_SIZE = 64
+)
+
+// 解压和数据记录计数由各个队列的消费线程更新, 在stats周期获取counter时取走
+type consumerCounterFields struct {
+	compressedBytes   uint64
+	decompressedBytes uint64
+	decompressFailed  uint64
+
+	messages  uint64
+	records   uint64
+	partial   uint64
+	histogram RecordsHistogram
+}
+
+// 每个消息都会更新计数, 各分片之间间隔一个缓存行, 避免不同消费线程更新时互相使对方的缓存行失效
+type consumerCounter struct {
+	_ [CACHE_LINE_SIZE]byte
+	consumerCounterFields
+}
+
+func (r *Receiver) allocCounterShard() uint8 {
+	return uint8((atomic.AddUint32(&r.nextCounterShard, 1) - 1) % COUNTER_SHARDS)
+}
+
+// 取走所有分片的计数
+func (r *Receiver) swapConsumerCounters() (counter consumerCounterFields) {
+	for i := range r.consumerCounters {
+		shard := &r.consumerCounters[i]
+		counter.compressedBytes += atomic.SwapUint64(&shard.compressedBytes, 0)
+		counter.decompressedBytes += atomic.SwapUint64(&shard.decompressedBytes, 0)
+		counter.decompressFailed += atomic.SwapUint64(&shard.decompressFailed, 0)
+		counter.messages += atomic.SwapUint64(&shard.messages, 0)
+		counter.records += atomic.SwapUint64(&shard.records, 0)
+		counter.partial += atomic.SwapUint64(&shard.partial, 0)
+		for bucket := range shard.histogram {
+			counter.histogram[bucket] += atomic.SwapUint64(&shard.histogram[bucket], 0)
+		}
+	}
+	return
+}
+
+// 解压在各个队列的消费线程中进行, 不属于某个Receiver, 因此日志中只打印IP
+var decompressLogs = newRateLimitedLogger(1, LOG_INTERVAL, LOG_LIMIT_KEYS)
+
+// 消费线程更新计数使用的分片, 不是由Receiver放入队列的buffer返回nil
+func (b *RecvBuffer) consumerCounter() *consumerCounter {
+	if b.receiver == nil {
+		return nil
+	}
+	return &b.receiver.consumerCounters[b.counterShard]
+}
+
+// 每个agent每LOG_INTERVAL秒只打印一次失败的日志, 防止日志刷屏
+func decompressFailed(b *RecvBuffer, err error) (*RecvBuffer, error) {
+	if shard := b.consumerCounter(); shard != nil {
+		atomic.AddUint64(&shard.decompressFailed, 1)
+	}
+	decompressLogs.Warningf(b.IP.String(), time.Now().Unix(), "decompress data from %s vtap %d failed: %s", b.IP, b.VtapID, err)
+	return b, err
+}
+
+// LZ4压缩的数据在消费线程中解压, 避免UDP单线程接收成为瓶颈.
+// 解压成功时原buffer归还到对应的pool, 返回从pool中获取的新buffer; 失败时返回原buffer.
+// 调用方处理完成后对返回的buffer调用ReleaseRecvBuffer
+func DecompressRecvBuffer(b *RecvBuffer) (*RecvBuffer, error) {
+	if b.Encoder != datatype.ENCODER_LZ4 {
+		return b, nil
+	}
+	compressed := b.Buffer[b.Begin:b.End]
+	if len(compressed) < datatype.LZ4_SIZE_LEN {
+		return decompressFailed(b, fmt.Errorf("lz4 payload length %d is too short", len(compressed)))
+	}
+	size := int(binary.LittleEndian.Uint32(compressed))
+	if size > RECV_BUFSIZE_MAX {
+		return decompressFailed(b, fmt.Errorf("lz4 decompressed size %d exceeds %d", size, RECV_BUFSIZE_MAX))
+	}
+
+	decompressed, _ := AcquireRecvBuffer(size, b.SocketType)
+	n, err := lz4.UncompressBlock(compressed[datatype.LZ4_SIZE_LEN:], decompressed.Buffer[:size])
+	if err == nil && n != size {
+		err = fmt.Errorf("lz4 decompressed size %d, expect %d", n, size)
+	}
+	if err != nil {
+		ReleaseRecvBuffer(decompressed)
+		return decompressFailed(b, err)
+	}
+	if shard := b.consumerCounter(); shard != nil {
+		atomic.AddUint64(&shard.compressedBytes, uint64(len(compressed)))
+		atomic.AddUint64(&shard.decompressedBytes, uint64(size))
+	}
+
+	decompressed.Begin = 0
+	decompressed.End = size
+	decompressed.setIP(b.IP)
+	decompressed.VtapID = b.VtapID
+	decompressed.TeamID = b.TeamID
+	decompressed.OrgID = b.OrgID
+	decompressed.Tenant = b.Tenant
+	decompressed.Timestamp = b.Timestamp
+	decompressed.receiver = b.receiver
+	decompressed.counterShard = b.counterShard
+	ReleaseRecvBuffer(b)
+	return decompressed, nil
+}
+
+// 一个消息中通常批量包含多条记录, 消费线程解码完一个消息后, 在释放RecvBuffer前调用此函数上报成功解码的记录数.
+// partial为true表示消息中间解码失败, 失败位置之后的记录被丢弃
+func ReportRecords(b *RecvBuffer, records int, partial bool) {
+	shard := b.consumerCounter()
+	if shard == nil {
+		return
+	}
+	atomic.AddUint64(&shard.messages, 1)
+	atomic.AddUint64(&shard.records, uint64(records))
+	if partial {
+		atomic.AddUint64(&shard.partial, 1)
+	}
+	bucket := recordsBucket(records)
+	atomic.AddUint64(&shard.histogram[bucket], 1)
+	b.receiver.reportAgentRecords(b, bucket)
 }
 
 type QueueCache struct {
@@ -182,35 +408,75 @@ type Status struct {
 	lastRemoteTimestamp  uint32 // 最后一次收到数据时数据中的时间戳
 	LastLocalTimestamp   uint32 // 最后一次收到数据时的本地时间
 	firstSeq             uint64
-	firstRemoteTimestamp uint32 // 第一次收到数据时数据中的时间戳
-	firstLocalTimestamp  uint32 // 第一次收到数据时的本地时间
+	firstRemoteTimestamp uint32       // 第一次收到数据时数据中的时间戳
+	firstLocalTimestamp  uint32       // 第一次收到数据时的本地时间
+	rxPackets            uint64       // 累计收到的消息数, 用于watch命令计算增量
+	headerVersion        uint16       // 最后一次收到数据的包头版本
+	restarts             uint32       // 包头版本变化的次数, 版本变化说明agent已升级重启
+	encoder              uint8        // 最后一次收到数据的包头Encoder, 低位为压缩类型, 高位为能力标志
+	compressedPackets    uint64       // 累计收到的压缩消息数
+	tenant               atomic.Value // *statusTenant, 最后一次匹配的租户规则, 租户表替换或ip变化后重新匹配
 }
 
-func NewStatus(now uint32, msgType datatype.MessageType, vtapID, orgId uint16, ip net.IP, seq uint64, timestamp uint32, serverType ServerType) *Status {
+func NewStatus(now uint32, msgType datatype.MessageType, vtapID, orgId, headerVersion uint16, encoder uint8, ip net.IP, seq uint64, timestamp uint32, serverType ServerType) *Status {
 	return &Status{
 		msgType:              msgType,
 		serverType:           serverType,
 		VTAPID:               vtapID,
 		orgId:                orgId,
-		ip:                   ip,
+		ip:                   append(net.IP(nil), ip...), // UDP收包时ip会被下一个包复用
 		lastSeq:              seq,
 		lastRemoteTimestamp:  timestamp,
 		LastLocalTimestamp:   now,
 		firstSeq:             seq,
 		firstRemoteTimestamp: timestamp,
 		firstLocalTimestamp:  now,
+		rxPackets:            1,
+		headerVersion:        headerVersion,
+		encoder:              encoder,
+		compressedPackets:    compressedCount(encoder),
 	}
 }
 
-func (s *Status) update(now uint32, msgType datatype.MessageType, vtapID, orgId uint16, ip net.IP, seq uint64, timestamp uint32, serverType ServerType) {
+func compressedCount(encoder uint8) uint64 {
+	if encoder&datatype.ENCODER_TYPE_MASK != datatype.ENCODER_RAW {
+		return 1
+	}
+	return 0
+}
+
+// ip, 编码或包头版本变化时update会修改非原子的字段, TCP路径需要持有写锁
+func (s *Status) changed(headerVersion uint16, encoder uint8, ip net.IP) bool {
+	return s.headerVersion != headerVersion || s.encoder != encoder || !s.ip.Equal(ip)
+}
+
+func (s *Status) update(now uint32, msgType datatype.MessageType, vtapID, orgId, headerVersion uint16, encoder uint8, ip net.IP, seq uint64, timestamp uint32, serverType ServerType, names *agentNameResolver) {
 	s.msgType = msgType
 	s.VTAPID = vtapID
 	s.orgId = orgId
-	s.ip = ip
+	if !s.ip.Equal(ip) {
+		s.ip = append(net.IP(nil), ip...)
+	}
 	s.lastSeq = seq
 	s.lastRemoteTimestamp = timestamp
 	s.LastLocalTimestamp = now
 	s.serverType = serverType
+	atomic.AddUint64(&s.rxPackets, 1) // 同一agent可能有多个TCP连接
+	if s.encoder != encoder {
+		s.encoder = encoder
+	}
+	if n := compressedCount(encoder); n > 0 {
+		atomic.AddUint64(&s.compressedPackets, n)
+	}
+	if s.headerVersion != headerVersion {
+		// 同一agent的包头版本变化时视为重启, 重新记录首次收到数据的信息
+		log.Infof("agent %s vtap %d header version changed from 0x%x to 0x%x, treat as restart", names.displayName(ip), vtapID, s.headerVersion, headerVersion)
+		s.headerVersion = headerVersion
+		s.restarts++
+		s.firstSeq = seq
+		s.firstRemoteTimestamp = timestamp
+		s.firstLocalTimestamp = now
+	}
 }
 
 type AdapterStatus struct {
@@ -220,6 +486,7 @@ type AdapterStatus struct {
 	TCPMetrisStatus []*Status
 	UDPStatusLocks  [datatype.MESSAGE_TYPE_MAX]sync.Mutex
 	TCPStatusLocks  [datatype.MESSAGE_TYPE_MAX]sync.RWMutex
+	agentNames      *agentNameResolver // 与所属Receiver相同, 为nil时只显示IP
 	UDPStatusFlow   [datatype.MESSAGE_TYPE_MAX]map[uint16]*Status
 	TCPStatusFlow   [datatype.MESSAGE_TYPE_MAX]map[uint16]*Status // vtapID非0, 使用vtapID作为key: 遥测数据，l4流日志数据，l7-http-dns流日志数据
 	UDPStatusOthers [datatype.MESSAGE_TYPE_MAX]map[string]*Status
@@ -235,22 +502,47 @@ func (s *AdapterStatus) init() {
 	}
 }
 
-func (s *AdapterStatus) Update(now uint32, msgType datatype.MessageType, vtapID, orgId uint16, ip net.IP, seq uint64, timestamp uint32, serverType ServerType) {
+// 清除所有agent的状态信息. UDP更新时读map不加锁, 因此这里替换为新的map而不是修改原有的map
+func (s *AdapterStatus) reset() int {
+	count := 0
+	for i := 0; i < int(datatype.MESSAGE_TYPE_MAX); i++ {
+		s.UDPStatusLocks[i].Lock()
+		count += len(s.UDPStatusFlow[i]) + len(s.UDPStatusOthers[i])
+		s.UDPStatusFlow[i] = make(map[uint16]*Status)
+		s.UDPStatusOthers[i] = make(map[string]*Status)
+		s.UDPStatusLocks[i].Unlock()
+
+		s.TCPStatusLocks[i].Lock()
+		count += len(s.TCPStatusFlow[i]) + len(s.TCPStatusOthers[i])
+		s.TCPStatusFlow[i] = make(map[uint16]*Status)
+		s.TCPStatusOthers[i] = make(map[string]*Status)
+		s.TCPStatusLocks[i].Unlock()
+	}
+	return count
+}
+
+// 返回agent对应的状态, 用于读取按agent缓存的信息
+func (s *AdapterStatus) Update(now uint32, msgType datatype.MessageType, vtapID, orgId, headerVersion uint16, encoder uint8, ip net.IP, seq uint64, timestamp uint32, serverType ServerType) *Status {
+	var updated *Status
 	if serverType == UDP { // UDP大部分时间无锁，只有在更新map时加锁, 防止调试命令读取时可能导致异常
 		if vtapID != 0 {
 			if status, ok := s.UDPStatusFlow[msgType][vtapID]; ok {
-				status.update(now, msgType, vtapID, orgId, ip, seq, timestamp, serverType)
+				status.update(now, msgType, vtapID, orgId, headerVersion, encoder, ip, seq, timestamp, serverType, s.agentNames)
+				updated = status
 			} else {
 				s.UDPStatusLocks[msgType].Lock()
-				s.UDPStatusFlow[msgType][vtapID] = NewStatus(now, msgType, vtapID, orgId, ip, seq, timestamp, serverType)
+				updated = NewStatus(now, msgType, vtapID, orgId, headerVersion, encoder, ip, seq, timestamp, serverType)
+				s.UDPStatusFlow[msgType][vtapID] = updated
 				s.UDPStatusLocks[msgType].Unlock()
 			}
 		} else {
 			if status, ok := s.UDPStatusOthers[msgType][ip.String()]; ok {
-				status.update(now, msgType, vtapID, orgId, ip, seq, timestamp, serverType)
+				status.update(now, msgType, vtapID, orgId, headerVersion, encoder, ip, seq, timestamp, serverType, s.agentNames)
+				updated = status
 			} else {
 				s.UDPStatusLocks[msgType].Lock()
-				s.UDPStatusOthers[msgType][ip.String()] = NewStatus(now, msgType, vtapID, orgId, ip, seq, timestamp, serverType)
+				updated = NewStatus(now, msgType, vtapID, orgId, headerVersion, encoder, ip, seq, timestamp, serverType)
+				s.UDPStatusOthers[msgType][ip.String()] = updated
 				s.UDPStatusLocks[msgType].Unlock()
 			}
 		}
@@ -266,28 +558,44 @@ func (s *AdapterStatus) Update(now uint32, msgType datatype.MessageType, vtapID,
 
 	} else { // TCP有锁,主要是读锁，但并行处理，基本不影响接收性能
 		if vtapID != 0 {
+			// 同一agent可能有多个TCP连接并行更新, 只有不修改ip, 编码和包头版本时可以在读锁下更新
 			s.TCPStatusLocks[msgType].RLock()
 			status, ok := s.TCPStatusFlow[msgType][vtapID]
-			s.TCPStatusLocks[msgType].RUnlock()
-			if ok {
-				status.update(now, msgType, vtapID, orgId, ip, seq, timestamp, serverType)
+			if ok && !status.changed(headerVersion, encoder, ip) {
+				status.update(now, msgType, vtapID, orgId, headerVersion, encoder, ip, seq, timestamp, serverType, s.agentNames)
+				updated = status
+				s.TCPStatusLocks[msgType].RUnlock()
 			} else {
-				newStatus := NewStatus(now, msgType, vtapID, orgId, ip, seq, timestamp, serverType)
+				s.TCPStatusLocks[msgType].RUnlock()
 				s.TCPStatusLocks[msgType].Lock()
-				s.TCPStatusFlow[msgType][vtapID] = newStatus
+				if status, ok := s.TCPStatusFlow[msgType][vtapID]; ok {
+					status.update(now, msgType, vtapID, orgId, headerVersion, encoder, ip, seq, timestamp, serverType, s.agentNames)
+					updated = status
+				} else {
+					updated = NewStatus(now, msgType, vtapID, orgId, headerVersion, encoder, ip, seq, timestamp, serverType)
+					s.TCPStatusFlow[msgType][vtapID] = updated
+				}
 				s.TCPStatusLocks[msgType].Unlock()
 			}
 
 		} else {
+			key := ip.String()
 			s.TCPStatusLocks[msgType].RLock()
-			status, ok := s.TCPStatusOthers[msgType][ip.String()]
-			s.TCPStatusLocks[msgType].RUnlock()
-			if ok {
-				status.update(now, msgType, vtapID, orgId, ip, seq, timestamp, serverType)
+			status, ok := s.TCPStatusOthers[msgType][key]
+			if ok && !status.changed(headerVersion, encoder, ip) {
+				status.update(now, msgType, vtapID, orgId, headerVersion, encoder, ip, seq, timestamp, serverType, s.agentNames)
+				updated = status
+				s.TCPStatusLocks[msgType].RUnlock()
 			} else {
-				newStatus := NewStatus(now, msgType, vtapID, orgId, ip, seq, timestamp, serverType)
+				s.TCPStatusLocks[msgType].RUnlock()
 				s.TCPStatusLocks[msgType].Lock()
-				s.TCPStatusOthers[msgType][ip.String()] = newStatus
+				if status, ok := s.TCPStatusOthers[msgType][key]; ok {
+					status.update(now, msgType, vtapID, orgId, headerVersion, encoder, ip, seq, timestamp, serverType, s.agentNames)
+					updated = status
+				} else {
+					updated = NewStatus(now, msgType, vtapID, orgId, headerVersion, encoder, ip, seq, timestamp, serverType)
+					s.TCPStatusOthers[msgType][key] = updated
+				}
 				s.TCPStatusLocks[msgType].Unlock()
 			}
 		}
@@ -303,64 +611,188 @@ func (s *AdapterStatus) Update(now uint32, msgType datatype.MessageType, vtapID,
 			s.TCPMetrisStatus = TCPStatus
 		}
 	}
+	return updated
 }
 
-func (s *AdapterStatus) GetStatus(msgType datatype.MessageType) string {
-	if msgType.HeaderType() == datatype.HEADER_TYPE_LT_VTAP {
-		UDPStatus := s.UDPStatusFlow[msgType]
-		TCPStatus := s.TCPStatusFlow[msgType]
-		allStatus := make([]*Status, 0, len(UDPStatus)+len(TCPStatus))
-		s.UDPStatusLocks[msgType].Lock()
-		for _, instance := range UDPStatus {
-			allStatus = append(allStatus, instance)
-		}
-		s.UDPStatusLocks[msgType].Unlock()
-		s.TCPStatusLocks[msgType].RLock()
-		for _, instance := range TCPStatus {
-			allStatus = append(allStatus, instance)
-		}
-		s.TCPStatusLocks[msgType].RUnlock()
-		sort.Slice(allStatus, func(i, j int) bool {
-			return allStatus[i].ip.String() < allStatus[j].ip.String()
-		})
-		status := fmt.Sprintf("MsgType VTAPID TridentIP                                Type LastSeq  LastRemoteTimestamp LastLocalTimestamp  LastDelay LastRecvFromNow FirstSeq FirstRemoteTimestamp FirstLocalTimestamp    OrgID\n")
-		status += fmt.Sprintf("-----------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------\n")
-		for _, instance := range allStatus {
-			status += fmt.Sprintf("%-7s %-6d %-40s %-4s %-8d %-19.19s %-19.19s %-9d %-15d %-8d %-19.19s  %-19.19s org-%d\n",
-				datatype.MessageTypeString[int(instance.msgType)], instance.VTAPID, instance.ip, instance.serverType,
-				instance.lastSeq, time.Unix(int64(instance.lastRemoteTimestamp), 0), time.Unix(int64(instance.LastLocalTimestamp), 0),
-				instance.LastLocalTimestamp-instance.lastRemoteTimestamp, uint32(time.Now().Unix())-instance.LastLocalTimestamp,
-				instance.firstSeq, time.Unix(int64(instance.firstRemoteTimestamp), 0), time.Unix(int64(instance.firstLocalTimestamp), 0), instance.orgId)
+// 调试命令输出的单条agent状态
+type StatusItem struct {
+	MsgType              string `json:"msg_type"`
+	VTAPID               uint16 `json:"vtap_id,omitempty"`
+	TridentIP            string `json:"trident_ip"`
+	Hostname             string `json:"hostname,omitempty"` // 开启主机名解析且已解析时有效
+	Type                 string `json:"type"`
+	LastSeq              uint64 `json:"last_seq,omitempty"`
+	LastRemoteTimestamp  uint32 `json:"last_remote_timestamp,omitempty"`
+	LastLocalTimestamp   uint32 `json:"last_local_timestamp"`
+	LastDelay            uint32 `json:"last_delay,omitempty"`
+	LastRecvFromNow      uint32 `json:"last_recv_from_now"`
+	FirstSeq             uint64 `json:"first_seq,omitempty"`
+	FirstRemoteTimestamp uint32 `json:"first_remote_timestamp,omitempty"`
+	FirstLocalTimestamp  uint32 `json:"first_local_timestamp"`
+	OrgID                uint16 `json:"org_id,omitempty"`
+	HeaderVersion        uint16 `json:"header_version"`
+	Restarts             uint32 `json:"restarts"`
+	Encoder              string `json:"encoder"`
+	HeaderCRC            bool   `json:"header_crc"` // agent是否在包头中携带CRC
+	CompressedPackets    uint64 `json:"compressed_packets"`
+	Tenant               string `json:"tenant,omitempty"` // 配置了租户规则且已匹配时有效
+}
+
+// 包头版本相同的agent个数
+type VersionSummary struct {
+	HeaderVersion uint16 `json:"header_version"`
+	Agents        int    `json:"agents"`
+}
+
+func headerVersionString(version uint16) string {
+	if version == datatype.OLD_VERSION {
+		return "old"
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+func encoderString(encoder uint8) string {
+	switch encoder & datatype.ENCODER_TYPE_MASK {
+	case datatype.ENCODER_RAW:
+		return "raw"
+	case datatype.ENCODER_LZ4:
+		return "lz4"
+	default:
+		return fmt.Sprintf("unknown(%d)", encoder&datatype.ENCODER_TYPE_MASK)
+	}
+}
+
+// 某个消息类型的agent状态列表, 可以渲染为表格, 也可以序列化为JSON
+type StatusReport struct {
+	MsgType  string            `json:"msg_type"`
+	WithVtap bool              `json:"with_vtap"` // 为true时, agent以vtapID区分, 否则以IP区分
+	Versions []*VersionSummary `json:"versions,omitempty"`
+	Items    []*StatusItem     `json:"items"`
+}
+
+func newStatusItem(instance *Status, now uint32, names *agentNameResolver) *StatusItem {
+	return &StatusItem{
+		MsgType:              datatype.MessageTypeString[int(instance.msgType)],
+		VTAPID:               instance.VTAPID,
+		TridentIP:            instance.ip.String(),
+		Hostname:             names.name(instance.ip),
+		Type:                 instance.serverType.String(),
+		LastSeq:              instance.lastSeq,
+		LastRemoteTimestamp:  instance.lastRemoteTimestamp,
+		LastLocalTimestamp:   instance.LastLocalTimestamp,
+		LastDelay:            instance.LastLocalTimestamp - instance.lastRemoteTimestamp,
+		LastRecvFromNow:      now - instance.LastLocalTimestamp,
+		FirstSeq:             instance.firstSeq,
+		FirstRemoteTimestamp: instance.firstRemoteTimestamp,
+		FirstLocalTimestamp:  instance.firstLocalTimestamp,
+		OrgID:                instance.orgId,
+		HeaderVersion:        instance.headerVersion,
+		Restarts:             instance.restarts,
+		Encoder:              encoderString(instance.encoder),
+		HeaderCRC:            instance.encoder&datatype.ENCODER_FLAG_HEADER_CRC != 0,
+		CompressedPackets:    atomic.LoadUint64(&instance.compressedPackets),
+		Tenant:               instance.tenantLabel(),
+	}
+}
+
+// 按包头版本统计agent个数, agent多的版本排在前面
+func newVersionSummary(items []*StatusItem) []*VersionSummary {
+	counts := make(map[uint16]int)
+	for _, item := range items {
+		counts[item.HeaderVersion]++
+	}
+	summary := make([]*VersionSummary, 0, len(counts))
+	for version, agents := range counts {
+		summary = append(summary, &VersionSummary{HeaderVersion: version, Agents: agents})
+	}
+	sort.Slice(summary, func(i, j int) bool {
+		if summary[i].Agents != summary[j].Agents {
+			return summary[i].Agents > summary[j].Agents
+		}
+		return summary[i].HeaderVersion > summary[j].HeaderVersion
+	})
+	return summary
+}
+
+func (r *StatusReport) String() string {
+	if r.WithVtap {
+		versions := make([]string, 0, len(r.Versions))
+		for _, v := range r.Versions {
+			versions = append(versions, fmt.Sprintf("%d agents %s", v.Agents, headerVersionString(v.HeaderVersion)))
+		}
+		status := fmt.Sprintf("Header versions: %s\n", strings.Join(versions, ", "))
+		status += fmt.Sprintf("MsgType VTAPID TridentIP                                Type LastSeq  LastRemoteTimestamp LastLocalTimestamp  LastDelay LastRecvFromNow FirstSeq FirstRemoteTimestamp FirstLocalTimestamp    OrgID   Version Restarts Encoder HeaderCRC Compressed\n")
+		status += fmt.Sprintf("-------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------\n")
+		for _, item := range r.Items {
+			status += fmt.Sprintf("%-7s %-6d %-40s %-4s %-8d %-19.19s %-19.19s %-9d %-15d %-8d %-19.19s  %-19.19s org-%-3d %-7s %-8d %-7s %-9v %d\n",
+				item.MsgType, item.VTAPID, displayName(item.TridentIP, item.Hostname), item.Type,
+				item.LastSeq, time.Unix(int64(item.LastRemoteTimestamp), 0), time.Unix(int64(item.LastLocalTimestamp), 0),
+				item.LastDelay, item.LastRecvFromNow,
+				item.FirstSeq, time.Unix(int64(item.FirstRemoteTimestamp), 0), time.Unix(int64(item.FirstLocalTimestamp), 0), item.OrgID,
+				headerVersionString(item.HeaderVersion), item.Restarts, item.Encoder, item.HeaderCRC, item.CompressedPackets)
 		}
 		return status
 	}
 
-	UDPStatus := s.UDPStatusOthers[msgType]
-	TCPStatus := s.TCPStatusOthers[msgType]
-	allStatus := make([]*Status, 0, len(UDPStatus)+len(TCPStatus))
+	status := fmt.Sprintf("MsgType TridentIP                                Type LastLocalTimestamp LastRecvFromNow FirstLocalTimestamp\n")
+	status += fmt.Sprintf("-----------------------------------------------------------------------------------------------------\n")
+	for _, item := range r.Items {
+		status += fmt.Sprintf("%-7s %-40s %-4s %-19.19s %-15d %-19.19s\n",
+			item.MsgType, displayName(item.TridentIP, item.Hostname), item.Type,
+			time.Unix(int64(item.LastLocalTimestamp), 0),
+			item.LastRecvFromNow,
+			time.Unix(int64(item.FirstLocalTimestamp), 0))
+	}
+	return status
+}
+
+func (s *AdapterStatus) GetStatusReport(msgType datatype.MessageType) *StatusReport {
+	var UDPStatus, TCPStatus []*Status
+	withVtap := msgType.HeaderType() == datatype.HEADER_TYPE_LT_VTAP
 	s.UDPStatusLocks[msgType].Lock()
-	for _, instance := range UDPStatus {
-		allStatus = append(allStatus, instance)
+	if withVtap {
+		for _, instance := range s.UDPStatusFlow[msgType] {
+			UDPStatus = append(UDPStatus, instance)
+		}
+	} else {
+		for _, instance := range s.UDPStatusOthers[msgType] {
+			UDPStatus = append(UDPStatus, instance)
+		}
 	}
 	s.UDPStatusLocks[msgType].Unlock()
 	s.TCPStatusLocks[msgType].RLock()
-	for _, instance := range TCPStatus {
-		allStatus = append(allStatus, instance)
+	if withVtap {
+		for _, instance := range s.TCPStatusFlow[msgType] {
+			TCPStatus = append(TCPStatus, instance)
+		}
+	} else {
+		for _, instance := range s.TCPStatusOthers[msgType] {
+			TCPStatus = append(TCPStatus, instance)
+		}
 	}
 	s.TCPStatusLocks[msgType].RUnlock()
+
+	allStatus := append(UDPStatus, TCPStatus...)
 	sort.Slice(allStatus, func(i, j int) bool {
 		return allStatus[i].ip.String() < allStatus[j].ip.String()
 	})
-	status := fmt.Sprintf("MsgType TridentIP                                Type LastLocalTimestamp LastRecvFromNow FirstLocalTimestamp\n")
-	status += fmt.Sprintf("-----------------------------------------------------------------------------------------------------\n")
+	now := uint32(time.Now().Unix())
+	report := &StatusReport{
+		MsgType:  datatype.MessageTypeString[int(msgType)],
+		WithVtap: withVtap,
+		Items:    make([]*StatusItem, 0, len(allStatus)),
+	}
 	for _, instance := range allStatus {
-		status += fmt.Sprintf("%-7s %-40s %-4s %-19.19s %-15d %-19.19s\n",
-			datatype.MessageTypeString[int(instance.msgType)], instance.ip, instance.serverType,
-			time.Unix(int64(instance.LastLocalTimestamp), 0),
-			uint32(time.Now().Unix())-instance.LastLocalTimestamp,
-			time.Unix(int64(instance.firstLocalTimestamp), 0))
+		report.Items = append(report.Items, newStatusItem(instance, now, s.agentNames))
 	}
-	return status
+	if withVtap {
+		report.Versions = newVersionSummary(report.Items)
+	}
+	return report
+}
+
+func (s *AdapterStatus) GetStatus(msgType datatype.MessageType) string {
+	return s.GetStatusReport(msgType).String()
 }
 
 type Handler struct {
@@ -369,6 +801,7 @@ type Handler struct {
 	nQueues        int
 	queueUDPCaches []QueueCache // UDP单线程处理，免锁
 	queueTCPCaches []QueueCache // TCP多线程处理，需加锁
+	counterShards  []uint8      // 每个队列的消费线程使用的计数分片
 }
 
 type Receiver struct {
@@ -384,63 +817,189 @@ type Receiver struct {
 	TCPReaderBuffer  int
 	TCPListener      net.Listener
 	TCPAddress       string
+	connLock         sync.Mutex // Start创建UDPConn和TCPListener时与Close互斥
 	lastUDPFlushTime int64
 	lastTCPFlushTime int64
 	timeNow          int64
-	lastLogTime      int64
-	lastTCPLogTime   int64
-	dropLogCount     int64
 
-	exit   bool
-	closed bool
+	udpReadTimeout time.Duration // UDP读超时, 为0时使用RECV_TIMEOUT
+	udpDeadline    int64         // 原子操作, 当前UDP读超时的时间(秒)
+	udpRefresh     uint32        // 原子操作, 定时器协程发现读超时即将到期时置1, 由UDP收包协程延后读超时
+
+	// 原子操作, 本统计周期内TCP收到的消息数, 用于轮流选择队列
+	tcpRxPackets uint64
+	// 仅UDP收包协程访问, UDP收到的消息数, 用于轮流选择队列. 不能使用tcpRxPackets, 否则没有TCP消息时UDP消息全部进入同一队列
+	udpRxPackets uint64
+
+	started  uint32         // 原子操作, 保证只有第一次Start创建收包协程
+	exit     uint32         // 原子操作, 为1时各收包协程退出
+	closed   uint32         // 原子操作
+	stopped  sync.WaitGroup // UDP, TCP收包协程, TCP连接协程和定时器协程
+	tcpConns tcpConns
+
+	headerCRCRequired    bool // 为true时丢弃不带包头CRC的消息, 默认兼容不带CRC的agent
+	legacyHeaderDisabled bool // 为true时丢弃旧版本包头的消息
 
-	counter *ReceiverCounter
+	warningLogs *rateLimitedLogger // 收包路径上的告警, 每个agent每类告警每LOG_INTERVAL秒最多打印一次
+	legacyLogs  *rateLimitedLogger // 旧版本包头的升级提示, 每个agent每LEGACY_WARNING_INTERVAL秒最多打印一次
+
+	counter     *ReceiverCounter // 创建后不再替换, 各字段原子累加, 获取时逐个字段原子交换
+	counterLock sync.Mutex       // stats和调试命令都会获取counter, 需要互斥, 保证同一次获取的各字段属于同一周期
+
+	consumerCounters [COUNTER_SHARDS]consumerCounter // 由各个队列的消费线程通过RecvBuffer.receiver更新
+	nextCounterShard uint32                          // 原子操作, 注册队列时依次分配分片
+	agentRecords     sync.Map                        // key为orgID<<16|vtapID, *agentRecords, 超过gone阈值未收到数据的agent被清除
 
 	status *AdapterStatus
+
+	watches watchManager
+
+	headerErrors headerErrors
+
+	errorTap          atomic.Value // *errorTap, 为nil时未开启
+	errorTapLock      sync.Mutex   // 开启和关闭error tap时互斥, 接收线程只读取errorTap
+	errorTapDirectory string       // ctl开启error tap时文件只能位于该目录下, 只能通过配置修改
+
+	agentHealth agentHealthTracker
+
+	tenants atomic.Value // *tenantTable, 为nil时未配置租户规则
+
+	mirror            atomic.Value // *mirror, 为nil时未开启
+	mirrorLock        sync.Mutex   // 开启和关闭转发时互斥, 接收线程只读取mirror
+	mirrorDestination string       // 配置的转发目标, ctl只能开关转发, 不能修改
+	mirrorFilters     []string
+
+	statsdReporter atomic.Value // *statsdReporter, 为nil时不推送
+	statsdLock     sync.Mutex
+
+	agentNames *agentNameResolver // 日志和调试命令中显示agent的主机名, 为nil时只显示IP. 创建后不再修改
 }
 
 type ReceiverCounter struct {
-	Invalid         uint64 `statsd:"invalid"`
-	Unregistered    uint64 `statsd:"unregistered"`
-	RxPackets       uint64 `statsd:"rx_packets"`
-	MaxDelay        int64  `statsd:"max_delay"`
-	MinDelay        int64  `statsd:"min_delay"`
-	UDPDropped      uint64 `statsd:"udp_dropped"`
-	UDPDisorder     uint64 `statsd:"udp_disorder"`      // 乱序个数
-	UDPDisorderSize uint64 `statsd:"udp_disorder_size"` // 乱序最大范围
-	NewBufferCount  uint64 `statsd:"new_buffer_count"`  // If the received data is large, you need to alloc memory, record the times.
+	Invalid         uint64 `statsd:"invalid" json:"invalid"`
+	Unregistered    uint64 `statsd:"unregistered" json:"unregistered"`
+	RxPackets       uint64 `statsd:"rx_packets" json:"rx_packets"`
+	MaxDelay        int64  `statsd:"max_delay,gauge" json:"max_delay"`
+	MinDelay        int64  `statsd:"min_delay,gauge" json:"min_delay"`
+	UDPDropped      uint64 `statsd:"udp_dropped" json:"udp_dropped"`
+	UDPDisorder     uint64 `statsd:"udp_disorder" json:"udp_disorder"`           // 乱序个数
+	UDPDisorderSize uint64 `statsd:"udp_disorder_size" json:"udp_disorder_size"` // 乱序最大范围
+	NewBufferCount  uint64 `statsd:"new_buffer_count" json:"new_buffer_count"`   // If the received data is large, you need to alloc memory, record the times.
+	UnknownVersion  uint64 `statsd:"unknown_version" json:"unknown_version"`     // 包头版本号比当前支持的最新版本还新, 无法解码
+	HeaderCRCError  uint64 `statsd:"header_crc_error" json:"header_crc_error"`   // 包头CRC校验失败, 或要求校验时包头未携带CRC
+	RxPartial       uint64 `statsd:"rx_partial" json:"rx_partial"`               // 被截断的UDP消息个数, 已收到的部分仍会转发
+	RxHeartbeats    uint64 `statsd:"rx_heartbeats" json:"rx_heartbeats"`         // 只有包头没有数据的心跳消息个数
+	RxLegacy        uint64 `statsd:"rx_legacy" json:"rx_legacy"`                 // 旧版本包头的消息个数, 发送的agent需要升级
+	TenantUnmatched uint64 `statsd:"tenant_unmatched" json:"tenant_unmatched"`   // 配置了租户规则时, 发送方IP未匹配任何规则的消息个数
+
+	CompressedBytes   uint64 `statsd:"compressed_bytes" json:"compressed_bytes"`
+	DecompressedBytes uint64 `statsd:"decompressed_bytes" json:"decompressed_bytes"`
+	DecompressFailed  uint64 `statsd:"decompress_failed" json:"decompress_failed"`
+
+	RxRecords     uint64  `statsd:"rx_records" json:"rx_records"`         // 消费线程解码出的记录数
+	PartialDecode uint64  `statsd:"partial_decode" json:"partial_decode"` // 只解码出部分记录的消息个数
+	AvgRecords    float64 `statsd:"avg_records,gauge" json:"avg_records"` // 平均每个消息包含的记录数
+
+	// 每个消息包含的记录数分布, 平均值无法区分批量发送少的空闲agent和批量发送多的繁忙agent
+	Records1       uint64 `statsd:"records_1" json:"records_1"` // 包含0或1条记录的消息个数
+	Records2To10   uint64 `statsd:"records_2_10" json:"records_2_10"`
+	Records11To50  uint64 `statsd:"records_11_50" json:"records_11_50"`
+	Records51To200 uint64 `statsd:"records_51_200" json:"records_51_200"`
+	RecordsOver200 uint64 `statsd:"records_over_200" json:"records_over_200"`
+
+	StatsdFailed   uint64 `statsd:"statsd_failed" json:"statsd_failed"`       // 推送指标时发送失败的包数和丢弃的周期数, 见SetStatsdReporter
+	UDPReadTimeout uint64 `statsd:"udp_read_timeout" json:"udp_read_timeout"` // UDP空闲超过RECV_TIMEOUT的次数
+	RxRunts        uint64 `statsd:"rx_runts" json:"rx_runts"`                 // 短于包头的UDP数据报个数, 不计入invalid
 }
 
+// 保留原有的参数, 参数无效时panic, 新代码使用NewReceiverWithConfig
 func NewReceiver(
 	listenPort, UDPReadBuffer, TCPReadBuffer, TCPReaderBuffer int, // 监听端口，默认同时监听tcp和upd的端口
 ) *Receiver {
-	receiver := &Receiver{
-		handlers:        make([]*Handler, datatype.MESSAGE_TYPE_MAX),
-		serverType:      BOTH,
-		UDPAddress:      &net.UDPAddr{Port: listenPort},
+	receiver, err := NewReceiverWithConfig(ReceiverConfig{
+		ListenPort:      listenPort,
 		UDPReadBuffer:   UDPReadBuffer,
 		TCPReadBuffer:   TCPReadBuffer,
 		TCPReaderBuffer: TCPReaderBuffer,
-		TCPAddress:      fmt.Sprintf("0.0.0.0:%d", listenPort),
-		timeNow:         time.Now().Unix(),
-		counter:         &ReceiverCounter{},
-		status:          &AdapterStatus{},
+	})
+	if err != nil {
+		panic(err)
+	}
+	return receiver
+}
+
+func NewReceiverWithConfig(config ReceiverConfig) (*Receiver, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	receiver := &Receiver{
+		handlers:             make([]*Handler, datatype.MESSAGE_TYPE_MAX),
+		serverType:           BOTH,
+		UDPAddress:           &net.UDPAddr{Port: config.ListenPort},
+		UDPReadBuffer:        config.UDPReadBuffer,
+		TCPReadBuffer:        config.TCPReadBuffer,
+		TCPReaderBuffer:      config.TCPReaderBuffer,
+		TCPAddress:           fmt.Sprintf("0.0.0.0:%d", config.ListenPort),
+		timeNow:              time.Now().Unix(),
+		headerCRCRequired:    config.HeaderCRCRequired,
+		legacyHeaderDisabled: config.LegacyHeaderDisabled,
+		errorTapDirectory:    config.ErrorTapDirectory,
+		mirrorDestination:    config.MirrorDestination,
+		mirrorFilters:        config.MirrorFilters,
+		counter:              &ReceiverCounter{MaxDelay: -ONE_HOUR, MinDelay: ONE_HOUR},
+		warningLogs:          newRateLimitedLogger(1, LOG_INTERVAL, LOG_LIMIT_KEYS),
+		legacyLogs:           newRateLimitedLogger(1, LEGACY_WARNING_INTERVAL, LOG_LIMIT_KEYS),
+		status:               &AdapterStatus{},
+	}
+	receiver.agentHealth.staleAfter, receiver.agentHealth.goneAfter = config.AgentStaleAfter, config.AgentGoneAfter
+	receiver.tenants.Store((*tenantTable)(nil))
+	receiver.mirror.Store((*mirror)(nil))
+	if len(config.TenantRules) > 0 {
+		// 规则已经过Validate检查
+		tenants, _ := newTenantTable(config.TenantRules, uint32(receiver.timeNow))
+		receiver.tenants.Store(tenants)
+	}
+	if config.MirrorDestination != "" {
+		if err := receiver.EnableMirror(config.MirrorDestination, config.MirrorFilters); err != nil {
+			return nil, err
+		}
+	}
+	if config.StatsdAddress != "" {
+		if err := receiver.SetStatsdReporter(config.StatsdAddress); err != nil {
+			receiver.DisableMirror()
+			return nil, err
+		}
+	}
+	if config.AgentNameReverseDNS || config.AgentNameFile != "" {
+		resolver, err := newAgentNameResolver(config.AgentNameReverseDNS, config.AgentNameFile)
+		if err != nil {
+			receiver.DisableMirror()
+			receiver.SetStatsdReporter("")
+			return nil, err
+		}
+		resolver.start()
+		receiver.agentNames = resolver
+		receiver.status.agentNames = resolver
 	}
 	receiver.status.init()
 
 	debug.ServerRegisterSimple(TRIDENT_ADAPTER_STATUS_CMD, receiver)
+	debug.Register(TRIDENT_ADAPTER_WATCH_CMD, receiver)
 	receiver.DropDetection.Init("receiver", DROP_DETECT_WINDOW_SIZE)
+	receiver.stopped.Add(1)
 	go receiver.timeNowAndFlushTicker()
-	return receiver
+	return receiver, nil
 }
 
 // 注册处理函数，收到msgType的数据，放到outQueues中
 func (r *Receiver) RegistHandler(msgType datatype.MessageType, outQueues queue.MultiQueueWriter, nQueues int) error {
 	queueUDPCaches := make([]QueueCache, nQueues)
 	queueTCPCaches := make([]QueueCache, nQueues)
+	counterShards := make([]uint8, nQueues)
 	for i := 0; i < nQueues; i++ {
 		queueUDPCaches[i].values = make([]interface{}, 0, QUEUE_BATCH_NUM)
 		queueTCPCaches[i].values = make([]interface{}, 0, QUEUE_BATCH_NUM)
+		counterShards[i] = r.allocCounterShard()
 	}
 	r.handlers[msgType] = &Handler{
 		msgType:        msgType,
@@ -448,66 +1007,184 @@ func (r *Receiver) RegistHandler(msgType datatype.MessageType, outQueues queue.M
 		nQueues:        nQueues,
 		queueUDPCaches: queueUDPCaches,
 		queueTCPCaches: queueTCPCaches,
+		counterShards:  counterShards,
 	}
 	return nil
 }
 
 func (r *Receiver) HandleSimpleCommand(op uint16, arg string) string {
+	args := parseCommandArgs(arg)
+	result := r.handleAdapterCommand(op, args)
+	if args.json {
+		return marshalCommandOutput(op, result)
+	}
+	return result.String()
+}
+
+func (r *Receiver) handleAdapterCommand(op uint16, args *commandArgs) fmt.Stringer {
 	msgType := datatype.MessageType(op)
 	if msgType < datatype.MESSAGE_TYPE_MAX {
-		return r.status.GetStatus(msgType)
+		return StatusReports{r.status.GetStatusReport(msgType)}
 	}
-	if msgType == datatype.MESSAGE_TYPE_MAX { // 兼容原来的status参数
-		return r.status.GetStatus(datatype.MESSAGE_TYPE_METRICS)
+	switch op {
+	case ADAPTER_CMD_STATUS: // 兼容原来的status参数
+		return StatusReports{r.status.GetStatusReport(datatype.MESSAGE_TYPE_METRICS)}
+	case ADAPTER_CMD_ALL:
+		reports := make(StatusReports, 0, datatype.MESSAGE_TYPE_MAX)
+		for i := 0; i < int(datatype.MESSAGE_TYPE_MAX); i++ {
+			reports = append(reports, r.status.GetStatusReport(datatype.MessageType(i)))
+		}
+		return reports
+	case ADAPTER_CMD_RESET_COUNTERS:
+		return r.resetCounters(args.includeLifetime)
+	case ADAPTER_CMD_POOL:
+		return GetBufferPoolStats()
+	case ADAPTER_CMD_WATCH:
+		return commandError("watch streams snapshots, run the watch subcommand instead")
+	case ADAPTER_CMD_ERRORS:
+		return r.headerErrors.report()
+	case ADAPTER_CMD_RECORDS:
+		return r.recordsReport()
+	case ADAPTER_CMD_ERROR_TAP:
+		return r.handleErrorTapCommand(args)
+	case ADAPTER_CMD_HEALTH:
+		return r.handleHealthCommand(args)
+	case ADAPTER_CMD_CONFIG:
+		return r.effectiveConfig()
+	case ADAPTER_CMD_TENANTS:
+		return r.handleTenantCommand(args)
+	case ADAPTER_CMD_MIRROR:
+		return r.handleMirrorCommand(args)
 	}
-	ret := ""
-	for i := 0; i < int(datatype.MESSAGE_TYPE_MAX); i++ {
-		ret += r.status.GetStatus(datatype.MessageType(i))
-		ret += "\n"
+	return commandError(fmt.Sprintf("unknown command %d", op))
+}
+
+// reset后的计数值不再上报stats, 而是返回给调试命令
+func (r *Receiver) resetCounters(includeLifetime bool) *CounterReset {
+	reset := &CounterReset{
+		Counter:         r.swapCounter(),
+		IncludeLifetime: includeLifetime,
+	}
+	if includeLifetime {
+		reset.ClearedInstances = r.status.reset()
+		r.headerErrors.reset()
+		r.resetAgentRecords()
 	}
-	return ret
+	return reset
 }
 
 func (r *Receiver) SetServerType(serverType ServerType) {
 	r.serverType = serverType
 }
 
+func (r *Receiver) SetHeaderCRCRequired(required bool) {
+	r.headerCRCRequired = required
+}
+
+func (r *Receiver) SetLegacyHeaderDisabled(disabled bool) {
+	r.legacyHeaderDisabled = disabled
+}
+
+// 旧版本包头的消息单独计数, 每个agent每小时最多打印一次升级提示
+func (r *Receiver) handleLegacyHeader(ip net.IP, vtapID uint16) {
+	atomic.AddUint64(&r.counter.RxLegacy, 1)
+	if ok, suppressed := r.legacyLogs.allowIP("", ip, r.timeNow); ok {
+		log.Warning(suppressedMessage(suppressed, "agent %s vtap %d is sending the deprecated legacy header format, please upgrade it", r.agentNames.displayName(ip), vtapID))
+	}
+}
+
 func (r *Receiver) GetCounter() interface{} {
-	counter := &ReceiverCounter{MaxDelay: -ONE_HOUR, MinDelay: ONE_HOUR}
-	counter, r.counter = r.counter, counter
+	counter := r.swapCounter()
+	r.reportStatsd(counter)
+	return counter
+}
+
+// 交换出当前周期的counter, stats周期获取和reset-counters命令都通过此函数获取, 保证每个计数只被取走一次.
+// 不替换r.counter指针, 否则收包协程取到旧指针后的累加会在交换后丢失
+func (r *Receiver) swapCounter() *ReceiverCounter {
+	r.counterLock.Lock()
+	defer r.counterLock.Unlock()
+
+	atomic.StoreUint64(&r.tcpRxPackets, 0)
+	counter := &ReceiverCounter{
+		Invalid:         atomic.SwapUint64(&r.counter.Invalid, 0),
+		Unregistered:    atomic.SwapUint64(&r.counter.Unregistered, 0),
+		RxPackets:       atomic.SwapUint64(&r.counter.RxPackets, 0),
+		MaxDelay:        atomic.SwapInt64(&r.counter.MaxDelay, -ONE_HOUR),
+		MinDelay:        atomic.SwapInt64(&r.counter.MinDelay, ONE_HOUR),
+		NewBufferCount:  atomic.SwapUint64(&r.counter.NewBufferCount, 0),
+		UnknownVersion:  atomic.SwapUint64(&r.counter.UnknownVersion, 0),
+		HeaderCRCError:  atomic.SwapUint64(&r.counter.HeaderCRCError, 0),
+		RxPartial:       atomic.SwapUint64(&r.counter.RxPartial, 0),
+		RxHeartbeats:    atomic.SwapUint64(&r.counter.RxHeartbeats, 0),
+		RxLegacy:        atomic.SwapUint64(&r.counter.RxLegacy, 0),
+		TenantUnmatched: atomic.SwapUint64(&r.counter.TenantUnmatched, 0),
+		UDPReadTimeout:  atomic.SwapUint64(&r.counter.UDPReadTimeout, 0),
+		RxRunts:         atomic.SwapUint64(&r.counter.RxRunts, 0),
+	}
 
 	dropCounter := r.DropDetection.GetCounter().(*cache.DropCounter)
 	counter.UDPDropped = dropCounter.Dropped
 	counter.UDPDisorder = dropCounter.Disorder
 	counter.UDPDisorderSize = dropCounter.DisorderSize
+
+	consumer := r.swapConsumerCounters()
+	counter.CompressedBytes = consumer.compressedBytes
+	counter.DecompressedBytes = consumer.decompressedBytes
+	counter.DecompressFailed = consumer.decompressFailed
+
+	counter.RxRecords = consumer.records
+	counter.PartialDecode = consumer.partial
+	if consumer.messages > 0 {
+		counter.AvgRecords = float64(counter.RxRecords) / float64(consumer.messages)
+	}
+	counter.Records1 = consumer.histogram[RECORDS_BUCKET_1]
+	counter.Records2To10 = consumer.histogram[RECORDS_BUCKET_2_10]
+	counter.Records11To50 = consumer.histogram[RECORDS_BUCKET_11_50]
+	counter.Records51To200 = consumer.histogram[RECORDS_BUCKET_51_200]
+	counter.RecordsOver200 = consumer.histogram[RECORDS_BUCKET_OVER_200]
 	return counter
 }
 
 func (r *Receiver) updateCounter(metriTimestamp uint32) {
 	delay := r.timeNow - int64(metriTimestamp)
-	if r.counter.MaxDelay < delay {
-		r.counter.MaxDelay = delay
+	// UDP和TCP协程同时更新, 需要CAS
+	for maxDelay := atomic.LoadInt64(&r.counter.MaxDelay); maxDelay < delay; maxDelay = atomic.LoadInt64(&r.counter.MaxDelay) {
+		if atomic.CompareAndSwapInt64(&r.counter.MaxDelay, maxDelay, delay) {
+			break
+		}
 	}
-	if r.counter.MinDelay > delay {
-		r.counter.MinDelay = delay
+	for minDelay := atomic.LoadInt64(&r.counter.MinDelay); minDelay > delay; minDelay = atomic.LoadInt64(&r.counter.MinDelay) {
+		if atomic.CompareAndSwapInt64(&r.counter.MinDelay, minDelay, delay) {
+			break
+		}
 	}
 }
 
 func (r *Receiver) timeNowAndFlushTicker() {
+	defer r.stopped.Done()
 	ticker := time.NewTicker(time.Second)
 	defer ticker.Stop()
 
 	for range ticker.C {
-		if r.exit {
+		if r.exiting() {
 			return
 		}
 		r.timeNow = time.Now().Unix()
+		r.checkUDPTimeout(r.timeNow)
 		r.flushPutTCPQueues()
+		if r.timeNow-r.agentHealth.lastCheck >= AGENT_HEALTH_CHECK_INTERVAL {
+			r.agentHealth.lastCheck = r.timeNow
+			r.checkAgentHealth()
+			r.expireAgentRecords()
+		}
 	}
 }
 
 func (r *Receiver) putUDPQueue(hash int, handler *Handler, buffer *RecvBuffer) {
 	hashKey := hash % handler.nQueues
+	buffer.receiver = r
+	buffer.counterShard = handler.counterShards[hashKey]
 
 	queueCache := &handler.queueUDPCaches[hashKey]
 	queueCache.values = append(queueCache.values, buffer)
@@ -520,6 +1197,8 @@ func (r *Receiver) putUDPQueue(hash int, handler *Handler, buffer *RecvBuffer) {
 
 func (r *Receiver) putTCPQueue(hash int, handler *Handler, buffer *RecvBuffer) {
 	hashKey := hash % handler.nQueues
+	buffer.receiver = r
+	buffer.counterShard = handler.counterShards[hashKey]
 
 	queueCache := &handler.queueTCPCaches[hashKey]
 	queueCache.Lock() // 存在多个tcp连接同时put，故需要加锁
@@ -639,40 +1318,86 @@ func ValidateFlowVersion(t datatype.MessageType, version uint32) error {
 	return nil
 }
 
+func (r *Receiver) udpTimeout() time.Duration {
+	if r.udpReadTimeout == 0 {
+		return RECV_TIMEOUT
+	}
+	return r.udpReadTimeout
+}
+
 func (r *Receiver) setUDPTimeout() {
-	// 每隔RECV_TIMEOUT 时间触发一次timeout，保证队列的数据都flush出去
-	r.UDPConn.SetReadDeadline(time.Now().Add(RECV_TIMEOUT))
+	// 空闲RECV_TIMEOUT 时间触发一次timeout，保证队列的数据都flush出去
+	deadline := time.Now().Add(r.udpTimeout())
+	atomic.StoreInt64(&r.udpDeadline, deadline.Unix())
+	r.UDPConn.SetReadDeadline(deadline)
 }
 
-func (r *Receiver) logReceiveError(size int, remoteAddr *net.UDPAddr, err error) {
-	atomic.AddUint64(&r.counter.Invalid, 1)
-	// 防止日志刷屏
-	if r.timeNow-r.lastLogTime < LOG_INTERVAL {
-		r.dropLogCount++
+// 读超时是绝对时间, 持续有流量时需要在到期前延后, 否则到期后会出现与空闲无关的超时.
+// 由定时器协程每秒检查, 剩余时间不足一半时通知UDP收包协程延后, 收包协程不需要每个包都调用time.Now()
+func (r *Receiver) checkUDPTimeout(now int64) {
+	if now >= atomic.LoadInt64(&r.udpDeadline)-int64(r.udpTimeout()/time.Second)/2 {
+		atomic.StoreUint32(&r.udpRefresh, 1)
+	}
+}
+
+func (r *Receiver) refreshUDPTimeout() {
+	if atomic.LoadUint32(&r.udpRefresh) == 0 {
 		return
 	}
-	r.lastLogTime = r.timeNow
+	atomic.StoreUint32(&r.udpRefresh, 0)
+	r.setUDPTimeout()
+	// 与超时时相同, 定期flush长时间未满的队列缓存
+	r.flushPutUDPQueues()
+}
 
+func (r *Receiver) logReceiveError(size int, remoteAddr *net.UDPAddr, err error) {
+	atomic.AddUint64(&r.counter.Invalid, 1)
+	// 防止日志刷屏, 限速丢弃时不格式化地址
 	if remoteAddr != nil {
+		ok, suppressed := r.warningLogs.allowIP("udp recv ", remoteAddr.IP, r.timeNow)
+		if !ok {
+			return
+		}
 		if err == nil && size == 0 {
-			log.Infof("UDP socket recv size %d from %s:%d, %s Already drop log count %d", size, remoteAddr.IP, remoteAddr.Port, SOCKET_READ_ERROR, r.dropLogCount)
+			log.Info(suppressedMessage(suppressed, "UDP socket recv size %d from %s, %s", size, r.agentNames.displayAddr(remoteAddr), SOCKET_READ_ERROR))
 		} else {
-			log.Warningf("UDP socket recv size %d from %s:%d, err:%s, already drop log count %d", size, remoteAddr.IP, remoteAddr.Port, err, r.dropLogCount)
+			log.Warning(suppressedMessage(suppressed, "UDP socket recv size %d from %s, err:%s", size, r.agentNames.displayAddr(remoteAddr), err))
 		}
 	} else {
-		log.Warningf("UDP socket recv size %d, %s, already drop log count %d", size, err, r.dropLogCount)
+		r.warningLogs.Warningf("udp recv", r.timeNow, "UDP socket recv size %d, %s", size, err)
+	}
+}
+
+// 包头不带CRC时, 仅在未要求校验的情况下通过
+func (r *Receiver) checkHeaderCRC(flowHeader *datatype.FlowHeader, baseHeaderBuffer, flowHeaderBuffer, crcBuffer []byte) bool {
+	if !flowHeader.HasHeaderCRC() {
+		return !r.headerCRCRequired
+	}
+	if len(crcBuffer) < datatype.HEADER_CRC_LEN {
+		return false
 	}
+	return binary.LittleEndian.Uint32(crcBuffer) == datatype.HeaderCRC(baseHeaderBuffer, flowHeaderBuffer)
 }
 
-func (r *Receiver) logTCPReceiveInvalidData(str string) {
+func (r *Receiver) logHeaderCRCError(ip net.IP) {
+	atomic.AddUint64(&r.counter.HeaderCRCError, 1)
+	if ok, suppressed := r.warningLogs.allowIP("header crc ", ip, r.timeNow); ok {
+		log.Warning(suppressedMessage(suppressed, "recv from %s, header crc check failed, header crc required: %v", r.agentNames.displayName(ip), r.headerCRCRequired))
+	}
+}
+
+// 未知版本单独计数, 升级期间可据此判断是否有比server更新的agent接入
+func (r *Receiver) logUnknownVersion(ip net.IP, err error) {
+	atomic.AddUint64(&r.counter.UnknownVersion, 1)
+	if ok, suppressed := r.warningLogs.allowIP("unknown version ", ip, r.timeNow); ok {
+		log.Warning(suppressedMessage(suppressed, "recv from %s, %s", r.agentNames.displayName(ip), err))
+	}
+}
+
+func (r *Receiver) logTCPReceiveInvalidData(ip net.IP, str string) {
 	atomic.AddUint64(&r.counter.Invalid, 1)
 	// 防止日志刷屏
-	if r.timeNow-r.lastTCPLogTime < LOG_INTERVAL {
-		r.dropLogCount++
-		return
-	}
-	r.lastTCPLogTime = r.timeNow
-	log.Warningf("%s, already drop log count %d", str, r.dropLogCount)
+	r.warningLogs.Warningf("tcp invalid "+ip.String(), r.timeNow, "%s", str)
 }
 
 func (r *Receiver) parseOrgIdTeamId(flowHeader *datatype.FlowHeader) (uint16, uint32) {
@@ -684,32 +1409,120 @@ func (r *Receiver) parseOrgIdTeamId(flowHeader *datatype.FlowHeader) (uint16, ui
 	if orgID == ckdb.INVALID_ORG_ID {
 		orgID = ckdb.DEFAULT_ORG_ID
 	} else if orgID > ckdb.MAX_ORG_ID {
-		if r.counter.Invalid == 0 {
-			log.Warningf("the org id (%d) in the header of the received agent message is illegal", orgID)
-		}
+		r.warningLogs.Warningf(fmt.Sprintf("illegal org %d", orgID), r.timeNow, "the org id (%d) in the header of the received agent message is illegal", orgID)
 		atomic.AddUint64(&r.counter.Invalid, 1)
 		orgID = ckdb.DEFAULT_ORG_ID
 	}
 	return orgID, teamID
 }
 
+type udpHeader struct {
+	base      datatype.BaseHeader
+	flow      datatype.FlowHeader
+	headerLen int  // payload的开始位置
+	end       int  // payload的结束位置
+	truncated bool // FrameSize大于实际收到的长度, 消息被截断
+}
+
+var errHeaderCRC = errors.New("header crc check failed")
+
+// 所有偏移都以实际收到的数据长度为界, 畸形的数据返回错误, 不会越界访问
+func (r *Receiver) decodeUDPHeader(packet []byte, header *udpHeader) *HeaderError {
+	if err := header.base.Decode(packet); err != nil {
+		return headerErrorFromBaseDecode(&header.base, len(packet), err)
+	}
+	if header.base.Type >= datatype.MESSAGE_TYPE_MAX {
+		return newHeaderError(REASON_UNKNOWN_TYPE, fmt.Errorf("unknown message type %d", header.base.Type))
+	}
+	header.headerLen = datatype.MESSAGE_HEADER_LEN
+	header.end = len(packet) // syslog,statsd数据的FrameSize长度是0,需要以实际长度为准
+	// 超过接收buffer或内核buffer的部分被丢弃, 仍然转发已收到的部分, 由消费线程解码其中完整的记录
+	header.truncated = int(header.base.FrameSize) > len(packet)
+	if header.base.Type == datatype.MESSAGE_TYPE_COMPRESS && int(header.base.FrameSize) < len(packet) {
+		header.end = int(header.base.FrameSize) // 可能收到的包长会大于FrameSize, 以FrameSize为准
+	}
+	if header.base.Type.HeaderType() != datatype.HEADER_TYPE_LT_VTAP {
+		return nil
+	}
+
+	if err := header.flow.Decode(packet[datatype.MESSAGE_HEADER_LEN:]); err != nil {
+		return headerErrorFromDecode(err)
+	}
+	if header.flow.Version == datatype.OLD_VERSION && r.legacyHeaderDisabled {
+		return newHeaderError(REASON_LEGACY_DISABLED, errLegacyHeaderDisabled)
+	}
+	header.headerLen += datatype.FLOW_HEADER_LEN
+	if !r.checkHeaderCRC(&header.flow, packet, packet[datatype.MESSAGE_HEADER_LEN:], packet[header.headerLen:]) {
+		return newHeaderError(REASON_HEADER_CRC, errHeaderCRC)
+	}
+	if header.flow.HasHeaderCRC() {
+		header.headerLen += datatype.HEADER_CRC_LEN
+	}
+	return nil
+}
+
+// 短于包头的数据报(端口扫描, 健康检查等)直接丢弃, 不解析包头, 也不更新agent状态
+func (r *Receiver) handleRunt(remoteAddr *net.UDPAddr, packet []byte) {
+	atomic.AddUint64(&r.counter.RxRunts, 1)
+	r.tapInvalid(remoteAddr, packet)
+	ok, suppressed := r.warningLogs.allowIP("udp runt ", remoteAddr.IP, r.timeNow)
+	if !ok {
+		return
+	}
+	if len(packet) == 0 {
+		log.Info(suppressedMessage(suppressed, "UDP socket recv size 0 from %s, %s", r.agentNames.displayAddr(remoteAddr), SOCKET_READ_ERROR))
+		return
+	}
+	log.Warning(suppressedMessage(suppressed, "UDP datagram from %s is %d bytes, shorter than the message header (%d bytes), dropped", r.agentNames.displayAddr(remoteAddr), len(packet), datatype.MESSAGE_HEADER_LEN))
+}
+
+func (r *Receiver) logHeaderError(packet []byte, remoteAddr *net.UDPAddr, err *HeaderError) {
+	switch err.Reason {
+	case REASON_UNKNOWN_VERSION:
+		r.logUnknownVersion(remoteAddr.IP, err.Err)
+	case REASON_HEADER_CRC:
+		r.logHeaderCRCError(remoteAddr.IP)
+	default:
+		r.logReceiveError(len(packet), remoteAddr, err)
+	}
+	r.headerErrors.record(uint32(r.timeNow), remoteAddr.IP, err, packet)
+}
+
+// 与ReadFromUDP相同, 但将发送方地址写入调用方复用的addr, 避免每个包分配一个UDPAddr.
+// addr及其IP在下次调用时被覆盖, 需要保留时复制
+func readFromUDP(conn *net.UDPConn, buffer []byte, addr *net.UDPAddr) (int, *net.UDPAddr, error) {
+	size, addrPort, err := conn.ReadFromUDPAddrPort(buffer)
+	if err != nil {
+		return size, nil, err
+	}
+	ip := addrPort.Addr().Unmap()
+	if ip.Is4() {
+		ip4 := ip.As4()
+		addr.IP = append(addr.IP[:0], ip4[:]...)
+	} else {
+		ip16 := ip.As16()
+		addr.IP = append(addr.IP[:0], ip16[:]...)
+	}
+	addr.Port = int(addrPort.Port())
+	addr.Zone = ip.Zone()
+	return size, addr, nil
+}
+
 func (r *Receiver) ProcessUDPServer() {
+	defer r.stopped.Done()
 	defer r.UDPConn.Close()
-	baseHeader := &datatype.BaseHeader{}
-	flowHeader := &datatype.FlowHeader{}
+	header := &udpHeader{}
+	addr := &net.UDPAddr{IP: make(net.IP, 0, net.IPv6len)}
 	r.setUDPTimeout()
-	for !r.exit {
+	for !r.exiting() {
 		recvBuffer, _ := AcquireRecvBuffer(RECV_BUFSIZE_2K, UDP)
-		size, remoteAddr, err := r.UDPConn.ReadFromUDP(recvBuffer.Buffer)
-		if err != nil || size < datatype.MESSAGE_HEADER_LEN {
+		size, remoteAddr, err := readFromUDP(r.UDPConn, recvBuffer.Buffer, addr)
+		if err != nil {
 			ReleaseRecvBuffer(recvBuffer)
 			r.flushPutUDPQueues()
-			if err == nil {
-				r.logReceiveError(size, remoteAddr, err)
-				continue
-			}
 			if netErr, ok := err.(net.Error); ok {
 				if netErr.Timeout() {
+					atomic.AddUint64(&r.counter.UDPReadTimeout, 1)
 					r.setUDPTimeout()
 					continue
 				}
@@ -718,73 +1531,138 @@ func (r *Receiver) ProcessUDPServer() {
 			time.Sleep(time.Second)
 			continue
 		}
-
-		if err := baseHeader.Decode(recvBuffer.Buffer); err != nil {
+		r.refreshUDPTimeout()
+		if size < datatype.MESSAGE_HEADER_LEN {
+			r.handleRunt(remoteAddr, recvBuffer.Buffer[:size])
 			ReleaseRecvBuffer(recvBuffer)
-			r.logReceiveError(size, remoteAddr, err)
+			r.flushPutUDPQueues()
 			continue
 		}
-		if baseHeader.Type >= datatype.MESSAGE_TYPE_MAX {
+
+		packet := recvBuffer.Buffer[:size]
+		r.mirrorDatagram(remoteAddr.IP, packet)
+		if err := r.decodeUDPHeader(packet, header); err != nil {
+			r.tapInvalid(remoteAddr, packet)
 			ReleaseRecvBuffer(recvBuffer)
-			r.logReceiveError(size, remoteAddr, fmt.Errorf("unknown message type %d", baseHeader.Type))
+			r.logHeaderError(packet, remoteAddr, err)
 			continue
 		}
 
-		headerLen := datatype.MESSAGE_HEADER_LEN
-		metricsTimestamp, vtapID, teamID, orgID := uint32(0), uint16(0), uint32(0), uint16(0)
+		baseHeader, flowHeader, headerLen := &header.base, &header.flow, header.headerLen
+		metricsTimestamp, vtapID, teamID, orgID, headerVersion, headerEncoder, encoder := uint32(0), uint16(0), uint32(0), uint16(0), uint16(0), uint8(0), uint8(datatype.ENCODER_RAW)
 		if baseHeader.Type.HeaderType() == datatype.HEADER_TYPE_LT_VTAP {
-			flowHeader.Decode(recvBuffer.Buffer[datatype.MESSAGE_HEADER_LEN:])
-			headerLen += datatype.FLOW_HEADER_LEN
+			headerVersion, headerEncoder, encoder = flowHeader.Version, flowHeader.Encoder, flowHeader.EncoderType()
 
 			vtapID = flowHeader.AgentID
 			orgID, teamID = r.parseOrgIdTeamId(flowHeader)
+			if headerVersion == datatype.OLD_VERSION {
+				r.handleLegacyHeader(remoteAddr.IP, vtapID)
+			}
+
+			if header.end == headerLen && !header.truncated {
+				r.handleHeartbeat(baseHeader.Type, vtapID, uint16(orgID), headerVersion, headerEncoder, remoteAddr.IP, UDP)
+				ReleaseRecvBuffer(recvBuffer)
+				continue
+			}
 
 			if baseHeader.Type == datatype.MESSAGE_TYPE_METRICS {
-				metricsTimestamp = r.getMetricsTimestamp(recvBuffer.Buffer[headerLen:])
-				r.updateCounter(metricsTimestamp)
-				r.DropDetection.Detect(getIpHash(remoteAddr.IP), 0, metricsTimestamp)
+				if encoder == datatype.ENCODER_RAW {
+					metricsTimestamp = r.getMetricsTimestamp(packet[headerLen:])
+					r.updateCounter(metricsTimestamp)
+					r.DropDetection.Detect(getIpHash(remoteAddr.IP), 0, metricsTimestamp)
+				} else {
+					// 压缩的数据在消费线程中才解压, 此时无法获取数据中的时间戳
+					metricsTimestamp = uint32(r.timeNow)
+				}
 			}
 		}
-		r.status.Update(uint32(r.timeNow), baseHeader.Type, vtapID, uint16(orgID), remoteAddr.IP, 0, metricsTimestamp, UDP)
+		status := r.status.Update(uint32(r.timeNow), baseHeader.Type, vtapID, uint16(orgID), headerVersion, headerEncoder, remoteAddr.IP, 0, metricsTimestamp, UDP)
 
 		// Unregistered messages are discarded directly after receiving them, but the connection is not disconnected to prevent the Agent from printing exception logs
 		if r.handlers[baseHeader.Type] == nil {
 			atomic.AddUint64(&r.counter.Unregistered, 1)
+			r.tapPolicyDrop(remoteAddr, packet)
 			ReleaseRecvBuffer(recvBuffer)
 		} else {
 			recvBuffer.Begin = headerLen
-			recvBuffer.End = size // syslog,statsd数据的FrameSize长度是0,需要以实际长度为准
-			if baseHeader.Type == datatype.MESSAGE_TYPE_COMPRESS {
-				recvBuffer.End = int(baseHeader.FrameSize) // 可能收到的包长会大于FrameSize, 以FrameSize为准
-			}
-			recvBuffer.IP = remoteAddr.IP
+			recvBuffer.End = header.end
+			recvBuffer.setIP(remoteAddr.IP)
 			recvBuffer.VtapID = vtapID
 			recvBuffer.TeamID = teamID
 			recvBuffer.OrgID = orgID
-			r.putUDPQueue(int(r.counter.RxPackets), r.handlers[baseHeader.Type], recvBuffer)
+			recvBuffer.Encoder = encoder
+			recvBuffer.Truncated = header.truncated
+			recvBuffer.Timestamp = uint32(r.timeNow)
+			recvBuffer.Tenant = r.tenantLabel(status, remoteAddr.IP)
+			if header.truncated {
+				atomic.AddUint64(&r.counter.RxPartial, 1)
+			}
+			atomic.AddUint64(&r.counter.RxPackets, 1)
+			r.udpRxPackets++
+			r.putUDPQueue(int(r.udpRxPackets), r.handlers[baseHeader.Type], recvBuffer)
 		}
 	}
 }
 
 func (r *Receiver) ProcessTCPServer() {
+	defer r.stopped.Done()
 	defer r.TCPListener.Close()
-	for !r.exit {
+	for !r.exiting() {
 		conn, err := r.TCPListener.Accept()
 		if err != nil {
+			// Close关闭了Listener
+			if r.exiting() {
+				return
+			}
 			log.Errorf("Accept error.%s ", err.Error())
 			time.Sleep(3 * time.Second)
 			continue
 		}
 		if tcpConn, ok := conn.(*net.TCPConn); ok {
 			if err := tcpConn.SetReadBuffer(r.TCPReadBuffer); err != nil {
-				log.Warningf("TCP client (%s) set read buffer failed, err: %s", conn.RemoteAddr().String(), err)
+				log.Warningf("TCP client (%s) set read buffer failed, err: %s", r.agentNames.displayAddr(conn.RemoteAddr()), err)
 			} else {
-				log.Infof("TCP client (%s) connect success, set read buffer %d.", conn.RemoteAddr().String(), r.TCPReadBuffer)
+				log.Infof("TCP client (%s) connect success, set read buffer %d.", r.agentNames.displayAddr(conn.RemoteAddr()), r.TCPReadBuffer)
 			}
 		} else {
-			log.Infof("TCP client (%s) connect success.", conn.RemoteAddr().String())
+			log.Infof("TCP client (%s) connect success.", r.agentNames.displayAddr(conn.RemoteAddr()))
 		}
-		go r.handleTCPConnection(conn)
+		r.tcpConns.add(conn)
+		r.stopped.Add(1)
+		go func() {
+			defer r.stopped.Done()
+			defer r.tcpConns.remove(conn)
+			r.handleTCPConnection(conn)
+		}()
+	}
+}
+
+// 当前的TCP连接, Close时关闭以唤醒阻塞在读上的连接协程
+type tcpConns struct {
+	sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func (c *tcpConns) add(conn net.Conn) {
+	c.Lock()
+	defer c.Unlock()
+	if c.conns == nil {
+		c.conns = make(map[net.Conn]struct{})
+	}
+	c.conns[conn] = struct{}{}
+}
+
+func (c *tcpConns) remove(conn net.Conn) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.conns, conn)
+}
+
+func (c *tcpConns) closeAll() {
+	c.Lock()
+	defer c.Unlock()
+	for conn := range c.conns {
+		conn.Close()
 	}
 }
 
@@ -811,6 +1689,14 @@ func getIpHash(ip net.IP) uint32 {
 	return GetIpHash(ip)
 }
 
+// 只有包头没有数据的消息是agent的心跳, 用于区分空闲的agent和已失联的agent.
+// 心跳只更新agent状态, 不进入队列, 也不参与丢包检测
+func (r *Receiver) handleHeartbeat(msgType datatype.MessageType, vtapID, orgID, headerVersion uint16, headerEncoder uint8, ip net.IP, serverType ServerType) {
+	atomic.AddUint64(&r.counter.RxHeartbeats, 1)
+	now := uint32(r.timeNow)
+	r.status.Update(now, msgType, vtapID, orgID, headerVersion, headerEncoder, ip, 0, now, serverType)
+}
+
 func (r *Receiver) getMetricsTimestamp(buffer []byte) uint32 {
 	now := uint32(time.Now().Unix())
 	if len(buffer) >= 4 {
@@ -848,73 +1734,124 @@ func (r *Receiver) handleTCPConnection(conn net.Conn) {
 	baseHeaderBuffer := make([]byte, datatype.MESSAGE_HEADER_LEN)
 	flowHeader := &datatype.FlowHeader{}
 	flowHeaderBuffer := make([]byte, datatype.FLOW_HEADER_LEN)
+	headerCRCBuffer := make([]byte, datatype.HEADER_CRC_LEN)
 	reader := bufio.NewReaderSize(conn, r.TCPReaderBuffer)
-	for !r.exit {
+	for !r.exiting() {
 		if err := ReadN(reader, baseHeaderBuffer); err != nil {
-			log.Warningf("TCP client (%s) connection read error: %s", conn.RemoteAddr().String(), err.Error())
+			if !r.exiting() {
+				log.Warningf("TCP client (%s) connection read error: %s", r.agentNames.displayAddr(conn.RemoteAddr()), err.Error())
+			}
 			return
 		}
 
 		if err := baseHeader.Decode(baseHeaderBuffer); err != nil {
-			log.Warningf("TCP client (%s) decode error: %s", conn.RemoteAddr().String(), err.Error())
+			log.Warningf("TCP client (%s) decode error: %s", r.agentNames.displayAddr(conn.RemoteAddr()), err.Error())
+			r.headerErrors.record(uint32(r.timeNow), ip, headerErrorFromBaseDecode(baseHeader, len(baseHeaderBuffer), err), baseHeaderBuffer)
 			return
 		}
-		// 收到只含包头的空包丢弃
-		if baseHeader.FrameSize == datatype.MESSAGE_HEADER_LEN+datatype.FLOW_HEADER_LEN {
-			if err := ReadN(reader, flowHeaderBuffer); err != nil {
-				log.Warningf("TCP client (%s) connection read error: %s", conn.RemoteAddr().String(), err.Error())
-			} else if r.counter.Invalid == 0 {
-				log.Infof("TCP client (%s) connection read empty content packet", conn.RemoteAddr().String())
-			}
-			atomic.AddUint64(&r.counter.Invalid, 1)
-			continue
-		}
 		if baseHeader.Type >= datatype.MESSAGE_TYPE_MAX {
-			if r.counter.Invalid == 0 {
-				log.Warningf("recv from %s, unknown message type %d", conn.RemoteAddr().String(), baseHeader.Type)
-			}
+			r.warningLogs.Warningf("unknown type "+ip.String(), r.timeNow, "recv from %s, unknown message type %d", r.agentNames.displayAddr(conn.RemoteAddr()), baseHeader.Type)
 			atomic.AddUint64(&r.counter.Invalid, 1)
+			r.headerErrors.record(uint32(r.timeNow), ip, newHeaderError(REASON_UNKNOWN_TYPE, fmt.Errorf("unknown message type %d", baseHeader.Type)), baseHeaderBuffer)
 			time.Sleep(10 * time.Second)
 			return
 		}
 
 		headerLen := datatype.MESSAGE_HEADER_LEN
-		metricsTimestamp, vtapID, teamID, orgID := uint32(0), uint16(0), uint32(0), uint16(0)
+		metricsTimestamp, vtapID, teamID, orgID, headerVersion, headerEncoder, encoder := uint32(0), uint16(0), uint32(0), uint16(0), uint16(0), uint8(0), uint8(datatype.ENCODER_RAW)
 		if baseHeader.Type.HeaderType() == datatype.HEADER_TYPE_LT_VTAP {
 			if err := ReadN(reader, flowHeaderBuffer); err != nil {
 				atomic.AddUint64(&r.counter.Invalid, 1)
-				log.Warningf("TCP client (%s) connection read error.%s", conn.RemoteAddr().String(), err.Error())
+				log.Warningf("TCP client (%s) connection read error.%s", r.agentNames.displayAddr(conn.RemoteAddr()), err.Error())
 				return
 			}
-			flowHeader.Decode(flowHeaderBuffer)
 			headerLen += datatype.FLOW_HEADER_LEN
+			if err := flowHeader.Decode(flowHeaderBuffer); err != nil {
+				r.logUnknownVersion(ip, err)
+				r.headerErrors.record(uint32(r.timeNow), ip, headerErrorFromDecode(err), baseHeaderBuffer, flowHeaderBuffer)
+				// 按FrameSize跳过整个消息, 连接上的后续消息仍可能被正确解码
+				if _, err := reader.Discard(int(baseHeader.FrameSize) - headerLen); err != nil {
+					log.Warningf("TCP client (%s) connection read error: %s", r.agentNames.displayAddr(conn.RemoteAddr()), err.Error())
+					return
+				}
+				continue
+			}
+			if flowHeader.Version == datatype.OLD_VERSION && r.legacyHeaderDisabled {
+				atomic.AddUint64(&r.counter.Invalid, 1)
+				r.headerErrors.record(uint32(r.timeNow), ip, newHeaderError(REASON_LEGACY_DISABLED, errLegacyHeaderDisabled), baseHeaderBuffer, flowHeaderBuffer)
+				if _, err := reader.Discard(int(baseHeader.FrameSize) - headerLen); err != nil {
+					log.Warningf("TCP client (%s) connection read error: %s", r.agentNames.displayAddr(conn.RemoteAddr()), err.Error())
+					return
+				}
+				continue
+			}
+			if flowHeader.HasHeaderCRC() {
+				if err := ReadN(reader, headerCRCBuffer); err != nil {
+					atomic.AddUint64(&r.counter.Invalid, 1)
+					log.Warningf("TCP client (%s) connection read error.%s", r.agentNames.displayAddr(conn.RemoteAddr()), err.Error())
+					return
+				}
+				headerLen += datatype.HEADER_CRC_LEN
+			}
+			if !r.checkHeaderCRC(flowHeader, baseHeaderBuffer, flowHeaderBuffer, headerCRCBuffer) {
+				r.logHeaderCRCError(ip)
+				r.headerErrors.record(uint32(r.timeNow), ip, newHeaderError(REASON_HEADER_CRC, errHeaderCRC), baseHeaderBuffer, flowHeaderBuffer, headerCRCBuffer)
+				if flowHeader.HasHeaderCRC() {
+					// 包头已损坏, FrameSize不可信, 无法定位下一个消息
+					return
+				}
+				if _, err := reader.Discard(int(baseHeader.FrameSize) - headerLen); err != nil {
+					log.Warningf("TCP client (%s) connection read error: %s", r.agentNames.displayAddr(conn.RemoteAddr()), err.Error())
+					return
+				}
+				continue
+			}
+			headerVersion, headerEncoder, encoder = flowHeader.Version, flowHeader.Encoder, flowHeader.EncoderType()
 
 			vtapID = flowHeader.AgentID
 			orgID, teamID = r.parseOrgIdTeamId(flowHeader)
+			if headerVersion == datatype.OLD_VERSION {
+				r.handleLegacyHeader(ip, vtapID)
+			}
 		}
 
 		dataLen := int(baseHeader.FrameSize) - headerLen
-		if dataLen > RECV_BUFSIZE_MAX {
-			r.logTCPReceiveInvalidData(fmt.Sprintf("TCP client (%s) wrong frame size (%d)", conn.RemoteAddr().String(), baseHeader.FrameSize))
+		if dataLen < 0 || dataLen > RECV_BUFSIZE_MAX {
+			r.logTCPReceiveInvalidData(ip, fmt.Sprintf("TCP client (%s) wrong frame size (%d)", r.agentNames.displayAddr(conn.RemoteAddr()), baseHeader.FrameSize))
+			headerErr := newHeaderError(REASON_FRAME_SIZE, fmt.Errorf("wrong frame size %d", baseHeader.FrameSize))
+			if headerLen > datatype.MESSAGE_HEADER_LEN {
+				r.headerErrors.record(uint32(r.timeNow), ip, headerErr, baseHeaderBuffer, flowHeaderBuffer)
+			} else {
+				r.headerErrors.record(uint32(r.timeNow), ip, headerErr, baseHeaderBuffer)
+			}
 			return
 		}
+		if dataLen == 0 && baseHeader.Type.HeaderType() == datatype.HEADER_TYPE_LT_VTAP {
+			r.handleHeartbeat(baseHeader.Type, vtapID, uint16(orgID), headerVersion, headerEncoder, ip, TCP)
+			continue
+		}
 		recvBuffer, isNew := AcquireRecvBuffer(dataLen, TCP)
 		if isNew {
-			r.counter.NewBufferCount++
+			atomic.AddUint64(&r.counter.NewBufferCount, 1)
 		}
 		if err := ReadN(reader, recvBuffer.Buffer[:dataLen]); err != nil {
 			atomic.AddUint64(&r.counter.Invalid, 1)
 			ReleaseRecvBuffer(recvBuffer)
-			log.Warningf("TCP client (%s) connection read error: %s", conn.RemoteAddr().String(), err.Error())
+			log.Warningf("TCP client (%s) connection read error: %s", r.agentNames.displayAddr(conn.RemoteAddr()), err.Error())
 			return
 		}
 
 		if baseHeader.Type == datatype.MESSAGE_TYPE_METRICS {
-			metricsTimestamp = r.getMetricsTimestamp(recvBuffer.Buffer)
-			r.updateCounter(metricsTimestamp)
+			if encoder == datatype.ENCODER_RAW {
+				metricsTimestamp = r.getMetricsTimestamp(recvBuffer.Buffer)
+				r.updateCounter(metricsTimestamp)
+			} else {
+				metricsTimestamp = uint32(r.timeNow)
+			}
 		}
-		r.status.Update(uint32(r.timeNow), baseHeader.Type, vtapID, uint16(orgID), ip, 0, metricsTimestamp, TCP)
+		status := r.status.Update(uint32(r.timeNow), baseHeader.Type, vtapID, uint16(orgID), headerVersion, headerEncoder, ip, 0, metricsTimestamp, TCP)
 		atomic.AddUint64(&r.counter.RxPackets, 1)
+		rxPackets := atomic.AddUint64(&r.tcpRxPackets, 1)
 
 		// Unregistered messages are discarded directly after receiving them, but the connection is not disconnected to prevent the Agent from printing exception logs
 		if r.handlers[baseHeader.Type] == nil {
@@ -927,12 +1864,22 @@ func (r *Receiver) handleTCPConnection(conn net.Conn) {
 			recvBuffer.VtapID = vtapID
 			recvBuffer.TeamID = teamID
 			recvBuffer.OrgID = orgID
-			r.putTCPQueue(int(r.counter.RxPackets), r.handlers[baseHeader.Type], recvBuffer)
+			recvBuffer.Encoder = encoder
+			recvBuffer.Timestamp = uint32(r.timeNow)
+			recvBuffer.Tenant = r.tenantLabel(status, ip)
+			r.putTCPQueue(int(rxPackets), r.handlers[baseHeader.Type], recvBuffer)
 		}
 	}
 }
 
+// 可以并发调用, 只有第一次调用生效, 之后的调用直接返回
 func (r *Receiver) Start() {
+	if !atomic.CompareAndSwapUint32(&r.started, 0, 1) {
+		log.Warning("receiver is already started")
+		return
+	}
+	r.connLock.Lock()
+	defer r.connLock.Unlock()
 	var err error
 	if r.serverType == UDP || r.serverType == BOTH {
 		if r.UDPConn, err = net.ListenUDP("udp", r.UDPAddress); err != nil {
@@ -940,26 +1887,77 @@ func (r *Receiver) Start() {
 			os.Exit(-1)
 		}
 		r.UDPConn.SetReadBuffer(r.UDPReadBuffer)
-		go r.ProcessUDPServer()
 	}
 	if r.serverType == TCP || r.serverType == BOTH {
 		if r.TCPListener, err = net.Listen("tcp", r.TCPAddress); err != nil {
 			log.Errorf("TCP listen at %s failed: %s", r.TCPAddress, err)
 			os.Exit(-1)
 		}
+	}
+	// 创建期间已经Close时不再启动收包协程, Close可能已经检查过连接, 这里负责关闭
+	if r.exiting() {
+		if r.UDPConn != nil {
+			r.UDPConn.Close()
+		}
+		if r.TCPListener != nil {
+			r.TCPListener.Close()
+		}
+		return
+	}
+	if r.UDPConn != nil {
+		r.stopped.Add(1)
+		go r.ProcessUDPServer()
+	}
+	if r.TCPListener != nil {
+		r.stopped.Add(1)
 		go r.ProcessTCPServer()
 	}
 
 	stats.RegisterCountableWithModulePrefix("ingester_", "recviver", r)
 }
 
+func (r *Receiver) exiting() bool {
+	return atomic.LoadUint32(&r.exit) == 1
+}
+
+// 通知各收包协程退出并等待, 最多等待CLOSE_TIMEOUT
 func (r *Receiver) Close() error {
-	r.exit = true
+	if !atomic.CompareAndSwapUint32(&r.exit, 0, 1) {
+		return nil
+	}
+	// 唤醒阻塞在读和Accept上的协程, 使其检查到exit. 持有connLock时Start已经完成或还未创建连接
+	r.connLock.Lock()
+	if r.UDPConn != nil {
+		r.UDPConn.SetReadDeadline(time.Now())
+	}
+	if r.TCPListener != nil {
+		r.TCPListener.Close()
+	}
+	r.connLock.Unlock()
+	r.tcpConns.closeAll()
+	stopped := make(chan struct{})
+	go func() {
+		r.stopped.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(CLOSE_TIMEOUT):
+		log.Warningf("receiver goroutines did not exit in %s", CLOSE_TIMEOUT)
+	}
+
+	r.stopWatchSessions()
+	r.DisableErrorTap()
+	r.DisableMirror()
+	r.SetStatsdReporter("")
+	if r.agentNames != nil {
+		r.agentNames.close()
+	}
 	log.Info("Stopped receiver")
-	r.closed = true
+	atomic.StoreUint32(&r.closed, 1)
 	return nil
 }
 
 func (r *Receiver) Closed() bool {
-	return r.closed
+	return atomic.LoadUint32(&r.closed) == 1
 }
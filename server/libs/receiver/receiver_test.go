@@ -0,0 +1,799 @@
+/*
+ * Copyright (c) 2024 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package receiver
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/deepflowio/deepflow/server/libs/datatype"
+	"github.com/deepflowio/deepflow/server/libs/queue"
+)
+
+// 只包含literal的LZ4 block: token(literal长度<<4) + literal
+func lz4LiteralPayload(data []byte) []byte {
+	payload := make([]byte, datatype.LZ4_SIZE_LEN, datatype.LZ4_SIZE_LEN+1+len(data))
+	binary.LittleEndian.PutUint32(payload, uint32(len(data)))
+	payload = append(payload, byte(len(data)<<4))
+	return append(payload, data...)
+}
+
+func TestDecompressRecvBuffer(t *testing.T) {
+	r := newTestReceiver()
+	data := []byte("deepflow agent")
+	payload := lz4LiteralPayload(data)
+
+	buf, _ := AcquireRecvBuffer(RECV_BUFSIZE_2K, UDP)
+	buf.Begin = 5
+	buf.End = buf.Begin + copy(buf.Buffer[buf.Begin:], payload)
+	buf.VtapID = 3
+	buf.OrgID = 2
+	buf.Encoder = datatype.ENCODER_LZ4
+	buf.receiver = r // 由r放入队列, 计数记在r上
+	decompressed, err := DecompressRecvBuffer(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decompressed.Buffer[decompressed.Begin:decompressed.End]) != string(data) ||
+		decompressed.VtapID != 3 || decompressed.OrgID != 2 || decompressed.Encoder != datatype.ENCODER_RAW || decompressed.receiver != r {
+		t.Errorf("unexpected decompressed buffer %+v", decompressed)
+	}
+	ReleaseRecvBuffer(decompressed)
+
+	buf, _ = AcquireRecvBuffer(RECV_BUFSIZE_2K, UDP)
+	buf.End = copy(buf.Buffer, payload[:len(payload)-1])
+	buf.Encoder = datatype.ENCODER_LZ4
+	buf.receiver = r
+	if ret, err := DecompressRecvBuffer(buf); err == nil || ret != buf {
+		t.Error("expect error for truncated payload")
+	}
+	ReleaseRecvBuffer(buf)
+
+	raw, _ := AcquireRecvBuffer(RECV_BUFSIZE_2K, UDP)
+	if ret, err := DecompressRecvBuffer(raw); err != nil || ret != raw {
+		t.Error("raw buffer should be returned as is")
+	}
+	ReleaseRecvBuffer(raw)
+
+	counter := r.GetCounter().(*ReceiverCounter)
+	if counter.CompressedBytes != uint64(len(payload)) || counter.DecompressedBytes != uint64(len(data)) || counter.DecompressFailed != 1 {
+		t.Errorf("unexpected decompress counter %+v", counter)
+	}
+}
+
+func TestCheckHeaderCRC(t *testing.T) {
+	r := newTestReceiver()
+	buf := make([]byte, datatype.MESSAGE_HEADER_LEN+datatype.FLOW_HEADER_LEN+datatype.HEADER_CRC_LEN)
+	(&datatype.BaseHeader{FrameSize: uint32(len(buf)), Type: datatype.MESSAGE_TYPE_METRICS}).Encode(buf)
+	flowHeaderBuffer, crcBuffer := buf[datatype.MESSAGE_HEADER_LEN:], buf[datatype.MESSAGE_HEADER_LEN+datatype.FLOW_HEADER_LEN:]
+
+	flowHeader := &datatype.FlowHeader{Version: datatype.LATEST_VERSION, AgentID: 3}
+	flowHeader.Encode(flowHeaderBuffer)
+	if !r.checkHeaderCRC(flowHeader, buf, flowHeaderBuffer, crcBuffer) {
+		t.Error("header without crc should pass when crc is not required")
+	}
+	r.SetHeaderCRCRequired(true)
+	if r.checkHeaderCRC(flowHeader, buf, flowHeaderBuffer, crcBuffer) {
+		t.Error("header without crc should fail when crc is required")
+	}
+
+	flowHeader.Encoder = datatype.ENCODER_FLAG_HEADER_CRC
+	flowHeader.Encode(flowHeaderBuffer)
+	binary.LittleEndian.PutUint32(crcBuffer, datatype.HeaderCRC(buf, flowHeaderBuffer))
+	if !r.checkHeaderCRC(flowHeader, buf, flowHeaderBuffer, crcBuffer) {
+		t.Error("header with valid crc should pass")
+	}
+	if r.checkHeaderCRC(flowHeader, buf, flowHeaderBuffer, crcBuffer[:2]) {
+		t.Error("truncated crc should fail")
+	}
+	buf[datatype.MESSAGE_TYPE_OFFSET] = uint8(datatype.MESSAGE_TYPE_TAGGEDFLOW)
+	if r.checkHeaderCRC(flowHeader, buf, flowHeaderBuffer, crcBuffer) {
+		t.Error("mangled header should fail")
+	}
+}
+
+func encodeUDPHeader(msgType datatype.MessageType, frameSize uint32, encoder uint8) []byte {
+	buf := make([]byte, datatype.MESSAGE_HEADER_LEN+datatype.FLOW_HEADER_LEN)
+	(&datatype.BaseHeader{FrameSize: frameSize, Type: msgType}).Encode(buf)
+	(&datatype.FlowHeader{Version: datatype.LATEST_VERSION, Encoder: encoder, AgentID: 1}).Encode(buf[datatype.MESSAGE_HEADER_LEN:])
+	return buf
+}
+
+func TestDecodeUDPHeaderMalformed(t *testing.T) {
+	r := newTestReceiver()
+	metrics := encodeUDPHeader(datatype.MESSAGE_TYPE_METRICS, 100, 0)
+	compress := encodeUDPHeader(datatype.MESSAGE_TYPE_COMPRESS, 100, 0)
+	cases := []struct {
+		name   string
+		packet []byte
+		valid  bool
+		end    int
+	}{
+		{"truncated base header", metrics[:datatype.MESSAGE_HEADER_LEN-1], false, 0},
+		{"truncated flow header", metrics[:datatype.MESSAGE_HEADER_LEN+datatype.FLOW_HEADER_LEN-1], false, 0},
+		{"crc flag without crc", encodeUDPHeader(datatype.MESSAGE_TYPE_METRICS, 100, datatype.ENCODER_FLAG_HEADER_CRC), false, 0},
+		{"unknown message type", encodeUDPHeader(datatype.MESSAGE_TYPE_MAX, 100, 0), false, 0},
+		{"frame size larger than datagram", compress[:datatype.MESSAGE_HEADER_LEN+2], true, datatype.MESSAGE_HEADER_LEN + 2},
+		{"metrics without payload", metrics, true, len(metrics)},
+	}
+	for _, c := range cases {
+		header := &udpHeader{}
+		err := r.decodeUDPHeader(c.packet, header)
+		if (err == nil) != c.valid {
+			t.Errorf("%s: unexpected error %v", c.name, err)
+			continue
+		}
+		if c.valid && header.end != c.end {
+			t.Errorf("%s: expect end %d, found %d", c.name, c.end, header.end)
+		}
+	}
+}
+
+func FuzzDecodeUDPHeader(f *testing.F) {
+	f.Add(encodeUDPHeader(datatype.MESSAGE_TYPE_METRICS, 100, 0))
+	f.Add(encodeUDPHeader(datatype.MESSAGE_TYPE_METRICS, 100, datatype.ENCODER_FLAG_HEADER_CRC))
+	f.Add(encodeUDPHeader(datatype.MESSAGE_TYPE_COMPRESS, 1000, 0))
+	f.Add(encodeUDPHeader(datatype.MESSAGE_TYPE_SYSLOG, 0, 0))
+
+	r := newTestReceiver()
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		header := &udpHeader{}
+		if err := r.decodeUDPHeader(packet, header); err != nil {
+			return
+		}
+		if header.headerLen > header.end || header.end > len(packet) {
+			t.Errorf("payload [%d, %d) out of packet length %d", header.headerLen, header.end, len(packet))
+		}
+	})
+}
+
+func TestReportRecords(t *testing.T) {
+	r := newTestReceiver()
+	agent1 := &RecvBuffer{VtapID: 1, OrgID: 1, IP: net.ParseIP("10.1.1.1"), receiver: r}
+	agent2 := &RecvBuffer{VtapID: 2, OrgID: 1, IP: net.ParseIP("10.1.1.2"), receiver: r, counterShard: 5} // 不同队列的消息计入不同分片
+	ReportRecords(agent1, 10, false)
+	ReportRecords(agent1, 3, true)
+	ReportRecords(agent2, 2, false)
+	ReportRecords(agent2, 1, false)
+	ReportRecords(agent2, 199, false)
+	ReportRecords(&RecvBuffer{receiver: r}, 201, false)
+	ReportRecords(&RecvBuffer{VtapID: 3, OrgID: 1}, 10, false) // 不是由Receiver放入队列的消息不计数
+	counter := r.GetCounter().(*ReceiverCounter)
+	if counter.RxRecords != 416 || counter.PartialDecode != 1 || counter.AvgRecords != 416.0/6 {
+		t.Errorf("unexpected record counter %+v", counter)
+	}
+	if counter.Records1 != 1 || counter.Records2To10 != 3 || counter.Records11To50 != 0 || counter.Records51To200 != 1 || counter.RecordsOver200 != 1 {
+		t.Errorf("unexpected records histogram %+v", counter)
+	}
+	if counter = r.GetCounter().(*ReceiverCounter); counter.RxRecords != 0 || counter.AvgRecords != 0 || counter.Records2To10 != 0 {
+		t.Errorf("record counter is not reset %+v", counter)
+	}
+
+	// 未携带vtapID的消息不按agent统计
+	report := r.recordsReport()
+	if len(report.Agents) != 2 || report.Agents[0].IP != "10.1.1.1" || report.Agents[0].Buckets != (RecordsHistogram{0, 2, 0, 0, 0}) ||
+		report.Agents[1].Buckets != (RecordsHistogram{1, 1, 0, 1, 0}) {
+		t.Errorf("unexpected agent records %+v", report.Agents)
+	}
+	output := &struct {
+		Result *RecordsReport `json:"result"`
+	}{}
+	if err := json.Unmarshal([]byte(r.HandleSimpleCommand(ADAPTER_CMD_RECORDS, CMD_ARG_JSON)), output); err != nil || len(output.Result.Labels) != RECORDS_BUCKET_MAX {
+		t.Errorf("unexpected records output %+v, %v", output, err)
+	}
+	r.resetCounters(true)
+	if report = r.recordsReport(); len(report.Agents) != 0 {
+		t.Errorf("agent records should be cleared with include-lifetime, %+v", report.Agents)
+	}
+}
+
+// 每个Receiver独立计数, 超过gone阈值未收到数据的agent被清除
+func TestAgentRecordsPerReceiver(t *testing.T) {
+	r, other := newTestReceiver(), newTestReceiver()
+	now := uint32(1700000000)
+	ReportRecords(&RecvBuffer{VtapID: 1, OrgID: 1, Timestamp: now, receiver: r}, 10, false)
+	ReportRecords(&RecvBuffer{VtapID: 2, OrgID: 1, Timestamp: now + AGENT_HEALTH_DEFAULT_GONE, receiver: r}, 10, false)
+	if counter := other.GetCounter().(*ReceiverCounter); counter.RxRecords != 0 || len(other.recordsReport().Agents) != 0 {
+		t.Errorf("records should not be shared between receivers, %+v", counter)
+	}
+
+	r.timeNow = int64(now + AGENT_HEALTH_DEFAULT_GONE - 1)
+	r.expireAgentRecords()
+	if agents := r.recordsReport().Agents; len(agents) != 2 {
+		t.Errorf("agents should be kept before gone threshold, %+v", agents)
+	}
+	r.timeNow++
+	r.expireAgentRecords()
+	if agents := r.recordsReport().Agents; len(agents) != 1 || agents[0].VTAPID != 2 {
+		t.Errorf("gone agent should be expired, %+v", agents)
+	}
+	// 清除后重新收到数据时重新开始统计
+	ReportRecords(&RecvBuffer{VtapID: 1, OrgID: 1, Timestamp: uint32(r.timeNow), receiver: r}, 1, false)
+	if agents := r.recordsReport().Agents; len(agents) != 2 || agents[0].Buckets != (RecordsHistogram{1, 0, 0, 0, 0}) {
+		t.Errorf("unexpected agent records %+v", agents)
+	}
+}
+
+func TestConsumerCounterShards(t *testing.T) {
+	r := newTestReceiver()
+	// 相邻分片的计数字段之间至少间隔一个缓存行
+	first := uintptr(unsafe.Pointer(&r.consumerCounters[0].consumerCounterFields))
+	second := uintptr(unsafe.Pointer(&r.consumerCounters[1].consumerCounterFields))
+	if gap := second - first - unsafe.Sizeof(consumerCounterFields{}); gap < CACHE_LINE_SIZE {
+		t.Errorf("gap between counter shards %d is less than a cache line", gap)
+	}
+
+	r.handlers = make([]*Handler, datatype.MESSAGE_TYPE_MAX)
+	r.RegistHandler(datatype.MESSAGE_TYPE_METRICS, queue.NewOverwriteQueues("test-shards", 4, 16), 4)
+	shards := map[uint8]bool{}
+	for _, shard := range r.handlers[datatype.MESSAGE_TYPE_METRICS].counterShards {
+		shards[shard] = true
+	}
+	if len(shards) != 4 {
+		t.Errorf("each queue should use its own counter shard, %v", r.handlers[datatype.MESSAGE_TYPE_METRICS].counterShards)
+	}
+}
+
+// 多个消费线程同时上报记录数. shared为分片前所有消费线程更新同一份计数, sharded为每个消费线程使用自己的分片
+func BenchmarkReportRecords(b *testing.B) {
+	for _, c := range []struct {
+		name    string
+		sharded bool
+	}{
+		{"shared", false},
+		{"sharded", true},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			r := newTestReceiver()
+			var shard uint32
+			b.RunParallel(func(pb *testing.PB) {
+				buffer := &RecvBuffer{receiver: r}
+				if c.sharded {
+					buffer.counterShard = uint8(atomic.AddUint32(&shard, 1) % COUNTER_SHARDS)
+				}
+				for pb.Next() {
+					ReportRecords(buffer, 10, false)
+				}
+			})
+			r.swapConsumerCounters()
+		})
+	}
+}
+
+func TestDecodeUDPHeaderTruncated(t *testing.T) {
+	r := newTestReceiver()
+	packet := append(encodeUDPHeader(datatype.MESSAGE_TYPE_METRICS, 100, 0), make([]byte, 20)...)
+	header := &udpHeader{}
+	if err := r.decodeUDPHeader(packet, header); err != nil || !header.truncated || header.end != len(packet) {
+		t.Errorf("truncated datagram should be forwarded, header %+v, err %v", header, err)
+	}
+
+	packet = encodeUDPHeader(datatype.MESSAGE_TYPE_METRICS, 0, 0)
+	(&datatype.BaseHeader{FrameSize: uint32(len(packet)), Type: datatype.MESSAGE_TYPE_METRICS}).Encode(packet)
+	if err := r.decodeUDPHeader(packet, header); err != nil || header.truncated {
+		t.Errorf("complete datagram should not be truncated, header %+v, err %v", header, err)
+	}
+}
+
+func TestDecodeUDPHeaderEncoded(t *testing.T) {
+	r := newTestReceiver()
+	r.SetHeaderCRCRequired(true)
+	flowHeader := datatype.FlowHeader{Version: datatype.LATEST_VERSION, Encoder: datatype.ENCODER_FLAG_HEADER_CRC, TeamID: 5, OrgID: 2, AgentID: 7}
+	for _, msgType := range []datatype.MessageType{datatype.MESSAGE_TYPE_COMPRESS, datatype.MESSAGE_TYPE_SYSLOG, datatype.MESSAGE_TYPE_METRICS, datatype.MESSAGE_TYPE_AGENT_LOG} {
+		encoder := &datatype.MessageEncoder{Type: msgType, FlowHeader: flowHeader}
+		encoder.Append([]byte("record1"))
+		encoder.Append([]byte("record2"))
+		packet := encoder.Emit(nil)
+
+		header := &udpHeader{}
+		if err := r.decodeUDPHeader(packet, header); err != nil {
+			t.Errorf("%s: %v", msgType, err)
+			continue
+		}
+		if string(packet[header.headerLen:header.end]) != "record1record2" || header.truncated {
+			t.Errorf("%s: unexpected payload %q, header %+v", msgType, packet[header.headerLen:header.end], header)
+		}
+		if msgType.HeaderType() == datatype.HEADER_TYPE_LT_VTAP && header.flow != flowHeader {
+			t.Errorf("%s: expect flow header %+v, actual %+v", msgType, flowHeader, header.flow)
+		}
+	}
+}
+
+func TestTCPHeartbeat(t *testing.T) {
+	r := newTestReceiver()
+	r.TCPReaderBuffer = RECV_BUFSIZE_2K
+	r.timeNow = 1700000000
+	server, client := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		r.handleTCPConnection(server)
+		close(done)
+	}()
+	heartbeat := encodeUDPHeader(datatype.MESSAGE_TYPE_METRICS, datatype.MESSAGE_HEADER_LEN+datatype.FLOW_HEADER_LEN, 0)
+	for i := 0; i < 2; i++ {
+		client.Write(heartbeat)
+	}
+	client.Close()
+	<-done
+
+	counter := r.GetCounter().(*ReceiverCounter)
+	if counter.RxHeartbeats != 2 || counter.RxPackets != 0 || counter.Invalid != 0 {
+		t.Errorf("unexpected counter %+v", counter)
+	}
+	items := r.status.GetStatusReport(datatype.MESSAGE_TYPE_METRICS).Items
+	if len(items) != 1 || items[0].VTAPID != 1 || items[0].LastLocalTimestamp != uint32(r.timeNow) || items[0].LastDelay != 0 {
+		t.Errorf("heartbeat should update agent status, %+v", items)
+	}
+}
+
+func TestRecvBufferQueue(t *testing.T) {
+	r := newTestReceiver()
+	r.TCPReaderBuffer = RECV_BUFSIZE_2K
+	r.timeNow = 1700000000
+	r.handlers = make([]*Handler, datatype.MESSAGE_TYPE_MAX)
+	released := 0
+	queues := queue.NewOverwriteQueues("test-recv-buffer", 1, 2, queue.OptionRelease(func(p interface{}) {
+		released++
+		ReleaseRecvBuffer(p.(*RecvBuffer))
+	}))
+	r.RegistHandler(datatype.MESSAGE_TYPE_METRICS, queues, 1)
+
+	encoder := &datatype.MessageEncoder{
+		Type:       datatype.MESSAGE_TYPE_METRICS,
+		FlowHeader: datatype.FlowHeader{Version: datatype.LATEST_VERSION, TeamID: 5, OrgID: 2, AgentID: 7},
+	}
+	server, client := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		r.handleTCPConnection(server)
+		close(done)
+	}()
+	for _, record := range []string{"record1", "record2", "record3"} {
+		encoder.Reset()
+		encoder.Append([]byte(record))
+		client.Write(encoder.Emit(nil))
+	}
+	client.Close()
+	<-done
+	// 第一个消息立即放入队列, 之后的消息在缓存超时后flush
+	received := uint32(r.timeNow)
+	r.timeNow += QUEUE_CACHE_FLUSH_TIMEOUT + 1
+	r.flushPutTCPQueues()
+
+	// 队列长度为2, 最早的消息被覆盖并由OptionRelease释放
+	if released != 1 || queues.Len(0) != 2 {
+		t.Fatalf("expect 1 released and 2 queued, actual %d released and %d queued", released, queues.Len(0))
+	}
+	for _, expected := range []string{"record2", "record3"} {
+		buffer := queues.Get(0).(*RecvBuffer)
+		if string(buffer.Payload()) != expected || buffer.VtapID != 7 || buffer.OrgID != 2 || buffer.TeamID != 5 ||
+			buffer.Timestamp != received || buffer.SocketType != TCP {
+			t.Errorf("unexpected buffer %+v, payload %q", buffer, buffer.Payload())
+		}
+		// 消费线程解码完成后负责释放, 归还后来源信息被清除
+		ReleaseRecvBuffer(buffer)
+		if buffer.VtapID != 0 || buffer.OrgID != 0 || buffer.TeamID != 0 || buffer.Timestamp != 0 || len(buffer.Payload()) != 0 {
+			t.Errorf("buffer should be reset after release, %+v", buffer)
+		}
+	}
+}
+
+func TestLegacyHeader(t *testing.T) {
+	r := newTestReceiver()
+	r.timeNow = 1700000000
+	packet := make([]byte, datatype.MESSAGE_HEADER_LEN, datatype.MESSAGE_HEADER_LEN+datatype.FLOW_HEADER_LEN)
+	(&datatype.BaseHeader{FrameSize: datatype.MESSAGE_HEADER_LEN + datatype.FLOW_HEADER_LEN, Type: datatype.MESSAGE_TYPE_METRICS}).Encode(packet)
+	// 旧版本: Version(4B, 20220117) | TeamID(4B) | OrgID(4B) | VTAPID(2B)
+	packet = append(packet, 0xd5, 0x88, 0x34, 0x01, 0, 0, 0, 0, 0, 0, 0, 0, 0x0a, 0x00)
+
+	header := &udpHeader{}
+	if err := r.decodeUDPHeader(packet, header); err != nil || header.flow.Version != datatype.OLD_VERSION || header.flow.AgentID != 10 {
+		t.Errorf("legacy header should be decoded, header %+v, err %v", header.flow, err)
+	}
+	r.SetLegacyHeaderDisabled(true)
+	if err := r.decodeUDPHeader(packet, header); err == nil || err.Reason != REASON_LEGACY_DISABLED {
+		t.Errorf("expect legacy disabled error, found %v", err)
+	}
+
+	ip := net.ParseIP("10.1.1.1")
+	r.handleLegacyHeader(ip, 10)
+	r.timeNow += LEGACY_WARNING_INTERVAL - 1
+	r.handleLegacyHeader(ip, 10)
+	entry := r.legacyLogs.keys[string(ip)].Value.(*logLimitEntry)
+	if entry.suppressed != 1 {
+		t.Errorf("warning should be printed once per interval, suppressed %d", entry.suppressed)
+	}
+	r.timeNow++
+	r.handleLegacyHeader(ip, 10)
+	if entry.suppressed != 0 || entry.lastRefill != r.timeNow {
+		t.Errorf("warning should be printed again after interval, %+v", entry)
+	}
+	if counter := r.GetCounter().(*ReceiverCounter); counter.RxLegacy != 3 {
+		t.Errorf("unexpected legacy counter %d", counter.RxLegacy)
+	}
+}
+
+// 收包协程累加的同时不断获取counter, 获取到的总和必须与累加的次数完全一致
+func TestCounterHarvest(t *testing.T) {
+	const (
+		loops      = 20000
+		tcpWriters = 4
+	)
+	r := newTestReceiver()
+	r.counter = &ReceiverCounter{MaxDelay: -ONE_HOUR, MinDelay: ONE_HOUR}
+	r.timeNow = 100000
+	remoteAddr := &net.UDPAddr{IP: net.ParseIP("10.1.1.1"), Port: 30033}
+
+	wg := sync.WaitGroup{}
+	wg.Add(2 + tcpWriters)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < loops; i++ {
+			r.logReceiveError(0, remoteAddr, nil)
+		}
+	}()
+	for w := 0; w < tcpWriters; w++ {
+		go func() {
+			defer wg.Done()
+			for i := 0; i < loops; i++ {
+				r.handleLegacyHeader(remoteAddr.IP, 1)
+			}
+		}()
+	}
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= loops; i++ {
+			r.updateCounter(uint32(r.timeNow) - uint32(i))
+		}
+	}()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	total := ReceiverCounter{MaxDelay: -ONE_HOUR, MinDelay: ONE_HOUR}
+	add := func(counter *ReceiverCounter) {
+		total.Invalid += counter.Invalid
+		total.RxLegacy += counter.RxLegacy
+		if counter.MaxDelay > total.MaxDelay {
+			total.MaxDelay = counter.MaxDelay
+		}
+		if counter.MinDelay < total.MinDelay {
+			total.MinDelay = counter.MinDelay
+		}
+	}
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		// stats周期和reset-counters命令交替获取
+		add(r.GetCounter().(*ReceiverCounter))
+		add(r.resetCounters(false).Counter)
+	}
+	add(r.GetCounter().(*ReceiverCounter))
+
+	if total.Invalid != loops || total.RxLegacy != loops*tcpWriters {
+		t.Errorf("expect invalid %d legacy %d, actual %d %d", loops, loops*tcpWriters, total.Invalid, total.RxLegacy)
+	}
+	if total.MaxDelay != loops || total.MinDelay != 1 {
+		t.Errorf("expect delay 1 to %d, actual %d to %d", loops, total.MinDelay, total.MaxDelay)
+	}
+}
+
+// 没有流量时Close也要及时返回, 不等待UDP读超时, 并且所有收包协程都已退出
+func TestReceiverClose(t *testing.T) {
+	r := newTestReceiver()
+	r.serverType = BOTH
+	r.UDPAddress = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	r.TCPAddress = "127.0.0.1:0"
+	r.TCPReaderBuffer = RECV_BUFSIZE_2K
+	r.stopped.Add(1)
+	go r.timeNowAndFlushTicker()
+	r.Start()
+
+	// 一个空闲的agent连接
+	client, err := net.Dial("tcp", r.TCPListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		r.tcpConns.Lock()
+		n := len(r.tcpConns.conns)
+		r.tcpConns.Unlock()
+		if n == 1 {
+			break
+		}
+	}
+
+	start := time.Now()
+	r.Close()
+	if elapsed := time.Since(start); elapsed >= CLOSE_TIMEOUT {
+		t.Errorf("close took %s", elapsed)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		r.stopped.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Error("receiver goroutines are still running after close")
+	}
+	if !r.Closed() {
+		t.Error("receiver should be closed")
+	}
+	// 重复Close直接返回
+	r.Close()
+}
+
+// 并发调用Start只创建一组收包协程: 重复的协程不会被Close唤醒, Close会等到超时
+func TestReceiverStartConcurrently(t *testing.T) {
+	r := newTestReceiver()
+	r.serverType = BOTH
+	r.UDPAddress = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	r.TCPAddress = "127.0.0.1:0"
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.Start()
+		}()
+	}
+	wg.Wait()
+	if r.UDPConn == nil || r.TCPListener == nil {
+		t.Fatal("receiver is not started")
+	}
+
+	start := time.Now()
+	r.Close()
+	if elapsed := time.Since(start); elapsed >= CLOSE_TIMEOUT {
+		t.Errorf("close took %s, duplicated goroutines are running", elapsed)
+	}
+}
+
+// Close与Start并发时, Close返回且Start结束后创建的连接都已关闭, 不会遗留收包协程
+func TestReceiverStartCloseConcurrently(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		r := newTestReceiver()
+		r.serverType = BOTH
+		r.UDPAddress = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+		r.TCPAddress = "127.0.0.1:0"
+
+		wg := sync.WaitGroup{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.Start()
+		}()
+		start := time.Now()
+		r.Close()
+		wg.Wait()
+		if elapsed := time.Since(start); elapsed >= CLOSE_TIMEOUT {
+			t.Fatalf("close took %s, receiver goroutines are not woken up", elapsed)
+		}
+		if r.UDPConn != nil && r.UDPConn.SetReadDeadline(time.Now()) == nil {
+			t.Fatal("UDP connection is not closed")
+		}
+		if r.TCPListener != nil && r.TCPListener.(*net.TCPListener).SetDeadline(time.Now()) == nil {
+			t.Fatal("TCP listener is not closed")
+		}
+	}
+}
+
+// 持续有流量时不应在启动时设置的读超时到期后出现超时, 空闲时仍然超时
+func TestUDPReadTimeoutRefresh(t *testing.T) {
+	r := newTestReceiver()
+	r.serverType = UDP
+	r.UDPAddress = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	r.udpReadTimeout = 2 * time.Second
+	r.Start()
+	defer r.Close()
+
+	client, err := net.DialUDP("udp", nil, r.UDPConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// 代替定时器协程检查读超时
+	for end := time.Now().Add(2 * r.udpReadTimeout); time.Now().Before(end); time.Sleep(50 * time.Millisecond) {
+		r.checkUDPTimeout(time.Now().Unix())
+		client.Write([]byte{0})
+	}
+	if timeouts := atomic.LoadUint64(&r.counter.UDPReadTimeout); timeouts != 0 {
+		t.Errorf("expect no read timeout with traffic, actual %d", timeouts)
+	}
+
+	time.Sleep(r.udpReadTimeout + time.Second)
+	if timeouts := atomic.LoadUint64(&r.counter.UDPReadTimeout); timeouts == 0 {
+		t.Error("expect read timeout when idle")
+	}
+}
+
+func TestReadFromUDP(t *testing.T) {
+	for _, ip := range []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback} {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+		if err != nil {
+			t.Logf("skip %s: %s", ip, err)
+			continue
+		}
+		client, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := client.LocalAddr().(*net.UDPAddr)
+
+		addr := &net.UDPAddr{IP: make(net.IP, 0, net.IPv6len)}
+		buffer := make([]byte, 16)
+		for i := 0; i < 2; i++ {
+			client.Write([]byte("deepflow"))
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			size, remoteAddr, err := readFromUDP(conn, buffer, addr)
+			if err != nil || size != 8 || remoteAddr != addr || !remoteAddr.IP.Equal(expected.IP) || remoteAddr.Port != expected.Port {
+				t.Errorf("expect %s, actual %v size %d err %v", expected, remoteAddr, size, err)
+			}
+			// IPv4地址为4字节, 与ReadFromUDP一致
+			if expectedLen := len(expected.IP); len(remoteAddr.IP) != expectedLen {
+				t.Errorf("expect ip length %d, actual %d", expectedLen, len(remoteAddr.IP))
+			}
+		}
+		client.Close()
+		conn.Close()
+	}
+
+	// 复用地址时, 保留的IP需要复制
+	b := &RecvBuffer{}
+	ip := net.IPv4(10, 1, 1, 1).To4()
+	b.setIP(ip)
+	ip[3] = 2
+	if !b.IP.Equal(net.IPv4(10, 1, 1, 1)) {
+		t.Errorf("ip should be copied, actual %s", b.IP)
+	}
+	if b.setIP(nil); b.IP != nil {
+		t.Errorf("expect nil ip, actual %s", b.IP)
+	}
+}
+
+// 收包路径上每个包的内存分配, ReadFromUDP为原来的实现
+func BenchmarkReadFromUDP(b *testing.B) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	client, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer client.Close()
+	packet := make([]byte, 512)
+	buffer := make([]byte, RECV_BUFSIZE_2K)
+
+	b.Run("ReadFromUDP", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			client.Write(packet)
+			if _, _, err := conn.ReadFromUDP(buffer); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("readFromUDP", func(b *testing.B) {
+		b.ReportAllocs()
+		addr := &net.UDPAddr{IP: make(net.IP, 0, net.IPv6len)}
+		for i := 0; i < b.N; i++ {
+			client.Write(packet)
+			if _, _, err := readFromUDP(conn, buffer, addr); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// 与TCP相同, UDP消息按收到的消息数轮流进入各个队列, 不受是否有TCP消息影响
+func TestUDPQueueDispatch(t *testing.T) {
+	r := newTestReceiver()
+	r.serverType = UDP
+	r.UDPAddress = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	r.UDPReadBuffer = 1 << 20
+	r.handlers = make([]*Handler, datatype.MESSAGE_TYPE_MAX)
+	queues := queue.NewOverwriteQueues("test-udp-dispatch", 4, 16)
+	r.RegistHandler(datatype.MESSAGE_TYPE_SYSLOG, queues, 4)
+	r.Start()
+
+	client, err := net.DialUDP("udp", nil, r.UDPConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	encoder := &datatype.MessageEncoder{Type: datatype.MESSAGE_TYPE_SYSLOG}
+	for i := 0; i < 4; i++ {
+		encoder.Reset()
+		encoder.Append([]byte("record"))
+		client.Write(encoder.Emit(nil))
+	}
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadUint64(&r.counter.RxPackets) < 4 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+	}
+	r.Close()
+
+	handler := r.handlers[datatype.MESSAGE_TYPE_SYSLOG]
+	counts := make([]int, handler.nQueues)
+	for i := range counts {
+		counts[i] = len(handler.queueUDPCaches[i].values) + queues.Len(queue.HashKey(i))
+	}
+	if !reflect.DeepEqual(counts, []int{1, 1, 1, 1}) {
+		t.Errorf("expect udp messages spread across queues, actual %v", counts)
+	}
+}
+
+// 短于包头的数据报只计数, 不解析包头, 也不创建agent状态
+func TestUDPRunt(t *testing.T) {
+	r := newTestReceiver()
+	r.serverType = UDP
+	r.UDPAddress = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	r.Start()
+	defer r.Close()
+
+	client, err := net.DialUDP("udp", nil, r.UDPConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte{0})
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadUint64(&r.counter.RxRunts) == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+	}
+
+	counter := r.GetCounter().(*ReceiverCounter)
+	if counter.RxRunts != 1 || counter.Invalid != 0 || counter.RxPackets != 0 {
+		t.Errorf("unexpected counter %+v", counter)
+	}
+	for msgType := datatype.MessageType(0); msgType < datatype.MESSAGE_TYPE_MAX; msgType++ {
+		if items := r.status.GetStatusReport(msgType).Items; len(items) != 0 {
+			t.Errorf("runt should not create agent status, %+v", items)
+		}
+	}
+}
+
+// 限速丢弃的日志不格式化地址和日志内容, 无效数据报不分配内存
+func TestInvalidDatagramLogSuppressed(t *testing.T) {
+	r := newTestReceiver()
+	remoteAddr := &net.UDPAddr{IP: net.IPv4(10, 1, 1, 1).To4(), Port: 30033}
+	r.handleRunt(remoteAddr, []byte{0})
+	r.logReceiveError(1, remoteAddr, errHeaderCRC)
+	if allocs := testing.AllocsPerRun(100, func() {
+		r.handleRunt(remoteAddr, []byte{0})
+		r.logReceiveError(1, remoteAddr, errHeaderCRC)
+	}); allocs != 0 {
+		t.Errorf("suppressed logs should not allocate, actual %.1f allocs", allocs)
+	}
+	if counter := r.GetCounter().(*ReceiverCounter); counter.RxRunts != 102 || counter.Invalid != 102 {
+		t.Errorf("unexpected counter %+v", counter)
+	}
+}
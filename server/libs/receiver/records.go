@@ -0,0 +1,159 @@
+/*
+ * Copyright (c) 2024 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package receiver
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// 每个消息包含的记录数分布区间, 0条记录的消息也计入第一个区间
+const (
+	RECORDS_BUCKET_1 = iota
+	RECORDS_BUCKET_2_10
+	RECORDS_BUCKET_11_50
+	RECORDS_BUCKET_51_200
+	RECORDS_BUCKET_OVER_200
+
+	RECORDS_BUCKET_MAX
+)
+
+var recordsBucketString = [RECORDS_BUCKET_MAX]string{
+	RECORDS_BUCKET_1:        "1",
+	RECORDS_BUCKET_2_10:     "2-10",
+	RECORDS_BUCKET_11_50:    "11-50",
+	RECORDS_BUCKET_51_200:   "51-200",
+	RECORDS_BUCKET_OVER_200: ">200",
+}
+
+func recordsBucket(records int) int {
+	switch {
+	case records <= 1:
+		return RECORDS_BUCKET_1
+	case records <= 10:
+		return RECORDS_BUCKET_2_10
+	case records <= 50:
+		return RECORDS_BUCKET_11_50
+	case records <= 200:
+		return RECORDS_BUCKET_51_200
+	default:
+		return RECORDS_BUCKET_OVER_200
+	}
+}
+
+type RecordsHistogram [RECORDS_BUCKET_MAX]uint64
+
+// 每个agent启动以来的记录数分布, 新agent才需要写map, 之后只做原子加
+type agentRecords struct {
+	vtapID    uint16
+	orgID     uint16
+	ip        net.IP
+	lastSeen  uint32 // 原子操作, 最后一次上报的消息的接收时间(秒)
+	histogram RecordsHistogram
+}
+
+func (r *Receiver) reportAgentRecords(b *RecvBuffer, bucket int) {
+	if b.VtapID == 0 {
+		return
+	}
+	key := uint32(b.OrgID)<<16 | uint32(b.VtapID)
+	value, ok := r.agentRecords.Load(key)
+	if !ok {
+		value, _ = r.agentRecords.LoadOrStore(key, &agentRecords{
+			vtapID: b.VtapID,
+			orgID:  b.OrgID,
+			ip:     append(net.IP(nil), b.IP...),
+		})
+	}
+	records := value.(*agentRecords)
+	if atomic.LoadUint32(&records.lastSeen) != b.Timestamp {
+		atomic.StoreUint32(&records.lastSeen, b.Timestamp)
+	}
+	atomic.AddUint64(&records.histogram[bucket], 1)
+}
+
+func (r *Receiver) resetAgentRecords() {
+	r.agentRecords.Range(func(key, _ interface{}) bool {
+		r.agentRecords.Delete(key)
+		return true
+	})
+}
+
+// 由定时协程与agent健康检查一起调用, 与健康检查使用相同的gone阈值, 清除已下线的agent, 避免map无限增长
+func (r *Receiver) expireAgentRecords() {
+	_, goneAfter := r.agentHealthThresholds()
+	now := uint32(r.timeNow)
+	r.agentRecords.Range(func(key, value interface{}) bool {
+		if lastSeen := atomic.LoadUint32(&value.(*agentRecords).lastSeen); now > lastSeen && now-lastSeen >= goneAfter {
+			r.agentRecords.Delete(key)
+		}
+		return true
+	})
+}
+
+type AgentRecordsItem struct {
+	VTAPID  uint16           `json:"vtap_id"`
+	OrgID   uint16           `json:"org_id"`
+	IP      string           `json:"ip"`
+	Buckets RecordsHistogram `json:"buckets"`
+}
+
+// 各agent每个消息包含的记录数分布, Buckets与Labels一一对应
+type RecordsReport struct {
+	Labels []string            `json:"labels"`
+	Agents []*AgentRecordsItem `json:"agents"`
+}
+
+func (r *Receiver) recordsReport() *RecordsReport {
+	report := &RecordsReport{Labels: recordsBucketString[:]}
+	r.agentRecords.Range(func(_, value interface{}) bool {
+		records := value.(*agentRecords)
+		item := &AgentRecordsItem{VTAPID: records.vtapID, OrgID: records.orgID, IP: records.ip.String()}
+		for i := range item.Buckets {
+			item.Buckets[i] = atomic.LoadUint64(&records.histogram[i])
+		}
+		report.Agents = append(report.Agents, item)
+		return true
+	})
+	sort.Slice(report.Agents, func(i, j int) bool {
+		if report.Agents[i].OrgID != report.Agents[j].OrgID {
+			return report.Agents[i].OrgID < report.Agents[j].OrgID
+		}
+		return report.Agents[i].VTAPID < report.Agents[j].VTAPID
+	})
+	return report
+}
+
+func (r *RecordsReport) String() string {
+	status := fmt.Sprintf("Records per message since start, gone agents are expired\n")
+	status += fmt.Sprintf("%-6s %-5s %-15s", "VTAPID", "OrgID", "IP")
+	for _, label := range r.Labels {
+		status += fmt.Sprintf(" %-10s", label)
+	}
+	status += fmt.Sprintf("\n%s\n", strings.Repeat("-", 28+11*len(r.Labels)))
+	for _, agent := range r.Agents {
+		status += fmt.Sprintf("%-6d %-5d %-15s", agent.VTAPID, agent.OrgID, agent.IP)
+		for _, count := range agent.Buckets {
+			status += fmt.Sprintf(" %-10d", count)
+		}
+		status += "\n"
+	}
+	return status
+}
@@ -0,0 +1,257 @@
+/*
+ * Copyright (c) 2024 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package receiver
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/deepflowio/deepflow/server/libs/queue"
+	"github.com/deepflowio/deepflow/server/libs/stats"
+)
+
+const (
+	STATSD_REPORTER_PREFIX     = "ingester_receiver"
+	STATSD_REPORTER_MAX_PACKET = 1400 // 与stats发送dfstatsd时的包长一致, 避免IP分片
+)
+
+// 一个stats周期的receiver指标
+type statsdSnapshot struct {
+	counter ReceiverCounter
+	pools   BufferPoolStatsList
+	queues  []statsdQueue
+	tenants []statsdTenant
+}
+
+type statsdQueue struct {
+	msgType string
+	index   int
+	pending int
+}
+
+type statsdTenant struct {
+	label     string
+	rxPackets uint64
+}
+
+// 将receiver的指标以statsd协议推送到指定地址, 用于没有拉取指标的环境.
+// 推送的是stats周期获取的同一份counter, 推送和stats上报的数值一致. 每个周期最多缓存一个待发送的快照,
+// 发送协程未完成时丢弃新的快照, 发送失败不重试
+type statsdReporter struct {
+	address  *net.UDPAddr
+	hostname string
+
+	conn      *net.UDPConn
+	snapshots chan *statsdSnapshot
+	stop      chan struct{}
+	stopped   sync.WaitGroup
+
+	failed uint64 // 发送失败的包数和丢弃的快照数, 在下一个stats周期上报
+}
+
+func newStatsdReporter(address string) (*statsdReporter, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	if addr.Port == 0 {
+		return nil, fmt.Errorf("statsd address %s has no port", address)
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &statsdReporter{
+		address:   addr,
+		hostname:  stats.GetHostname(),
+		conn:      conn,
+		snapshots: make(chan *statsdSnapshot, 1),
+		stop:      make(chan struct{}),
+	}
+	s.stopped.Add(1)
+	go s.run()
+	return s, nil
+}
+
+func (s *statsdReporter) close() {
+	close(s.stop)
+	s.stopped.Wait()
+}
+
+// 由stats协程调用, 不阻塞
+func (s *statsdReporter) report(snapshot *statsdSnapshot) {
+	select {
+	case s.snapshots <- snapshot:
+	default:
+		atomic.AddUint64(&s.failed, 1)
+	}
+}
+
+func (s *statsdReporter) run() {
+	defer s.stopped.Done()
+	defer s.conn.Close()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case snapshot := <-s.snapshots:
+			for _, packet := range s.encode(snapshot) {
+				if _, err := s.conn.Write(packet); err != nil {
+					atomic.AddUint64(&s.failed, 1)
+				}
+			}
+		}
+	}
+}
+
+// statsd行协议, 标签使用InfluxDB格式(与stats发送statsd时相同): name,tag=value:1|c
+func (s *statsdReporter) encode(snapshot *statsdSnapshot) [][]byte {
+	lines := []string{}
+	hostTag := ""
+	if s.hostname != "" {
+		hostTag = ",host=" + strings.ReplaceAll(s.hostname, ":", "-")
+	}
+
+	val := reflect.ValueOf(&snapshot.counter).Elem()
+	for i := 0; i < val.NumField(); i++ {
+		opts := strings.Split(val.Type().Field(i).Tag.Get("statsd"), ",")
+		if opts[0] == "" {
+			continue
+		}
+		metricType := "c"
+		if len(opts) > 1 && opts[1] == "gauge" {
+			metricType = "g"
+		}
+		name := STATSD_REPORTER_PREFIX + "." + opts[0] + hostTag
+		switch field := val.Field(i); field.Kind() {
+		case reflect.Uint64:
+			lines = append(lines, statsdLine(name, strconv.FormatUint(field.Uint(), 10), metricType)...)
+		case reflect.Int64:
+			lines = append(lines, statsdLine(name, strconv.FormatInt(field.Int(), 10), metricType)...)
+		case reflect.Float64:
+			lines = append(lines, statsdLine(name, strconv.FormatFloat(field.Float(), 'f', -1, 64), metricType)...)
+		}
+	}
+
+	for _, pool := range snapshot.pools {
+		tags := hostTag + ",buffer_size=" + strconv.Itoa(pool.BufferSize)
+		for _, gauge := range []struct {
+			name  string
+			value uint64
+		}{
+			{"outstanding", pool.Outstanding},
+			{"pooled", pool.Pooled},
+			{"allocated", pool.Allocated},
+			{"high_water_mark", pool.HighWaterMark},
+			{"misses", pool.Misses},
+		} {
+			lines = append(lines, statsdLine(STATSD_REPORTER_PREFIX+"_pool."+gauge.name+tags, strconv.FormatUint(gauge.value, 10), "g")...)
+		}
+	}
+
+	for _, q := range snapshot.queues {
+		name := fmt.Sprintf("%s_queue.pending%s,msg_type=%s,queue=%d", STATSD_REPORTER_PREFIX, hostTag, q.msgType, q.index)
+		lines = append(lines, statsdLine(name, strconv.Itoa(q.pending), "g")...)
+	}
+
+	for _, tenant := range snapshot.tenants {
+		name := fmt.Sprintf("%s_tenant.rx_packets%s,tenant=%s", STATSD_REPORTER_PREFIX, hostTag, statsdTagValue(tenant.label))
+		lines = append(lines, statsdLine(name, strconv.FormatUint(tenant.rxPackets, 10), "c")...)
+	}
+
+	// 多行合并为一个包, 以换行分隔
+	packets := [][]byte{}
+	packet := &bytes.Buffer{}
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > STATSD_REPORTER_MAX_PACKET {
+			packets = append(packets, packet.Bytes())
+			packet = &bytes.Buffer{}
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	if packet.Len() > 0 {
+		packets = append(packets, packet.Bytes())
+	}
+	return packets
+}
+
+// 标签值中的分隔符替换为'-', 与host标签的处理一致
+func statsdTagValue(value string) string {
+	return strings.NewReplacer(":", "-", ",", "-", "=", "-", "|", "-", " ", "-").Replace(value)
+}
+
+// statsd的gauge值带符号时表示增减, 负数需要先置0
+func statsdLine(name, value, metricType string) []string {
+	if metricType == "g" && strings.HasPrefix(value, "-") {
+		return []string{name + ":0|g", name + ":" + value + "|g"}
+	}
+	return []string{name + ":" + value + "|" + metricType}
+}
+
+// 开启向address推送指标, address为空时关闭. 推送周期与stats周期相同
+func (r *Receiver) SetStatsdReporter(address string) error {
+	var reporter *statsdReporter
+	if address != "" {
+		var err error
+		if reporter, err = newStatsdReporter(address); err != nil {
+			return err
+		}
+	}
+	r.statsdLock.Lock()
+	defer r.statsdLock.Unlock()
+	if old := r.loadStatsdReporter(); old != nil {
+		old.close()
+	}
+	r.statsdReporter.Store(reporter)
+	if reporter != nil {
+		log.Infof("receiver statsd reporter enabled, sending to %s", reporter.address)
+	}
+	return nil
+}
+
+func (r *Receiver) loadStatsdReporter() *statsdReporter {
+	reporter, _ := r.statsdReporter.Load().(*statsdReporter)
+	return reporter
+}
+
+// 将stats周期获取的counter交给推送协程
+func (r *Receiver) reportStatsd(counter *ReceiverCounter) {
+	reporter := r.loadStatsdReporter()
+	if reporter == nil {
+		return
+	}
+	counter.StatsdFailed = atomic.SwapUint64(&reporter.failed, 0)
+	snapshot := &statsdSnapshot{counter: *counter, pools: GetBufferPoolStats(), tenants: r.loadTenantTable().swapRxPackets()}
+	for _, handler := range r.handlers {
+		if handler == nil {
+			continue
+		}
+		for i := 0; i < handler.nQueues; i++ {
+			snapshot.queues = append(snapshot.queues, statsdQueue{msgType: handler.msgType.String(), index: i, pending: handler.queues.Len(queue.HashKey(i))})
+		}
+	}
+	reporter.report(snapshot)
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright (c) 2024 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package receiver
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deepflowio/deepflow/server/libs/datatype"
+	"github.com/deepflowio/deepflow/server/libs/queue"
+)
+
+func TestStatsdEncode(t *testing.T) {
+	s := &statsdReporter{hostname: "node:1"}
+	snapshot := &statsdSnapshot{
+		counter: ReceiverCounter{RxPackets: 10, MaxDelay: -3600, MinDelay: 5, AvgRecords: 1.5},
+		pools:   BufferPoolStatsList{{BufferSize: 2048, Outstanding: 3}},
+		queues:  []statsdQueue{{msgType: "metrics", index: 1, pending: 7}},
+		tenants: []statsdTenant{{label: "bu a", rxPackets: 4}},
+	}
+	packets := s.encode(snapshot)
+	lines := []string{}
+	for _, packet := range packets {
+		if len(packet) > STATSD_REPORTER_MAX_PACKET {
+			t.Errorf("packet size %d exceeds %d", len(packet), STATSD_REPORTER_MAX_PACKET)
+		}
+		lines = append(lines, strings.Split(string(packet), "\n")...)
+	}
+	for _, expected := range []string{
+		"ingester_receiver.rx_packets,host=node-1:10|c",
+		"ingester_receiver.invalid,host=node-1:0|c",
+		"ingester_receiver.max_delay,host=node-1:0|g",
+		"ingester_receiver.max_delay,host=node-1:-3600|g",
+		"ingester_receiver.min_delay,host=node-1:5|g",
+		"ingester_receiver.avg_records,host=node-1:1.5|g",
+		"ingester_receiver_pool.outstanding,host=node-1,buffer_size=2048:3|g",
+		"ingester_receiver_queue.pending,host=node-1,msg_type=metrics,queue=1:7|g",
+		"ingester_receiver_tenant.rx_packets,host=node-1,tenant=bu-a:4|c",
+	} {
+		found := false
+		for _, line := range lines {
+			if line == expected {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("line %q not found in %v", expected, lines)
+		}
+	}
+}
+
+func TestStatsdReporter(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	r := newTestReceiver()
+	r.UDPAddress = &net.UDPAddr{Port: DEFAULT_LISTEN_PORT}
+	r.counter = &ReceiverCounter{}
+	r.handlers = make([]*Handler, datatype.MESSAGE_TYPE_MAX)
+	r.RegistHandler(datatype.MESSAGE_TYPE_METRICS, queue.NewOverwriteQueues("test-statsd", 1, 4), 1)
+	if err := r.SetStatsdReporter(conn.LocalAddr().String()); err != nil {
+		t.Fatal(err)
+	}
+	defer r.SetStatsdReporter("")
+
+	// 推送的是stats获取的同一份counter
+	r.counter.RxPackets = 42
+	counter := r.GetCounter().(*ReceiverCounter)
+	if counter.RxPackets != 42 {
+		t.Fatalf("unexpected counter %+v", counter)
+	}
+	buffer := make([]byte, 2*STATSD_REPORTER_MAX_PACKET)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	received := ""
+	for !strings.Contains(received, "ingester_receiver_queue.pending") {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			t.Fatalf("read failed: %v, received %s", err, received)
+		}
+		received += string(buffer[:n]) + "\n"
+	}
+	if !strings.Contains(received, "ingester_receiver.rx_packets:42|c") {
+		t.Errorf("rx_packets not found in %s", received)
+	}
+	if r.effectiveConfig().StatsdAddress != conn.LocalAddr().String() {
+		t.Errorf("unexpected config %+v", r.effectiveConfig())
+	}
+
+	r.SetStatsdReporter("")
+	if r.loadStatsdReporter() != nil {
+		t.Error("reporter should be disabled")
+	}
+	if err := r.SetStatsdReporter("127.0.0.1"); err == nil {
+		t.Error("expect error for address without port")
+	}
+}
@@ -0,0 +1,305 @@
+/*
+ * Copyright (c) 2024 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package receiver
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/deepflowio/deepflow/server/libs/datatype"
+)
+
+type tenantRule struct {
+	rxPackets uint64 // 上个stats周期以来匹配的消息个数, 推送statsd时清零
+	network   *net.IPNet
+	ones      int
+	label     string
+}
+
+// agent IP网段到租户标签的映射表, 按最长前缀匹配. 加载后规则不再修改, 重新加载时整体替换.
+// 匹配结果缓存在agent的Status上, 随agent状态一起过期, 表替换后重新匹配
+type tenantTable struct {
+	rules    []tenantRule // 按前缀长度从长到短排序
+	loadTime uint32
+
+	unmatched uint64 // 加载以来未匹配任何规则的消息个数
+}
+
+// Status上缓存的匹配结果, rule为nil表示未匹配
+type statusTenant struct {
+	table *tenantTable
+	ip    net.IP
+	rule  *tenantRule
+}
+
+// 网段也可以是单个IP
+func parseIPNet(value string) (*net.IPNet, error) {
+	if !strings.Contains(value, "/") {
+		if ip := net.ParseIP(value); ip != nil {
+			if ip.To4() != nil {
+				value += "/32"
+			} else {
+				value += "/128"
+			}
+		}
+	}
+	_, network, err := net.ParseCIDR(value)
+	return network, err
+}
+
+// 规则格式为"网段=标签", 如"10.1.0.0/16=bu-a", 网段也可以是单个IP
+func parseTenantRule(rule string) (tenantRule, error) {
+	i := strings.LastIndexByte(rule, '=')
+	if i <= 0 || i == len(rule)-1 {
+		return tenantRule{}, fmt.Errorf("invalid tenant rule %q, expect PREFIX=LABEL", rule)
+	}
+	network, err := parseIPNet(rule[:i])
+	if err != nil {
+		return tenantRule{}, fmt.Errorf("invalid tenant rule %q: %s", rule, err)
+	}
+	ones, bits := network.Mask.Size()
+	// IPv4的规则同时匹配IPv4-mapped IPv6地址, 统一按IPv6的前缀长度排序
+	if bits == 8*net.IPv4len {
+		ones += 8 * (net.IPv6len - net.IPv4len)
+	}
+	return tenantRule{network: network, ones: ones, label: rule[i+1:]}, nil
+}
+
+func newTenantTable(rules []string, now uint32) (*tenantTable, error) {
+	t := &tenantTable{
+		rules:    make([]tenantRule, 0, len(rules)),
+		loadTime: now,
+	}
+	prefixes := make(map[string]string, len(rules))
+	for _, rule := range rules {
+		parsed, err := parseTenantRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		prefix := parsed.network.String()
+		if label, ok := prefixes[prefix]; ok {
+			return nil, fmt.Errorf("duplicate tenant prefix %s with labels %s and %s", prefix, label, parsed.label)
+		}
+		prefixes[prefix] = parsed.label
+		t.rules = append(t.rules, parsed)
+	}
+	sort.SliceStable(t.rules, func(i, j int) bool {
+		return t.rules[i].ones > t.rules[j].ones
+	})
+	return t, nil
+}
+
+// 返回ip匹配的最长前缀规则, 未匹配时为nil
+func (t *tenantTable) match(ip net.IP) *tenantRule {
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return nil
+	}
+	for i := range t.rules {
+		if t.rules[i].network.Contains(ip16) {
+			return &t.rules[i]
+		}
+	}
+	return nil
+}
+
+// 返回ip所属的租户标签, 未匹配时为空
+func (t *tenantTable) lookup(ip net.IP) string {
+	if rule := t.match(ip); rule != nil {
+		return rule.label
+	}
+	return ""
+}
+
+// 同一agent只在首次收到消息, 租户表替换或ip变化时匹配一次
+func (s *Status) tenantRule(table *tenantTable, ip net.IP) *tenantRule {
+	if cached, _ := s.tenant.Load().(*statusTenant); cached != nil && cached.table == table && cached.ip.Equal(ip) {
+		return cached.rule
+	}
+	rule := table.match(ip)
+	s.tenant.Store(&statusTenant{table: table, ip: append(net.IP(nil), ip...), rule: rule})
+	return rule
+}
+
+// 最后一次收到的消息所属的租户, 未配置规则或未匹配时为空
+func (s *Status) tenantLabel() string {
+	if cached, _ := s.tenant.Load().(*statusTenant); cached != nil && cached.rule != nil {
+		return cached.rule.label
+	}
+	return ""
+}
+
+// 返回规则的文本形式, 与配置的格式一致
+func (t *tenantTable) ruleStrings() []string {
+	rules := make([]string, 0, len(t.rules))
+	for _, rule := range t.rules {
+		rules = append(rules, rule.network.String()+"="+rule.label)
+	}
+	return rules
+}
+
+// 替换租户映射表, rules为空时不再标记租户. 接收线程读取的始终是完整的新表或旧表
+func (r *Receiver) SetTenantRules(rules []string) error {
+	if len(rules) == 0 {
+		r.tenants.Store((*tenantTable)(nil))
+		log.Info("receiver tenant rules cleared")
+		return nil
+	}
+	table, err := newTenantTable(rules, uint32(time.Now().Unix()))
+	if err != nil {
+		return err
+	}
+	r.tenants.Store(table)
+	log.Infof("receiver tenant rules loaded: %s", strings.Join(table.ruleStrings(), ","))
+	return nil
+}
+
+func (r *Receiver) loadTenantTable() *tenantTable {
+	table, _ := r.tenants.Load().(*tenantTable)
+	return table
+}
+
+// status为发送方agent的状态, 未配置规则时不计数未匹配的消息
+func (r *Receiver) tenantLabel(status *Status, ip net.IP) string {
+	table := r.loadTenantTable()
+	if table == nil {
+		return ""
+	}
+	rule := status.tenantRule(table, ip)
+	if rule == nil {
+		atomic.AddUint64(&table.unmatched, 1)
+		atomic.AddUint64(&r.counter.TenantUnmatched, 1)
+		return ""
+	}
+	atomic.AddUint64(&rule.rxPackets, 1)
+	return rule.label
+}
+
+// 各租户上个stats周期以来的消息个数, 同一标签的多条规则合并计数
+func (t *tenantTable) swapRxPackets() []statsdTenant {
+	if t == nil {
+		return nil
+	}
+	tenants := []statsdTenant{}
+	index := make(map[string]int, len(t.rules))
+	for i := range t.rules {
+		rxPackets := atomic.SwapUint64(&t.rules[i].rxPackets, 0)
+		label := t.rules[i].label
+		if j, ok := index[label]; ok {
+			tenants[j].rxPackets += rxPackets
+			continue
+		}
+		index[label] = len(tenants)
+		tenants = append(tenants, statsdTenant{label: label, rxPackets: rxPackets})
+	}
+	return tenants
+}
+
+type TenantAgent struct {
+	IP    string `json:"ip"`
+	Label string `json:"label,omitempty"` // 为空表示未匹配任何规则
+}
+
+type TenantReport struct {
+	Rules     []string       `json:"rules"`
+	LoadTime  uint32         `json:"load_time,omitempty"`
+	Unmatched uint64         `json:"unmatched"` // 加载以来未匹配任何规则的消息个数
+	Agents    []*TenantAgent `json:"agents"`    // 状态未过期的agent及其租户
+}
+
+// agents为状态未过期的agent IP
+func (t *tenantTable) report(agents []net.IP) *TenantReport {
+	report := &TenantReport{Rules: []string{}, Agents: []*TenantAgent{}}
+	if t == nil {
+		return report
+	}
+	report.Rules = t.ruleStrings()
+	report.LoadTime = t.loadTime
+	report.Unmatched = atomic.LoadUint64(&t.unmatched)
+	for _, ip := range agents {
+		report.Agents = append(report.Agents, &TenantAgent{IP: ip.String(), Label: t.lookup(ip)})
+	}
+	sort.Slice(report.Agents, func(i, j int) bool {
+		return report.Agents[i].IP < report.Agents[j].IP
+	})
+	return report
+}
+
+func (r *TenantReport) String() string {
+	if len(r.Rules) == 0 {
+		return "No tenant rules configured\n"
+	}
+	status := fmt.Sprintf("Tenant rules loaded at %s, %d unmatched messages since loaded:\n", time.Unix(int64(r.LoadTime), 0), r.Unmatched)
+	for _, rule := range r.Rules {
+		status += fmt.Sprintf("    %s\n", rule)
+	}
+	status += fmt.Sprintf("AgentIP                                  Label\n")
+	status += fmt.Sprintf("------------------------------------------------------\n")
+	for _, agent := range r.Agents {
+		label := agent.Label
+		if label == "" {
+			label = "-"
+		}
+		status += fmt.Sprintf("%-40s %s\n", agent.IP, label)
+	}
+	return status
+}
+
+func (r *Receiver) handleTenantCommand(args *commandArgs) fmt.Stringer {
+	if args.tenantReload {
+		if err := r.SetTenantRules(args.tenantRules); err != nil {
+			return commandError(fmt.Sprintf("reload tenant rules failed: %s", err))
+		}
+	}
+	return r.loadTenantTable().report(r.status.agentIPs())
+}
+
+// 所有消息类型中出现过的agent IP, 每个IP只返回一次
+func (s *AdapterStatus) agentIPs() []net.IP {
+	ips := []net.IP{}
+	seen := make(map[string]bool)
+	add := func(status *Status) {
+		if key := status.ip.String(); !seen[key] {
+			seen[key] = true
+			ips = append(ips, status.ip)
+		}
+	}
+	for i := 0; i < int(datatype.MESSAGE_TYPE_MAX); i++ {
+		s.UDPStatusLocks[i].Lock()
+		for _, status := range s.UDPStatusFlow[i] {
+			add(status)
+		}
+		for _, status := range s.UDPStatusOthers[i] {
+			add(status)
+		}
+		s.UDPStatusLocks[i].Unlock()
+
+		s.TCPStatusLocks[i].RLock()
+		for _, status := range s.TCPStatusFlow[i] {
+			add(status)
+		}
+		for _, status := range s.TCPStatusOthers[i] {
+			add(status)
+		}
+		s.TCPStatusLocks[i].RUnlock()
+	}
+	return ips
+}
@@ -0,0 +1,154 @@
+/*
+ * Copyright (c) 2024 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package receiver
+
+import (
+	"encoding/json"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/deepflowio/deepflow/server/libs/datatype"
+)
+
+func TestTenantTableLookup(t *testing.T) {
+	table, err := newTenantTable([]string{"10.0.0.0/8=bu-a", "10.1.0.0/16=bu-b", "10.1.2.3=bu-c", "fd00::/8=bu-v6", "::/0=other-v6"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		ip       string
+		expected string
+	}{
+		{"10.2.0.1", "bu-a"},
+		{"10.1.0.1", "bu-b"},
+		{"10.1.2.3", "bu-c"},
+		{"::ffff:10.1.0.1", "bu-b"}, // IPv4-mapped地址匹配IPv4的规则
+		{"fd00::1", "bu-v6"},
+		{"fe80::1", "other-v6"},
+		{"192.168.0.1", ""},
+		{"", ""},
+	} {
+		if label := table.lookup(net.ParseIP(c.ip)); label != c.expected {
+			t.Errorf("%s: expect %q, actual %q", c.ip, c.expected, label)
+		}
+	}
+}
+
+func TestTenantTableInvalid(t *testing.T) {
+	for _, rules := range [][]string{
+		{"10.0.0.0/8"},
+		{"10.0.0.0/8="},
+		{"=bu-a"},
+		{"10.0.0.0/33=bu-a"},
+		{"bu-a=10.0.0.0/8"},
+		{"10.0.0.0/8=bu-a", "10.0.0.0/8=bu-b"},
+		{"10.0.0.1/8=bu-a", "10.0.0.0/8=bu-b"}, // 主机位不为0时与网段相同
+	} {
+		if _, err := newTenantTable(rules, 0); err == nil {
+			t.Errorf("%v: expect error", rules)
+		}
+	}
+}
+
+// 模拟收到agent的消息, 返回消息的租户标签
+func receiveTenantMessage(r *Receiver, vtapID uint16, ip string) string {
+	now := uint32(time.Now().Unix())
+	status := r.status.Update(now, datatype.MESSAGE_TYPE_METRICS, vtapID, 1, datatype.LATEST_VERSION, datatype.ENCODER_RAW, net.ParseIP(ip), 0, now, UDP)
+	return r.tenantLabel(status, net.ParseIP(ip))
+}
+
+func TestTenantCommand(t *testing.T) {
+	r := newTestReceiver()
+	r.counter = &ReceiverCounter{}
+	r.tenants.Store((*tenantTable)(nil))
+	if label := receiveTenantMessage(r, 1, "10.1.0.1"); label != "" || r.counter.TenantUnmatched != 0 {
+		t.Errorf("no tenant should be labeled without rules, actual %q, unmatched %d", label, r.counter.TenantUnmatched)
+	}
+
+	result := r.HandleSimpleCommand(ADAPTER_CMD_TENANTS, "reload rule=10.0.0.0/8=bu-a rule=10.1.0.0/16=bu-b")
+	if result == "" {
+		t.Fatal("empty result")
+	}
+	for i, ip := range []string{"10.1.0.1", "10.2.0.1", "192.168.0.1", "192.168.0.1"} {
+		receiveTenantMessage(r, uint16(i+1), ip)
+	}
+	if r.counter.TenantUnmatched != 2 {
+		t.Errorf("expect 2 unmatched, actual %d", r.counter.TenantUnmatched)
+	}
+
+	output := &struct {
+		Result *TenantReport `json:"result"`
+	}{}
+	if err := json.Unmarshal([]byte(r.HandleSimpleCommand(ADAPTER_CMD_TENANTS, CMD_ARG_JSON)), output); err != nil {
+		t.Fatal(err)
+	}
+	expected := []*TenantAgent{{"10.1.0.1", "bu-b"}, {"10.2.0.1", "bu-a"}, {"192.168.0.1", ""}}
+	if !reflect.DeepEqual(output.Result.Rules, []string{"10.1.0.0/16=bu-b", "10.0.0.0/8=bu-a"}) ||
+		output.Result.Unmatched != 2 || !reflect.DeepEqual(output.Result.Agents, expected) {
+		t.Errorf("unexpected report %+v", output.Result)
+	}
+
+	// 无效的规则不影响正在使用的表
+	failed := &CommandOutput{}
+	if err := json.Unmarshal([]byte(r.HandleSimpleCommand(ADAPTER_CMD_TENANTS, "json reload rule=10.0.0.0/8")), failed); err != nil || failed.Error == "" {
+		t.Errorf("expect error for invalid rule, actual %+v, err %v", failed, err)
+	}
+	if label := receiveTenantMessage(r, 2, "10.2.0.1"); label != "bu-a" {
+		t.Errorf("rules should be kept after a failed reload, actual %q", label)
+	}
+
+	// 不带规则的reload清除所有规则
+	r.HandleSimpleCommand(ADAPTER_CMD_TENANTS, "reload")
+	if label := receiveTenantMessage(r, 2, "10.2.0.1"); label != "" || r.loadTenantTable() != nil {
+		t.Errorf("rules should be cleared, actual %q", label)
+	}
+}
+
+func TestTenantCachedOnStatus(t *testing.T) {
+	r := newTestReceiver()
+	r.tenants.Store((*tenantTable)(nil))
+	r.SetTenantRules([]string{"10.0.0.0/8=bu-a"})
+	for i := 0; i < 3; i++ {
+		if label := receiveTenantMessage(r, 1, "10.1.0.1"); label != "bu-a" {
+			t.Fatalf("expect bu-a, actual %q", label)
+		}
+	}
+	status := r.status.UDPStatusFlow[datatype.MESSAGE_TYPE_METRICS][1]
+	if item := newStatusItem(status, 0, nil); item.Tenant != "bu-a" {
+		t.Errorf("status should carry tenant bu-a, actual %q", item.Tenant)
+	}
+
+	// agent IP变化和租户表替换后重新匹配
+	if label := receiveTenantMessage(r, 1, "192.168.0.1"); label != "" {
+		t.Errorf("expect no tenant after ip changed, actual %q", label)
+	}
+	r.SetTenantRules([]string{"192.168.0.0/16=bu-b"})
+	if label := receiveTenantMessage(r, 1, "192.168.0.1"); label != "bu-b" || status.tenantLabel() != "bu-b" {
+		t.Errorf("expect bu-b after reload, actual %q", label)
+	}
+
+	// 计数按标签上报statsd, 上报后清零
+	tenants := r.loadTenantTable().swapRxPackets()
+	if !reflect.DeepEqual(tenants, []statsdTenant{{label: "bu-b", rxPackets: 1}}) {
+		t.Errorf("unexpected tenant packets %+v", tenants)
+	}
+	if tenants := r.loadTenantTable().swapRxPackets(); tenants[0].rxPackets != 0 {
+		t.Errorf("tenant packets should be cleared, actual %+v", tenants)
+	}
+}
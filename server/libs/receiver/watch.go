@@ -0,0 +1,441 @@
+/*
+ * Copyright (c) 2024 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package receiver
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/deepflowio/deepflow/server/libs/datatype"
+	"github.com/deepflowio/deepflow/server/libs/debug"
+)
+
+// watch命令需要持续推送数据, 无法使用简单命令接口, 使用单独的模块号, 与ingesterctl.INGESTERCTL_ADAPTER一致
+const TRIDENT_ADAPTER_WATCH_CMD = 0
+
+const (
+	WATCH_CMD_START = iota
+	WATCH_CMD_KEEPALIVE
+	WATCH_CMD_STOP
+)
+
+const (
+	WATCH_MAX_SESSIONS       = 4
+	WATCH_MIN_INTERVAL       = 100 * time.Millisecond
+	WATCH_DEFAULT_INTERVAL   = time.Second
+	WATCH_DEFAULT_COUNT      = 10
+	WATCH_TOP_N              = 10
+	WATCH_KEEPALIVE_INTERVAL = time.Second
+	WATCH_CLIENT_TIMEOUT     = 5 * WATCH_KEEPALIVE_INTERVAL // 超过该时间未收到客户端的keepalive, 认为客户端已断开
+)
+
+type watchRequest struct {
+	Interval time.Duration
+	Count    int // 为0时一直推送, 直到客户端断开
+	JSON     bool
+}
+
+// 服务端推送给客户端的消息, 第一条消息为应答
+type watchMessage struct {
+	Error string
+	Text  string
+	Done  bool
+}
+
+type watchKey struct {
+	msgType    datatype.MessageType
+	serverType ServerType
+	vtapID     uint16
+	ip         string
+}
+
+type watchPackets map[watchKey]uint64
+
+// 某个agent在一个周期内的消息数增量
+type WatchAgentDelta struct {
+	MsgType   string `json:"msg_type"`
+	VTAPID    uint16 `json:"vtap_id,omitempty"`
+	TridentIP string `json:"trident_ip"`
+	Type      string `json:"type"`
+	RxPackets uint64 `json:"rx_packets"`
+	Total     uint64 `json:"total"`
+}
+
+type WatchDelta struct {
+	Sequence     int                `json:"sequence"`
+	Timestamp    int64              `json:"timestamp"`
+	RxPackets    uint64             `json:"rx_packets"` // 本周期所有agent的消息数之和
+	ActiveAgents int                `json:"active_agents"`
+	TotalAgents  int                `json:"total_agents"`
+	Top          []*WatchAgentDelta `json:"top"` // 增量最大的前WATCH_TOP_N个agent
+}
+
+func (d *WatchDelta) String() string {
+	status := fmt.Sprintf("#%d %s rx_packets %d active_agents %d/%d\n",
+		d.Sequence, time.Unix(d.Timestamp, 0).Format("2006-01-02 15:04:05"), d.RxPackets, d.ActiveAgents, d.TotalAgents)
+	status += fmt.Sprintf("MsgType VTAPID TridentIP                                Type RxPackets  Total\n")
+	status += fmt.Sprintf("----------------------------------------------------------------------------------\n")
+	for _, agent := range d.Top {
+		status += fmt.Sprintf("%-7s %-6d %-40s %-4s %-10d %d\n",
+			agent.MsgType, agent.VTAPID, agent.TridentIP, agent.Type, agent.RxPackets, agent.Total)
+	}
+	return status
+}
+
+func (s *AdapterStatus) packetSnapshot() watchPackets {
+	packets := make(watchPackets)
+	add := func(status *Status) {
+		key := watchKey{status.msgType, status.serverType, status.VTAPID, status.ip.String()}
+		packets[key] = atomic.LoadUint64(&status.rxPackets)
+	}
+	for i := 0; i < int(datatype.MESSAGE_TYPE_MAX); i++ {
+		s.UDPStatusLocks[i].Lock()
+		for _, status := range s.UDPStatusFlow[i] {
+			add(status)
+		}
+		for _, status := range s.UDPStatusOthers[i] {
+			add(status)
+		}
+		s.UDPStatusLocks[i].Unlock()
+
+		s.TCPStatusLocks[i].RLock()
+		for _, status := range s.TCPStatusFlow[i] {
+			add(status)
+		}
+		for _, status := range s.TCPStatusOthers[i] {
+			add(status)
+		}
+		s.TCPStatusLocks[i].RUnlock()
+	}
+	return packets
+}
+
+// agent状态被reset后计数会重新开始, 此时以当前值作为增量
+func newWatchDelta(sequence int, now int64, last, current watchPackets) *WatchDelta {
+	delta := &WatchDelta{Sequence: sequence, Timestamp: now, TotalAgents: len(current)}
+	agents := make([]*WatchAgentDelta, 0, len(current))
+	for key, total := range current {
+		rxPackets := total
+		if lastTotal, ok := last[key]; ok && lastTotal <= total {
+			rxPackets = total - lastTotal
+		}
+		if rxPackets == 0 {
+			continue
+		}
+		delta.RxPackets += rxPackets
+		delta.ActiveAgents++
+		agents = append(agents, &WatchAgentDelta{
+			MsgType:   datatype.MessageTypeString[int(key.msgType)],
+			VTAPID:    key.vtapID,
+			TridentIP: key.ip,
+			Type:      key.serverType.String(),
+			RxPackets: rxPackets,
+			Total:     total,
+		})
+	}
+	sort.Slice(agents, func(i, j int) bool {
+		if agents[i].RxPackets != agents[j].RxPackets {
+			return agents[i].RxPackets > agents[j].RxPackets
+		}
+		return agents[i].TridentIP < agents[j].TridentIP
+	})
+	if len(agents) > WATCH_TOP_N {
+		agents = agents[:WATCH_TOP_N]
+	}
+	delta.Top = agents
+	return delta
+}
+
+type watchSession struct {
+	key       string
+	request   *watchRequest
+	lastAlive int64 // 最后一次收到客户端keepalive的时间, UnixNano
+	stop      chan struct{}
+	stopOnce  sync.Once
+}
+
+func (s *watchSession) keepalive() {
+	atomic.StoreInt64(&s.lastAlive, time.Now().UnixNano())
+}
+
+func (s *watchSession) isAlive() bool {
+	return time.Now().UnixNano()-atomic.LoadInt64(&s.lastAlive) < int64(WATCH_CLIENT_TIMEOUT)
+}
+
+func (s *watchSession) close() {
+	s.stopOnce.Do(func() { close(s.stop) })
+}
+
+type watchManager struct {
+	sync.Mutex
+	sessions map[string]*watchSession // 以客户端地址为key
+	closed   bool                     // Receiver关闭后不再接受新的会话
+	running  sync.WaitGroup           // 推送协程, 只在未关闭时持有锁增加
+}
+
+func (r *Receiver) addWatchSession(key string, request *watchRequest) (*watchSession, error) {
+	if request.Interval < WATCH_MIN_INTERVAL {
+		return nil, fmt.Errorf("interval %s is less than %s", request.Interval, WATCH_MIN_INTERVAL)
+	}
+	r.watches.Lock()
+	defer r.watches.Unlock()
+	if r.watches.closed {
+		return nil, errors.New("receiver is closed")
+	}
+	if r.watches.sessions == nil {
+		r.watches.sessions = make(map[string]*watchSession)
+	}
+	if _, ok := r.watches.sessions[key]; ok {
+		return nil, fmt.Errorf("watch session from %s already exists", key)
+	}
+	if len(r.watches.sessions) >= WATCH_MAX_SESSIONS {
+		return nil, fmt.Errorf("too many watch sessions, at most %d", WATCH_MAX_SESSIONS)
+	}
+	session := &watchSession{key: key, request: request, stop: make(chan struct{})}
+	session.keepalive()
+	r.watches.sessions[key] = session
+	return session, nil
+}
+
+func (r *Receiver) getWatchSession(key string) *watchSession {
+	r.watches.Lock()
+	defer r.watches.Unlock()
+	return r.watches.sessions[key]
+}
+
+func (r *Receiver) removeWatchSession(session *watchSession) {
+	r.watches.Lock()
+	if r.watches.sessions[session.key] == session {
+		delete(r.watches.sessions, session.key)
+	}
+	r.watches.Unlock()
+	session.close()
+}
+
+// 在新的协程中运行会话, Receiver关闭时由stopWatchSessions等待其退出
+func (r *Receiver) goWatchSession(session *watchSession, send func(*watchMessage) error) {
+	r.watches.Lock()
+	defer r.watches.Unlock()
+	if r.watches.closed { // 会话已被stopWatchSessions停止
+		return
+	}
+	r.watches.running.Add(1)
+	go func() {
+		defer r.watches.running.Done()
+		r.runWatchSession(session, send)
+	}()
+}
+
+// Receiver关闭时停止所有会话, 并等待推送协程退出
+func (r *Receiver) stopWatchSessions() {
+	r.watches.Lock()
+	r.watches.closed = true
+	for key, session := range r.watches.sessions {
+		delete(r.watches.sessions, key)
+		session.close()
+	}
+	r.watches.Unlock()
+	r.watches.running.Wait()
+}
+
+// 每个周期推送一次增量, 直到达到次数、客户端停止或断开
+func (r *Receiver) runWatchSession(session *watchSession, send func(*watchMessage) error) {
+	defer r.removeWatchSession(session)
+	ticker := time.NewTicker(session.request.Interval)
+	defer ticker.Stop()
+
+	last := r.status.packetSnapshot()
+	for sequence := 1; session.request.Count <= 0 || sequence <= session.request.Count; sequence++ {
+		select {
+		case <-session.stop:
+			if r.exiting() { // 通知客户端退出, 不必等待超时
+				send(&watchMessage{Error: "receiver closed", Done: true})
+			}
+			return
+		case <-ticker.C:
+		}
+		if !session.isAlive() {
+			log.Infof("watch session from %s stopped, client keepalive timeout", session.key)
+			return
+		}
+		current := r.status.packetSnapshot()
+		delta := newWatchDelta(sequence, time.Now().Unix(), last, current)
+		last = current
+
+		message := &watchMessage{Done: sequence == session.request.Count}
+		if session.request.JSON {
+			message.Text = marshalCommandOutput(ADAPTER_CMD_WATCH, delta)
+		} else {
+			message.Text = delta.String()
+		}
+		if err := send(message); err != nil {
+			log.Infof("watch session from %s stopped, send failed: %s", session.key, err)
+			return
+		}
+	}
+}
+
+func sendWatchMessage(conn *net.UDPConn, remote *net.UDPAddr, message *watchMessage) error {
+	buffer := bytes.Buffer{}
+	if err := gob.NewEncoder(&buffer).Encode(message); err != nil {
+		return err
+	}
+	return debug.SendToClient(conn, remote, 0, &buffer)
+}
+
+func (r *Receiver) RecvCommand(conn *net.UDPConn, remote *net.UDPAddr, operate uint16, arg *bytes.Buffer) {
+	key := remote.String()
+	switch operate {
+	case WATCH_CMD_START:
+		request := &watchRequest{}
+		if err := gob.NewDecoder(arg).Decode(request); err != nil {
+			sendWatchMessage(conn, remote, &watchMessage{Error: err.Error(), Done: true})
+			return
+		}
+		session, err := r.addWatchSession(key, request)
+		if err != nil {
+			sendWatchMessage(conn, remote, &watchMessage{Error: err.Error(), Done: true})
+			return
+		}
+		if err := sendWatchMessage(conn, remote, &watchMessage{}); err != nil {
+			r.removeWatchSession(session)
+			return
+		}
+		log.Infof("watch session from %s started, interval %s count %d", key, request.Interval, request.Count)
+		r.goWatchSession(session, func(message *watchMessage) error {
+			return sendWatchMessage(conn, remote, message)
+		})
+	case WATCH_CMD_KEEPALIVE:
+		if session := r.getWatchSession(key); session != nil {
+			session.keepalive()
+		}
+	case WATCH_CMD_STOP:
+		if session := r.getWatchSession(key); session != nil {
+			r.removeWatchSession(session)
+		}
+	default:
+		log.Warningf("Trident Adapter recv unknown watch command (%v).", operate)
+	}
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func recvWatchMessage(conn *net.UDPConn) (*watchMessage, error) {
+	buffer, err := debug.RecvFromServer(conn)
+	if err != nil {
+		return nil, err
+	}
+	message := &watchMessage{}
+	if err := gob.NewDecoder(buffer).Decode(message); err != nil {
+		return nil, err
+	}
+	if message.Error != "" {
+		return nil, errors.New(message.Error)
+	}
+	return message, nil
+}
+
+func runWatchClient(request *watchRequest) {
+	buffer := bytes.Buffer{}
+	if err := gob.NewEncoder(&buffer).Encode(request); err != nil {
+		fmt.Println(err)
+		return
+	}
+	conn, result, err := debug.SendToServer(TRIDENT_ADAPTER_WATCH_CMD, WATCH_CMD_START, &buffer)
+	if conn != nil {
+		defer conn.Close()
+	}
+	if err != nil {
+		fmt.Println("Watch failed", err)
+		return
+	}
+	message := &watchMessage{}
+	if err := gob.NewDecoder(result).Decode(message); err != nil || message.Error != "" {
+		fmt.Println("Watch failed", err, message.Error)
+		return
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	// 服务端超过该时间没有推送数据, 认为服务端已退出
+	serverTimeout := request.Interval + WATCH_CLIENT_TIMEOUT
+	lastRecv, lastKeepalive := time.Now(), time.Now()
+	for {
+		select {
+		case <-sigs:
+			debug.SendOnly(conn, TRIDENT_ADAPTER_WATCH_CMD, WATCH_CMD_STOP, nil)
+			return
+		default:
+		}
+		if time.Since(lastKeepalive) >= WATCH_KEEPALIVE_INTERVAL {
+			lastKeepalive = time.Now()
+			debug.SendOnly(conn, TRIDENT_ADAPTER_WATCH_CMD, WATCH_CMD_KEEPALIVE, nil)
+		}
+
+		conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		message, err := recvWatchMessage(conn)
+		if err != nil {
+			if !isTimeout(err) {
+				fmt.Println("Watch failed", err)
+				return
+			}
+			if time.Since(lastRecv) > serverTimeout {
+				fmt.Println("Watch stopped, no data from server")
+				return
+			}
+			continue
+		}
+		lastRecv = time.Now()
+		fmt.Println(strings.TrimRight(message.Text, "\n"))
+		if message.Done {
+			return
+		}
+	}
+}
+
+func registerWatchCommand(jsonOutput *bool) *cobra.Command {
+	request := &watchRequest{}
+	command := &cobra.Command{
+		Use:   "watch",
+		Short: "stream agent rx packets deltas every interval",
+		Run: func(cmd *cobra.Command, args []string) {
+			request.JSON = *jsonOutput
+			runWatchClient(request)
+		},
+	}
+	command.Flags().DurationVar(&request.Interval, "interval", WATCH_DEFAULT_INTERVAL, "interval between two snapshots")
+	command.Flags().IntVar(&request.Count, "count", WATCH_DEFAULT_COUNT, "number of snapshots, 0 means until interrupted")
+	return command
+}
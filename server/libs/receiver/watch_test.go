@@ -0,0 +1,141 @@
+/*
+ * Copyright (c) 2024 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package receiver
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/deepflowio/deepflow/server/libs/datatype"
+)
+
+func TestWatchDelta(t *testing.T) {
+	r := newTestReceiver()
+	now := uint32(1700000000)
+	for i := 0; i < WATCH_TOP_N+2; i++ {
+		r.status.Update(now, datatype.MESSAGE_TYPE_METRICS, uint16(i+1), 1, datatype.LATEST_VERSION, datatype.ENCODER_RAW, net.ParseIP(fmt.Sprintf("10.1.1.%d", i+1)), 0, now, TCP)
+	}
+	last := r.status.packetSnapshot()
+	for i := 0; i < 5; i++ {
+		r.status.Update(now, datatype.MESSAGE_TYPE_METRICS, 1, 1, datatype.LATEST_VERSION, datatype.ENCODER_RAW, net.ParseIP("10.1.1.1"), 0, now, TCP)
+	}
+	r.status.Update(now, datatype.MESSAGE_TYPE_METRICS, 2, 1, datatype.LATEST_VERSION, datatype.ENCODER_RAW, net.ParseIP("10.1.1.2"), 0, now, TCP)
+	r.status.Update(now, datatype.MESSAGE_TYPE_SYSLOG, 0, 1, datatype.OLD_VERSION, datatype.ENCODER_RAW, net.ParseIP("10.1.1.100"), 0, 0, UDP)
+
+	delta := newWatchDelta(1, int64(now), last, r.status.packetSnapshot())
+	if delta.RxPackets != 7 || delta.ActiveAgents != 3 || delta.TotalAgents != WATCH_TOP_N+3 {
+		t.Errorf("unexpected aggregate delta %+v", delta)
+	}
+	if len(delta.Top) != 3 || delta.Top[0].VTAPID != 1 || delta.Top[0].RxPackets != 5 || delta.Top[0].Total != 6 {
+		t.Errorf("unexpected top agents %+v", delta.Top)
+	}
+
+	last = r.status.packetSnapshot()
+	r.status.reset()
+	r.status.Update(now, datatype.MESSAGE_TYPE_METRICS, 1, 1, datatype.LATEST_VERSION, datatype.ENCODER_RAW, net.ParseIP("10.1.1.1"), 0, now, TCP)
+	if delta = newWatchDelta(2, int64(now), last, r.status.packetSnapshot()); delta.RxPackets != 1 {
+		t.Errorf("unexpected delta after reset %+v", delta)
+	}
+}
+
+func TestWatchSession(t *testing.T) {
+	r := newTestReceiver()
+	request := &watchRequest{Interval: WATCH_MIN_INTERVAL, Count: 2}
+	session, err := r.addWatchSession("127.0.0.1:10000", request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := []*watchMessage{}
+	r.runWatchSession(session, func(message *watchMessage) error {
+		messages = append(messages, message)
+		return nil
+	})
+	if len(messages) != 2 || messages[0].Done || !messages[1].Done {
+		t.Errorf("unexpected watch messages %+v", messages)
+	}
+	if r.getWatchSession("127.0.0.1:10000") != nil {
+		t.Error("watch session should be removed after finished")
+	}
+
+	request = &watchRequest{Interval: WATCH_MIN_INTERVAL}
+	session, _ = r.addWatchSession("127.0.0.1:10000", request)
+	sendCount := 0
+	r.runWatchSession(session, func(message *watchMessage) error {
+		sendCount++
+		return errors.New("client closed")
+	})
+	if sendCount != 1 || r.getWatchSession("127.0.0.1:10000") != nil {
+		t.Errorf("watch session should stop after send failed, send count %d", sendCount)
+	}
+}
+
+// Receiver关闭时停止所有会话, 等待推送协程退出并通知客户端
+func TestWatchSessionClose(t *testing.T) {
+	r := newTestReceiver()
+	request := &watchRequest{Interval: time.Hour}
+	var lock sync.Mutex
+	messages := []*watchMessage{}
+	for i := 0; i < 2; i++ {
+		session, err := r.addWatchSession(fmt.Sprintf("127.0.0.1:%d", 10000+i), request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.goWatchSession(session, func(message *watchMessage) error {
+			lock.Lock()
+			defer lock.Unlock()
+			messages = append(messages, message)
+			return nil
+		})
+	}
+	r.Close()
+
+	lock.Lock()
+	if len(messages) != 2 || messages[0].Error == "" || !messages[0].Done || messages[1].Error == "" || !messages[1].Done {
+		t.Errorf("clients should be notified before close returns, %+v", messages)
+	}
+	lock.Unlock()
+	if r.getWatchSession("127.0.0.1:10000") != nil {
+		t.Error("watch sessions should be removed after close")
+	}
+	if _, err := r.addWatchSession("127.0.0.1:10000", request); err == nil {
+		t.Error("expect error for watch session after close")
+	}
+}
+
+func TestWatchSessionLimit(t *testing.T) {
+	r := newTestReceiver()
+	request := &watchRequest{Interval: time.Second}
+	if _, err := r.addWatchSession("127.0.0.1:10000", &watchRequest{}); err == nil {
+		t.Error("expect error for too small interval")
+	}
+	for i := 0; i < WATCH_MAX_SESSIONS; i++ {
+		if _, err := r.addWatchSession(fmt.Sprintf("127.0.0.1:%d", 10000+i), request); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := r.addWatchSession("127.0.0.1:20000", request); err == nil {
+		t.Error("expect error for too many sessions")
+	}
+	r.removeWatchSession(r.getWatchSession("127.0.0.1:10000"))
+	if _, err := r.addWatchSession("127.0.0.1:20000", request); err != nil {
+		t.Error(err)
+	}
+}
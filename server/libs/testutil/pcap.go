@@ -0,0 +1,141 @@
+/*
+ * Copyright (c) 2024 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// 供各模块单元测试共用的辅助函数, 不应被非测试代码引用
+package testutil
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/deepflowio/deepflow/server/libs/pcap"
+)
+
+type Frame struct {
+	Data      []byte // 按Snaplen截断后的数据
+	Length    int    // 报文的原始长度, 可能大于抓包文件中保存的长度
+	Timestamp time.Time
+}
+
+// 各过滤条件同时满足的帧才会返回, 端口和协议仅匹配最外层的IP和TCP/UDP头
+type PcapOptions struct {
+	Snaplen   int                    // 大于0时将每帧截断到该长度
+	Limit     int                    // 大于0时最多返回的帧数, 在过滤之后计数
+	Ports     []uint16               // 非空时仅保留源或目的端口在其中的TCP/UDP帧
+	Protocols []layers.IPProtocol    // 非空时仅保留IP协议在其中的帧, IPv6为基本头的Next Header
+	Filter    func(data []byte) bool // 非空时仅保留返回true的帧, 输入为截断前的数据
+}
+
+// 读取pcap或pcapng文件, options为nil时返回全部帧
+func LoadPcap(file string, options *PcapOptions) ([]Frame, error) {
+	if options == nil {
+		options = &PcapOptions{}
+	}
+	reader, closer, err := pcap.OpenFile(file)
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+	var frames []Frame
+	for options.Limit <= 0 || len(frames) < options.Limit {
+		data, ci, err := reader.ReadPacketData()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return frames, fmt.Errorf("read frame %d of %s failed: %s", len(frames)+1, file, err)
+		}
+		if !options.match(data) {
+			continue
+		}
+		if options.Snaplen > 0 && len(data) > options.Snaplen {
+			data = data[:options.Snaplen]
+		}
+		frames = append(frames, Frame{Data: data, Length: ci.Length, Timestamp: ci.Timestamp})
+	}
+	return frames, nil
+}
+
+func (o *PcapOptions) match(data []byte) bool {
+	if o.Filter != nil && !o.Filter(data) {
+		return false
+	}
+	if len(o.Ports) == 0 && len(o.Protocols) == 0 {
+		return true
+	}
+	protocol, srcPort, dstPort, ok := outerHeaders(data)
+	if !ok {
+		return false
+	}
+	if len(o.Protocols) > 0 && !containsProtocol(o.Protocols, protocol) {
+		return false
+	}
+	if len(o.Ports) > 0 && !containsPort(o.Ports, srcPort) && !containsPort(o.Ports, dstPort) {
+		return false
+	}
+	return true
+}
+
+// 返回最外层IP头的协议和其后TCP/UDP头的端口, 不是TCP/UDP时端口为0, 不是IP报文时ok为false
+func outerHeaders(data []byte) (protocol layers.IPProtocol, srcPort, dstPort uint16, ok bool) {
+	packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	for _, layer := range packet.Layers() {
+		switch l := layer.(type) {
+		case *layers.IPv4:
+			if ok {
+				return
+			}
+			protocol, ok = l.Protocol, true
+		case *layers.IPv6:
+			if ok {
+				return
+			}
+			protocol, ok = l.NextHeader, true
+		case *layers.TCP:
+			if ok {
+				srcPort, dstPort = uint16(l.SrcPort), uint16(l.DstPort)
+				return
+			}
+		case *layers.UDP:
+			if ok {
+				srcPort, dstPort = uint16(l.SrcPort), uint16(l.DstPort)
+				return
+			}
+		}
+	}
+	return
+}
+
+func containsProtocol(protocols []layers.IPProtocol, protocol layers.IPProtocol) bool {
+	for _, p := range protocols {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+func containsPort(ports []uint16, port uint16) bool {
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright (c) 2024 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package testutil
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// testdata/sample.pcap依次为:
+//  1. IPv4 UDP 50000->4789
+//  2. IPv4 TCP 40000->80
+//  3. IPv4 UDP 53->33333, 原始长度142, 抓包时截断为64
+//  4. IPv4 ICMP
+//  5. IPv6 UDP 50001->4789
+//  6. ARP
+//
+// 时间戳从1700000000.000001开始每帧递增1ms
+const samplePcap = "testdata/sample.pcap"
+
+func lengths(frames []Frame) []int {
+	result := []int{}
+	for _, frame := range frames {
+		result = append(result, len(frame.Data))
+	}
+	return result
+}
+
+func TestLoadPcap(t *testing.T) {
+	testCases := []struct {
+		name     string
+		options  *PcapOptions
+		expected []int // 返回帧的数据长度
+	}{
+		{"all", nil, []int{60, 60, 64, 60, 78, 60}},
+		{"snaplen", &PcapOptions{Snaplen: 62}, []int{60, 60, 62, 60, 62, 60}},
+		{"limit", &PcapOptions{Limit: 2}, []int{60, 60}},
+		{"port", &PcapOptions{Ports: []uint16{4789}}, []int{60, 78}},
+		{"source-port", &PcapOptions{Ports: []uint16{53}}, []int{64}},
+		{"protocol", &PcapOptions{Protocols: []layers.IPProtocol{layers.IPProtocolTCP, layers.IPProtocolICMPv4}}, []int{60, 60}},
+		{"protocol-and-port", &PcapOptions{Protocols: []layers.IPProtocol{layers.IPProtocolUDP}, Ports: []uint16{80, 53}}, []int{64}},
+		{"filter", &PcapOptions{Filter: func(data []byte) bool { return len(data) > 60 }}, []int{64, 78}},
+		{"limit-after-filter", &PcapOptions{Ports: []uint16{4789}, Limit: 1, Snaplen: 20}, []int{20}},
+	}
+	for _, tc := range testCases {
+		frames, err := LoadPcap(samplePcap, tc.options)
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+		if actual := lengths(frames); !reflect.DeepEqual(actual, tc.expected) {
+			t.Errorf("%s: expect %v, actual %v", tc.name, tc.expected, actual)
+		}
+	}
+}
+
+func TestLoadPcapFrameInfo(t *testing.T) {
+	frames, err := LoadPcap(samplePcap, &PcapOptions{Snaplen: 32})
+	if err != nil || len(frames) != 6 {
+		t.Fatalf("load %s failed: %v, %d frames", samplePcap, err, len(frames))
+	}
+	// 原始长度不受截断影响
+	if frames[2].Length != 142 || frames[4].Length != 78 {
+		t.Errorf("unexpected length %d %d", frames[2].Length, frames[4].Length)
+	}
+	base := time.Unix(1700000000, 1000)
+	for i, frame := range frames {
+		if expected := base.Add(time.Duration(i) * time.Millisecond); !frame.Timestamp.Equal(expected) {
+			t.Errorf("frame %d: expect timestamp %s, actual %s", i, expected, frame.Timestamp)
+		}
+	}
+}
+
+func TestLoadPcapError(t *testing.T) {
+	if _, err := LoadPcap("testdata/not-exist.pcap", nil); err == nil {
+		t.Error("expect error for missing file")
+	}
+	// 既不是pcap也不是pcapng
+	file := filepath.Join(t.TempDir(), "invalid.pcap")
+	os.WriteFile(file, []byte("not a pcap file"), 0644)
+	if _, err := LoadPcap(file, nil); err == nil {
+		t.Error("expect error for invalid file")
+	}
+}